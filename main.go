@@ -1,18 +1,36 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"math/big"
+	"math/rand"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	mimcHash "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/math/bits"
 )
 
+// charsPerElement is how many 8-bit characters of Str2 are packed into each field element
+// absorbed by the digest; 31 bytes always fit below the BN254 modulus
+const charsPerElement = 31
+
+// SubstringCircuit proves that Str1 occurs in the secret text Str2. The verifier only sees
+// Str2Digest, the MiMC digest of the agreed text computed off-circuit with str2Digest.
 type SubstringCircuit struct {
-	Str1 [3]frontend.Variable       `gnark:"str1,secret"`
-	Str2 [1000000]frontend.Variable `gnark:"str2,public"`
+	Str1       [3]frontend.Variable       `gnark:"str1,secret"`
+	IsWildcard [3]frontend.Variable       `gnark:"isWildcard,secret"` // 1 where Str1 matches any character
+	Str2       [1000000]frontend.Variable `gnark:"str2,secret"`
+	Str2Digest frontend.Variable          `gnark:"str2Digest,public"`
+
+	allowAllWildcards bool // Accept a pattern made only of wildcards, which matches any text
 }
 
 // func xorComparison(api frontend.API, a, b frontend.Variable) frontend.Variable {
@@ -20,22 +38,102 @@ type SubstringCircuit struct {
 // }
 
 func (circuit *SubstringCircuit) Define(api frontend.API) error {
+	if err := assertDigest(api, circuit.Str2[:], circuit.Str2Digest); err != nil {
+		return err
+	}
+	assertSubstring(api, circuit.Str1[:], circuit.IsWildcard[:], circuit.Str2[:], circuit.allowAllWildcards)
+	return nil
+}
+
+// assertDigest asserts that text hashes to digest. Each character is range-checked to 8
+// bits, so packing charsPerElement of them into one element is injective.
+func assertDigest(api frontend.API, text []frontend.Variable, digest frontend.Variable) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(text); start += charsPerElement {
+		packed := frontend.Variable(0)
+		for j, c := range text[start:min(start+charsPerElement, len(text))] {
+			bits.ToBinary(api, c, bits.WithNbDigits(8))
+			packed = api.Add(packed, api.Mul(c, new(big.Int).Lsh(big.NewInt(1), uint(8*j))))
+		}
+		hFunc.Write(packed)
+	}
+	api.AssertIsEqual(hFunc.Sum(), digest)
+	return nil
+}
+
+// str2Digest computes the digest checked by assertDigest off-circuit, absorbing text in
+// the same order: charsPerElement characters per element, the first in the lowest byte
+func str2Digest(text []byte) *big.Int {
+	hFunc := mimcHash.NewMiMC()
+	for start := 0; start < len(text); start += charsPerElement {
+		chunk := text[start:min(start+charsPerElement, len(text))]
+		packed := make([]byte, len(chunk))
+		for j := range chunk {
+			packed[len(chunk)-1-j] = chunk[j] // SetBytes is big-endian
+		}
+		var elem fr.Element
+		elem.SetBytes(packed)
+		bytes := elem.Bytes()
+		hFunc.Write(bytes[:])
+	}
+	return new(big.Int).SetBytes(hFunc.Sum(nil))
+}
+
+// textBytes converts a text of character variables, as built by generateString, to bytes
+func textBytes(text []frontend.Variable) []byte {
+	b := make([]byte, len(text))
+	for i := range text {
+		b[i] = byte(text[i].(int))
+	}
+	return b
+}
+
+// assertSubstring asserts that str1 occurs in str2, where positions with isWildcard set
+// match any character. Unless allowAllWildcards is set, at least one position must be literal.
+func assertSubstring(api frontend.API, str1, isWildcard, str2 []frontend.Variable, allowAllWildcards bool) {
+	allWildcards := frontend.Variable(1)
+	for j := range isWildcard {
+		api.AssertIsBoolean(isWildcard[j])
+		allWildcards = api.And(allWildcards, isWildcard[j])
+	}
+	if !allowAllWildcards {
+		api.AssertIsEqual(allWildcards, 0)
+	}
+
 	found := frontend.Variable(0)
 
-	for i := 0; i <= len(circuit.Str2)-len(circuit.Str1); i++ {
+	for i := 0; i <= len(str2)-len(str1); i++ {
 		isMatch := frontend.Variable(1)
-		for j := 0; j < len(circuit.Str1); j++ {
-			// xorResult := xorComparison(api, circuit.Str1[j], circuit.Str2[i+j])
+		for j := 0; j < len(str1); j++ {
+			// xorResult := xorComparison(api, str1[j], str2[i+j])
 			// isMatch = api.And(isMatch, api.IsZero(xorResult))
 
-			isMatch = api.IsZero(api.Sub(circuit.Str1[j], circuit.Str2[i+j]))
+			charMatch := api.Or(isWildcard[j], api.IsZero(api.Sub(str1[j], str2[i+j])))
+			isMatch = api.And(isMatch, charMatch)
 		}
 		found = api.Or(found, isMatch)
 	}
 
 	api.AssertIsEqual(found, frontend.Variable(1))
+}
 
-	return nil
+// parsePattern converts a 3-character pattern to the Str1 and IsWildcard witnesses,
+// treating '?' as a wildcard
+func parsePattern(pattern string) (str1, isWildcard [3]frontend.Variable, err error) {
+	if len(pattern) != len(str1) {
+		return str1, isWildcard, fmt.Errorf("pattern %q must be %d characters", pattern, len(str1))
+	}
+	for j := 0; j < len(pattern); j++ {
+		if pattern[j] == '?' {
+			str1[j], isWildcard[j] = 0, 1
+		} else {
+			str1[j], isWildcard[j] = int(pattern[j]), 0
+		}
+	}
+	return str1, isWildcard, nil
 }
 
 func generateString(N int) []frontend.Variable {
@@ -60,35 +158,83 @@ func generateString(N int) []frontend.Variable {
 	return result
 }
 
+// generateRandomText returns n lowercase letters drawn from a generator seeded with seed,
+// so benchmarks can use a realistic text and still be reproduced exactly
+func generateRandomText(n int, seed int64) []frontend.Variable {
+	rng := rand.New(rand.NewSource(seed))
+	text := make([]frontend.Variable, n)
+	for i := range text {
+		text[i] = 'a' + rng.Intn(26)
+	}
+	return text
+}
+
 func convertToFixedSizeArray1000000(s []frontend.Variable) [1000000]frontend.Variable {
 	var arr [1000000]frontend.Variable
 	copy(arr[:], s) // Copy elements from the slice to the array
 	return arr
 }
 
+// circuitSize is the size of a compiled constraint system
+type circuitSize struct {
+	NbConstraints, NbPublic, NbSecret, NbInternal int
+}
+
+// sizeOf returns the size of ccs
+func sizeOf(ccs constraint.ConstraintSystem) circuitSize {
+	return circuitSize{
+		NbConstraints: ccs.GetNbConstraints(),
+		NbPublic:      ccs.GetNbPublicVariables(),
+		NbSecret:      ccs.GetNbSecretVariables(),
+		NbInternal:    ccs.GetNbInternalVariables(),
+	}
+}
+
+func (s circuitSize) String() string {
+	return fmt.Sprintf("%d constraints, %d public, %d secret and %d internal variables", s.NbConstraints, s.NbPublic, s.NbSecret, s.NbInternal)
+}
+
 func main() {
-	str1 := [3]frontend.Variable{
-		frontend.Variable(97),
-		frontend.Variable(98),
-		frontend.Variable(99),
+	pattern := flag.String("pattern", "abc", "3-character pattern to prove; '?' matches any character")
+	allowAllWildcards := flag.Bool("allow-all-wildcards", false, "Accept a pattern made only of '?' wildcards")
+	randomText := flag.Bool("random-text", false, "Prove against random lowercase text drawn with -seed instead of the repeating test string")
+	seed := flag.Int64("seed", 1, "Seed for -random-text; the same seed always gives the same text")
+	flag.Parse()
+
+	str1, isWildcard, err := parsePattern(*pattern)
+	if err != nil {
+		log.Fatalf("Invalid pattern: %v", err)
 	}
 
 	str2s := generateString(1000000)
 	str2 := convertToFixedSizeArray1000000(str2s)
-	var circuit SubstringCircuit
+
+	if *randomText {
+		str2s = generateRandomText(len(str2s), *seed)
+		str2 = convertToFixedSizeArray1000000(str2s)
+		fmt.Printf("Random text with seed %d\n", *seed)
+	}
+
+	circuit := SubstringCircuit{allowAllWildcards: *allowAllWildcards}
 	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit)
 	if err != nil {
 		log.Fatalf("Circuit compilation failed: %v", err)
 	}
+	fmt.Printf("Circuit size: %s\n", sizeOf(ccs))
 
 	pk, vk, err := groth16.Setup(ccs)
 	if err != nil {
 		log.Fatalf("Setup failed: %v", err)
 	}
 
+	// The verifier pins the digest of the agreed text instead of receiving the text itself
+	digest := str2Digest(textBytes(str2s))
+	fmt.Printf("Str2 digest: %s\n", digest)
 	assignment := SubstringCircuit{
-		Str1: str1,
-		Str2: str2,
+		Str1:       str1,
+		IsWildcard: isWildcard,
+		Str2:       str2,
+		Str2Digest: digest,
 	}
 
 	witness, err := frontend.NewWitness(&assignment, ecc.BN254.ScalarField())
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+)
+
+// TestRandomText checks that generateRandomText is reproducible for a seed, differs
+// across seeds and only yields lowercase letters
+func TestRandomText(t *testing.T) {
+	a, b, other := generateRandomText(1000, 7), generateRandomText(1000, 7), generateRandomText(1000, 8)
+	differs := false
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("seed 7 gave %v and %v at %d", a[i], b[i], i)
+		}
+		if c := a[i].(int); c < 'a' || c > 'z' {
+			t.Fatalf("character %d is %d, not a lowercase letter", i, c)
+		}
+		differs = differs || a[i] != other[i]
+	}
+	if !differs {
+		t.Fatal("seeds 7 and 8 gave the same text")
+	}
+}
+
+// proverCase is an assignment for assertProver and whether it satisfies the circuit
+type proverCase struct {
+	name       string
+	assignment frontend.Circuit
+	valid      bool
+}
+
+// assertProver runs each case in its own subtest through gnark's test assertions on BN254
+// with Groth16, expecting ProverSucceeded for the valid ones and ProverFailed for the rest
+func assertProver(t *testing.T, circuit frontend.Circuit, cases []proverCase) {
+	assert := test.NewAssert(t)
+	for _, c := range cases {
+		assert.Run(func(assert *test.Assert) {
+			if c.valid {
+				assert.ProverSucceeded(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			} else {
+				assert.ProverFailed(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			}
+		}, c.name)
+	}
+}
+
+// TestSubstringCircuit checks that the circuit, over a text short enough to prove in a
+// test, accepts patterns present in the generated text, with and without a wildcard, and
+// rejects an absent pattern, a non-boolean wildcard mask and a digest of another text
+func TestSubstringCircuit(t *testing.T) {
+	str2 := generateString(310)
+	digest := str2Digest(textBytes(str2))
+	assignment := func(pattern string, isWildcard [3]frontend.Variable, digest *big.Int) *sizedSubstringCircuit {
+		var str1 [3]frontend.Variable
+		for j := range str1 {
+			str1[j] = int(pattern[j])
+		}
+		return &sizedSubstringCircuit{Str1: str1, IsWildcard: isWildcard, Str2: str2, Str2Digest: digest}
+	}
+	literal, middle := [3]frontend.Variable{0, 0, 0}, [3]frontend.Variable{0, 1, 0}
+	assertProver(t, &sizedSubstringCircuit{Str2: make([]frontend.Variable, len(str2))}, []proverCase{
+		{"present", assignment("abc", literal, digest), true},
+		{"present with a wildcard", assignment("azc", middle, digest), true},
+		{"absent", assignment("zzz", literal, digest), false},
+		{"absent with a wildcard", assignment("zzc", middle, digest), false},
+		{"non-boolean wildcard mask", assignment("abc", [3]frontend.Variable{0, 2, 0}, digest), false},
+		{"wrong digest", assignment("abc", literal, new(big.Int).Add(digest, big.NewInt(1))), false},
+	})
+}
+
+// digestCheckLen is the text length used by TestDigest, spanning more than one packed element
+const digestCheckLen = 40
+
+// digestCircuit runs assertDigest and assertSubstring over a short text
+type digestCircuit struct {
+	Str1       [3]frontend.Variable
+	Str2       [digestCheckLen]frontend.Variable
+	Str2Digest frontend.Variable `gnark:",public"`
+}
+
+func (circuit *digestCircuit) Define(api frontend.API) error {
+	if err := assertDigest(api, circuit.Str2[:], circuit.Str2Digest); err != nil {
+		return err
+	}
+	assertSubstring(api, circuit.Str1[:], []frontend.Variable{0, 0, 0}, circuit.Str2[:], false)
+	return nil
+}
+
+// TestDigest checks that a witness is accepted with the digest of its own text and
+// rejected when it uses a different text than the one committed to, even one that
+// contains the pattern
+func TestDigest(t *testing.T) {
+	committed := []byte("the agreed text, long enough to need two elements")[:digestCheckLen]
+	doctored := append([]byte(nil), committed...)
+	doctored[5] = 'x' // Still contains "the"
+	toVariables := func(text []byte) (v [digestCheckLen]frontend.Variable) {
+		for i := range v {
+			v[i] = int(text[i])
+		}
+		return v
+	}
+	honest := digestCircuit{Str1: [3]frontend.Variable{'t', 'h', 'e'}, Str2: toVariables(committed), Str2Digest: str2Digest(committed)}
+	forged := honest
+	forged.Str2 = toVariables(doctored)
+	// A character above 255 would alias the next byte of its packed element
+	aliased := honest
+	aliased.Str2[0], aliased.Str2[1] = int(committed[0])+256, int(committed[1])-1
+	assertProver(t, &digestCircuit{}, []proverCase{
+		{"committed text", &honest, true},
+		{"text differing from the committed digest", &forged, false},
+		{"out-of-range character", &aliased, false},
+	})
+}
+
+// sizedSubstringCircuit is SubstringCircuit over a text of any length
+type sizedSubstringCircuit struct {
+	Str1       [3]frontend.Variable
+	IsWildcard [3]frontend.Variable
+	Str2       []frontend.Variable
+	Str2Digest frontend.Variable `gnark:",public"`
+}
+
+func (circuit *sizedSubstringCircuit) Define(api frontend.API) error {
+	if err := assertDigest(api, circuit.Str2, circuit.Str2Digest); err != nil {
+		return err
+	}
+	assertSubstring(api, circuit.Str1[:], circuit.IsWildcard[:], circuit.Str2, false)
+	return nil
+}
+
+// TestCircuitSize compiles the naive circuit for small texts and checks that it costs
+// between 28 and 36 constraints per text character, which catches accidental blowups
+func TestCircuitSize(t *testing.T) {
+	for _, textLength := range []int{62, 310, 1240} {
+		circuit := sizedSubstringCircuit{Str2: make([]frontend.Variable, textLength)}
+		ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := sizeOf(ccs)
+		fmt.Printf("Text of %d characters: %s\n", textLength, size)
+		if perChar := size.NbConstraints / textLength; perChar < 28 || perChar > 36 {
+			t.Fatalf("text of %d characters: %d constraints, %d per character, want 28 to 36", textLength, size.NbConstraints, perChar)
+		}
+		if size.NbPublic != 2 || size.NbSecret != 6+textLength {
+			t.Fatalf("text of %d characters: %d public and %d secret variables, want 2 and %d", textLength, size.NbPublic, size.NbSecret, 6+textLength)
+		}
+	}
+}
+
+// wildcardCircuit runs assertSubstring over a short text so wildcard cases solve quickly
+type wildcardCircuit struct {
+	Str1       [3]frontend.Variable
+	IsWildcard [3]frontend.Variable
+	Str2       [7]frontend.Variable
+
+	allowAllWildcards bool
+}
+
+func (circuit *wildcardCircuit) Define(api frontend.API) error {
+	assertSubstring(api, circuit.Str1[:], circuit.IsWildcard[:], circuit.Str2[:], circuit.allowAllWildcards)
+	return nil
+}
+
+// TestWildcards checks wildcards at the start, middle and end of a pattern, patterns
+// that still do not occur, and all-wildcard patterns with and without allowAllWildcards
+func TestWildcards(t *testing.T) {
+	var text [7]frontend.Variable
+	for i, c := range "xxabcxx" {
+		text[i] = int(c)
+	}
+	cases := []struct {
+		pattern           string
+		allowAllWildcards bool
+		want              bool
+	}{
+		{"?bc", false, true},
+		{"a?c", false, true},
+		{"ab?", false, true},
+		{"z?c", false, false},
+		{"?zz", false, false},
+		{"???", false, false},
+		{"???", true, true},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		str1, isWildcard, err := parsePattern(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignment := wildcardCircuit{Str1: str1, IsWildcard: isWildcard, Str2: text}
+		err = test.IsSolved(&wildcardCircuit{allowAllWildcards: c.allowAllWildcards}, &assignment, field)
+		if got := err == nil; got != c.want {
+			t.Fatalf("pattern %q (allowAllWildcards=%v): accepted=%v, want %v", c.pattern, c.allowAllWildcards, got, c.want)
+		}
+	}
+}
+
+// containsSubstring is the off-circuit oracle the circuits are checked against
+func containsSubstring(text, pattern string) bool {
+	return strings.Contains(text, pattern)
+}
+
+// oracleRounds is how many random cases TestOracle tries
+const oracleRounds = 300
+
+// randomOracleCase returns a random ASCII text of 1 to 12 characters and a pattern of 1
+// to 4. Both are mostly drawn from "abc", and half the patterns are cut from the text,
+// so roughly half of them occur.
+func randomOracleCase(rng *rand.Rand) (text, pattern string) {
+	randomString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			if rng.Intn(4) == 0 {
+				b[i] = byte(' ' + rng.Intn('~'-' '+1))
+			} else {
+				b[i] = byte('a' + rng.Intn(3))
+			}
+		}
+		return string(b)
+	}
+	text = randomString(1 + rng.Intn(12))
+	patternLength := 1 + rng.Intn(4)
+	if start := rng.Intn(len(text)); rng.Intn(2) == 0 && start+patternLength <= len(text) {
+		return text, text[start : start+patternLength]
+	}
+	return text, randomString(patternLength)
+}
+
+// toVariables converts s to one character variable per byte
+func toVariables(s string) []frontend.Variable {
+	v := make([]frontend.Variable, len(s))
+	for i := range v {
+		v[i] = int(s[i])
+	}
+	return v
+}
+
+// oracleCircuit runs assertSubstring, without wildcards, over a pattern and text of any length
+type oracleCircuit struct {
+	Str1 []frontend.Variable
+	Str2 []frontend.Variable
+}
+
+func (circuit *oracleCircuit) Define(api frontend.API) error {
+	literal := make([]frontend.Variable, len(circuit.Str1))
+	for j := range literal {
+		literal[j] = 0
+	}
+	assertSubstring(api, circuit.Str1, literal, circuit.Str2, false)
+	return nil
+}
+
+// TestOracle checks on seeded random texts and patterns that the naive circuit is
+// satisfiable exactly when containsSubstring says the pattern occurs
+func TestOracle(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	field := ecc.BN254.ScalarField()
+	for round := 0; round < oracleRounds; round++ {
+		text, pattern := randomOracleCase(rng)
+		circuit := oracleCircuit{Str1: make([]frontend.Variable, len(pattern)), Str2: make([]frontend.Variable, len(text))}
+		assignment := oracleCircuit{Str1: toVariables(pattern), Str2: toVariables(text)}
+		accepted := test.IsSolved(&circuit, &assignment, field) == nil
+		if want := containsSubstring(text, pattern); accepted != want {
+			t.Fatalf("round %d: pattern %q in text %q: accepted=%v, oracle says %v", round, pattern, text, accepted, want)
+		}
+	}
+}
@@ -1,535 +1,6666 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	gohash "hash"
+	"hash/fnv"
+	"index/suffixarray"
+	"io"
+	"log/slog"
+	"math"
 	"math/big"
+	mathbits "math/bits"
+	"math/rand"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254"
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
 	mimcHash "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
+	edbn254 "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards"
+	tedwards "github.com/consensys/gnark-crypto/ecc/twistededwards"
 	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+	gnarklogger "github.com/consensys/gnark/logger"
+	"github.com/consensys/gnark/profile"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/algebra/native/twistededwards"
+	"github.com/consensys/gnark/std/hash"
 	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/hash/sha2"
+	"github.com/consensys/gnark/std/math/bits"
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/math/uints"
+	stdgroth16 "github.com/consensys/gnark/std/recursion/groth16"
+	"github.com/consensys/gnark/test/unsafekzg"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
 )
 
 const (
 	maxStr1Len  = 70     // Max length for Str1
 	maxStr2Len  = 700000 // Fixed length for Str2
 	maxProofLen = 30     // Maximum length for Merkle proofs
+
+	// entrySeparator joins entries in the superstring. No Charset allows it, so no leaf
+	// spans the boundary between two unrelated certificates.
+	entrySeparator = '\x01'
 )
 
 var (
 	// Field modulus for BN254
 	fieldModulus = fr.Modulus()
+
+	// ErrStaleTree is returned when a saved tree was built from different inputs
+	ErrStaleTree = errors.New("saved merkle tree does not match the current input")
+
+	// ErrPatternExists is returned when inserting a pattern that already has a leaf
+	ErrPatternExists = errors.New("pattern already in merkle tree")
+
+	// ErrPatternPresent is returned when asked to prove non-membership of a present pattern
+	ErrPatternPresent = errors.New("pattern is present in the tree")
+
+	// ErrTreeUnsorted is returned when non-inclusion is requested from a tree whose leaves were updated in place
+	ErrTreeUnsorted = errors.New("merkle tree leaves are no longer sorted")
+
+	// ErrLevelOutOfRange is returned for a level below the leaves or above the root
+	ErrLevelOutOfRange = errors.New("merkle tree level out of range")
+
+	// ErrCompactTree is returned when updating a tree whose internal levels are not stored
+	ErrCompactTree = errors.New("merkle tree uses compact storage and cannot be updated incrementally")
+
+	// ErrPatternTooLong is returned for patterns that do not fit in the maxStr1Len-character Str1 witness
+	ErrPatternTooLong = errors.New("pattern longer than maxStr1Len")
+
+	// ErrPatternNotFound is returned when asked to prove inclusion of a pattern with no leaf
+	ErrPatternNotFound = errors.New("pattern not in merkle tree")
+
+	// ErrDisallowedChars is returned for patterns with runes the tree's Charset rejects, which NewMerkleTree never adds
+	ErrDisallowedChars = errors.New("pattern contains characters the merkle tree never holds")
+
+	// ErrNotExpressible is returned for patterns a label tree cannot hold, such as a label
+	// cut at a dot; see LeafLabels
+	ErrNotExpressible = errors.New("pattern is not whole labels, which is all a label tree holds")
+
+	// ErrCircuitMismatch is returned when cached keys or a proof bundle were made for
+	// another compiled circuit than the current one
+	ErrCircuitMismatch = errors.New("made for a different circuit")
+
+	// ErrBadProofPath is returned for a Merkle proof that VerifyPath rejects, before any time is spent proving it
+	ErrBadProofPath = errors.New("merkle proof does not reach the tree's root")
+
+	// ErrUnsupportedHash is returned for a hash function with no gadget in the gnark version we build against
+	ErrUnsupportedHash = errors.New("hash function not supported by this gnark version")
+
+	// Leveled logger; console output goes to stderr so stdout stays free for results
+	logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
 )
 
 // SubstringCircuit defines the circuit for verifying the inclusion of a substring via a Merkle proof
 type SubstringCircuit struct {
 	// Private inputs
 	Str1         [maxStr1Len]frontend.Variable  `gnark:"str1,secret"`
+	Length       frontend.Variable              `gnark:"length,secret"` // Characters before the zero padding of Str1
 	ProofPath    [maxProofLen]frontend.Variable `gnark:"proofPath,secret"`
 	ProofPathDir [maxProofLen]frontend.Variable `gnark:"proofPathDir,secret"`
-	Masks        [maxProofLen]frontend.Variable `gnark:"masks,secret"`
+	ProofLength  frontend.Variable              `gnark:"proofLength,secret"` // Levels of ProofPath in use; the rest are zero
 
 	// Public inputs
 	MerkleRoot frontend.Variable `gnark:"merkleRoot,public"`
-}
-type ProcessingStats struct {
-	TreeBuildTime      time.Duration
-	CircuitCompileTime time.Duration
-	SetupTime          time.Duration
-	TotalProofTime     time.Duration
-	VerificationTime   time.Duration
-	SuccessfulProofs   int
-	FailedProofs       int
-	NotFoundPatterns   int
+
+	hash         HashFunc             // Hash of the tree being proven against; set from MerkleTree.Hash before compiling
+	breakdown    *constraintBreakdown // When set, Define counts the constraints of each part into it
+	unusedLevels int                  // Top levels of ProofPath above the tree's height, pinned to zero instead of hashed
 }
 
-// Define the circuit constraints
-func (circuit *SubstringCircuit) Define(api frontend.API) error {
-	// Initialize MiMC hash function
-	hFunc, err := mimc.NewMiMC(api)
-	if err != nil {
-		return err
-	}
+// HashFunc selects the hash used for tree leaves and nodes, both off-circuit and in-circuit
+type HashFunc uint8
 
-	// 1. Hash the input pattern
-	hFunc.Reset()
-	for i := 0; i < maxStr1Len; i++ {
-		// Character values are already small, no need for modulo
-		hFunc.Write(circuit.Str1[i])
-	}
-	patternHash := hFunc.Sum()
+const (
+	HashMiMC      HashFunc = iota
+	HashPoseidon2          // Reserved: gnark v0.11.0 has no Poseidon2 gadget, so nothing accepts it
+	HashSHA256             // Digests are reduced into the BN254 scalar field
+	HashPedersen           // Over Baby Jubjub, the twisted Edwards curve embedded in BN254
+)
 
-	// 2. Verify Merkle proof
-	currentHash := patternHash
+func (h HashFunc) String() string {
+	switch h {
+	case HashMiMC:
+		return "mimc"
+	case HashPoseidon2:
+		return "poseidon2"
+	case HashSHA256:
+		return "sha256"
+	case HashPedersen:
+		return "pedersen"
+	default:
+		return fmt.Sprintf("HashFunc(%d)", uint8(h))
+	}
+}
 
-	// Process proof elements
-	for i := 0; i < maxProofLen; i++ {
-		mask := circuit.Masks[i] // 1 if active, 0 if inactive
+// parseHashFunc parses a -hash flag value
+func parseHashFunc(name string) (HashFunc, error) {
+	switch strings.ToLower(name) {
+	case "mimc":
+		return HashMiMC, nil
+	case "sha256":
+		return HashSHA256, nil
+	case "pedersen":
+		return HashPedersen, nil
+	default:
+		return 0, fmt.Errorf("unknown hash function %q (want mimc, sha256 or pedersen)", name)
+	}
+}
 
-		// Prepare the pair to hash
-		dirIsZero := api.IsZero(circuit.ProofPathDir[i])
-		left := api.Select(dirIsZero, currentHash, circuit.ProofPath[i])
-		right := api.Select(dirIsZero, circuit.ProofPath[i], currentHash)
+// newCircuitHasher returns the in-circuit hasher matching h
+func newCircuitHasher(api frontend.API, h HashFunc) (hash.FieldHasher, error) {
+	switch h {
+	case HashMiMC:
+		hFunc, err := mimc.NewMiMC(api)
+		if err != nil {
+			return nil, err
+		}
+		return &hFunc, nil
+	case HashSHA256:
+		return newSHA256FieldHasher(api)
+	case HashPedersen:
+		return newPedersenFieldHasher(api)
+	default:
+		return nil, fmt.Errorf("%s: %w", h, ErrUnsupportedHash)
+	}
+}
 
-		// Hash the pair
-		hFunc.Reset()
-		hFunc.Write(left)
-		hFunc.Write(right)
-		newHash := hFunc.Sum()
+// newOffCircuitHasher returns the hasher matching h for hashPatternWith and hashNodePair,
+// which reduce its digest into the field, or ErrUnsupportedHash
+func newOffCircuitHasher(h HashFunc) (gohash.Hash, error) {
+	switch h {
+	case HashMiMC:
+		return mimcHash.NewMiMC(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashPedersen:
+		return &pedersenHasher{}, nil
+	default:
+		return nil, fmt.Errorf("%s: %w", h, ErrUnsupportedHash)
+	}
+}
 
-		// Update currentHash based on the mask
-		deltaHash := api.Sub(newHash, currentHash)
-		currentHash = api.Add(currentHash, api.Mul(mask, deltaHash))
+// mustOffCircuitHasher is newOffCircuitHasher for a hash already accepted by
+// parseHashFunc or LoadMerkleTree, or set by the program itself; it panics otherwise
+func mustOffCircuitHasher(h HashFunc) gohash.Hash {
+	hFunc, err := newOffCircuitHasher(h)
+	if err != nil {
+		panic(err)
 	}
+	return hFunc
+}
 
-	// 3. Check root match
-	api.AssertIsEqual(currentHash, circuit.MerkleRoot)
+// sha256FieldHasher adapts std/hash/sha2 to hash.FieldHasher like crypto/sha256 is used
+// off-circuit: every written element is absorbed as its 32-byte big-endian encoding, and
+// the digest is read as a big-endian integer reduced into the field
+type sha256FieldHasher struct {
+	api  frontend.API
+	uapi *uints.BinaryField[uints.U32]
+	data []frontend.Variable
+}
 
-	return nil
+func newSHA256FieldHasher(api frontend.API) (*sha256FieldHasher, error) {
+	uapi, err := uints.New[uints.U32](api)
+	if err != nil {
+		return nil, err
+	}
+	return &sha256FieldHasher{api: api, uapi: uapi}, nil
 }
 
-// MerkleTree represents the Merkle tree for pattern verification
-type MerkleTree struct {
-	Leaves         []*big.Int
-	Nodes          [][]*big.Int
-	Root           *big.Int
-	PatternToIndex map[string]int // Map from pattern to leaf index
+func (h *sha256FieldHasher) Write(data ...frontend.Variable) {
+	h.data = append(h.data, data...)
 }
 
-// NewMerkleTree constructs a Merkle tree from the given superString and maxPatternLen
-func NewMerkleTree(superString string, maxPatternLen int) *MerkleTree {
-	fmt.Println("Building Merkle Tree...")
-	startTime := time.Now()
+func (h *sha256FieldHasher) Reset() {
+	h.data = nil
+}
 
-	// Generate all possible substrings up to maxPatternLen and remove duplicates
-	substrSet := make(map[string]struct{})
-	runeSuperString := []rune(superString)
-	superStringLen := len(runeSuperString)
-
-	for length := 1; length <= maxPatternLen; length++ {
-		for start := 0; start <= superStringLen-length; start++ {
-			substrRune := runeSuperString[start : start+length]
-			substr := string(substrRune)
-			if isURLSubstring(substrRune) {
-				substrSet[substr] = struct{}{}
-			}
+func (h *sha256FieldHasher) Sum() frontend.Variable {
+	// sha2.New only fails when uints.New does, which newSHA256FieldHasher already ran
+	hFunc, err := sha2.New(h.api)
+	if err != nil {
+		panic(err)
+	}
+	for _, v := range h.data {
+		// Canonical little-endian bits, padded from the field size to 256
+		vBits := bits.ToBinary(h.api, v, bits.WithNbDigits(8*fr.Bytes))
+		encoded := make([]uints.U8, fr.Bytes)
+		for i := range encoded {
+			encoded[fr.Bytes-1-i] = h.uapi.ByteValueOf(bits.FromBinary(h.api, vBits[8*i:8*i+8]))
 		}
+		hFunc.Write(encoded)
 	}
-
-	// Convert set to slice
-	var patterns []string
-	for substr := range substrSet {
-		patterns = append(patterns, substr)
+	sum := frontend.Variable(0)
+	for _, b := range hFunc.Sum() {
+		sum = h.api.Add(h.api.Mul(sum, 256), b.Val)
 	}
+	return sum
+}
 
-	// Sort the patterns slice to ensure deterministic ordering
-	sort.Strings(patterns)
+// Pedersen hash: the digest of elements m_1..m_k is the x-coordinate of
+// k·G_0 + Σ lo(m_i)·G_2i-1 + hi(m_i)·G_2i on Baby Jubjub, where lo and hi are the low
+// pedersenSplit bits and the rest. Both halves are below the subgroup order, and the count
+// term keeps trailing zero elements from colliding, so the hash is binding as long as the
+// generators' discrete logs are unknown. The x-coordinate is injective on the subgroup.
 
-	fmt.Printf("Total unique substrings to hash: %d\n", len(patterns))
+// maxPedersenInputs is the most elements one Pedersen hash absorbs: a leaf writes the
+// length and ceil(maxStr1Len/charsPerElement) packed chunks, a node its two children
+const maxPedersenInputs = 1 + (maxStr1Len+charsPerElement-1)/charsPerElement
 
-	// Convert patterns to leaves and build pattern to index map
-	leaves := make([]*big.Int, len(patterns))
-	patternToIndex := make(map[string]int)
-	for i, pattern := range patterns {
-		// Log the pattern being hashed
-		// log.Printf("Hashing pattern %d/%d: '%s'", i+1, len(patterns), pattern)
+// pedersenSplit is where each element is split into its two scalars
+const pedersenSplit = 128
 
-		patternHash := computeHashOffCircuit(pattern)
-		leaves[i] = patternHash
-		patternToIndex[pattern] = i
-		if (i+1)%100000 == 0 || i+1 == len(patterns) {
-			fmt.Printf("Hashed %d/%d substrings\n", i+1, len(patterns))
+var (
+	pedersenOnce sync.Once
+	// pedersenGens are G_0..G_2k, hashed to the curve so no discrete log between them is known
+	pedersenGens []edbn254.PointAffine
+	// pedersenTables[j][w][v] is v·4^w·G_j+1, for the circuit's 2-bit windows
+	pedersenTables [][][4]edbn254.PointAffine
+)
+
+// pedersenSetup derives the generators by try-and-increment: y is the SHA-256 of a counter
+// reduced into the field, kept when the curve equation has a solution for x, and the point
+// is multiplied by the cofactor to land in the prime-order subgroup
+func pedersenSetup() {
+	params := edbn254.GetEdwardsCurve()
+	cofactor := params.Cofactor.BigInt(new(big.Int))
+	for i := 0; len(pedersenGens) < 1+2*maxPedersenInputs; i++ {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("merkle_tree pedersen generator %d", i)))
+		var x, y, ySquare, num, den fr.Element
+		y.SetBytes(digest[:])
+		ySquare.Square(&y)
+		num.SetOne().Sub(&num, &ySquare)
+		den.Mul(&ySquare, &params.D).Sub(&params.A, &den)
+		if x.Div(&num, &den).Sqrt(&x) == nil {
+			continue
 		}
+		g := edbn254.NewPointAffine(x, y)
+		g.ScalarMultiplication(&g, cofactor)
+		if g.IsZero() {
+			continue
+		}
+		pedersenGens = append(pedersenGens, g)
 	}
 
-	tree := &MerkleTree{
-		Leaves:         leaves,
-		PatternToIndex: patternToIndex,
+	windows := (pedersenSplit + 1) / 2
+	for _, g := range pedersenGens[1:] {
+		table := make([][4]edbn254.PointAffine, windows)
+		base := g
+		for w := range table {
+			table[w][0].Y.SetOne()
+			table[w][1] = base
+			table[w][2].Double(&base)
+			table[w][3].Add(&table[w][2], &base)
+			base.Double(&table[w][2])
+		}
+		pedersenTables = append(pedersenTables, table)
 	}
-	tree.buildLevels()
+}
 
-	elapsedTime := time.Since(startTime)
-	fmt.Printf("Merkle Tree built in %s\n", elapsedTime)
+// pedersenHash returns the Pedersen digest of inputs, at most maxPedersenInputs of them
+func pedersenHash(inputs []fr.Element) fr.Element {
+	if len(inputs) > maxPedersenInputs {
+		panic(fmt.Sprintf("pedersen hash of %d elements, at most %d", len(inputs), maxPedersenInputs))
+	}
+	pedersenOnce.Do(pedersenSetup)
+	var sum, term edbn254.PointAffine
+	sum.ScalarMultiplication(&pedersenGens[0], big.NewInt(int64(len(inputs))))
+	for i := range inputs {
+		v := inputs[i].BigInt(new(big.Int))
+		hi := new(big.Int).Rsh(v, pedersenSplit)
+		lo := v.Sub(v, new(big.Int).Lsh(hi, pedersenSplit))
+		term.ScalarMultiplication(&pedersenGens[2*i+1], lo)
+		sum.Add(&sum, &term)
+		term.ScalarMultiplication(&pedersenGens[2*i+2], hi)
+		sum.Add(&sum, &term)
+	}
+	return sum.X
+}
 
-	return tree
+// pedersenHasher is the off-circuit Pedersen hash as a hash.Hash: it absorbs 32-byte
+// big-endian field elements like gnark-crypto's MiMC, refusing non-canonical ones, and
+// Sum appends the digest in the same encoding
+type pedersenHasher struct {
+	inputs []fr.Element
 }
-func (mt *MerkleTree) buildLevels() {
-	hFunc := mimcHash.NewMiMC()
-	modulus := fr.Modulus()
 
-	currentLevel := mt.Leaves
-	mt.Nodes = append(mt.Nodes, currentLevel)
+func (h *pedersenHasher) Write(p []byte) (int, error) {
+	if len(p)%fr.Bytes != 0 {
+		return 0, fmt.Errorf("pedersen: write of %d bytes, not a multiple of %d", len(p), fr.Bytes)
+	}
+	for start := 0; start < len(p); start += fr.Bytes {
+		var elem fr.Element
+		if err := elem.SetBytesCanonical(p[start : start+fr.Bytes]); err != nil {
+			return start, err
+		}
+		h.inputs = append(h.inputs, elem)
+	}
+	return len(p), nil
+}
 
-	level := 0
-	for len(currentLevel) > 1 {
-		nextLevel := make([]*big.Int, (len(currentLevel)+1)/2)
-		for i := 0; i < len(currentLevel); i += 2 {
-			// First value
-			var leftElem fr.Element
-			leftElem.SetBigInt(currentLevel[i])
+func (h *pedersenHasher) Sum(b []byte) []byte {
+	digest := pedersenHash(h.inputs)
+	encoded := digest.Bytes()
+	return append(b, encoded[:]...)
+}
 
-			// Second value (or zero)
-			var rightElem fr.Element
-			if i+1 < len(currentLevel) {
-				rightElem.SetBigInt(currentLevel[i+1])
-			} else {
-				rightElem.SetZero()
-			}
+func (h *pedersenHasher) Reset()         { h.inputs = nil }
+func (h *pedersenHasher) Size() int      { return fr.Bytes }
+func (h *pedersenHasher) BlockSize() int { return fr.Bytes }
 
-			// Hash the pair
-			hFunc.Reset()
-			leftBytes := leftElem.Bytes()
-			rightBytes := rightElem.Bytes()
-			hFunc.Write(leftBytes[:])  // Convert array to slice
-			hFunc.Write(rightBytes[:]) // Convert array to slice
+// pedersenFieldHasher is pedersenHasher in-circuit. Each element is split into canonical
+// bits, and every 2-bit window of a half selects a precomputed multiple of its generator,
+// so each window costs one lookup and one complete twisted Edwards addition.
+type pedersenFieldHasher struct {
+	api   frontend.API
+	curve twistededwards.Curve
+	data  []frontend.Variable
+}
 
-			// Reduce result mod field size
-			hashBytes := hFunc.Sum(nil)
-			hashInt := new(big.Int).SetBytes(hashBytes)
-			nextLevel[i/2] = new(big.Int).Mod(hashInt, modulus)
-		}
-		currentLevel = nextLevel
-		mt.Nodes = append(mt.Nodes, currentLevel)
-		level++
-		fmt.Printf("Built level %d with %d nodes\n", level, len(currentLevel))
+func newPedersenFieldHasher(api frontend.API) (*pedersenFieldHasher, error) {
+	curve, err := twistededwards.NewEdCurve(api, tedwards.BN254)
+	if err != nil {
+		return nil, err
 	}
+	return &pedersenFieldHasher{api: api, curve: curve}, nil
+}
 
-	mt.Root = mt.Nodes[len(mt.Nodes)-1][0]
+func (h *pedersenFieldHasher) Write(data ...frontend.Variable) {
+	h.data = append(h.data, data...)
 }
 
-func isAllowedURLRune(r rune) bool {
-	// Only allow ASCII letters (a-z, A-Z)
-	if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
-		return true
-	}
-	// Allow digits (0-9)
-	if r >= '0' && r <= '9' {
-		return true
+func (h *pedersenFieldHasher) Reset() {
+	h.data = nil
+}
+
+func (h *pedersenFieldHasher) Sum() frontend.Variable {
+	if len(h.data) > maxPedersenInputs {
+		panic(fmt.Sprintf("pedersen hash of %d elements, at most %d", len(h.data), maxPedersenInputs))
 	}
-	// Allow specific URL-safe special characters
-	switch r {
-	case '-', '.', '*':
-		return true
-	default:
-		return false
+	pedersenOnce.Do(pedersenSetup)
+	var count edbn254.PointAffine
+	count.ScalarMultiplication(&pedersenGens[0], big.NewInt(int64(len(h.data))))
+	sum := twistededwards.Point{X: count.X.BigInt(new(big.Int)), Y: count.Y.BigInt(new(big.Int))}
+	for i, v := range h.data {
+		// The default digit count is the field size, with the check that v is reduced
+		vBits := bits.ToBinary(h.api, v)
+		for half, halfBits := range [][]frontend.Variable{vBits[:pedersenSplit], vBits[pedersenSplit:]} {
+			table := pedersenTables[2*i+half]
+			for w := 0; 2*w < len(halfBits); w++ {
+				b1 := frontend.Variable(0)
+				if 2*w+1 < len(halfBits) {
+					b1 = halfBits[2*w+1]
+				}
+				var xs, ys [4]*big.Int
+				for k := range table[w] {
+					xs[k], ys[k] = table[w][k].X.BigInt(new(big.Int)), table[w][k].Y.BigInt(new(big.Int))
+				}
+				sum = h.curve.Add(sum, twistededwards.Point{
+					X: h.api.Lookup2(halfBits[2*w], b1, xs[0], xs[1], xs[2], xs[3]),
+					Y: h.api.Lookup2(halfBits[2*w], b1, ys[0], ys[1], ys[2], ys[3]),
+				})
+			}
+		}
 	}
+	return sum.X
 }
 
-// GenerateProof generates a Merkle proof for the given pattern
-func (mt *MerkleTree) GenerateProof(pattern string) ([maxProofLen]*big.Int, [maxProofLen]*big.Int, int) {
-	var proofPath [maxProofLen]*big.Int
-	var proofDir [maxProofLen]*big.Int
+// circuitSize is the size of a compiled constraint system
+type circuitSize struct {
+	NbConstraints, NbPublic, NbSecret, NbInternal int
+}
 
-	// Initialize all elements with zeros
-	for i := 0; i < maxProofLen; i++ {
-		proofPath[i] = big.NewInt(0)
-		proofDir[i] = big.NewInt(0)
+// sizeOf returns the size of ccs
+func sizeOf(ccs constraint.ConstraintSystem) circuitSize {
+	return circuitSize{
+		NbConstraints: ccs.GetNbConstraints(),
+		NbPublic:      ccs.GetNbPublicVariables(),
+		NbSecret:      ccs.GetNbSecretVariables(),
+		NbInternal:    ccs.GetNbInternalVariables(),
 	}
+}
 
-	// Find leaf index using the map
-	leafIndex, exists := mt.PatternToIndex[pattern]
-	if !exists {
-		return proofPath, proofDir, 0
-	}
+// LogValue logs the size as a group of counts
+func (s circuitSize) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int("constraints", s.NbConstraints), slog.Int("public", s.NbPublic),
+		slog.Int("secret", s.NbSecret), slog.Int("internal", s.NbInternal),
+		slog.Int64("estimatedProverBytes", s.EstimatedProverBytes()))
+}
 
-	proofLength := 0
-	currentIndex := leafIndex
+// proverBytesPerConstraint is a rough groth16 prover memory cost per constraint on BN254:
+// the proving key's G1 and G2 points for each wire plus the solver and FFT buffers
+const proverBytesPerConstraint = 512
+
+// EstimatedProverBytes estimates the memory groth16.Setup and Prove need for the circuit,
+// for capacity planning only
+func (s circuitSize) EstimatedProverBytes() int64 {
+	return int64(s.NbConstraints) * proverBytesPerConstraint
+}
 
-	// Calculate total tree height (will be consistent for all proofs)
-	treeHeight := len(mt.Nodes) - 1 // -1 because leaves level is included
+// constraintBreakdown attributes SubstringCircuit constraints to its two parts, counted
+// with gnark's profile package while compiling
+type constraintBreakdown struct {
+	PatternHash int // hashPatternInCircuit, including the character range checks
+	ProofPath   int // proofLevels and merkleRootInCircuit
+}
 
-	// Generate proof up to the tree height
-	for level := 0; level < treeHeight; level++ {
-		siblingIndex := currentIndex ^ 1
-		if siblingIndex < len(mt.Nodes[level]) {
-			proofPath[level] = mt.Nodes[level][siblingIndex]
-			proofDir[level] = big.NewInt(int64(currentIndex % 2))
-		}
-		proofLength = level + 1 // Always set length to current level + 1
-		currentIndex /= 2
+// countConstraints runs f and, unless count is nil, stores the number of constraints it
+// added. Profiling sessions may overlap, so parts of one Define can be counted separately.
+func countConstraints(count *int, f func()) {
+	if count == nil {
+		f()
+		return
 	}
+	p := profile.Start(profile.WithNoOutput())
+	f()
+	p.Stop()
+	*count = p.NbConstraints()
+}
 
-	// Fill remaining positions with zeros (should be consistent now)
-	for i := proofLength; i < maxProofLen; i++ {
-		proofPath[i] = big.NewInt(0)
-		proofDir[i] = big.NewInt(0)
+// logCompiled logs the size and estimated prover memory of a freshly compiled circuit,
+// with its constraint breakdown when one was counted, and returns the size
+func logCompiled(msg string, ccs constraint.ConstraintSystem, elapsed time.Duration, breakdown *constraintBreakdown) circuitSize {
+	size := sizeOf(ccs)
+	attrs := []any{"elapsed", elapsed, "size", size}
+	if breakdown != nil {
+		attrs = append(attrs, "patternHashConstraints", breakdown.PatternHash, "proofPathConstraints", breakdown.ProofPath)
 	}
+	logger.Info(msg, attrs...)
+	return size
+}
 
-	return proofPath, proofDir, proofLength
+// ProcessingStats collects timings and outcome counters for a proving run
+type ProcessingStats struct {
+	TotalTime          time.Duration
+	TreeBuildTime      time.Duration
+	CircuitCompileTime time.Duration
+	SetupTime          time.Duration
+	TotalProofTime     time.Duration
+	VerificationTime   time.Duration
+	ProcessedPatterns  int
+	SuccessfulProofs   int
+	CachedProofs       int
+	FailedProofs       int
+	NotFoundPatterns   int
+	InvalidPatterns    int // Patterns with characters the tree never holds, or not whole labels in a label tree, counted apart from NotFoundPatterns
+	BadProofPaths      int // Patterns whose Merkle proof failed VerifyPath and was never proved, counted apart from FailedProofs
+	Results            []SubstringResult
+	Batches            []BatchResult // Only with -batch-size > 1
+	BatchVerifyTime    time.Duration // Only with -batch-verify
+	BatchVerifyFailed  []string      // Patterns whose proofs failed the -batch-verify check
+	Circuit            circuitSize
+	Breakdown          *constraintBreakdown // Only for circuits built on SubstringCircuit
+	Memory             []memSample          // Only with -mem-stats-interval
+	DuplicatesSkipped  int                  // Repeated entries given their first occurrence's result; not in the outcome counters
+	ProofBytes         int64                // Serialized size of every proof made or read from the cache, batch proofs included
+	SizedProofs        int                  // Proofs counted in ProofBytes
 }
 
-// computeHashOffCircuit computes the MiMC hash of the given pattern
-func computeHashOffCircuit(pattern string) *big.Int {
-	// Initialize MiMC hash function
-	hFunc := mimcHash.NewMiMC()
-	hFunc.Reset()
+// AverageProofBytes returns the mean serialized proof size, or 0 when no proof was made
+func (s ProcessingStats) AverageProofBytes() int64 {
+	if s.SizedProofs == 0 {
+		return 0
+	}
+	return s.ProofBytes / int64(s.SizedProofs)
+}
 
-	// Get field modulus
-	modulus := fr.Modulus()
+// addProofSize counts one proof of n serialized bytes in ProofBytes
+func (s *ProcessingStats) addProofSize(n int64) {
+	if n > 0 {
+		s.ProofBytes += n
+		s.SizedProofs++
+	}
+}
 
-	runePattern := []rune(pattern)
-	for i := 0; i < maxStr1Len; i++ {
-		var val big.Int
-		if i < len(runePattern) {
-			// Convert character to big.Int and reduce mod field modulus
-			val.SetUint64(uint64(runePattern[i]))
-			val.Mod(&val, modulus)
-		} else {
-			val.SetInt64(0)
-		}
+// countingWriter counts the bytes written to it and discards them
+type countingWriter struct {
+	n int64
+}
 
-		// Convert to fr.Element properly
-		var elem fr.Element
-		elem.SetBigInt(&val)
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
 
-		// Write element bytes
-		bytes := elem.Bytes()
-		hFunc.Write(bytes[:])
+// proofSize returns the size of proof serialized with WriteTo, the form the cache and
+// bundles store
+func proofSize(proof io.WriterTo) (int64, error) {
+	var w countingWriter
+	if _, err := proof.WriteTo(&w); err != nil {
+		return 0, err
 	}
-
-	// Get hash and reduce mod field size
-	hashBytes := hFunc.Sum(nil)
-	hashInt := new(big.Int).SetBytes(hashBytes)
-	return hashInt.Mod(hashInt, modulus)
+	return w.n, nil
 }
 
-func isURLSubstring(substr []rune) bool {
-	for _, r := range substr {
-		if !isAllowedURLRune(r) {
-			return false
-		}
-	}
-	return true
+// circuitStatsJSON is the compiled circuit's size in the stats JSON
+type circuitStatsJSON struct {
+	Constraints            int   `json:"constraints"`
+	Public                 int   `json:"public"`
+	Secret                 int   `json:"secret"`
+	Internal               int   `json:"internal"`
+	EstimatedProverBytes   int64 `json:"estimatedProverBytes"`
+	PatternHashConstraints int   `json:"patternHashConstraints,omitempty"`
+	ProofPathConstraints   int   `json:"proofPathConstraints,omitempty"`
 }
 
-func main() {
-	stats := ProcessingStats{}
-	totalStartTime := time.Now()
-	// Open the log file
-	logFile, err := os.OpenFile("debug.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
-	}
-	defer logFile.Close()
+// BatchResult records the outcome of one MultiPatternCircuit proof
+type BatchResult struct {
+	Patterns   []string
+	Padded     int // Slots filled by repeating the last pattern
+	ProveTime  time.Duration
+	VerifyTime time.Duration
+	ProofBytes int64
+	Err        error
+}
 
-	// Set log output to the file
-	log.SetOutput(logFile)
-	// Optional: include timestamps and file info in logs
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+// SubstringResult records the outcome of processing a single substring
+type SubstringResult struct {
+	Pattern    string
+	Entry      int // Index of the pattern in the input list
+	ProofEntry int // Entry whose outcome this is; an earlier one for a repeated pattern
+	Found      bool
+	Cached     bool
+	ProveTime  time.Duration
+	VerifyTime time.Duration
+	ProofBytes int64
+	ProofFile  string // Cached proof or bundle holding the proof, when one was read or written
+	Err        error
+}
 
-	// Load decoded entries and substrings from JSON files
-	decodedEntriesFile := "combined_raw_decoded_entries.json"
-	substringsFile := "c-nimbus24_subj-common-names_1000.json"
+// durationMillis converts a duration to fractional milliseconds for machine-readable output
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
 
-	decodedEntries, err := loadJSONFile(decodedEntriesFile)
-	if err != nil {
-		log.Fatalf("Failed to load decoded entries: %v", err)
+// MarshalJSON emits durations as millisecond numbers rather than Go duration strings
+func (s ProcessingStats) MarshalJSON() ([]byte, error) {
+	results := s.Results
+	if results == nil {
+		results = []SubstringResult{}
 	}
-	log.Printf("Loaded %d decoded entries", len(decodedEntries))
-
-	substrings, err := loadJSONFile(substringsFile)
-	if err != nil {
-		log.Fatalf("Failed to load substrings: %v", err)
+	var circuit *circuitStatsJSON
+	if s.Circuit.NbConstraints > 0 {
+		circuit = &circuitStatsJSON{
+			Constraints:          s.Circuit.NbConstraints,
+			Public:               s.Circuit.NbPublic,
+			Secret:               s.Circuit.NbSecret,
+			Internal:             s.Circuit.NbInternal,
+			EstimatedProverBytes: s.Circuit.EstimatedProverBytes(),
+		}
+		if s.Breakdown != nil {
+			circuit.PatternHashConstraints = s.Breakdown.PatternHash
+			circuit.ProofPathConstraints = s.Breakdown.ProofPath
+		}
 	}
-	log.Printf("Loaded %d substrings", len(substrings))
+	return json.Marshal(struct {
+		TotalMs           float64           `json:"totalMs"`
+		TreeBuildMs       float64           `json:"treeBuildMs"`
+		CircuitCompileMs  float64           `json:"circuitCompileMs"`
+		SetupMs           float64           `json:"setupMs"`
+		TotalProofMs      float64           `json:"totalProofMs"`
+		VerificationMs    float64           `json:"verificationMs"`
+		ProcessedPatterns int               `json:"processed"`
+		SuccessfulProofs  int               `json:"successful"`
+		CachedProofs      int               `json:"cached"`
+		FailedProofs      int               `json:"failed"`
+		NotFoundPatterns  int               `json:"notFound"`
+		InvalidPatterns   int               `json:"invalid"`
+		BadProofPaths     int               `json:"badProofPaths"`
+		Results           []SubstringResult `json:"substrings"`
+		Batches           []BatchResult     `json:"batches,omitempty"`
+		BatchVerifyMs     float64           `json:"batchVerifyMs,omitempty"`
+		BatchVerifyFailed []string          `json:"batchVerifyFailed,omitempty"`
+		Circuit           *circuitStatsJSON `json:"circuit,omitempty"`
+		Memory            []memSample       `json:"memory,omitempty"`
+		DuplicatesSkipped int               `json:"duplicatesSkipped"`
+		ProofBytes        int64             `json:"proofBytes"`
+		AvgProofBytes     int64             `json:"avgProofBytes"`
+	}{
+		TotalMs:           durationMillis(s.TotalTime),
+		TreeBuildMs:       durationMillis(s.TreeBuildTime),
+		CircuitCompileMs:  durationMillis(s.CircuitCompileTime),
+		SetupMs:           durationMillis(s.SetupTime),
+		TotalProofMs:      durationMillis(s.TotalProofTime),
+		VerificationMs:    durationMillis(s.VerificationTime),
+		ProcessedPatterns: s.ProcessedPatterns,
+		SuccessfulProofs:  s.SuccessfulProofs,
+		CachedProofs:      s.CachedProofs,
+		FailedProofs:      s.FailedProofs,
+		NotFoundPatterns:  s.NotFoundPatterns,
+		InvalidPatterns:   s.InvalidPatterns,
+		BadProofPaths:     s.BadProofPaths,
+		Results:           results,
+		Batches:           s.Batches,
+		BatchVerifyMs:     durationMillis(s.BatchVerifyTime),
+		BatchVerifyFailed: s.BatchVerifyFailed,
+		Circuit:           circuit,
+		Memory:            s.Memory,
+		DuplicatesSkipped: s.DuplicatesSkipped,
+		ProofBytes:        s.ProofBytes,
+		AvgProofBytes:     s.AverageProofBytes(),
+	})
+}
 
-	// Concatenate decoded entries and build Merkle tree
-	superString := strings.Join(decodedEntries, "")
-	runeSuperString := []rune(superString)
-	if len(runeSuperString) > maxStr2Len {
-		runeSuperString = runeSuperString[:maxStr2Len]
+// MarshalJSON emits a per-batch record with durations in milliseconds
+func (b BatchResult) MarshalJSON() ([]byte, error) {
+	errMsg := ""
+	if b.Err != nil {
+		errMsg = b.Err.Error()
 	}
-	superString = string(runeSuperString)
+	return json.Marshal(struct {
+		Patterns   []string `json:"patterns"`
+		Padded     int      `json:"padded"`
+		ProveMs    float64  `json:"proveMs"`
+		VerifyMs   float64  `json:"verifyMs"`
+		ProofBytes int64    `json:"proofBytes"`
+		Error      string   `json:"error,omitempty"`
+	}{
+		Patterns:   b.Patterns,
+		Padded:     b.Padded,
+		ProveMs:    durationMillis(b.ProveTime),
+		VerifyMs:   durationMillis(b.VerifyTime),
+		ProofBytes: b.ProofBytes,
+		Error:      errMsg,
+	})
+}
 
-	treeBuildStart := time.Now()
-	merkleTree := NewMerkleTree(superString, maxStr1Len)
-	stats.TreeBuildTime = time.Since(treeBuildStart)
-	fmt.Printf("Merkle Tree built in %s\n", stats.TreeBuildTime)
+// MarshalJSON emits a per-substring record with durations in milliseconds
+func (r SubstringResult) MarshalJSON() ([]byte, error) {
+	errMsg := ""
+	if r.Err != nil {
+		errMsg = r.Err.Error()
+	}
+	return json.Marshal(struct {
+		Pattern    string  `json:"pattern"`
+		Entry      int     `json:"entry"`
+		ProofEntry int     `json:"proofEntry"`
+		Found      bool    `json:"found"`
+		Cached     bool    `json:"cached"`
+		ProveMs    float64 `json:"proveMs"`
+		VerifyMs   float64 `json:"verifyMs"`
+		ProofBytes int64   `json:"proofBytes"`
+		ProofFile  string  `json:"proofFile,omitempty"`
+		Error      string  `json:"error,omitempty"`
+	}{
+		Pattern:    r.Pattern,
+		Entry:      r.Entry,
+		ProofEntry: r.ProofEntry,
+		Found:      r.Found,
+		Cached:     r.Cached,
+		ProveMs:    durationMillis(r.ProveTime),
+		VerifyMs:   durationMillis(r.VerifyTime),
+		ProofBytes: r.ProofBytes,
+		ProofFile:  r.ProofFile,
+		Error:      errMsg,
+	})
+}
 
-	// Compile the circuit
-	var circuit SubstringCircuit
-	compileStart := time.Now()
-	fmt.Println("Compiling circuit...")
-	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &circuit)
+// Define the circuit constraints
+func (circuit *SubstringCircuit) Define(api frontend.API) error {
+	// Initialize the hash function the tree was built with
+	hFunc, err := newCircuitHasher(api, circuit.hash)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	stats.CircuitCompileTime = time.Since(compileStart)
-	fmt.Printf("Circuit compiled in %s\n", stats.CircuitCompileTime)
 
-	// Setup proving/verifying keys
-	fmt.Println("Setting up proving and verifying keys...")
-	pk, vk, err := groth16.Setup(ccs)
-	if err != nil {
-		panic(err)
+	var hashCount, pathCount *int
+	if circuit.breakdown != nil {
+		hashCount, pathCount = &circuit.breakdown.PatternHash, &circuit.breakdown.ProofPath
 	}
-	fmt.Println("Keys setup completed.")
 
-	// Process each substring
-	totalSubstrings := len(substrings)
-	fmt.Printf("Processing %d substrings...\n", totalSubstrings)
+	// 1. Hash the input pattern
+	var patternHash, currentHash frontend.Variable
+	countConstraints(hashCount, func() {
+		patternHash = hashPatternInCircuit(api, hFunc, circuit.Str1[:], circuit.Length)
+	})
 
-	proofStartTime := time.Now()
-	for idx, substring := range substrings {
-		if substring == "" {
-			continue
+	// 2. Verify Merkle proof over the levels the tree has
+	countConstraints(pathCount, func() {
+		n := maxProofLen - circuit.unusedLevels
+		for i := n; i < maxProofLen; i++ {
+			api.AssertIsEqual(circuit.ProofPath[i], 0)
+			api.AssertIsEqual(circuit.ProofPathDir[i], 0)
 		}
+		levels := proofLevels(api, circuit.ProofLength, n)
+		currentHash = merkleRootInCircuit(api, hFunc, patternHash, circuit.ProofPath[:n], circuit.ProofPathDir[:n], levels)
+	})
 
-		// Log the substring being processed
-		log.Printf("Processing substring %d/%d: '%s'", idx+1, totalSubstrings, substring)
+	// 3. Check root match
+	api.AssertIsEqual(currentHash, circuit.MerkleRoot)
 
-		// if strings.ContainsAny(substring, "-.,:;/?#@!$&*()") {
-		// 	fmt.Printf("\nDebug for punctuation-containing string '%s':\n", substring)
-		// 	fmt.Printf("Unicode values: ")
-		// 	for _, r := range substring {
-		// 		fmt.Printf("%d ", r)
-		// 	}
-		// 	fmt.Printf("\n")
+	return nil
+}
 
-		// 	// Print hash values
-		// 	offCircuitHash := computeHashOffCircuit(substring)
-		// 	fmt.Printf("Off-circuit hash: %v\n", offCircuitHash)
-		// }
+// CommittedPatternCircuit is SubstringCircuit with the pattern also bound to the public
+// PatternCommitment = MiMC(Salt, Length, packed Str1), computed off-circuit by
+// commitPattern, so a verifier can tie the proof to a pattern agreed out-of-band
+type CommittedPatternCircuit struct {
+	SubstringCircuit
+	Salt              frontend.Variable `gnark:"salt,secret"`
+	PatternCommitment frontend.Variable `gnark:"patternCommitment,public"`
+}
 
-		// Generate Merkle proof
-		proofPath, proofDir, proofLength := merkleTree.GenerateProof(substring)
+func (circuit *CommittedPatternCircuit) Define(api frontend.API) error {
+	// Range-checks Str1, which the commitment below relies on
+	if err := circuit.SubstringCircuit.Define(api); err != nil {
+		return err
+	}
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	hFunc.Write(circuit.Salt, circuit.Length)
+	hFunc.Write(packStr1(api, circuit.Str1[:])...)
+	api.AssertIsEqual(hFunc.Sum(), circuit.PatternCommitment)
+	return nil
+}
 
-		// fmt.Printf("\nproofPath: '%s'", proofPath)
-		// fmt.Printf("\nproofDir: '%s'", proofDir)
+// commitPattern computes the PatternCommitment checked by CommittedPatternCircuit
+func commitPattern(salt *big.Int, pattern string) *big.Int {
+	fields := append([]*big.Int{salt, big.NewInt(int64(patternLength(pattern)))}, packPattern(pattern)...)
+	return hashFieldElements(mimcHash.NewMiMC(), fields...)
+}
 
-		// Skip if proof length is zero (substring not found)
-		if proofLength == 0 {
-			stats.NotFoundPatterns++
-			fmt.Printf("\nSubstring '%s' not found in the Merkle tree.\n", substring)
-			log.Printf("\nSubstring '%s' not found in the Merkle tree.\n", substring)
-			continue
-		}
+// newPatternSalt returns a random salt for commitPattern
+func newPatternSalt() (*big.Int, error) {
+	var salt fr.Element
+	if _, err := salt.SetRandom(); err != nil {
+		return nil, err
+	}
+	return salt.BigInt(new(big.Int)), nil
+}
 
-		// Create witness with actual values
-		witness := SubstringCircuit{}
+// ProofBundle is what a prover hands to a verifier: the proof and the public inputs it
+// was made against
+type ProofBundle struct {
+	Proof             groth16.Proof
+	MerkleRoot        *big.Int
+	PatternCommitment *big.Int // Set for CommittedPatternCircuit proofs, nil for SubstringCircuit ones
+	CircuitVersion    string   // circuitVersion of the circuit the proof was made with, empty when unknown
+}
 
-		// Handle Unicode characters in substring
-		runeSubstring := []rune(substring)
-		// Fill in the string values
-		for i := 0; i < maxStr1Len; i++ {
-			if i < len(runeSubstring) {
-				// Use uint64 to match computeHashOffCircuit
-				witness.Str1[i] = frontend.Variable(uint64(runeSubstring[i]))
-			} else {
-				witness.Str1[i] = 0
-			}
-		}
+// checkCircuit returns ErrCircuitMismatch unless the bundle was made with the circuit
+// whose circuitVersion is version, which verifying it against that circuit's keys would
+// only report as a failed pairing check
+func (b *ProofBundle) checkCircuit(version string) error {
+	if b.CircuitVersion == "" {
+		return fmt.Errorf("bundle records no circuit version: %w", ErrCircuitMismatch)
+	}
+	if b.CircuitVersion != version {
+		return fmt.Errorf("bundle for circuit %.12s, not %.12s: %w", b.CircuitVersion, version, ErrCircuitMismatch)
+	}
+	return nil
+}
 
-		// Create Masks array
-		for i := 0; i < maxProofLen; i++ {
-			if i < proofLength {
-				witness.Masks[i] = 1
-			} else {
-				witness.Masks[i] = 0
-			}
-		}
+// Verify checks the bundled proof against vk and the bundled public inputs
+func (b *ProofBundle) Verify(vk groth16.VerifyingKey) error {
+	publicWitness, err := b.publicWitness()
+	if err != nil {
+		return err
+	}
+	return groth16.Verify(b.Proof, vk, publicWitness)
+}
 
-		// Convert proof path values to frontend.Variable
-		for i := 0; i < maxProofLen; i++ {
-			if i < proofLength {
-				witness.ProofPath[i] = proofPath[i]
-				witness.ProofPathDir[i] = proofDir[i]
+// publicWitness returns the public witness of the bundled inputs
+func (b *ProofBundle) publicWitness() (witness.Witness, error) {
+	var assignment frontend.Circuit = &SubstringCircuit{MerkleRoot: b.MerkleRoot}
+	if b.PatternCommitment != nil {
+		assignment = &CommittedPatternCircuit{
+			SubstringCircuit:  SubstringCircuit{MerkleRoot: b.MerkleRoot},
+			PatternCommitment: b.PatternCommitment,
+		}
+	}
+	return frontend.NewWitness(assignment, fieldModulus, frontend.PublicOnly())
+}
+
+const (
+	bundleFileMagic   = "MPB2" // Identifies the serialized ProofBundle format and its version
+	bundleFileMagicV1 = "MPB1" // The format before bundles recorded their circuit version
+)
+
+// WriteTo writes the bundle as the magic, the circuit version prefixed by its length in
+// one byte, the 32-byte root, a flag byte and the 32-byte pattern commitment when the
+// flag is 1, then the proof
+func (b *ProofBundle) WriteTo(w io.Writer) (int64, error) {
+	if len(b.CircuitVersion) > 255 {
+		return 0, fmt.Errorf("circuit version of %d bytes", len(b.CircuitVersion))
+	}
+	var buf bytes.Buffer
+	buf.WriteString(bundleFileMagic)
+	buf.WriteByte(byte(len(b.CircuitVersion)))
+	buf.WriteString(b.CircuitVersion)
+	var elem fr.Element
+	elem.SetBigInt(b.MerkleRoot)
+	root := elem.Bytes()
+	buf.Write(root[:])
+	if b.PatternCommitment == nil {
+		buf.WriteByte(0)
+	} else {
+		elem.SetBigInt(b.PatternCommitment)
+		commitment := elem.Bytes()
+		buf.WriteByte(1)
+		buf.Write(commitment[:])
+	}
+	if _, err := b.Proof.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// ReadFrom reads a bundle written by WriteTo, or by the format before it, which leaves
+// CircuitVersion empty
+func (b *ProofBundle) ReadFrom(r io.Reader) (int64, error) {
+	magic := make([]byte, len(bundleFileMagic))
+	n, err := io.ReadFull(r, magic)
+	if err != nil {
+		return int64(n), err
+	}
+	b.CircuitVersion = ""
+	switch string(magic) {
+	case bundleFileMagic:
+		var length [1]byte
+		m, err := io.ReadFull(r, length[:])
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+		version := make([]byte, length[0])
+		m, err = io.ReadFull(r, version)
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+		b.CircuitVersion = string(version)
+	case bundleFileMagicV1:
+	default:
+		return int64(n), errors.New("not a proof bundle")
+	}
+	header := make([]byte, fr.Bytes+1)
+	m, err := io.ReadFull(r, header)
+	n += m
+	if err != nil {
+		return int64(n), err
+	}
+	b.MerkleRoot = new(big.Int).SetBytes(header[:fr.Bytes])
+	b.PatternCommitment = nil
+	switch header[len(header)-1] {
+	case 0:
+	case 1:
+		var commitment [fr.Bytes]byte
+		m, err := io.ReadFull(r, commitment[:])
+		n += m
+		if err != nil {
+			return int64(n), err
+		}
+		b.PatternCommitment = new(big.Int).SetBytes(commitment[:])
+	default:
+		return int64(n), errors.New("malformed proof bundle")
+	}
+	b.Proof = groth16.NewProof(ecc.BN254)
+	proofBytes, err := b.Proof.ReadFrom(r)
+	return int64(n) + proofBytes, err
+}
+
+// bundleOpening is what the prover keeps for each bundle written with -bundle-dir: the
+// pattern and the salt that open its commitment
+type bundleOpening struct {
+	Pattern string `json:"pattern"`
+	Salt    string `json:"salt"`
+}
+
+// writeBundle writes bundle to dir as name.bundle, with the opening of its commitment in
+// name.opening.json
+func bundlePath(dir, name string) string {
+	return filepath.Join(dir, name+".bundle")
+}
+
+func writeBundle(dir, name string, bundle ProofBundle, pattern string, salt *big.Int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeToFile(bundlePath(dir, name), &bundle); err != nil {
+		return err
+	}
+	data, err := json.Marshal(bundleOpening{Pattern: pattern, Salt: salt.Text(16)})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".opening.json"), append(data, '\n'), 0600)
+}
+
+// VersionedRootCircuit is SubstringCircuit with the root also bound to the public
+// ListVersion of the allow-list through ListCommitment = MiMC(MerkleRoot, ListVersion),
+// computed off-circuit by commitListVersion. A verifier pinning the commitment of the
+// current list rejects proofs made against a stale one.
+type VersionedRootCircuit struct {
+	SubstringCircuit
+	ListVersion    frontend.Variable `gnark:"listVersion,public"`
+	ListCommitment frontend.Variable `gnark:"listCommitment,public"`
+}
+
+func (circuit *VersionedRootCircuit) Define(api frontend.API) error {
+	if err := circuit.SubstringCircuit.Define(api); err != nil {
+		return err
+	}
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	hFunc.Write(circuit.MerkleRoot, circuit.ListVersion)
+	api.AssertIsEqual(hFunc.Sum(), circuit.ListCommitment)
+	return nil
+}
+
+// commitListVersion computes the ListCommitment checked by VersionedRootCircuit
+func commitListVersion(root, version *big.Int) *big.Int {
+	return hashFieldElements(mimcHash.NewMiMC(), root, version)
+}
+
+// patternProof is one pattern's Merkle opening inside MultiPatternCircuit
+type patternProof struct {
+	Str1         [maxStr1Len]frontend.Variable
+	Length       frontend.Variable
+	ProofPath    [maxProofLen]frontend.Variable
+	ProofPathDir [maxProofLen]frontend.Variable
+	ProofLength  frontend.Variable
+}
+
+// MultiPatternCircuit proves that every one of len(Proofs) secret patterns is a leaf of
+// the tree with the public MerkleRoot, so setup and verification are paid once per batch
+type MultiPatternCircuit struct {
+	Proofs     []patternProof    `gnark:"proofs,secret"`
+	MerkleRoot frontend.Variable `gnark:"merkleRoot,public"`
+
+	hash HashFunc
+}
+
+// newMultiPatternCircuit returns a MultiPatternCircuit shaped for batchSize patterns
+func newMultiPatternCircuit(batchSize int, h HashFunc) *MultiPatternCircuit {
+	return &MultiPatternCircuit{Proofs: make([]patternProof, batchSize), hash: h}
+}
+
+func (circuit *MultiPatternCircuit) Define(api frontend.API) error {
+	hFunc, err := newCircuitHasher(api, circuit.hash)
+	if err != nil {
+		return err
+	}
+	for i := range circuit.Proofs {
+		p := &circuit.Proofs[i]
+		patternHash := hashPatternInCircuit(api, hFunc, p.Str1[:], p.Length)
+		root := merkleRootInCircuit(api, hFunc, patternHash, p.ProofPath[:], p.ProofPathDir[:], proofLevels(api, p.ProofLength, maxProofLen))
+		api.AssertIsEqual(root, circuit.MerkleRoot)
+	}
+	return nil
+}
+
+// buildBatchWitness returns a MultiPatternCircuit assignment for patterns, padding the
+// batch to batchSize by repeating the last pattern
+func buildBatchWitness(mt *MerkleTree, patterns []string, batchSize int) (*MultiPatternCircuit, error) {
+	if len(patterns) == 0 || len(patterns) > batchSize {
+		return nil, fmt.Errorf("batch of %d patterns does not fit a batch size of %d", len(patterns), batchSize)
+	}
+	assignment := newMultiPatternCircuit(batchSize, mt.Hash)
+	assignment.MerkleRoot = mt.Root
+	for i := range assignment.Proofs {
+		pattern := patterns[min(i, len(patterns)-1)]
+		proof, err := mt.GenerateProof(pattern)
+		if err != nil {
+			return nil, err
+		}
+		witness, err := buildWitness(pattern, proof, mt.Root)
+		if err != nil {
+			return nil, err
+		}
+		assignment.Proofs[i] = patternProof{
+			Str1:         witness.Str1,
+			Length:       witness.Length,
+			ProofPath:    witness.ProofPath,
+			ProofPathDir: witness.ProofPathDir,
+			ProofLength:  witness.ProofLength,
+		}
+	}
+	return assignment, nil
+}
+
+// proofLevels returns, for each of the n proof levels, 1 if i < proofLength and 0
+// otherwise, and asserts that 0 <= proofLength <= n. Level i is active when proofLength
+// is none of 0..i, which costs a few constraints per level instead of a full comparison,
+// and the flags are ones followed by zeros by construction.
+func proofLevels(api frontend.API, proofLength frontend.Variable, n int) []frontend.Variable {
+	levels := make([]frontend.Variable, n)
+	active := frontend.Variable(1)
+	for i := range levels {
+		active = api.Mul(active, api.Sub(1, api.IsZero(api.Sub(proofLength, i))))
+		levels[i] = active
+	}
+	// Every level is still active only if proofLength is n, or outside 0..n
+	api.AssertIsEqual(api.Mul(active, api.Sub(proofLength, n)), 0)
+	return levels
+}
+
+// merkleRootInCircuit hashes leafHash up the tree along the proof path, skipping levels
+// whose flag from proofLevels is 0, and returns the resulting root. The flags must be
+// boolean: any other value would interpolate between the old and new hash, letting a
+// prover steer the last active level to any root. Directions must be bits, and both path
+// and direction must be 0 on skipped levels, so that each leaf has exactly one witness.
+func merkleRootInCircuit(api frontend.API, hFunc hash.FieldHasher, leafHash frontend.Variable, path, dirs, levels []frontend.Variable) frontend.Variable {
+	currentHash := leafHash
+
+	// Process proof elements
+	for i := range path {
+		active := levels[i] // 1 if i < ProofLength, 0 beyond it
+
+		// Nothing may be smuggled into the levels the hash skips
+		api.AssertIsBoolean(dirs[i])
+		inactive := api.Sub(1, active)
+		api.AssertIsEqual(api.Mul(inactive, path[i]), 0)
+		api.AssertIsEqual(api.Mul(inactive, dirs[i]), 0)
+
+		// Prepare the pair to hash
+		left := api.Select(dirs[i], path[i], currentHash)
+		right := api.Select(dirs[i], currentHash, path[i])
+
+		// Hash the pair
+		hFunc.Reset()
+		hFunc.Write(left)
+		hFunc.Write(right)
+		newHash := hFunc.Sum()
+
+		// Keep the new hash only on active levels
+		deltaHash := api.Sub(newHash, currentHash)
+		currentHash = api.Add(currentHash, api.Mul(active, deltaHash))
+	}
+
+	return currentHash
+}
+
+// hashPatternInCircuit constrains length to match the zero padding of str1, range checks
+// every character to 8 bits and returns the MiMC digest of the length followed by the
+// characters packed charsPerElement at a time, mirroring computeHashOffCircuit
+func hashPatternInCircuit(api frontend.API, hFunc hash.FieldHasher, str1 []frontend.Variable, length frontend.Variable) frontend.Variable {
+	assertPatternLength(api, str1, length)
+	for i := range str1 {
+		bits.ToBinary(api, str1[i], bits.WithNbDigits(8))
+	}
+	hFunc.Reset()
+	hFunc.Write(length)
+	hFunc.Write(packStr1(api, str1)...)
+	return hFunc.Sum()
+}
+
+// packStr1 packs str1 into charsPerElement characters per element like packPattern. It
+// adds no range checks; callers must have checked every character to 8 bits.
+func packStr1(api frontend.API, str1 []frontend.Variable) []frontend.Variable {
+	var packed []frontend.Variable
+	for start := 0; start < len(str1); start += charsPerElement {
+		end := min(start+charsPerElement, len(str1))
+		val := frontend.Variable(0)
+		for i := start; i < end; i++ {
+			coeff := new(big.Int).Lsh(big.NewInt(1), uint(8*(end-1-i)))
+			val = api.Add(val, api.Mul(str1[i], coeff))
+		}
+		packed = append(packed, val)
+	}
+	return packed
+}
+
+// assertPatternLength asserts that the first length characters of str1 are non-zero and
+// the rest are zero, so a pattern cannot be padded with NUL characters to forge another
+func assertPatternLength(api frontend.API, str1 []frontend.Variable, length frontend.Variable) {
+	count := frontend.Variable(0)
+	prevNonZero := frontend.Variable(1)
+	for i := range str1 {
+		nonZero := api.Sub(1, api.IsZero(str1[i]))
+		// A non-zero character may not follow a zero one
+		api.AssertIsEqual(api.Mul(nonZero, api.Sub(1, prevNonZero)), 0)
+		count = api.Add(count, nonZero)
+		prevNonZero = nonZero
+	}
+	api.AssertIsEqual(count, length)
+}
+
+// MerkleTree represents the Merkle tree for pattern verification
+type MerkleTree struct {
+	Leaves         []*big.Int
+	Nodes          [][]*big.Int
+	Root           *big.Int
+	PatternToIndex map[string][]int // Leaf indices holding each pattern, in increasing order
+	SourceHash     [32]byte         // Hash of the superString and maxPatternLen the tree was built from
+	Hash           HashFunc         // Hash of leaves and nodes: HashMiMC, HashSHA256 or HashPedersen
+	Sources        []EntrySource    // Entry files the superString was read from; see WithEntrySources
+
+	charset   Charset       // Runes leaves may hold; see WithCharset
+	normalize Normalization // Applied to every pattern before it is looked up; see WithNormalization
+	leafMode  LeafMode      // Which substrings of the entries are leaves; see WithLeafMode
+	compact   bool          // Only the leaves and top levels are kept in Nodes; see WithCompactStorage
+	hashCache string        // File of pattern hashes reused across builds; see WithHashCache
+	unsorted  bool          // Leaves were appended or tombstoned, so leaf order no longer follows pattern order
+	bloom     *BloomFilter  // Consulted before PatternToIndex when set, so most absent patterns skip the map
+	patterns  []string      // Patterns by leaf index, built lazily by patternsByIndex
+}
+
+// compactCachedNodes is the largest level kept in memory by compact storage, so proofs
+// only recompute the subtrees below the cached top levels
+const compactCachedNodes = 1 << 10
+
+// TreeOption configures NewMerkleTree
+type TreeOption func(*MerkleTree)
+
+// WithCompactStorage keeps only the leaf layer and the top few levels in memory.
+// GenerateProof then recomputes the missing sibling hashes on demand, trading
+// O(n / compactCachedNodes) hashing per proof for roughly half the node storage.
+func WithCompactStorage() TreeOption {
+	return func(mt *MerkleTree) {
+		mt.compact = true
+	}
+}
+
+// WithHash builds the tree with h instead of MiMC; SubstringCircuit must be compiled with
+// the same hash, which it takes from MerkleTree.Hash
+func WithHash(h HashFunc) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.Hash = h
+	}
+}
+
+// WithCharset builds the tree from substrings made only of runes c allows, and reports
+// patterns with other runes as ErrDisallowedChars, instead of using DefaultCharset
+func WithCharset(c Charset) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.charset = c
+	}
+}
+
+// WithNormalization normalizes every pattern with n before it is looked up or proved, and
+// records n in the tree's source hash and saved file. The superstring must be built from
+// entries normalized with the same n, see Normalization.ApplyAll.
+func WithNormalization(n Normalization) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.normalize = n
+	}
+}
+
+// WithLeafMode builds the tree from the substrings m selects instead of from every
+// substring, and records m in the tree's source hash. Patterns a label mode cannot hold
+// are reported as ErrNotExpressible rather than as missing.
+func WithLeafMode(m LeafMode) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.leafMode = m
+	}
+}
+
+// WithEntrySources records the entry files the superstring was read from, and how many
+// entries each contributed, in the tree and its saved file. It does not change the tree.
+func WithEntrySources(sources []EntrySource) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.Sources = sources
+	}
+}
+
+// WithHashCache reuses leaf hashes saved in filename by earlier builds and saves the
+// ones it had to compute, so rebuilding from the same or overlapping input skips most
+// hashing. The cache is discarded when the leaf encoding parameters change.
+func WithHashCache(filename string) TreeOption {
+	return func(mt *MerkleTree) {
+		mt.hashCache = filename
+	}
+}
+
+// NewMerkleTree constructs a Merkle tree from the given superString and maxPatternLen
+func NewMerkleTree(superString string, maxPatternLen int, opts ...TreeOption) *MerkleTree {
+	logger.Info("Building Merkle Tree...")
+	startTime := time.Now()
+
+	// Only the charset and normalization are needed here; NewMerkleTreeFromLeaves applies the options again
+	var settings MerkleTree
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
+	// Generate all possible substrings up to maxPatternLen and remove duplicates
+	var patterns []string
+	if settings.leafMode == LeafSubstrings {
+		patterns = uniqueSubstrings(superString, maxPatternLen, settings.charset)
+	} else {
+		// Reading from a string never fails
+		patterns, _ = uniqueLabelsFrom(strings.NewReader(superString), maxPatternLen, settings.charset, settings.leafMode, io.Discard)
+	}
+
+	logger.Info("Total unique substrings to hash", "count", len(patterns), "leafMode", settings.leafMode)
+
+	tree := NewMerkleTreeFromLeaves(patterns, opts...)
+	tree.SourceHash = treeSourceHash(superString, maxPatternLen, settings.charset, settings.normalize, settings.leafMode)
+
+	elapsedTime := time.Since(startTime)
+	logger.Info("Merkle Tree built", "elapsed", elapsedTime)
+
+	return tree
+}
+
+// NewMerkleTreeFromReader is NewMerkleTree over the text read from r, which is streamed in
+// blocks so the whole text never has to be held; see uniqueSubstringsFrom. For valid UTF-8
+// it builds the same tree, source hash included, as NewMerkleTree.
+func NewMerkleTreeFromReader(r io.RuneReader, maxPatternLen int, opts ...TreeOption) (*MerkleTree, error) {
+	logger.Info("Building Merkle Tree from a stream...")
+	startTime := time.Now()
+
+	var settings MerkleTree
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
+	source := newSourceHasher(maxPatternLen, settings.charset, settings.normalize, settings.leafMode)
+	var patterns []string
+	var err error
+	if settings.leafMode == LeafSubstrings {
+		patterns, err = uniqueSubstringsFrom(r, maxPatternLen, settings.charset, source)
+	} else {
+		patterns, err = uniqueLabelsFrom(r, maxPatternLen, settings.charset, settings.leafMode, source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Total unique substrings to hash", "count", len(patterns), "leafMode", settings.leafMode)
+
+	tree := NewMerkleTreeFromLeaves(patterns, opts...)
+	tree.SourceHash = source.Sum()
+
+	logger.Info("Merkle Tree built", "elapsed", time.Since(startTime))
+	return tree, nil
+}
+
+// NewMerkleTreeFromLeaves builds a tree with one leaf per entry of patterns, in the given
+// order. Unlike NewMerkleTree it keeps repeated patterns, each at its own leaf, so
+// GenerateProof can open any of their occurrences.
+func NewMerkleTreeFromLeaves(patterns []string, opts ...TreeOption) *MerkleTree {
+	// Build pattern to index map
+	patternToIndex := make(map[string][]int, len(patterns))
+	for i, pattern := range patterns {
+		patternToIndex[pattern] = append(patternToIndex[pattern], i)
+	}
+
+	tree := &MerkleTree{
+		PatternToIndex: patternToIndex,
+		unsorted:       !slices.IsSorted(patterns),
+	}
+	for _, opt := range opts {
+		opt(tree)
+	}
+
+	// Convert patterns to leaves in parallel; ordering is fixed by patterns
+	if tree.hashCache != "" {
+		tree.Leaves = hashLeavesCached(patterns, tree.hashCache, tree.Hash)
+	} else {
+		tree.Leaves = hashLeaves(patterns, tree.Hash, runtime.NumCPU())
+	}
+	tree.buildLevels()
+	return tree
+}
+
+// RequiredProofLen returns ceil(log2(numLeaves)), the height of a tree over numLeaves
+// leaves and so the length of every proof in it
+func RequiredProofLen(numLeaves int) int {
+	if numLeaves <= 1 {
+		return 0
+	}
+	return mathbits.Len(uint(numLeaves - 1))
+}
+
+// unusedLevels returns how many of the circuit's maxProofLen levels lie above the tree
+func (mt *MerkleTree) unusedLevels() int {
+	return max(0, maxProofLen-RequiredProofLen(len(mt.Leaves)))
+}
+
+// uniqueSubstrings returns the sorted, deduplicated substrings of superString of at most
+// maxPatternLen UTF-8 bytes that start and end on rune boundaries and consist only of
+// runes charset allows.
+//
+// Every returned string is a slice of superString, so no character data is copied; memory
+// is bounded by the number of unique substrings (at most len(superString)*maxPatternLen)
+// times roughly 16 bytes for the string header plus map overhead while deduplicating,
+// instead of also holding a private copy of each substring's bytes.
+func uniqueSubstrings(superString string, maxPatternLen int, charset Charset) []string {
+	substrSet := make(map[string]struct{})
+	addSubstrings(substrSet, superString, maxPatternLen, charset, true)
+	return sortedSubstrings(substrSet)
+}
+
+// textBlockSize is how many bytes of text uniqueSubstringsFrom reads at a time
+const textBlockSize = 1 << 16
+
+// uniqueSubstringsFrom is uniqueSubstrings over the text read from r, also writing the
+// text to w. It reads textBlockSize bytes at a time and keys the set with slices of the
+// block a substring was first found in, so blocks that add no new substring, common in
+// repetitive CT data, are freed as soon as they are enumerated. Invalid UTF-8 reads as
+// U+FFFD.
+func uniqueSubstringsFrom(r io.RuneReader, maxPatternLen int, charset Charset, w io.Writer) ([]string, error) {
+	substrSet := make(map[string]struct{})
+	buf := make([]byte, 0, textBlockSize+utf8.UTFMax)
+	carry := "" // Start of the text whose substrings the last block could not finish
+	for {
+		buf = buf[:0]
+		var err error
+		for len(buf) < textBlockSize {
+			var c rune
+			if c, _, err = r.ReadRune(); err != nil {
+				break
+			}
+			buf = utf8.AppendRune(buf, c)
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+
+		block := carry + string(buf)
+		next := addSubstrings(substrSet, block, maxPatternLen, charset, err == io.EOF)
+		if err == io.EOF {
+			return sortedSubstrings(substrSet), nil
+		}
+		carry = block[next:]
+	}
+}
+
+// addSubstrings adds to substrSet every substring of block that uniqueSubstrings would
+// take, keyed by slices of block. Unless final, substrings starting fewer than
+// maxPatternLen bytes before the end of block may continue into the next block, so they
+// are left out; the returned offset is where the first of them starts, len(block) if none.
+func addSubstrings(substrSet map[string]struct{}, block string, maxPatternLen int, charset Charset, final bool) int {
+	// Byte offset of every rune, plus the end of the block
+	offsets := make([]int, 0, len(block)+1)
+	allowed := make([]bool, 0, len(block))
+	for i, r := range block {
+		offsets = append(offsets, i)
+		allowed = append(allowed, charset.Allows(r))
+	}
+	offsets = append(offsets, len(block))
+	numRunes := len(allowed)
+
+	// runLen[i] is the number of consecutive allowed runes starting at rune i, so a
+	// substring is valid exactly when its length fits in the run at its start
+	runLen := make([]int, numRunes+1)
+	for i := numRunes - 1; i >= 0; i-- {
+		if allowed[i] {
+			runLen[i] = runLen[i+1] + 1
+		}
+	}
+
+	for start := 0; start < numRunes; start++ {
+		if !final && len(block)-offsets[start] < maxPatternLen {
+			return offsets[start]
+		}
+		for end := start + 1; end <= start+runLen[start] && offsets[end]-offsets[start] <= maxPatternLen; end++ {
+			// Storing an existing key again would replace it with this slice, keeping block alive
+			if substr := block[offsets[start]:offsets[end]]; !hasSubstring(substrSet, substr) {
+				substrSet[substr] = struct{}{}
+			}
+		}
+	}
+	return len(block)
+}
+
+// hasSubstring reports whether substrSet holds substr
+func hasSubstring(substrSet map[string]struct{}, substr string) bool {
+	_, ok := substrSet[substr]
+	return ok
+}
+
+// sortedSubstrings returns the keys of substrSet in sorted order
+func sortedSubstrings(substrSet map[string]struct{}) []string {
+	// Convert set to slice
+	patterns := make([]string, 0, len(substrSet))
+	for substr := range substrSet {
+		patterns = append(patterns, substr)
+	}
+
+	// Sort the patterns slice to ensure deterministic ordering
+	sort.Strings(patterns)
+	return patterns
+}
+
+// LeafMode selects which substrings of the entries become leaves. Common names are
+// almost always queried as whole labels or full hostnames, which the label modes hold
+// with orders of magnitude fewer leaves than every substring.
+type LeafMode int
+
+const (
+	LeafSubstrings  LeafMode = iota // Every substring of at most maxPatternLen bytes
+	LeafLabels                      // Every dot-separated label and every full hostname
+	LeafRegistrable                 // LeafLabels, plus each hostname's label-aligned suffixes down to its registrable domain
+)
+
+// ParseLeafMode parses a -leaf-mode value: substrings, labels or registrable
+func ParseLeafMode(spec string) (LeafMode, error) {
+	switch strings.ToLower(spec) {
+	case "", "substrings":
+		return LeafSubstrings, nil
+	case "labels":
+		return LeafLabels, nil
+	case "registrable":
+		return LeafRegistrable, nil
+	}
+	return LeafSubstrings, fmt.Errorf("unknown leaf mode %q (want substrings, labels or registrable)", spec)
+}
+
+func (m LeafMode) String() string {
+	switch m {
+	case LeafLabels:
+		return "labels"
+	case LeafRegistrable:
+		return "registrable"
+	}
+	return "substrings"
+}
+
+// uniqueLabelsFrom is uniqueSubstringsFrom for the label modes: every maximal run of runes
+// charset allows is a hostname, and the leaves are its labels, the hostname itself and,
+// for LeafRegistrable, its suffixes down to its registrable domain, each of at most
+// maxPatternLen bytes. A run with an empty label between two dots is not a hostname, so
+// only its labels are taken. The text is written to w as it is read.
+func uniqueLabelsFrom(r io.RuneReader, maxPatternLen int, charset Charset, mode LeafMode, w io.Writer) ([]string, error) {
+	labelSet := make(map[string]struct{})
+	out := bufio.NewWriterSize(w, textBlockSize)
+	var host []byte
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == nil {
+			out.WriteRune(c)
+			if charset.Allows(c) {
+				host = utf8.AppendRune(host, c)
+				continue
+			}
+		}
+		addLabels(labelSet, string(host), maxPatternLen, mode)
+		host = host[:0]
+		if err == io.EOF {
+			if err := out.Flush(); err != nil {
+				return nil, err
+			}
+			return sortedSubstrings(labelSet), nil
+		}
+	}
+}
+
+// addLabels adds to labelSet the leaves uniqueLabelsFrom takes from one hostname
+func addLabels(labelSet map[string]struct{}, host string, maxPatternLen int, mode LeafMode) {
+	add := func(leaf string) {
+		if leaf != "" && len(leaf) <= maxPatternLen {
+			labelSet[leaf] = struct{}{}
+		}
+	}
+	host = strings.Trim(host, ".")
+	for _, label := range strings.Split(host, ".") {
+		add(label)
+	}
+	if strings.Contains(host, "..") {
+		return
+	}
+	add(host)
+	if mode != LeafRegistrable {
+		return
+	}
+	// A public suffix on its own, such as co.uk, has no registrable domain
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return
+	}
+	for suffix := host; len(suffix) > len(registrable); {
+		suffix = suffix[strings.IndexByte(suffix, '.')+1:]
+		add(suffix)
+	}
+}
+
+// checkPatternLabels returns ErrNotExpressible if mt is a label tree and pattern, already
+// normalized, is not whole labels: empty, cut at a leading or trailing dot, or with an
+// empty label. Such a pattern is not merely absent: no label tree ever holds it.
+func (mt *MerkleTree) checkPatternLabels(pattern string) error {
+	if mt.leafMode == LeafSubstrings {
+		return nil
+	}
+	if pattern == "" || strings.HasPrefix(pattern, ".") || strings.HasSuffix(pattern, ".") || strings.Contains(pattern, "..") {
+		return fmt.Errorf("%q in a %s tree: %w", pattern, mt.leafMode, ErrNotExpressible)
+	}
+	return nil
+}
+
+// TextIndex is a suffix array over the superstring. It answers whether a pattern occurs
+// anywhere in the text in O(len(pattern) * log(len(text))), so a pattern that does not
+// is known to be missing before any tree lookup or proving. A pattern that does occur may
+// still have no leaf, for being too long or crossing a character the charset rejects.
+type TextIndex struct {
+	sa *suffixarray.Index
+}
+
+// NewTextIndex indexes text, which it keeps; it must not be modified afterwards
+func NewTextIndex(text []byte) *TextIndex {
+	return &TextIndex{sa: suffixarray.New(text)}
+}
+
+// Contains reports whether pattern occurs in the indexed text; the empty pattern always does
+func (ti *TextIndex) Contains(pattern string) bool {
+	return pattern == "" || len(ti.sa.Lookup([]byte(pattern), 1)) > 0
+}
+
+// NewQueriedMerkleTree builds a tree from only the patterns a run will query, instead of
+// every substring of the text: the distinct normalized patterns that occur in the text
+// index holds, fit in maxPatternLen bytes and consist of runes the charset allows, the
+// leaves NewMerkleTree would have given them. The tree depends on the patterns as well as
+// the text, so its source hash is left zero and it is not meant to be saved.
+func NewQueriedMerkleTree(patterns []string, index *TextIndex, maxPatternLen int, opts ...TreeOption) (*MerkleTree, error) {
+	var settings MerkleTree
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	if settings.leafMode != LeafSubstrings {
+		return nil, fmt.Errorf("queried trees hold substrings, not %s", settings.leafMode)
+	}
+	leafSet := make(map[string]struct{})
+	for _, pattern := range settings.normalize.ApplyAll(patterns) {
+		if pattern == "" || len(pattern) > maxPatternLen || !index.Contains(pattern) {
+			continue
+		}
+		allowed := true
+		for _, r := range pattern {
+			allowed = allowed && settings.charset.Allows(r)
+		}
+		if allowed {
+			leafSet[pattern] = struct{}{}
+		}
+	}
+	if len(leafSet) == 0 {
+		return nil, errors.New("no queried pattern occurs in the text")
+	}
+	leaves := sortedSubstrings(leafSet)
+	logger.Info("Total queried substrings to hash", "count", len(leaves), "queried", len(patterns))
+	return NewMerkleTreeFromLeaves(leaves, opts...), nil
+}
+
+// BloomFilter is a compact pre-filter over a tree's patterns: MayContain never misses a
+// pattern that was added, and wrongly reports an absent one at about the false-positive
+// rate it was sized for. It takes roughly 1.44*log2(1/rate) bits per pattern, against the
+// hundreds of bytes per pattern of PatternToIndex, so it can answer "not present" for
+// services that mostly get absent patterns without holding the tree.
+type BloomFilter struct {
+	words  []uint64
+	bits   uint64  // Length of the bit array, a multiple of 64
+	hashes int     // Bit positions set per pattern
+	fpRate float64 // False-positive rate the filter was sized for
+}
+
+// NewBloomFilter sizes a filter for n patterns at the false-positive rate fpRate, which
+// must lie strictly between 0 and 1
+func NewBloomFilter(n int, fpRate float64) (*BloomFilter, error) {
+	if !(fpRate > 0 && fpRate < 1) {
+		return nil, fmt.Errorf("false-positive rate %v must be between 0 and 1", fpRate)
+	}
+	n = max(n, 1)
+	bits := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	bits = (max(bits, 64) + 63) / 64 * 64
+	hashes := max(1, int(math.Round(float64(bits)/float64(n)*math.Ln2)))
+	return &BloomFilter{words: make([]uint64, bits/64), bits: bits, hashes: hashes, fpRate: fpRate}, nil
+}
+
+// positions calls f with each bit position of pattern, derived from the two halves of its
+// FNV-1a 128-bit hash by double hashing
+func (bf *BloomFilter) positions(pattern string, f func(bit uint64) bool) {
+	h := fnv.New128a()
+	io.WriteString(h, pattern)
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])|1
+	for i := 0; i < bf.hashes; i++ {
+		if !f((h1 + uint64(i)*h2) % bf.bits) {
+			return
+		}
+	}
+}
+
+// Add records pattern in the filter
+func (bf *BloomFilter) Add(pattern string) {
+	bf.positions(pattern, func(bit uint64) bool {
+		bf.words[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// MayContain reports false only when pattern was never added
+func (bf *BloomFilter) MayContain(pattern string) bool {
+	found := true
+	bf.positions(pattern, func(bit uint64) bool {
+		found = bf.words[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// SizeBytes returns the size of the filter's bit array
+func (bf *BloomFilter) SizeBytes() int {
+	return len(bf.words) * 8
+}
+
+// newTreeBloomFilter builds a filter over every pattern of mt at the rate fpRate
+func newTreeBloomFilter(mt *MerkleTree, fpRate float64) (*BloomFilter, error) {
+	bf, err := NewBloomFilter(len(mt.PatternToIndex), fpRate)
+	if err != nil {
+		return nil, err
+	}
+	for pattern := range mt.PatternToIndex {
+		bf.Add(pattern)
+	}
+	return bf, nil
+}
+
+const bloomFileMagic = "MKB1" // Identifies the serialized BloomFilter format and its version
+
+// bloomFilterPath returns where the filter for the tree saved at treeFile is kept
+func bloomFilterPath(treeFile string) string {
+	return treeFile + ".bloom"
+}
+
+// Save writes the filter to filename with the source hash of the tree it was built from:
+// the magic, the source hash, the rate, the hash count and bit count, then the bits
+func (bf *BloomFilter) Save(filename string, sourceHash [32]byte) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(bloomFileMagic)
+	w.Write(sourceHash[:])
+	binary.Write(w, binary.BigEndian, math.Float64bits(bf.fpRate))
+	binary.Write(w, binary.BigEndian, uint32(bf.hashes))
+	binary.Write(w, binary.BigEndian, bf.bits)
+	binary.Write(w, binary.BigEndian, bf.words)
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// maxBloomBits bounds the bit array LoadBloomFilter allocates, 2 GiB of bits
+const maxBloomBits = 1 << 34
+
+// LoadBloomFilter reads a filter written by Save, returning ErrStaleTree when it was built
+// for a tree with another source hash than sourceHash
+func LoadBloomFilter(filename string, sourceHash [32]byte) (*BloomFilter, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	var header struct {
+		Magic      [len(bloomFileMagic)]byte
+		SourceHash [32]byte
+		FPRate     uint64
+		Hashes     uint32
+		Bits       uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Magic[:]) != bloomFileMagic {
+		return nil, fmt.Errorf("%s: not a bloom filter file", filename)
+	}
+	if header.SourceHash != sourceHash {
+		return nil, ErrStaleTree
+	}
+	if header.Bits == 0 || header.Bits%64 != 0 || header.Bits > maxBloomBits || header.Hashes == 0 || header.Hashes > 64 {
+		return nil, fmt.Errorf("%s: malformed bloom filter of %d bits and %d hashes", filename, header.Bits, header.Hashes)
+	}
+	bf := &BloomFilter{words: make([]uint64, header.Bits/64), bits: header.Bits, hashes: int(header.Hashes),
+		fpRate: math.Float64frombits(header.FPRate)}
+	if err := binary.Read(r, binary.BigEndian, bf.words); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// loadOrBuildBloomFilter loads the filter saved next to treeFile for mt at the rate fpRate,
+// or builds one and saves it there. Trees without a source hash, changed since they were
+// built, get a filter that is not saved.
+func loadOrBuildBloomFilter(treeFile string, mt *MerkleTree, fpRate float64) (*BloomFilter, error) {
+	saveable := treeFile != "" && mt.SourceHash != [32]byte{}
+	if saveable {
+		bf, err := LoadBloomFilter(bloomFilterPath(treeFile), mt.SourceHash)
+		if err == nil && bf.fpRate == fpRate {
+			logger.Info("Loaded saved Bloom filter", "path", bloomFilterPath(treeFile), "bytes", bf.SizeBytes())
+			return bf, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logger.Info("Not using saved Bloom filter", "path", bloomFilterPath(treeFile), "reason", err)
+		}
+	}
+	bf, err := newTreeBloomFilter(mt, fpRate)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Bloom filter built", "patterns", len(mt.PatternToIndex), "bytes", bf.SizeBytes(), "hashes", bf.hashes, "fpRate", fpRate)
+	if saveable {
+		if err := bf.Save(bloomFilterPath(treeFile), mt.SourceHash); err != nil {
+			logger.Warn("Failed to save Bloom filter", "path", bloomFilterPath(treeFile), "err", err)
+		}
+	}
+	return bf, nil
+}
+
+// hashLeaves hashes patterns into leaves with h using the given number of workers, each
+// with its own hasher and a contiguous slice of the input
+func hashLeaves(patterns []string, h HashFunc, workers int) []*big.Int {
+	leaves := make([]*big.Int, len(patterns))
+	if workers < 1 {
+		workers = 1
+	}
+	chunk := (len(patterns) + workers - 1) / workers
+
+	var done atomic.Int64
+	var wg sync.WaitGroup
+	for start := 0; start < len(patterns); start += chunk {
+		end := min(start+chunk, len(patterns))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			hFunc := mustOffCircuitHasher(h)
+			for i := start; i < end; i++ {
+				// Log the pattern being hashed
+				// logger.Debug("Hashing pattern", "index", i+1, "total", len(patterns), "pattern", patterns[i])
+
+				leaves[i] = hashPatternWith(hFunc, patterns[i])
+				if n := done.Add(1); n%100000 == 0 || int(n) == len(patterns) {
+					logger.Info("Hashed substrings", "done", n, "total", len(patterns))
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	return leaves
+}
+
+func (mt *MerkleTree) buildLevels() {
+	if height := RequiredProofLen(len(mt.Leaves)); height > maxProofLen {
+		logger.Warn("Merkle tree is taller than the circuit's proofs; deep leaves cannot be proven",
+			"leaves", len(mt.Leaves), "height", height, "maxProofLen", maxProofLen)
+	}
+	currentLevel := mt.Leaves
+	mt.Nodes = append(mt.Nodes, currentLevel)
+
+	level := 0
+	if mt.compact {
+		// The levels too big to cache are never built: the first cached level is hashed
+		// subtree by subtree straight from the leaves by nodeAt, which holds one path at
+		// a time, and the levels above it are built as usual
+		for mt.levelSize(level+1) > compactCachedNodes {
+			mt.Nodes = append(mt.Nodes, nil)
+			level++
+		}
+		if level > 0 {
+			level++
+			mt.Nodes = append(mt.Nodes, nil)
+			cached := make([]*big.Int, mt.levelSize(level))
+			for i := range cached {
+				cached[i] = mt.nodeAt(level, i)
+			}
+			mt.Nodes[level] = cached
+			currentLevel = cached
+			logger.Debug("Built level", "level", level, "nodes", len(currentLevel))
+		}
+	}
+	for len(currentLevel) > 1 {
+		nextLevel := make([]*big.Int, (len(currentLevel)+1)/2)
+		for i := 0; i < len(currentLevel); i += 2 {
+			// Second value (or zero)
+			var right *big.Int
+			if i+1 < len(currentLevel) {
+				right = currentLevel[i+1]
+			}
+			nextLevel[i/2] = mt.hashPair(currentLevel[i], right)
+		}
+		currentLevel = nextLevel
+		mt.Nodes = append(mt.Nodes, currentLevel)
+		level++
+		logger.Debug("Built level", "level", level, "nodes", len(currentLevel))
+	}
+
+	mt.Root = currentLevel[0]
+}
+
+// hashNodePair hashes two child nodes into their parent; a nil right child is treated as zero
+func hashNodePair(hFunc gohash.Hash, left, right *big.Int) *big.Int {
+	return hashFieldElements(hFunc, left, right)
+}
+
+// hashFieldElements is the one off-circuit encoding of field elements into a hash, used
+// for leaves, nodes and commitments alike. It resets hFunc, absorbs each value reduced
+// into the field as its 32-byte big-endian fr.Element encoding, nil as zero, and reads the
+// digest as a big-endian integer reduced into the field. That is what newCircuitHasher's
+// hashers do with the same values as variables, whose Sum is already a field element:
+// MiMC and Pedersen digests are canonical elements, so only SHA-256 needs the reduction.
+func hashFieldElements(hFunc gohash.Hash, vals ...*big.Int) *big.Int {
+	hFunc.Reset()
+	var elem fr.Element
+	for _, val := range vals {
+		if val == nil {
+			elem.SetZero()
+		} else {
+			elem.SetBigInt(val)
+		}
+		bytes := elem.Bytes()
+		hFunc.Write(bytes[:])
+	}
+	hashInt := new(big.Int).SetBytes(hFunc.Sum(nil))
+	return hashInt.Mod(hashInt, fieldModulus)
+}
+
+// nodeHashers pools off-circuit hashers for each HashFunc, so hashPair never shares one
+// hasher's state between goroutines
+var nodeHashers [HashPedersen + 1]sync.Pool
+
+// hashPair hashes two child nodes into their parent with the tree's hash, like
+// hashNodePair, taking a hasher from nodeHashers for the call. It is safe to call from
+// several goroutines at once.
+func (mt *MerkleTree) hashPair(left, right *big.Int) *big.Int {
+	pool := &nodeHashers[mt.Hash]
+	hFunc, ok := pool.Get().(gohash.Hash)
+	if !ok {
+		hFunc = mustOffCircuitHasher(mt.Hash)
+	}
+	defer pool.Put(hFunc)
+	return hashNodePair(hFunc, left, right)
+}
+
+// levelSize returns the number of nodes at the given level, whether or not it is stored
+func (mt *MerkleTree) levelSize(level int) int {
+	size := len(mt.Leaves)
+	for l := 0; l < level; l++ {
+		size = (size + 1) / 2
+	}
+	return size
+}
+
+// nodeAt returns the node at (level, index), recomputing it from the leaves when the
+// level was dropped by compact storage
+func (mt *MerkleTree) nodeAt(level, index int) *big.Int {
+	if mt.Nodes[level] != nil {
+		return mt.Nodes[level][index]
+	}
+	left := mt.nodeAt(level-1, 2*index)
+	var right *big.Int
+	if 2*index+1 < mt.levelSize(level-1) {
+		right = mt.nodeAt(level-1, 2*index+1)
+	}
+	return mt.hashPair(left, right)
+}
+
+// Height returns the number of levels above the leaves, so level 0 holds the leaves and
+// level Height() only the root
+func (mt *MerkleTree) Height() int {
+	return len(mt.Nodes) - 1
+}
+
+// Level returns a copy of the nodes at level, 0 being the leaves, recomputing a level
+// compact storage dropped
+func (mt *MerkleTree) Level(level int) ([]*big.Int, error) {
+	if level < 0 || level > mt.Height() {
+		return nil, fmt.Errorf("level %d of a tree of height %d: %w", level, mt.Height(), ErrLevelOutOfRange)
+	}
+	nodes := make([]*big.Int, mt.levelSize(level))
+	for i := range nodes {
+		nodes[i] = new(big.Int).Set(mt.nodeAt(level, i))
+	}
+	return nodes, nil
+}
+
+// LevelRoot reconstructs the root from the nodes of level alone, hashing them pairwise
+// up to the top as buildLevels does. It equals Root for every level of an intact tree,
+// so an altered node shows up as the one level whose LevelRoot no longer matches.
+func (mt *MerkleTree) LevelRoot(level int) (*big.Int, error) {
+	if level < 0 || level > mt.Height() {
+		return nil, fmt.Errorf("level %d of a tree of height %d: %w", level, mt.Height(), ErrLevelOutOfRange)
+	}
+	nodes := make([]*big.Int, mt.levelSize(level))
+	for i := range nodes {
+		nodes[i] = mt.nodeAt(level, i)
+	}
+	return RootFromLevel(nodes, mt.Hash)
+}
+
+// RootFromLevel hashes one level of nodes pairwise with h, an odd last node paired with
+// zero, until a single node is left and returns it, so anyone holding a level can check
+// it against a published root. It fails with ErrUnsupportedHash for a hash with no hasher.
+func RootFromLevel(nodes []*big.Int, h HashFunc) (*big.Int, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	hFunc, err := newOffCircuitHasher(h)
+	if err != nil {
+		return nil, err
+	}
+	for len(nodes) > 1 {
+		next := make([]*big.Int, (len(nodes)+1)/2)
+		for i := 0; i < len(nodes); i += 2 {
+			var right *big.Int
+			if i+1 < len(nodes) {
+				right = nodes[i+1]
+			}
+			next[i/2] = hashNodePair(hFunc, nodes[i], right)
+		}
+		nodes = next
+	}
+	return nodes[0], nil
+}
+
+// AddPatterns appends a leaf for every pattern not already in the tree, recomputing only
+// the O(log n) nodes on each new leaf's path, and returns the new root. New leaves go at
+// the end rather than in sorted position, so the result matches buildLevels over the
+// extended leaf order, not NewMerkleTree over the extended input.
+//
+// Leaf indices of existing patterns never change, but the root does, so proofs generated
+// before the update only verify against the old root and must be regenerated.
+func (mt *MerkleTree) AddPatterns(patterns []string) (*big.Int, error) {
+	if mt.compact {
+		return nil, ErrCompactTree
+	}
+	for _, pattern := range patterns {
+		if _, exists := mt.PatternToIndex[pattern]; exists {
+			continue
+		}
+		index := len(mt.Leaves)
+		mt.Leaves = append(mt.Leaves, computeHashOffCircuit(pattern, mt.Hash))
+		mt.Nodes[0] = mt.Leaves
+		mt.PatternToIndex[pattern] = []int{index}
+		if mt.bloom != nil {
+			mt.bloom.Add(pattern)
+		}
+		mt.recomputePath(index)
+		mt.unsorted = true
+		mt.patterns = nil
+	}
+	mt.SourceHash = [32]byte{} // The tree no longer corresponds to a single superString
+	return mt.Root, nil
+}
+
+// Insert appends a single new pattern as the last leaf, rehashing only its path up to
+// the (possibly taller) new root and extending PatternToIndex
+func (mt *MerkleTree) Insert(pattern string) error {
+	if _, exists := mt.PatternToIndex[pattern]; exists {
+		return fmt.Errorf("insert %q: %w", pattern, ErrPatternExists)
+	}
+	_, err := mt.AddPatterns([]string{pattern})
+	return err
+}
+
+// RemovePatterns tombstones every leaf of the given patterns by zeroing it, recomputes
+// their paths and returns the new root. Leaf positions are kept so other indices stay
+// stable; as with AddPatterns, earlier proofs must be regenerated against the new root.
+func (mt *MerkleTree) RemovePatterns(patterns []string) (*big.Int, error) {
+	if mt.compact {
+		return nil, ErrCompactTree
+	}
+	for _, pattern := range patterns {
+		indices, exists := mt.PatternToIndex[pattern]
+		if !exists {
+			continue
+		}
+		for _, index := range indices {
+			mt.Leaves[index] = big.NewInt(0)
+			mt.recomputePath(index)
+		}
+		delete(mt.PatternToIndex, pattern)
+		mt.unsorted = true
+		mt.patterns = nil
+	}
+	mt.SourceHash = [32]byte{}
+	return mt.Root, nil
+}
+
+// recomputePath rehashes every ancestor of the leaf at leafIndex, extending levels and
+// adding a new root level when the tree grows
+func (mt *MerkleTree) recomputePath(leafIndex int) {
+	hFunc := mustOffCircuitHasher(mt.Hash)
+	index := leafIndex
+	for level := 0; len(mt.Nodes[level]) > 1; level++ {
+		nodes := mt.Nodes[level]
+		parent := index / 2
+
+		var right *big.Int
+		if 2*parent+1 < len(nodes) {
+			right = nodes[2*parent+1]
+		}
+		parentHash := hashNodePair(hFunc, nodes[2*parent], right)
+
+		if level+1 == len(mt.Nodes) {
+			mt.Nodes = append(mt.Nodes, nil)
+		}
+		if parent == len(mt.Nodes[level+1]) {
+			mt.Nodes[level+1] = append(mt.Nodes[level+1], parentHash)
+		} else {
+			mt.Nodes[level+1][parent] = parentHash
+		}
+		index = parent
+	}
+	mt.Root = mt.Nodes[len(mt.Nodes)-1][0]
+}
+
+// hashCacheMagic identifies a pattern hash cache file and its version
+const hashCacheMagic = "MKH1"
+
+// hashCacheParams are the leaf encoding parameters a hash cache was written under; a
+// cache written under different ones is discarded
+type hashCacheParams struct {
+	Hash            HashFunc
+	LeafFormat      uint8
+	MaxStr1Len      uint32
+	CharsPerElement uint32
+}
+
+// newHashCacheParams returns the current leaf encoding parameters for hash function h
+func newHashCacheParams(h HashFunc) hashCacheParams {
+	return hashCacheParams{Hash: h, LeafFormat: leafFormatVersion, MaxStr1Len: maxStr1Len, CharsPerElement: charsPerElement}
+}
+
+// hashLeavesCached is hashLeaves backed by the hash cache in filename: patterns found
+// there are not rehashed, and newly hashed ones are added to it
+func hashLeavesCached(patterns []string, filename string, h HashFunc) []*big.Int {
+	params := newHashCacheParams(h)
+	cached := loadHashCache(filename, params)
+	var missing []string
+	for _, pattern := range patterns {
+		if _, ok := cached[pattern]; !ok {
+			missing = append(missing, pattern)
+		}
+	}
+	logger.Info("Hash cache", "path", filename, "hits", len(patterns)-len(missing), "misses", len(missing))
+
+	if len(missing) > 0 {
+		for i, leaf := range hashLeaves(missing, h, runtime.NumCPU()) {
+			cached[missing[i]] = leaf
+		}
+		if err := saveHashCache(filename, params, cached); err != nil {
+			logger.Warn("Failed to save hash cache", "path", filename, "err", err)
+		}
+	}
+
+	leaves := make([]*big.Int, len(patterns))
+	for i, pattern := range patterns {
+		leaves[i] = cached[pattern]
+	}
+	return leaves
+}
+
+// loadHashCache reads the pattern hashes saved by saveHashCache. A missing or unreadable
+// file, or one written under other parameters, yields an empty cache.
+func loadHashCache(filename string, params hashCacheParams) map[string]*big.Int {
+	hashes := make(map[string]*big.Int)
+	file, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Cannot open hash cache", "path", filename, "err", err)
+		}
+		return hashes
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(hashCacheMagic))
+	var saved hashCacheParams
+	var count uint64
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != hashCacheMagic {
+		logger.Info("Discarding hash cache with an unknown format", "path", filename)
+		return hashes
+	}
+	if err := binary.Read(r, binary.BigEndian, &saved); err != nil || saved != params {
+		logger.Info("Discarding hash cache written with other parameters", "path", filename)
+		return hashes
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return hashes
+	}
+	var buf [fr.Bytes]byte
+	for i := uint64(0); i < count; i++ {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > maxStr1Len {
+			logger.Warn("Discarding corrupt hash cache", "path", filename)
+			return make(map[string]*big.Int)
+		}
+		pattern := make([]byte, n)
+		if _, err := io.ReadFull(r, pattern); err != nil {
+			return make(map[string]*big.Int)
+		}
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return make(map[string]*big.Int)
+		}
+		hashes[string(pattern)] = new(big.Int).SetBytes(buf[:])
+	}
+	return hashes
+}
+
+// saveHashCache writes hashes to filename: a header with the parameters they were
+// computed under, then each pattern with its 32-byte hash
+func saveHashCache(filename string, params hashCacheParams, hashes map[string]*big.Int) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	w.WriteString(hashCacheMagic)
+	binary.Write(w, binary.BigEndian, params)
+	binary.Write(w, binary.BigEndian, uint64(len(hashes)))
+	var buf [fr.Bytes]byte
+	var varint [binary.MaxVarintLen64]byte
+	for pattern, hash := range hashes {
+		w.Write(varint[:binary.PutUvarint(varint[:], uint64(len(pattern)))])
+		w.WriteString(pattern)
+		hash.FillBytes(buf[:])
+		w.Write(buf[:])
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// treeSourceHash identifies the inputs a tree was built from so stale tree files can be rejected
+func treeSourceHash(superString string, maxPatternLen int, charset Charset, normalize Normalization, leafMode LeafMode) [32]byte {
+	h := newSourceHasher(maxPatternLen, charset, normalize, leafMode)
+	io.WriteString(h, superString)
+	return h.Sum()
+}
+
+// sourceHasher computes treeSourceHash over a text written to it in pieces, so a streamed
+// text can be identified without holding it
+type sourceHasher struct {
+	sha interface {
+		io.Writer
+		Sum([]byte) []byte
+	}
+}
+
+// newSourceHasher starts treeSourceHash for the given tree parameters. The leaf mode is
+// only hashed when it is not LeafSubstrings, so trees saved before it existed still load.
+func newSourceHasher(maxPatternLen int, charset Charset, normalize Normalization, leafMode LeafMode) *sourceHasher {
+	h := sha256.New()
+	fmt.Fprintf(h, "maxPatternLen=%d;charset=%s;normalize=%s;", maxPatternLen, charset, normalize)
+	if leafMode != LeafSubstrings {
+		fmt.Fprintf(h, "leafMode=%s;", leafMode)
+	}
+	return &sourceHasher{sha: h}
+}
+
+func (h *sourceHasher) Write(p []byte) (int, error) {
+	return h.sha.Write(p)
+}
+
+// Sum returns the source hash of the text written so far
+func (h *sourceHasher) Sum() [32]byte {
+	var sum [32]byte
+	copy(sum[:], h.sha.Sum(nil))
+	return sum
+}
+
+const (
+	treeFileMagic     = "MKT5" // Identifies the serialized tree format and its version
+	leafFormatVersion = 4      // Leaf hash encoding: 1 absorbed one character per MiMC call, 2 packs charsPerElement, 3 prefixes the length, 4 hashes UTF-8 bytes
+)
+
+// Save writes the tree to filename in a compact binary encoding: a header with the
+// source hash, hash function, leaf format, normalization steps and entry sources, every stored level as fixed-width 32-byte nodes (levels dropped by
+// compact storage are written as empty), then the pattern index.
+func (mt *MerkleTree) Save(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	w.WriteString(treeFileMagic)
+	w.Write(mt.SourceHash[:])
+	w.WriteByte(byte(mt.Hash))
+	w.WriteByte(leafFormatVersion)
+	var varint [binary.MaxVarintLen64]byte
+	normalize := mt.normalize.String()
+	w.Write(varint[:binary.PutUvarint(varint[:], uint64(len(normalize)))])
+	w.WriteString(normalize)
+	w.Write(varint[:binary.PutUvarint(varint[:], uint64(len(mt.Sources)))])
+	for _, source := range mt.Sources {
+		w.Write(varint[:binary.PutUvarint(varint[:], uint64(len(source.Path)))])
+		w.WriteString(source.Path)
+		w.Write(varint[:binary.PutUvarint(varint[:], uint64(source.Entries))])
+	}
+	binary.Write(w, binary.BigEndian, uint32(len(mt.Nodes)))
+	var buf [fr.Bytes]byte
+	for _, level := range mt.Nodes {
+		binary.Write(w, binary.BigEndian, uint64(len(level)))
+		for _, node := range level {
+			node.FillBytes(buf[:])
+			w.Write(buf[:])
+		}
+	}
+
+	// One record per leaf, so a repeated pattern is written once for each of its leaves
+	numRecords := 0
+	for _, indices := range mt.PatternToIndex {
+		numRecords += len(indices)
+	}
+	binary.Write(w, binary.BigEndian, uint64(numRecords))
+	for pattern, indices := range mt.PatternToIndex {
+		for _, index := range indices {
+			w.Write(varint[:binary.PutUvarint(varint[:], uint64(len(pattern)))])
+			w.WriteString(pattern)
+			w.Write(varint[:binary.PutUvarint(varint[:], uint64(index))])
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LoadMerkleTree reads a tree written by Save, returning ErrStaleTree when it was built
+// from different inputs than sourceHash describes. The options set what Save does not
+// record, such as the charset, leaf mode and compact storage, which skips the levels it
+// would drop instead of reading them; the hash function, normalization and entry sources
+// always come from the file.
+func LoadMerkleTree(filename string, sourceHash [32]byte, opts ...TreeOption) (*MerkleTree, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	magic := make([]byte, len(treeFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != treeFileMagic {
+		return nil, fmt.Errorf("%s: not a merkle tree file", filename)
+	}
+
+	mt := &MerkleTree{}
+	for _, opt := range opts {
+		opt(mt)
+	}
+	if _, err := io.ReadFull(r, mt.SourceHash[:]); err != nil {
+		return nil, err
+	}
+	if mt.SourceHash != sourceHash {
+		return nil, ErrStaleTree
+	}
+	hashByte, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	mt.Hash = HashFunc(hashByte)
+	if _, err := newOffCircuitHasher(mt.Hash); err != nil {
+		return nil, err
+	}
+	leafFormat, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if leafFormat != leafFormatVersion {
+		return nil, fmt.Errorf("leaf format %d, want %d: %w", leafFormat, leafFormatVersion, ErrStaleTree)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxNormalizationSpec {
+		return nil, fmt.Errorf("%s: malformed normalization steps", filename)
+	}
+	normalize := make([]byte, n)
+	if _, err := io.ReadFull(r, normalize); err != nil {
+		return nil, err
+	}
+	if mt.normalize, err = ParseNormalization(string(normalize)); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if mt.Sources, err = readEntrySources(r); err != nil {
+		return nil, fmt.Errorf("%s: entry sources: %w", filename, err)
+	}
+
+	var numLevels uint32
+	if err := binary.Read(r, binary.BigEndian, &numLevels); err != nil {
+		return nil, err
+	}
+	var buf [fr.Bytes]byte
+	mt.Nodes = make([][]*big.Int, numLevels)
+	for l := range mt.Nodes {
+		var count uint64
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		if count == 0 && l > 0 {
+			// Level dropped by compact storage
+			mt.compact = true
+			continue
+		}
+		if mt.compact && l > 0 && count > compactCachedNodes {
+			if _, err := r.Discard(int(count) * fr.Bytes); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		level := make([]*big.Int, count)
+		for i := range level {
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return nil, err
+			}
+			level[i] = new(big.Int).SetBytes(buf[:])
+		}
+		mt.Nodes[l] = level
+	}
+	if len(mt.Nodes) == 0 || mt.Nodes[0] == nil || len(mt.Nodes[len(mt.Nodes)-1]) != 1 {
+		return nil, fmt.Errorf("%s: malformed tree levels", filename)
+	}
+	mt.Leaves = mt.Nodes[0]
+	mt.Root = mt.Nodes[len(mt.Nodes)-1][0]
+
+	var numPatterns uint64
+	if err := binary.Read(r, binary.BigEndian, &numPatterns); err != nil {
+		return nil, err
+	}
+	mt.PatternToIndex = make(map[string][]int, numPatterns)
+	for i := uint64(0); i < numPatterns; i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		pattern := make([]byte, length)
+		if _, err := io.ReadFull(r, pattern); err != nil {
+			return nil, err
+		}
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		mt.PatternToIndex[string(pattern)] = append(mt.PatternToIndex[string(pattern)], int(index))
+	}
+
+	return mt, nil
+}
+
+// readEntrySources reads the entry sources Save writes after the normalization steps
+func readEntrySources(r *bufio.Reader) ([]EntrySource, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxEntrySources {
+		return nil, fmt.Errorf("%d sources, at most %d", n, maxEntrySources)
+	}
+	var sources []EntrySource
+	for i := uint64(0); i < n; i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if length > maxEntrySourcePath {
+			return nil, fmt.Errorf("path of %d bytes, at most %d", length, maxEntrySourcePath)
+		}
+		path := make([]byte, length)
+		if _, err := io.ReadFull(r, path); err != nil {
+			return nil, err
+		}
+		entries, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, EntrySource{Path: string(path), Entries: int(entries)})
+	}
+	return sources, nil
+}
+
+// Charset decides which runes may appear in tree leaves. NewMerkleTree only adds
+// substrings made of allowed runes, and a pattern with any other rune is reported as
+// ErrDisallowedChars rather than as missing. Any rune may be allowed: leaves are hashed
+// as UTF-8 bytes, so a multi-byte rune takes several of the circuit's 8-bit characters.
+// The zero Charset is DefaultCharset.
+type Charset struct {
+	name  string
+	allow func(rune) bool
+}
+
+var (
+	// CharsetDNS admits host names and certificate common names: ASCII letters, digits,
+	// '-' and '.', plus '_' for service labels and '*' for wildcard names
+	CharsetDNS = NewCharsetAllowlist("dns", "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._*")
+
+	// CharsetURL admits the RFC 3986 unreserved and reserved characters and '%' for
+	// percent-encoding, which covers ports and bracketed IPv6 hosts
+	CharsetURL = NewCharsetAllowlist("url", "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._~:/?#[]@!$&'()*+,;=%")
+
+	// CharsetASCIIPrintable admits every printable ASCII character, space included
+	CharsetASCIIPrintable = NewCharsetFunc("ascii-printable", func(r rune) bool { return r >= ' ' && r <= '~' })
+
+	// DefaultCharset is used by trees built without WithCharset
+	DefaultCharset = CharsetDNS
+)
+
+// NewCharsetAllowlist returns a Charset admitting exactly the runes of chars
+func NewCharsetAllowlist(name, chars string) Charset {
+	return NewCharsetFunc(name, func(r rune) bool { return strings.ContainsRune(chars, r) })
+}
+
+// NewCharsetRegexp returns a Charset admitting the runes that expr, typically a character
+// class such as [a-z0-9_:], matches as a whole
+func NewCharsetRegexp(name, expr string) (Charset, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return Charset{}, err
+	}
+	return NewCharsetFunc(name, func(r rune) bool { return re.MatchString(string(r)) }), nil
+}
+
+// NewCharsetFunc returns a Charset admitting the runes allow accepts
+func NewCharsetFunc(name string, allow func(rune) bool) Charset {
+	return Charset{name: name, allow: allow}
+}
+
+// ParseCharset parses a -charset value: a preset (dns, url or ascii-printable),
+// chars:<the allowed characters> or regexp:<an expression each allowed rune matches>
+func ParseCharset(spec string) (Charset, error) {
+	switch name, arg, _ := strings.Cut(spec, ":"); strings.ToLower(name) {
+	case "dns":
+		return CharsetDNS, nil
+	case "url":
+		return CharsetURL, nil
+	case "ascii-printable":
+		return CharsetASCIIPrintable, nil
+	case "chars":
+		if arg == "" {
+			return Charset{}, errors.New("chars: needs at least one character")
+		}
+		return NewCharsetAllowlist(spec, arg), nil
+	case "regexp":
+		if arg == "" {
+			return Charset{}, errors.New("regexp: needs an expression")
+		}
+		return NewCharsetRegexp(spec, arg)
+	default:
+		return Charset{}, fmt.Errorf("unknown charset %q (want dns, url, ascii-printable, chars:<characters> or regexp:<expression>)", spec)
+	}
+}
+
+// Allows reports whether r may appear in a leaf. entrySeparator never may, whatever the
+// charset admits, so chars: and regexp: charsets cannot let a leaf span two entries.
+func (c Charset) Allows(r rune) bool {
+	if r == entrySeparator {
+		return false
+	}
+	if c.allow == nil {
+		return DefaultCharset.Allows(r)
+	}
+	return c.allow(r)
+}
+
+// String returns the preset name or the spec the charset was parsed from
+func (c Charset) String() string {
+	if c.allow == nil {
+		return DefaultCharset.name
+	}
+	return c.name
+}
+
+// Normalization rewrites domain names into one representation, since CT subject common
+// names arrive in mixed case, sometimes with a trailing dot, and with internationalized
+// labels either as Unicode or as punycode. The zero Normalization changes nothing.
+type Normalization struct {
+	Lowercase       bool // Fold letters to lower case
+	TrimTrailingDot bool // Drop the final '.' of a fully qualified name
+	Punycode        bool // Encode labels with non-ASCII characters as xn-- ASCII
+}
+
+// maxNormalizationSpec bounds the normalization steps LoadMerkleTree reads, far above "all" spelled out
+const maxNormalizationSpec = 64
+
+// ParseNormalization parses a -normalize value: none, all, or a comma-separated list of
+// lowercase, trailing-dot and punycode
+func ParseNormalization(spec string) (Normalization, error) {
+	var n Normalization
+	switch strings.ToLower(spec) {
+	case "", "none":
+		return n, nil
+	case "all":
+		return Normalization{Lowercase: true, TrimTrailingDot: true, Punycode: true}, nil
+	}
+	for _, name := range strings.Split(spec, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "lowercase":
+			n.Lowercase = true
+		case "trailing-dot":
+			n.TrimTrailingDot = true
+		case "punycode":
+			n.Punycode = true
+		default:
+			return Normalization{}, fmt.Errorf("unknown normalization step %q (want none, all, or a list of lowercase, trailing-dot and punycode)", name)
+		}
+	}
+	return n, nil
+}
+
+// String lists the enabled steps in the order Apply runs them, or none
+func (n Normalization) String() string {
+	var names []string
+	if n.Lowercase {
+		names = append(names, "lowercase")
+	}
+	if n.TrimTrailingDot {
+		names = append(names, "trailing-dot")
+	}
+	if n.Punycode {
+		names = append(names, "punycode")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Apply returns s with the enabled steps applied: lowercasing first, so punycode encodes
+// the lower-case labels, then dropping a trailing dot, then punycode. A name punycode
+// cannot encode keeps its Unicode labels.
+func (n Normalization) Apply(s string) string {
+	if n.Lowercase {
+		s = strings.ToLower(s)
+	}
+	if n.TrimTrailingDot {
+		s = strings.TrimSuffix(s, ".")
+	}
+	if n.Punycode {
+		if ascii, err := idna.Punycode.ToASCII(s); err == nil {
+			s = ascii
+		}
+	}
+	return s
+}
+
+// ApplyAll returns ss with every element normalized, or ss itself when n changes nothing
+func (n Normalization) ApplyAll(ss []string) []string {
+	if n == (Normalization{}) {
+		return ss
+	}
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = n.Apply(s)
+	}
+	return out
+}
+
+// MerkleProof opens one leaf of a MerkleTree, laid out the way SubstringCircuit takes it
+type MerkleProof struct {
+	Path      [maxProofLen]*big.Int // Sibling per level, zero for a missing right sibling
+	Dirs      [maxProofLen]*big.Int // 1 where the node on the path is a right child
+	Mask      [maxProofLen]int      // 1 for the levels below Depth, the ones the circuit hashes
+	LeafIndex int
+	Depth     int // Levels in use, SubstringCircuit's ProofLength; 0 for a single-leaf tree
+}
+
+// GenerateProof generates the Merkle proof for the first leaf holding pattern. The error
+// wraps ErrPatternNotFound when the tree has no such leaf.
+func (mt *MerkleTree) GenerateProof(pattern string) (*MerkleProof, error) {
+	return mt.GenerateOccurrenceProof(pattern, 0)
+}
+
+// GenerateOccurrenceProof generates the Merkle proof for the given occurrence of pattern,
+// counted from 0 in leaf order. The error wraps ErrPatternNotFound when the pattern or
+// that occurrence is missing.
+func (mt *MerkleTree) GenerateOccurrenceProof(pattern string, occurrence int) (*MerkleProof, error) {
+	// A pattern the filter rules out is definitely absent; a false positive still falls
+	// through to the exact map
+	var indices []int
+	if mt.bloom == nil || mt.bloom.MayContain(pattern) {
+		indices = mt.PatternToIndex[pattern]
+	}
+	if len(indices) == 0 {
+		if err := mt.checkPatternLabels(pattern); err != nil {
+			return nil, fmt.Errorf("%w: %w", err, ErrPatternNotFound)
+		}
+		return nil, fmt.Errorf("%q: %w", pattern, ErrPatternNotFound)
+	}
+	if occurrence < 0 || occurrence >= len(indices) {
+		return nil, fmt.Errorf("%q occurrence %d of %d: %w", pattern, occurrence, len(indices), ErrPatternNotFound)
+	}
+	return mt.proofForLeaf(indices[occurrence])
+}
+
+// proofForLeaf generates the Merkle proof for the leaf at leafIndex
+func (mt *MerkleTree) proofForLeaf(leafIndex int) (*MerkleProof, error) {
+	if leafIndex < 0 || leafIndex >= mt.levelSize(0) {
+		return nil, fmt.Errorf("leaf index %d outside a tree of %d leaves", leafIndex, mt.levelSize(0))
+	}
+	depth := len(mt.Nodes) - 1 // -1 because leaves level is included
+	if depth > maxProofLen {
+		return nil, fmt.Errorf("tree of height %d does not fit maxProofLen %d", depth, maxProofLen)
+	}
+
+	proof := &MerkleProof{LeafIndex: leafIndex, Depth: depth}
+	for i := 0; i < maxProofLen; i++ {
+		proof.Path[i] = big.NewInt(0)
+		proof.Dirs[i] = big.NewInt(0)
+	}
+	currentIndex := leafIndex
+	for level := 0; level < depth; level++ {
+		if siblingIndex := currentIndex ^ 1; siblingIndex < mt.levelSize(level) {
+			proof.Path[level] = mt.nodeAt(level, siblingIndex)
+		}
+		proof.Dirs[level] = big.NewInt(int64(currentIndex % 2))
+		proof.Mask[level] = 1
+		currentIndex /= 2
+	}
+	return proof, nil
+}
+
+// VerifyProofOffCircuit replays the hashing SubstringCircuit performs for pattern and the
+// given proof, returning whether it reaches mt.Root along with the computed root
+func (mt *MerkleTree) VerifyProofOffCircuit(pattern string, proof *MerkleProof) (bool, *big.Int) {
+	root, ok := mt.rootFromPath(proof, computeHashOffCircuit(pattern, mt.Hash))
+	return ok && root.Cmp(mt.Root) == 0, root
+}
+
+// VerifyPath reports whether hashing leaf up along proof, each pair ordered as in
+// SubstringCircuit, reaches mt.Root. It is a cheap stand-in for the prover: a proof it
+// rejects would leave the circuit unsatisfied.
+func (mt *MerkleTree) VerifyPath(proof *MerkleProof, leaf *big.Int) bool {
+	root, ok := mt.rootFromPath(proof, leaf)
+	return ok && root.Cmp(mt.Root) == 0
+}
+
+// rootFromPath hashes leaf up the proof's Depth levels and returns the root reached. The
+// result is false if the proof breaks a rule merkleRootInCircuit asserts: a direction other
+// than 0 or 1, or a sibling or direction set beyond Depth. Values must be canonical field
+// elements, which the circuit would silently reduce. Nil entries count as zero.
+func (mt *MerkleTree) rootFromPath(proof *MerkleProof, leaf *big.Int) (*big.Int, bool) {
+	if proof == nil || proof.Depth < 0 || proof.Depth > maxProofLen {
+		return leaf, false
+	}
+	hFunc := mustOffCircuitHasher(mt.Hash)
+	currentHash := leaf
+	for i := 0; i < maxProofLen; i++ {
+		sibling, dir := proof.Path[i], proof.Dirs[i]
+		if sibling == nil {
+			sibling = new(big.Int)
+		}
+		if dir == nil {
+			dir = new(big.Int)
+		}
+		switch {
+		case sibling.Sign() < 0 || sibling.Cmp(fieldModulus) >= 0:
+			return currentHash, false
+		case dir.Sign() != 0 && dir.Cmp(big.NewInt(1)) != 0:
+			return currentHash, false
+		case i >= proof.Depth:
+			if sibling.Sign() != 0 || dir.Sign() != 0 {
+				return currentHash, false
+			}
+		case dir.Sign() == 0:
+			currentHash = hashNodePair(hFunc, currentHash, sibling)
+		default:
+			currentHash = hashNodePair(hFunc, sibling, currentHash)
+		}
+	}
+	return currentHash, true
+}
+
+// buildWitness assembles the SubstringCircuit assignment for pattern and its Merkle proof
+func buildWitness(pattern string, proof *MerkleProof, root *big.Int) (SubstringCircuit, error) {
+	witness := SubstringCircuit{}
+	if err := checkPatternLength(pattern); err != nil {
+		return witness, err
+	}
+
+	// Fill in the string values
+	witness.Str1 = patternToStr1(pattern)
+	witness.Length = patternLength(pattern)
+
+	// A nil proof opens nothing, for sentinels whose hash the circuit ignores
+	if proof == nil {
+		proof = &MerkleProof{}
+	}
+	witness.ProofLength = proof.Depth
+
+	// Convert proof path values to frontend.Variable
+	for i := 0; i < maxProofLen; i++ {
+		if proof.Mask[i] == 1 {
+			witness.ProofPath[i] = proof.Path[i]
+			witness.ProofPathDir[i] = proof.Dirs[i]
+		} else {
+			witness.ProofPath[i] = 0
+			witness.ProofPathDir[i] = 0
+		}
+	}
+
+	witness.MerkleRoot = root
+	return witness, nil
+}
+
+// MerkleForest holds one MerkleTree per decoded entry and a top tree over their roots, so
+// a proof opens a pattern's leaf in its entry's subtree and then that subtree's root in the
+// top tree. Subtrees differ in height, but every subtree root sits at the top tree's height
+// below Root, so the top levels of any path spell out the entry.
+type MerkleForest struct {
+	Trees []*MerkleTree // One per entry, in entry order; nil for an entry with no substrings
+	Top   *MerkleTree   // Its leaves are the roots of Trees, zero for a nil tree
+	Root  *big.Int
+	Hash  HashFunc
+
+	maxPatternLen int
+	charset       Charset
+	opts          []TreeOption
+}
+
+// NewMerkleForest returns an empty forest whose subtrees BuildFromEntries builds like
+// NewMerkleTree with maxPatternLen and opts
+func NewMerkleForest(maxPatternLen int, opts ...TreeOption) *MerkleForest {
+	var settings MerkleTree
+	for _, opt := range opts {
+		opt(&settings)
+	}
+	return &MerkleForest{Hash: settings.Hash, maxPatternLen: maxPatternLen, charset: settings.charset, opts: opts}
+}
+
+// BuildFromEntries builds one subtree over the substrings of each entry, then the top tree
+// over their roots, replacing whatever the forest held
+func (f *MerkleForest) BuildFromEntries(entries []string) error {
+	if len(entries) == 0 {
+		return errors.New("merkle forest needs at least one entry")
+	}
+	trees := make([]*MerkleTree, len(entries))
+	roots := make([]*big.Int, len(entries))
+	for k, entry := range entries {
+		roots[k] = new(big.Int)
+		if len(uniqueSubstrings(entry, f.maxPatternLen, f.charset)) > 0 {
+			trees[k] = NewMerkleTree(entry, f.maxPatternLen, f.opts...)
+			roots[k] = trees[k].Root
+		}
+	}
+	top := &MerkleTree{Leaves: roots, Hash: f.Hash}
+	top.buildLevels()
+
+	f.Trees, f.Top, f.Root = trees, top, top.Root
+	return nil
+}
+
+// Height returns the length of the longest path in the forest, from the deepest leaf of
+// any subtree up to Root
+func (f *MerkleForest) Height() int {
+	height := 0
+	for _, tree := range f.Trees {
+		if tree != nil {
+			height = max(height, tree.Height())
+		}
+	}
+	return height + f.Top.Height()
+}
+
+// ForestProof opens one leaf of a MerkleForest: the embedded MerkleProof is the combined
+// path, the levels of the entry's subtree followed by those of the top tree, and LeafIndex
+// counts within that subtree
+type ForestProof struct {
+	MerkleProof
+	Entry        int // Entry whose subtree holds the leaf, the top tree's leaf index
+	SubtreeDepth int // Levels of the path inside the subtree; the remaining ones are the top tree's
+}
+
+// GenerateProof generates the two-level proof for the first leaf holding pattern in the
+// first entry that has one. The error wraps ErrPatternNotFound when no entry does.
+func (f *MerkleForest) GenerateProof(pattern string) (*ForestProof, error) {
+	entry := slices.IndexFunc(f.Trees, func(tree *MerkleTree) bool {
+		return tree != nil && len(tree.PatternToIndex[pattern]) > 0
+	})
+	if entry < 0 {
+		return nil, fmt.Errorf("%q: %w", pattern, ErrPatternNotFound)
+	}
+	sub, err := f.Trees[entry].GenerateProof(pattern)
+	if err != nil {
+		return nil, err
+	}
+	top, err := f.Top.proofForLeaf(entry)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Depth+top.Depth > maxProofLen {
+		return nil, fmt.Errorf("entry %d: path of %d levels does not fit maxProofLen %d", entry, sub.Depth+top.Depth, maxProofLen)
+	}
+
+	proof := &ForestProof{MerkleProof: *sub, Entry: entry, SubtreeDepth: sub.Depth}
+	for level := 0; level < top.Depth; level++ {
+		proof.Path[sub.Depth+level] = top.Path[level]
+		proof.Dirs[sub.Depth+level] = top.Dirs[level]
+		proof.Mask[sub.Depth+level] = 1
+	}
+	proof.Depth = sub.Depth + top.Depth
+	return proof, nil
+}
+
+// VerifyProofOffCircuit replays the hashing ForestCircuit performs for pattern and the
+// given proof, returning whether it reaches f.Root through the top levels that spell out
+// proof.Entry
+func (f *MerkleForest) VerifyProofOffCircuit(pattern string, proof *ForestProof) bool {
+	if proof == nil || proof.Depth != proof.SubtreeDepth+f.Top.Height() {
+		return false
+	}
+	entry := 0
+	for level := proof.Depth - 1; level >= proof.SubtreeDepth; level-- {
+		entry = 2*entry + int(proof.Dirs[level].Int64())
+	}
+	root, ok := f.Top.rootFromPath(&proof.MerkleProof, computeHashOffCircuit(pattern, f.Hash))
+	return ok && entry == proof.Entry && root.Cmp(f.Root) == 0
+}
+
+// ForestCircuit is SubstringCircuit over the combined path of a ForestProof, proving
+// against the forest's single root. The entry holding the match stays secret, but is bound
+// to the directions of the last topLevels active levels of the path, the top tree's.
+type ForestCircuit struct {
+	SubstringCircuit
+	EntryIndex frontend.Variable `gnark:"entryIndex,secret"`
+
+	topLevels int // Height of the forest's top tree; set by newCircuit
+}
+
+// newCircuit returns the ForestCircuit to compile for proofs against f
+func (f *MerkleForest) newCircuit() *ForestCircuit {
+	return &ForestCircuit{
+		SubstringCircuit: SubstringCircuit{hash: f.Hash, unusedLevels: maxProofLen - f.Height()},
+		topLevels:        f.Top.Height(),
+	}
+}
+
+func (circuit *ForestCircuit) Define(api frontend.API) error {
+	if err := circuit.SubstringCircuit.Define(api); err != nil {
+		return err
+	}
+
+	// A level is the top tree's when it is active but not among the first
+	// ProofLength-topLevels, the subtree's; its direction is the next bit of the entry
+	n := maxProofLen - circuit.unusedLevels
+	levels := proofLevels(api, circuit.ProofLength, n)
+	subtree := proofLevels(api, api.Sub(circuit.ProofLength, circuit.topLevels), n)
+	entry, weight := frontend.Variable(0), frontend.Variable(1)
+	for i := 0; i < n; i++ {
+		top := api.Sub(levels[i], subtree[i])
+		entry = api.Add(entry, api.Mul(top, circuit.ProofPathDir[i], weight))
+		weight = api.Add(weight, api.Mul(top, weight))
+	}
+	api.AssertIsEqual(entry, circuit.EntryIndex)
+	return nil
+}
+
+// buildForestWitness assembles the ForestCircuit assignment for pattern and its forest proof
+func buildForestWitness(pattern string, proof *ForestProof, root *big.Int) (*ForestCircuit, error) {
+	leaf, err := buildWitness(pattern, &proof.MerkleProof, root)
+	if err != nil {
+		return nil, err
+	}
+	return &ForestCircuit{SubstringCircuit: leaf, EntryIndex: proof.Entry}, nil
+}
+
+// patternLength returns the Length witness for pattern, its number of UTF-8 bytes
+func patternLength(pattern string) int {
+	return len(pattern)
+}
+
+// checkPatternLength returns ErrPatternTooLong if pattern would be truncated by patternToStr1
+func checkPatternLength(pattern string) error {
+	if n := len(pattern); n > maxStr1Len {
+		return fmt.Errorf("%q has %d bytes: %w", pattern, n, ErrPatternTooLong)
+	}
+	return nil
+}
+
+// checkPatternChars returns ErrDisallowedChars, naming the offending runes, if pattern
+// has runes mt's Charset rejects and no leaf in mt. Such a pattern is not merely absent:
+// NewMerkleTree never adds it, though AddPatterns may.
+func (mt *MerkleTree) checkPatternChars(pattern string) error {
+	if _, ok := mt.PatternToIndex[pattern]; ok {
+		return nil
+	}
+	var disallowed []rune
+	for _, r := range pattern {
+		if !mt.charset.Allows(r) && !slices.Contains(disallowed, r) {
+			disallowed = append(disallowed, r)
+		}
+	}
+	if len(disallowed) > 0 {
+		return fmt.Errorf("%q has %q, outside charset %s: %w", pattern, string(disallowed), mt.charset, ErrDisallowedChars)
+	}
+	return nil
+}
+
+// disallowedPatterns returns the non-empty patterns checkPatternChars rejects, so they
+// can be reported before any proving starts
+func (mt *MerkleTree) disallowedPatterns(patterns []string) []string {
+	var disallowed []string
+	for _, pattern := range patterns {
+		if pattern != "" && errors.Is(mt.checkPatternChars(mt.normalize.Apply(pattern)), ErrDisallowedChars) {
+			disallowed = append(disallowed, pattern)
+		}
+	}
+	return disallowed
+}
+
+// patternToStr1 converts a pattern to the zero-padded Str1 witness, one UTF-8 byte per
+// element, so a multi-byte rune spans several elements and each fits the circuit's 8 bits
+func patternToStr1(pattern string) [maxStr1Len]frontend.Variable {
+	var str1 [maxStr1Len]frontend.Variable
+	for i := 0; i < maxStr1Len; i++ {
+		if i < len(pattern) {
+			// Use uint64 to match computeHashOffCircuit
+			str1[i] = frontend.Variable(uint64(pattern[i]))
+		} else {
+			str1[i] = 0
+		}
+	}
+	return str1
+}
+
+// computeHashOffCircuit computes the hash of the given pattern with h
+func computeHashOffCircuit(pattern string, h HashFunc) *big.Int {
+	return hashPatternWith(mustOffCircuitHasher(h), pattern)
+}
+
+// charsPerElement is how many 8-bit characters are packed into one field element before
+// hashing; 31 bytes always stay below the BN254 modulus
+const charsPerElement = 31
+
+// packPattern packs the zero-padded UTF-8 bytes of pattern big-endian into
+// ceil(maxStr1Len/charsPerElement) field elements, one byte per character
+func packPattern(pattern string) []*big.Int {
+	return packChars(pattern, maxStr1Len)
+}
+
+// packChars is packPattern for s zero padded to capacity bytes instead of maxStr1Len,
+// mirroring packStr1 over a slice of that length
+func packChars(s string, capacity int) []*big.Int {
+	var packed []*big.Int
+	for start := 0; start < capacity; start += charsPerElement {
+		val := new(big.Int)
+		for i := start; i < min(start+charsPerElement, capacity); i++ {
+			val.Lsh(val, 8)
+			if i < len(s) {
+				val.Add(val, big.NewInt(int64(s[i])))
+			}
+		}
+		packed = append(packed, val)
+	}
+	return packed
+}
+
+// hashPatternWith computes the MiMC hash of pattern reusing hFunc, which must not be shared across goroutines
+func hashPatternWith(hFunc gohash.Hash, pattern string) *big.Int {
+	return hashCharsWith(hFunc, pattern, maxStr1Len)
+}
+
+// hashCharsWith is hashPatternWith for s zero padded to capacity bytes, mirroring
+// hashPatternInCircuit over a slice of that length
+func hashCharsWith(hFunc gohash.Hash, s string, capacity int) *big.Int {
+	// Absorb the length first so zero padding cannot be confused with NUL characters
+	fields := append([]*big.Int{big.NewInt(int64(len(s)))}, packChars(s, capacity)...)
+	return hashFieldElements(hFunc, fields...)
+}
+
+// patternsByIndex returns the pattern stored at each leaf index ("" for tombstones)
+func (mt *MerkleTree) patternsByIndex() []string {
+	if mt.patterns == nil {
+		mt.patterns = make([]string, len(mt.Leaves))
+		for pattern, indices := range mt.PatternToIndex {
+			for _, index := range indices {
+				mt.patterns[index] = pattern
+			}
+		}
+	}
+	return mt.patterns
+}
+
+// NonInclusionCircuit proves that the secret pattern Str1 is not a leaf of the sorted
+// Merkle tree with the public MerkleRoot, by opening two adjacent leaves Low < Str1 < High.
+// A pattern below the first leaf sets LowIsSentinel and opens leaf 0 as High; a pattern
+// above the last leaf sets HighIsSentinel and opens the last leaf as Low.
+type NonInclusionCircuit struct {
+	Str1           [maxStr1Len]frontend.Variable  `gnark:"str1,secret"`
+	Low            [maxStr1Len]frontend.Variable  `gnark:"low,secret"`
+	LowLength      frontend.Variable              `gnark:"lowLength,secret"`
+	High           [maxStr1Len]frontend.Variable  `gnark:"high,secret"`
+	HighLength     frontend.Variable              `gnark:"highLength,secret"`
+	LowPath        [maxProofLen]frontend.Variable `gnark:"lowPath,secret"`
+	LowPathDir     [maxProofLen]frontend.Variable `gnark:"lowPathDir,secret"`
+	HighPath       [maxProofLen]frontend.Variable `gnark:"highPath,secret"`
+	HighPathDir    [maxProofLen]frontend.Variable `gnark:"highPathDir,secret"`
+	ProofLength    frontend.Variable              `gnark:"proofLength,secret"` // Shared: every leaf has the same depth
+	LowIsSentinel  frontend.Variable              `gnark:"lowIsSentinel,secret"`
+	HighIsSentinel frontend.Variable              `gnark:"highIsSentinel,secret"`
+
+	MerkleRoot frontend.Variable `gnark:"merkleRoot,public"`
+}
+
+func (circuit *NonInclusionCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	api.AssertIsBoolean(circuit.LowIsSentinel)
+	api.AssertIsBoolean(circuit.HighIsSentinel)
+	api.AssertIsEqual(api.Mul(circuit.LowIsSentinel, circuit.HighIsSentinel), 0)
+	lowActive := api.Sub(1, circuit.LowIsSentinel)
+	highActive := api.Sub(1, circuit.HighIsSentinel)
+
+	// 1. Both neighbours are leaves of the tree (unless they are sentinels)
+	levels := proofLevels(api, circuit.ProofLength, maxProofLen)
+	lowRoot := merkleRootInCircuit(api, &hFunc, hashPatternInCircuit(api, &hFunc, circuit.Low[:], circuit.LowLength),
+		circuit.LowPath[:], circuit.LowPathDir[:], levels)
+	highRoot := merkleRootInCircuit(api, &hFunc, hashPatternInCircuit(api, &hFunc, circuit.High[:], circuit.HighLength),
+		circuit.HighPath[:], circuit.HighPathDir[:], levels)
+	api.AssertIsEqual(api.Mul(lowActive, api.Sub(lowRoot, circuit.MerkleRoot)), 0)
+	api.AssertIsEqual(api.Mul(highActive, api.Sub(highRoot, circuit.MerkleRoot)), 0)
+
+	// 2. The leaves are adjacent: the path bits encode the leaf indices
+	lowIndex := frontend.Variable(0)
+	highIndex := frontend.Variable(0)
+	for i := 0; i < maxProofLen; i++ {
+		api.AssertIsBoolean(circuit.LowPathDir[i])
+		api.AssertIsBoolean(circuit.HighPathDir[i])
+		weight := new(big.Int).Lsh(big.NewInt(1), uint(i))
+		lowIndex = api.Add(lowIndex, api.Mul(levels[i], circuit.LowPathDir[i], weight))
+		highIndex = api.Add(highIndex, api.Mul(levels[i], circuit.HighPathDir[i], weight))
+
+		// Low is the last leaf when it has no right sibling at any level where it is a left child
+		noRightSibling := api.Mul(levels[i], api.Sub(1, circuit.LowPathDir[i]), circuit.LowPath[i])
+		api.AssertIsEqual(api.Mul(circuit.HighIsSentinel, noRightSibling), 0)
+	}
+	// highIndex == lowIndex+1, or 0 when there is no lower neighbour
+	expectedHigh := api.Mul(lowActive, api.Add(lowIndex, 1))
+	api.AssertIsEqual(api.Mul(highActive, api.Sub(highIndex, expectedHigh)), 0)
+
+	// 3. Low < Str1 < High lexicographically; Low and High were range checked when hashed
+	for i := range circuit.Str1 {
+		bits.ToBinary(api, circuit.Str1[i], bits.WithNbDigits(charBits))
+	}
+	api.AssertIsEqual(api.Mul(lowActive, api.Sub(1, lexLess(api, circuit.Low[:], circuit.Str1[:]))), 0)
+	api.AssertIsEqual(api.Mul(highActive, api.Sub(1, lexLess(api, circuit.Str1[:], circuit.High[:]))), 0)
+
+	return nil
+}
+
+// charBits bounds character values: every character is one UTF-8 byte
+const charBits = 8
+
+// lexLess returns 1 if the zero-padded string a sorts strictly before b, else 0. Every
+// character must already be range checked to charBits, so the order is that of the
+// UTF-8 bytes, the one sort.Strings uses for the leaves.
+func lexLess(api frontend.API, a, b []frontend.Variable) frontend.Variable {
+	less := frontend.Variable(0)
+	prefixEqual := frontend.Variable(1)
+	offset := new(big.Int).Lsh(big.NewInt(1), charBits)
+	for i := range a {
+		// a[i] < b[i] iff b[i]-a[i]-1+2^charBits has its top bit set
+		diff := api.Add(api.Sub(b[i], a[i]), offset, -1)
+		diffBits := bits.ToBinary(api, diff, bits.WithNbDigits(charBits+1))
+		less = api.Add(less, api.Mul(prefixEqual, diffBits[charBits]))
+		prefixEqual = api.Mul(prefixEqual, api.IsZero(api.Sub(a[i], b[i])))
+	}
+	return less
+}
+
+// GenerateNonInclusionProof returns a NonInclusionCircuit assignment showing that pattern
+// lies strictly between two adjacent leaves, or ErrPatternPresent if it is a leaf. The
+// tree must be freshly built so its leaves are in sorted pattern order.
+func (mt *MerkleTree) GenerateNonInclusionProof(pattern string) (*NonInclusionCircuit, error) {
+	if mt.unsorted {
+		return nil, ErrTreeUnsorted
+	}
+	if err := checkPatternLength(pattern); err != nil {
+		return nil, err
+	}
+	if _, exists := mt.PatternToIndex[pattern]; exists {
+		return nil, fmt.Errorf("non-inclusion of %q: %w", pattern, ErrPatternPresent)
+	}
+	patterns := mt.patternsByIndex()
+	high := sort.SearchStrings(patterns, pattern)
+
+	assignment := &NonInclusionCircuit{
+		Str1:           patternToStr1(pattern),
+		LowIsSentinel:  0,
+		HighIsSentinel: 0,
+		MerkleRoot:     mt.Root,
+	}
+	var lowWitness, highWitness SubstringCircuit
+	var err error
+	if high == 0 {
+		assignment.LowIsSentinel = 1
+		lowWitness, err = buildWitness("", nil, mt.Root)
+	} else {
+		var proof *MerkleProof
+		if proof, err = mt.proofForLeaf(high - 1); err == nil {
+			lowWitness, err = buildWitness(patterns[high-1], proof, mt.Root)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if high == len(patterns) {
+		assignment.HighIsSentinel = 1
+		highWitness, err = buildWitness("", nil, mt.Root)
+	} else {
+		var proof *MerkleProof
+		if proof, err = mt.proofForLeaf(high); err == nil {
+			highWitness, err = buildWitness(patterns[high], proof, mt.Root)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	assignment.Low, assignment.LowLength = lowWitness.Str1, lowWitness.Length
+	assignment.LowPath, assignment.LowPathDir = lowWitness.ProofPath, lowWitness.ProofPathDir
+	assignment.High, assignment.HighLength = highWitness.Str1, highWitness.Length
+	assignment.HighPath, assignment.HighPathDir = highWitness.ProofPath, highWitness.ProofPathDir
+	if assignment.HighIsSentinel == 1 {
+		assignment.ProofLength = lowWitness.ProofLength
+	} else {
+		assignment.ProofLength = highWitness.ProofLength
+	}
+	return assignment, nil
+}
+
+// RFC6962Tree is a Merkle tree hashed as in RFC 6962 section 2.1, so its root matches the
+// SHA-256 trees computed by Certificate Transparency logs over the same leaves
+type RFC6962Tree struct {
+	Levels         [][][sha256.Size]byte // Levels[0] holds the leaf hashes; an unpaired last node is promoted unchanged
+	Root           [sha256.Size]byte
+	PatternToIndex map[string]int
+}
+
+// rfc6962LeafHash returns SHA-256(0x00 || data)
+func rfc6962LeafHash(data []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte{0x00}, data...))
+}
+
+// rfc6962NodeHash returns SHA-256(0x01 || left || right)
+func rfc6962NodeHash(left, right [sha256.Size]byte) [sha256.Size]byte {
+	buf := make([]byte, 0, 1+2*sha256.Size)
+	buf = append(buf, 0x01)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// NewRFC6962Tree builds the tree over leaves in the given order. Promoting an unpaired
+// last node instead of pairing it gives the same root as the recursive split at the
+// largest power of two in RFC 6962.
+func NewRFC6962Tree(leaves []string) *RFC6962Tree {
+	t := &RFC6962Tree{PatternToIndex: make(map[string]int, len(leaves))}
+	level := make([][sha256.Size]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = rfc6962LeafHash([]byte(leaf))
+		t.PatternToIndex[leaf] = i
+	}
+	t.Levels = append(t.Levels, level)
+	if len(level) == 0 {
+		t.Root = sha256.Sum256(nil)
+		return t
+	}
+
+	for len(level) > 1 {
+		next := make([][sha256.Size]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = rfc6962NodeHash(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		t.Levels = append(t.Levels, next)
+		level = next
+	}
+	t.Root = level[0]
+	return t
+}
+
+// AuditPath returns the siblings of leaf index from the bottom up, with dirs[i] = 1 when
+// the sibling is on the left. Levels where the node was promoted have no entry.
+func (t *RFC6962Tree) AuditPath(index int) (path [][sha256.Size]byte, dirs []int) {
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			path = append(path, level[sibling])
+			dirs = append(dirs, index&1)
+		}
+		index /= 2
+	}
+	return path, dirs
+}
+
+// rfc6962RootHalves splits a 32-byte root into two big-endian 16-byte field elements
+func rfc6962RootHalves(root [sha256.Size]byte) (hi, lo *big.Int) {
+	return new(big.Int).SetBytes(root[:16]), new(big.Int).SetBytes(root[16:])
+}
+
+// RFC6962Circuit proves that the secret Leaf is included in the RFC 6962 tree with the
+// public root. Every level costs two SHA-256 compressions, so it is far larger than the
+// MiMC SubstringCircuit and only used with -rfc6962.
+type RFC6962Circuit struct {
+	Leaf         [maxStr1Len]uints.U8               `gnark:"leaf,secret"`
+	LeafLen      frontend.Variable                  `gnark:"leafLen,secret"`
+	ProofPath    [maxProofLen][sha256.Size]uints.U8 `gnark:"proofPath,secret"`
+	ProofPathDir [maxProofLen]frontend.Variable     `gnark:"proofPathDir,secret"`
+	ProofLength  frontend.Variable                  `gnark:"proofLength,secret"` // Levels of ProofPath in use
+
+	RootHi frontend.Variable `gnark:"rootHi,public"` // First 16 bytes of the root, big-endian
+	RootLo frontend.Variable `gnark:"rootLo,public"` // Last 16 bytes of the root, big-endian
+}
+
+func (circuit *RFC6962Circuit) Define(api frontend.API) error {
+	uapi, err := uints.New[uints.U32](api)
+	if err != nil {
+		return err
+	}
+
+	// 1. Leaf hash over the first LeafLen bytes
+	leafHasher, err := sha2.New(api)
+	if err != nil {
+		return err
+	}
+	leafHasher.Write([]uints.U8{uints.NewU8(0x00)})
+	leafHasher.Write(circuit.Leaf[:])
+	current := leafHasher.FixedLengthSum(api.Add(circuit.LeafLen, 1))
+
+	// 2. Hash up the audit path, skipping levels at or above ProofLength
+	levels := proofLevels(api, circuit.ProofLength, maxProofLen)
+	for i := 0; i < maxProofLen; i++ {
+		api.AssertIsBoolean(circuit.ProofPathDir[i])
+		left := make([]uints.U8, sha256.Size)
+		right := make([]uints.U8, sha256.Size)
+		for j := range left {
+			left[j] = uapi.ByteValueOf(api.Select(circuit.ProofPathDir[i], circuit.ProofPath[i][j].Val, current[j].Val))
+			right[j] = uapi.ByteValueOf(api.Select(circuit.ProofPathDir[i], current[j].Val, circuit.ProofPath[i][j].Val))
+		}
+
+		nodeHasher, err := sha2.New(api)
+		if err != nil {
+			return err
+		}
+		nodeHasher.Write([]uints.U8{uints.NewU8(0x01)})
+		nodeHasher.Write(left)
+		nodeHasher.Write(right)
+		parent := nodeHasher.Sum()
+		for j := range current {
+			current[j] = uapi.ByteValueOf(api.Select(levels[i], parent[j].Val, current[j].Val))
+		}
+	}
+
+	// 3. Check the root against its packed halves
+	hi, lo := frontend.Variable(0), frontend.Variable(0)
+	for j := 0; j < sha256.Size/2; j++ {
+		hi = api.Add(api.Mul(hi, 256), current[j].Val)
+		lo = api.Add(api.Mul(lo, 256), current[sha256.Size/2+j].Val)
+	}
+	api.AssertIsEqual(hi, circuit.RootHi)
+	api.AssertIsEqual(lo, circuit.RootLo)
+	return nil
+}
+
+// GenerateWitness returns an RFC6962Circuit assignment proving pattern is a leaf
+func (t *RFC6962Tree) GenerateWitness(pattern string) (*RFC6962Circuit, error) {
+	index, ok := t.PatternToIndex[pattern]
+	if !ok {
+		return nil, fmt.Errorf("%q: %w", pattern, ErrPatternNotFound)
+	}
+	if len(pattern) > maxStr1Len {
+		return nil, fmt.Errorf("%q is %d bytes, more than the %d the circuit hashes: %w", pattern, len(pattern), maxStr1Len, ErrPatternTooLong)
+	}
+	path, dirs := t.AuditPath(index)
+	if len(path) > maxProofLen {
+		return nil, fmt.Errorf("audit path of %d levels exceeds maxProofLen", len(path))
+	}
+
+	assignment := &RFC6962Circuit{LeafLen: len(pattern), ProofLength: len(path)}
+	leaf := make([]byte, maxStr1Len)
+	copy(leaf, pattern)
+	copy(assignment.Leaf[:], uints.NewU8Array(leaf))
+	var zero [sha256.Size]byte
+	for i := 0; i < maxProofLen; i++ {
+		sibling, dir := zero, 0
+		if i < len(path) {
+			sibling, dir = path[i], dirs[i]
+		}
+		copy(assignment.ProofPath[i][:], uints.NewU8Array(sibling[:]))
+		assignment.ProofPathDir[i] = dir
+	}
+	assignment.RootHi, assignment.RootLo = rfc6962RootHalves(t.Root)
+	return assignment, nil
+}
+
+// maxEntryLen is how many bytes of an entry EntryMatchCircuit opens; NewEntryTree refuses
+// longer entries
+const maxEntryLen = 256
+
+// ErrEntryTooLong is returned by NewEntryTree for entries EntryMatchCircuit cannot open
+var ErrEntryTooLong = errors.New("entry longer than maxEntryLen")
+
+// EntryTree commits to whole entries instead of their substrings: leaf k hashes entry k
+// like a pattern, its length and then its bytes packed over maxEntryLen. It has one leaf
+// per entry where MerkleTree has one per distinct substring, and EntryMatchCircuit
+// searches the opened entry for the pattern in-circuit instead.
+type EntryTree struct {
+	Entries []string
+	Root    *big.Int
+	Hash    HashFunc
+
+	tree *MerkleTree // Its leaves are the entry hashes; only its levels and proofs are used
+}
+
+// NewEntryTree builds the tree over entries in the given order with the hash chosen by
+// opts. Entries longer than maxEntryLen, or holding a NUL byte the zero padding would hide,
+// are refused.
+func NewEntryTree(entries []string, opts ...TreeOption) (*EntryTree, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("entry tree needs at least one entry")
+	}
+	tree := &MerkleTree{}
+	for _, opt := range opts {
+		opt(tree)
+	}
+	hFunc, err := newOffCircuitHasher(tree.Hash)
+	if err != nil {
+		return nil, err
+	}
+	tree.Leaves = make([]*big.Int, len(entries))
+	for k, entry := range entries {
+		if len(entry) > maxEntryLen {
+			return nil, fmt.Errorf("entry %d has %d bytes: %w", k, len(entry), ErrEntryTooLong)
+		}
+		if strings.IndexByte(entry, 0) >= 0 {
+			return nil, fmt.Errorf("entry %d holds a NUL byte", k)
+		}
+		tree.Leaves[k] = hashCharsWith(hFunc, entry, maxEntryLen)
+	}
+	tree.buildLevels()
+	return &EntryTree{Entries: entries, Root: tree.Root, Hash: tree.Hash, tree: tree}, nil
+}
+
+// Leaves returns the number of leaves, one per entry
+func (t *EntryTree) Leaves() int {
+	return len(t.tree.Leaves)
+}
+
+// EntryMatchCircuit proves that the secret pattern Str1 occurs in a secret entry of the
+// EntryTree with the public root: the entry's leaf is opened along the Merkle path, then
+// every window of the entry is compared with the pattern
+type EntryMatchCircuit struct {
+	Str1         [maxStr1Len]frontend.Variable  `gnark:"str1,secret"`
+	Length       frontend.Variable              `gnark:"length,secret"`
+	Entry        [maxEntryLen]frontend.Variable `gnark:"entry,secret"`
+	EntryLength  frontend.Variable              `gnark:"entryLength,secret"`
+	ProofPath    [maxProofLen]frontend.Variable `gnark:"proofPath,secret"`
+	ProofPathDir [maxProofLen]frontend.Variable `gnark:"proofPathDir,secret"`
+	ProofLength  frontend.Variable              `gnark:"proofLength,secret"`
+
+	MerkleRoot frontend.Variable `gnark:"merkleRoot,public"`
+
+	hash         HashFunc // Hash of the tree; set by EntryTree.newCircuit
+	unusedLevels int      // Top levels of ProofPath above the tree's height, pinned to zero
+}
+
+// newCircuit returns the EntryMatchCircuit to compile for proofs against t
+func (t *EntryTree) newCircuit() *EntryMatchCircuit {
+	return &EntryMatchCircuit{hash: t.Hash, unusedLevels: t.tree.unusedLevels()}
+}
+
+func (circuit *EntryMatchCircuit) Define(api frontend.API) error {
+	hFunc, err := newCircuitHasher(api, circuit.hash)
+	if err != nil {
+		return err
+	}
+
+	// 1. Open the entry: range checked, zero padded past EntryLength and in the tree
+	leaf := hashPatternInCircuit(api, hFunc, circuit.Entry[:], circuit.EntryLength)
+	n := maxProofLen - circuit.unusedLevels
+	for i := n; i < maxProofLen; i++ {
+		api.AssertIsEqual(circuit.ProofPath[i], 0)
+		api.AssertIsEqual(circuit.ProofPathDir[i], 0)
+	}
+	levels := proofLevels(api, circuit.ProofLength, n)
+	api.AssertIsEqual(merkleRootInCircuit(api, hFunc, leaf, circuit.ProofPath[:n], circuit.ProofPathDir[:n], levels), circuit.MerkleRoot)
+
+	// 2. Search it for the pattern
+	assertPatternInEntry(api, circuit.Str1[:], circuit.Length, circuit.Entry[:])
+	return nil
+}
+
+// assertPatternInEntry asserts that the first length characters of pattern, at least one,
+// occur in entry. Both are zero padded, so a window running into the entry's padding
+// compares non-zero pattern characters with zeros and fails: an entry shorter than the
+// pattern matches nowhere. The caller range checks entry to 8 bits; pattern is checked
+// here. Window i matches when the sum over the pattern's characters j of
+// (entry[i+j] - pattern[j])^2 is zero, which for 8-bit characters stays far below the
+// field size and so vanishes only when every term does; some window matches exactly when
+// the product of all window sums is zero.
+func assertPatternInEntry(api frontend.API, pattern []frontend.Variable, length frontend.Variable, entry []frontend.Variable) {
+	assertPatternLength(api, pattern, length)
+	api.AssertIsDifferent(length, 0)
+	active := make([]frontend.Variable, len(pattern))
+	for j := range pattern {
+		bits.ToBinary(api, pattern[j], bits.WithNbDigits(8))
+		active[j] = api.Sub(1, api.IsZero(pattern[j]))
+	}
+
+	product := frontend.Variable(1)
+	for i := range entry {
+		sum := frontend.Variable(0)
+		for j := range pattern {
+			c := frontend.Variable(0)
+			if i+j < len(entry) {
+				c = entry[i+j]
+			}
+			diff := api.Mul(active[j], api.Sub(c, pattern[j]))
+			sum = api.Add(sum, api.Mul(diff, diff))
+		}
+		product = api.Mul(product, sum)
+	}
+	api.AssertIsEqual(product, 0)
+}
+
+// GenerateWitness returns an EntryMatchCircuit assignment proving pattern occurs in the
+// first entry holding it. The error wraps ErrPatternNotFound when no entry does, as for a
+// pattern only found across two entries.
+func (t *EntryTree) GenerateWitness(pattern string) (*EntryMatchCircuit, error) {
+	if pattern == "" {
+		return nil, errors.New("empty pattern occurs in every entry and proves nothing")
+	}
+	entry := slices.IndexFunc(t.Entries, func(e string) bool { return strings.Contains(e, pattern) })
+	if entry < 0 {
+		return nil, fmt.Errorf("%q: %w", pattern, ErrPatternNotFound)
+	}
+	return t.witnessFor(pattern, entry)
+}
+
+// witnessFor assembles the EntryMatchCircuit assignment opening the given entry for
+// pattern, whether or not the entry holds it
+func (t *EntryTree) witnessFor(pattern string, entry int) (*EntryMatchCircuit, error) {
+	if err := checkPatternLength(pattern); err != nil {
+		return nil, err
+	}
+	proof, err := t.tree.proofForLeaf(entry)
+	if err != nil {
+		return nil, err
+	}
+	assignment := &EntryMatchCircuit{
+		Str1:        patternToStr1(pattern),
+		Length:      patternLength(pattern),
+		EntryLength: len(t.Entries[entry]),
+		ProofLength: proof.Depth,
+		MerkleRoot:  t.Root,
+	}
+	for i := range assignment.Entry {
+		assignment.Entry[i] = 0
+		if i < len(t.Entries[entry]) {
+			assignment.Entry[i] = int(t.Entries[entry][i])
+		}
+	}
+	for i := 0; i < maxProofLen; i++ {
+		assignment.ProofPath[i], assignment.ProofPathDir[i] = proof.Path[i], proof.Dirs[i]
+	}
+	return assignment, nil
+}
+
+// smtDepth is the depth of the sparse Merkle tree; a pattern's leaf position is the low
+// smtDepth bits of its MiMC hash
+const smtDepth = 64
+
+// SparseMerkleTree is a fixed-depth Merkle tree keyed by pattern hash, where every empty
+// leaf is zero and empty subtrees hash to precomputed defaults. It supports proving that
+// a pattern is NOT in the set by opening the empty leaf at the pattern's key.
+type SparseMerkleTree struct {
+	nodes    []map[uint64]*big.Int // Non-default nodes per level, keyed by index; level 0 holds the leaves
+	defaults []*big.Int            // Hash of an empty subtree at each level
+	Root     *big.Int
+}
+
+// smtKey returns the leaf position of a pattern hash
+func smtKey(patternHash *big.Int) uint64 {
+	return new(big.Int).And(patternHash, new(big.Int).SetUint64(^uint64(0))).Uint64() >> (64 - smtDepth)
+}
+
+// NewSparseMerkleTree builds a sparse Merkle tree with one leaf per pattern, holding the
+// pattern's hash at the position given by smtKey
+func NewSparseMerkleTree(patterns []string) *SparseMerkleTree {
+	hFunc := mimcHash.NewMiMC()
+	t := &SparseMerkleTree{
+		nodes:    make([]map[uint64]*big.Int, smtDepth+1),
+		defaults: make([]*big.Int, smtDepth+1),
+	}
+	t.defaults[0] = big.NewInt(0)
+	for l := 1; l <= smtDepth; l++ {
+		t.defaults[l] = hashNodePair(hFunc, t.defaults[l-1], t.defaults[l-1])
+	}
+
+	t.nodes[0] = make(map[uint64]*big.Int, len(patterns))
+	for _, pattern := range patterns {
+		leaf := hashPatternWith(hFunc, pattern)
+		t.nodes[0][smtKey(leaf)] = leaf
+	}
+	for l := 0; l < smtDepth; l++ {
+		t.nodes[l+1] = make(map[uint64]*big.Int, len(t.nodes[l])/2+1)
+		for index := range t.nodes[l] {
+			parent := index >> 1
+			if _, done := t.nodes[l+1][parent]; done {
+				continue
+			}
+			t.nodes[l+1][parent] = hashNodePair(hFunc, t.node(l, parent<<1), t.node(l, parent<<1|1))
+		}
+	}
+	t.Root = t.node(smtDepth, 0)
+	return t
+}
+
+// node returns the node at (level, index), falling back to the empty-subtree default
+func (t *SparseMerkleTree) node(level int, index uint64) *big.Int {
+	if n, ok := t.nodes[level][index]; ok {
+		return n
+	}
+	return t.defaults[level]
+}
+
+// siblings returns the sibling hashes along the path from the leaf at key to the root
+func (t *SparseMerkleTree) siblings(key uint64) [smtDepth]*big.Int {
+	var path [smtDepth]*big.Int
+	for l := 0; l < smtDepth; l++ {
+		path[l] = t.node(l, key^1)
+		key >>= 1
+	}
+	return path
+}
+
+// GenerateNonMembershipProof returns the sibling path proving that the leaf at the
+// pattern's key is empty, or ErrPatternPresent if that leaf is occupied
+func (t *SparseMerkleTree) GenerateNonMembershipProof(pattern string) ([smtDepth]*big.Int, error) {
+	if err := checkPatternLength(pattern); err != nil {
+		return [smtDepth]*big.Int{}, err
+	}
+	key := smtKey(computeHashOffCircuit(pattern, HashMiMC))
+	if _, occupied := t.nodes[0][key]; occupied {
+		return [smtDepth]*big.Int{}, fmt.Errorf("non-membership of %q: %w", pattern, ErrPatternPresent)
+	}
+	return t.siblings(key), nil
+}
+
+// NonMembershipCircuit proves that the secret pattern Str1 is not in the sparse Merkle
+// tree with the public Root: the empty leaf at the pattern's key hashes up to Root
+type NonMembershipCircuit struct {
+	Str1     [maxStr1Len]frontend.Variable `gnark:"str1,secret"`
+	Length   frontend.Variable             `gnark:"length,secret"`
+	Siblings [smtDepth]frontend.Variable   `gnark:"siblings,secret"`
+	Root     frontend.Variable             `gnark:"root,public"`
+}
+
+func (circuit *NonMembershipCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+
+	// The key is the low smtDepth bits of the pattern hash, least significant bit first
+	patternHash := hashPatternInCircuit(api, &hFunc, circuit.Str1[:], circuit.Length)
+	keyBits := bits.ToBinary(api, patternHash)
+
+	// Start from an empty leaf and hash up to the root
+	currentHash := frontend.Variable(0)
+	for i := 0; i < smtDepth; i++ {
+		isRight := keyBits[64-smtDepth+i]
+		left := api.Select(isRight, circuit.Siblings[i], currentHash)
+		right := api.Select(isRight, currentHash, circuit.Siblings[i])
+
+		hFunc.Reset()
+		hFunc.Write(left)
+		hFunc.Write(right)
+		currentHash = hFunc.Sum()
+	}
+
+	api.AssertIsEqual(currentHash, circuit.Root)
+	return nil
+}
+
+// runConfig holds the inputs, sizes and proving backend of a run
+type runConfig struct {
+	Entries       string // Decoded entry files or globs, comma-separated, concatenated into the superstring
+	Patterns      string // JSON array of substrings to prove
+	MaxPatternLen int    // Longest substring the tree holds in UTF-8 bytes, at most maxStr1Len
+	MaxTextLen    int    // Superstring length in UTF-8 bytes the entries are truncated to
+	Backend       string // groth16 or plonk
+	KeysDir       string // Where proving and verifying keys are cached; empty for <cache-dir>/keys
+	Charset       string // Runes the tree holds, parsed by ParseCharset
+	Normalize     string // Steps applied to entries and patterns, parsed by ParseNormalization
+	LeafMode      string // Substrings of the entries the tree holds, parsed by ParseLeafMode
+}
+
+// registerConfigFlags defines the runConfig flags on fs, filling the returned config when fs is parsed
+func registerConfigFlags(fs *flag.FlagSet) *runConfig {
+	cfg := &runConfig{}
+	fs.StringVar(&cfg.Entries, "entries", "combined_raw_decoded_entries.json", "Decoded entries to build the Merkle tree from: comma-separated JSON or JSON Lines files or glob patterns such as entries-*.json, read in filename order")
+	fs.StringVar(&cfg.Patterns, "patterns", "c-nimbus24_subj-common-names_1000.json", "JSON array of substrings to prove")
+	fs.IntVar(&cfg.MaxPatternLen, "max-pattern-len", maxStr1Len, "Longest substring in UTF-8 bytes to put in the Merkle tree, at most the circuit's maxStr1Len")
+	fs.IntVar(&cfg.MaxTextLen, "max-text-len", maxStr2Len, "Truncate the concatenated entries to this many UTF-8 bytes, cutting on a character boundary")
+	fs.StringVar(&cfg.Backend, "backend", "groth16", "Proving backend: groth16 or plonk")
+	fs.StringVar(&cfg.KeysDir, "keys-dir", "", "Directory for cached proving and verifying keys (default <cache-dir>/keys)")
+	fs.StringVar(&cfg.Charset, "charset", "dns", "Characters the Merkle tree holds: dns, url, ascii-printable, chars:<characters> or regexp:<expression>")
+	fs.StringVar(&cfg.Normalize, "normalize", "none", "Normalization of entries and patterns: none, all, or a comma-separated list of lowercase, trailing-dot and punycode")
+	fs.StringVar(&cfg.LeafMode, "leaf-mode", "substrings", "Leaves of the Merkle tree: every substring, whole dot-separated labels and hostnames (labels), or labels, hostnames and their suffixes down to the registrable domain (registrable)")
+	return cfg
+}
+
+// validate reports flag values the run cannot use
+func (cfg *runConfig) validate() error {
+	if cfg.MaxPatternLen < 1 || cfg.MaxPatternLen > maxStr1Len {
+		return fmt.Errorf("-max-pattern-len %d: must be between 1 and %d", cfg.MaxPatternLen, maxStr1Len)
+	}
+	if cfg.MaxTextLen < 1 {
+		return fmt.Errorf("-max-text-len %d: must be positive", cfg.MaxTextLen)
+	}
+	if strings.Trim(cfg.Entries, ", ") == "" {
+		return errors.New("-entries: needs at least one file")
+	}
+	if cfg.Backend != "groth16" && cfg.Backend != "plonk" {
+		return fmt.Errorf("-backend %q: must be groth16 or plonk", cfg.Backend)
+	}
+	if _, err := ParseCharset(cfg.Charset); err != nil {
+		return fmt.Errorf("-charset: %w", err)
+	}
+	if _, err := ParseNormalization(cfg.Normalize); err != nil {
+		return fmt.Errorf("-normalize: %w", err)
+	}
+	if _, err := ParseLeafMode(cfg.LeafMode); err != nil {
+		return fmt.Errorf("-leaf-mode: %w", err)
+	}
+	return nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fatal("Run failed", "err", err)
+	}
+}
+
+// run parses the flags and carries out the requested command. Errors are returned rather
+// than exiting, so the deferred stats and profile writers still run.
+func run() error {
+	cfg := registerConfigFlags(flag.CommandLine)
+	statsJSONFile := flag.String("stats-json", "", "Write final statistics and per-substring results as JSON to this file")
+	statsCSVFile := flag.String("stats-csv", "", "Write per-substring results as CSV to this file")
+	reportFile := flag.String("report", "", "Write a JSON report of final statistics with human-readable durations to this file")
+	reportVerbose := flag.Bool("report-verbose", false, "Include each substring's outcome in the -report file")
+	logLevel := flag.String("log-level", "info", "Console log level: debug, info, warn or error")
+	verbose := flag.Bool("verbose", false, "Shorthand for -log-level=debug")
+	logFilePath := flag.String("log-file", "debug.log", "Also write all messages at debug level to this file (empty to disable)")
+	cacheDir := flag.String("cache-dir", "proof_cache", "Directory for cached keys and proofs")
+	compactTree := flag.Bool("compact-tree", false, "Keep only the leaves and top levels of the Merkle tree in memory")
+	hashCacheFile := flag.String("hash-cache", "", "Reuse leaf hashes from this file across tree builds, adding new ones (empty to disable)")
+	noCache := flag.Bool("no-cache", false, "Disable the proof cache and always run groth16.Prove")
+	hashName := flag.String("hash", "mimc", "Hash function for tree leaves, nodes and the circuit: mimc, sha256 or pedersen")
+	batchSize := flag.Int("batch-size", 1, "Prove this many substrings per proof with MultiPatternCircuit (1 proves each separately)")
+	bundleDir := flag.String("bundle-dir", "", "Prove CommittedPatternCircuit and write each verified proof bundle, and the opening of its commitment, to this directory")
+	fanIn := flag.Int("fan-in", 2, "Inner proofs per aggregate proof for the aggregate command")
+	aggregateDir := flag.String("aggregate-dir", "aggregates", "Directory for the aggregate command's proofs and statements")
+	workers := flag.Int("workers", 1, "Prove this many substrings at once on separate goroutines")
+	benchPatternLens := flag.String("bench-pattern-lens", "4,8", "Comma-separated pattern lengths for the bench compare command")
+	benchTextLens := flag.String("bench-text-lens", "64,256,1024", "Comma-separated text lengths for the bench compare command")
+	benchFormat := flag.String("bench-format", "csv", "Table format for the bench compare command: csv or markdown")
+	batchVerify := flag.Bool("batch-verify", false, "Verify new proofs together with VerifyBundles after proving them all")
+	listVersion := flag.Int64("list-version", -1, "Prove VersionedRootCircuit, binding each proof to this allow-list version through a public commitment to it and the root (-1 to disable)")
+	rfc6962 := flag.Bool("rfc6962", false, "Prove inclusion in an RFC 6962 SHA-256 tree over the same leaves (much larger circuit)")
+	cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile of the run to this file")
+	memProfile := flag.String("memprofile", "", "Write a heap profile to this file when the run ends, even after an error")
+	pprofAddr := flag.String("pprof-addr", "", "Serve net/http/pprof on this address during the run, such as localhost:6060")
+	memStatsInterval := flag.Duration("mem-stats-interval", 0, "Log heap and system memory at this interval and record it in -stats-json (0 to disable)")
+	treeFile := flag.String("tree-file", "merkle_tree.bin", "Load the Merkle tree from this file if it matches the input, saving it after a rebuild (empty to disable)")
+	estimate := flag.Bool("estimate", false, "Prove one representative substring after setup, print the estimated time to prove them all and exit")
+	textIndex := flag.Bool("text-index", false, "Index the decoded entries to report substrings that do not occur in them before any tree lookup or proving")
+	bloomRate := flag.Float64("bloom-fp-rate", 0, "Consult a Bloom filter with this false-positive rate before the pattern index, kept next to -tree-file as .bloom (0 to disable)")
+	onlyQueried := flag.Bool("only-queried", false, "Build the Merkle tree from only the queried substrings that occur in the entries, implying -text-index; the tree is not loaded or saved")
+	flag.Parse()
+	if *verbose {
+		*logLevel = "debug"
+	}
+
+	stats := ProcessingStats{}
+	totalStartTime := time.Now()
+
+	// Write machine-readable stats at the end of the run, including after a panic or error
+	defer func() {
+		stats.TotalTime = time.Since(totalStartTime)
+		if *statsJSONFile != "" {
+			if err := writeStatsJSON(*statsJSONFile, stats); err != nil {
+				logger.Error("Failed to write stats JSON", "err", err)
+			}
+		}
+		if *reportFile != "" {
+			if err := writeReport(*reportFile, stats, *reportVerbose); err != nil {
+				logger.Error("Failed to write report", "err", err)
+			}
+		}
+		if *statsCSVFile != "" {
+			if err := writeStatsCSV(*statsCSVFile, stats); err != nil {
+				logger.Error("Failed to write stats CSV", "err", err)
+			}
+		}
+	}()
+
+	// Configure console logging and the optional debug log file
+	logFile, err := setupLogger(*logLevel, *logFilePath)
+	if err != nil {
+		return fmt.Errorf("set up logging: %w", err)
+	}
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	// Profile the run on request; the profiles are written however it ends
+	prof, err := startProfiling(*cpuProfile, *memProfile, *pprofAddr)
+	if err != nil {
+		return fmt.Errorf("start profiling: %w", err)
+	}
+	defer func() {
+		if err := prof.Stop(); err != nil {
+			logger.Error("Failed to write profiles", "err", err)
+		}
+	}()
+	if *memStatsInterval > 0 {
+		sampler := startMemSampler(*memStatsInterval)
+		// Runs before the stats are written above
+		defer func() { stats.Memory = sampler.Stop() }()
+	}
+
+	hashFunc, err := parseHashFunc(*hashName)
+	if err != nil {
+		return fmt.Errorf("invalid -hash: %w", err)
+	}
+	if *batchSize < 1 || (*batchSize > 1 && *rfc6962) {
+		return fmt.Errorf("invalid -batch-size %d: must be at least 1, and 1 with -rfc6962", *batchSize)
+	}
+	if *batchVerify && (*batchSize > 1 || *rfc6962) {
+		return errors.New("-batch-verify only applies to SubstringCircuit proofs, not -batch-size or -rfc6962")
+	}
+	if *workers < 1 || (*workers > 1 && *batchSize > 1) {
+		return fmt.Errorf("invalid -workers %d: must be at least 1, and 1 with -batch-size", *workers)
+	}
+	if *bundleDir != "" && (*batchSize > 1 || *rfc6962) {
+		return errors.New("-bundle-dir only applies to single-pattern proofs, not -batch-size or -rfc6962")
+	}
+	if *listVersion < -1 || (*listVersion >= 0 && (*batchSize > 1 || *rfc6962 || *bundleDir != "" || *batchVerify)) {
+		return fmt.Errorf("invalid -list-version %d: must be -1 or a version, which only applies to single-pattern proofs, not -batch-size, -rfc6962, -bundle-dir or -batch-verify", *listVersion)
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid flags: %w", err)
+	}
+	charset, err := ParseCharset(cfg.Charset)
+	if err != nil {
+		return fmt.Errorf("invalid -charset: %w", err)
+	}
+	normalize, err := ParseNormalization(cfg.Normalize)
+	if err != nil {
+		return fmt.Errorf("invalid -normalize: %w", err)
+	}
+	leafMode, err := ParseLeafMode(cfg.LeafMode)
+	if err != nil {
+		return fmt.Errorf("invalid -leaf-mode: %w", err)
+	}
+	if *onlyQueried && leafMode != LeafSubstrings {
+		return errors.New("-only-queried builds a substring tree, not one with -leaf-mode " + leafMode.String())
+	}
+	usePlonk := cfg.Backend == "plonk"
+	if usePlonk && (*batchSize > 1 || *batchVerify || *bundleDir != "") {
+		return errors.New("-backend plonk does not support -batch-size, -batch-verify or -bundle-dir")
+	}
+	keysDir := cfg.KeysDir
+	if keysDir == "" {
+		keysDir = filepath.Join(*cacheDir, "keys")
+	}
+
+	// aggregate BUNDLE...: prove bundles written with -bundle-dir -fan-in at a time
+	if flag.Arg(0) == "aggregate" {
+		if err := runAggregate(flag.Args()[1:], hashFunc, keysDir, *aggregateDir, *fanIn); err != nil {
+			return fmt.Errorf("aggregate: %w", err)
+		}
+		return nil
+	}
+
+	// bench compare: compile, set up, prove and verify every circuit at each size
+	if flag.Arg(0) == "bench" {
+		if flag.Arg(1) != "compare" {
+			return fmt.Errorf("unknown bench command %q", flag.Arg(1))
+		}
+		// gnark logs to stdout, which is reserved for the table
+		gnarklogger.Disable()
+		patternLens, err := parseIntList(*benchPatternLens)
+		if err != nil {
+			return fmt.Errorf("invalid -bench-pattern-lens: %w", err)
+		}
+		textLens, err := parseIntList(*benchTextLens)
+		if err != nil {
+			return fmt.Errorf("invalid -bench-text-lens: %w", err)
+		}
+		rows, err := runBenchCompare(patternLens, textLens)
+		if err != nil {
+			return fmt.Errorf("bench compare: %w", err)
+		}
+		if err := writeBenchTable(os.Stdout, rows, *benchFormat); err != nil {
+			return fmt.Errorf("write bench table: %w", err)
+		}
+		return nil
+	}
+
+	// Stream the decoded entries into the superstring, normalized and truncated, so entries
+	// past -max-text-len are never read; patterns are normalized the same way by ProcessSubstrings
+	entryFiles, err := expandEntryPaths(cfg.Entries)
+	if err != nil {
+		return fmt.Errorf("load decoded entries: %w", err)
+	}
+	// Only the source hash is kept from this pass; the text is streamed again into the tree
+	// when the saved one does not match, so it is never held whole
+	openText := func() *superStringReader { return newSuperStringReader(entryFiles, cfg.MaxTextLen, normalize) }
+	text := openText()
+	source := newSourceHasher(cfg.MaxPatternLen, charset, normalize, leafMode)
+	// The index needs the whole text, so it is only held with -text-index or -only-queried
+	var indexed bytes.Buffer
+	var sink io.Writer = source
+	if *textIndex || *onlyQueried {
+		sink = io.MultiWriter(source, &indexed)
+	}
+	textBytes, err := io.Copy(sink, text)
+	text.Close()
+	if err != nil {
+		return fmt.Errorf("load decoded entries: %w", err)
+	}
+	var index *TextIndex
+	if *textIndex || *onlyQueried {
+		indexStart := time.Now()
+		index = NewTextIndex(indexed.Bytes())
+		logger.Info("Indexed decoded entries", "textBytes", indexed.Len(), "elapsed", time.Since(indexStart))
+	}
+	sources, sourceHash := text.Sources(), source.Sum()
+	for _, source := range sources {
+		logger.Debug("Read entry file", "path", source.Path, "count", source.Entries)
+	}
+	logger.Info("Loaded decoded entries", "files", len(sources), "count", totalEntries(sources), "textBytes", textBytes)
+
+	substrings, err := loadJSONFile(cfg.Patterns)
+	if err != nil {
+		return fmt.Errorf("load substrings: %w", err)
+	}
+	logger.Info("Loaded substrings", "count", len(substrings))
+
+	// Reuse the saved tree when it was built from the same input, otherwise rebuild and save it
+	treeBuildStart := time.Now()
+	treePath := *treeFile
+	if *onlyQueried {
+		// The tree depends on the patterns, which the source hash does not cover
+		treePath = ""
+	}
+	treeOpts := []TreeOption{WithHash(hashFunc), WithCharset(charset), WithNormalization(normalize), WithLeafMode(leafMode), WithEntrySources(sources)}
+	if *compactTree {
+		treeOpts = append(treeOpts, WithCompactStorage())
+	}
+	if *hashCacheFile != "" {
+		treeOpts = append(treeOpts, WithHashCache(*hashCacheFile))
+	}
+	// Save does not record the charset or leaf mode; the source hash already pins them
+	merkleTree, err := LoadMerkleTree(treePath, sourceHash, treeOpts...)
+	if err == nil && merkleTree.Hash != hashFunc {
+		err = fmt.Errorf("tree was built with %s, not %s", merkleTree.Hash, hashFunc)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Info("Not using saved Merkle Tree", "path", *treeFile, "reason", err)
+		}
+		if *onlyQueried {
+			merkleTree, err = NewQueriedMerkleTree(substrings, index, cfg.MaxPatternLen, treeOpts...)
+		} else {
+			text := openText()
+			merkleTree, err = NewMerkleTreeFromReader(bufio.NewReader(text), cfg.MaxPatternLen, treeOpts...)
+			text.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("build merkle tree: %w", err)
+		}
+		if !*onlyQueried && merkleTree.SourceHash != sourceHash {
+			return errors.New("build merkle tree: decoded entries changed while reading them")
+		}
+		if treePath != "" {
+			if err := merkleTree.Save(treePath); err != nil {
+				logger.Warn("Failed to save Merkle Tree", "path", treePath, "err", err)
+			}
+		}
+	} else {
+		logger.Info("Loaded saved Merkle Tree", "path", *treeFile, "leaves", len(merkleTree.Leaves), "normalize", merkleTree.normalize,
+			"builtFromFiles", len(merkleTree.Sources), "builtFromEntries", totalEntries(merkleTree.Sources))
+	}
+	if *bloomRate != 0 {
+		if merkleTree.bloom, err = loadOrBuildBloomFilter(treePath, merkleTree, *bloomRate); err != nil {
+			return fmt.Errorf("invalid -bloom-fp-rate: %w", err)
+		}
+	}
+	stats.TreeBuildTime = time.Since(treeBuildStart)
+	logger.Info("Merkle Tree ready", "elapsed", stats.TreeBuildTime)
+
+	// Patterns the charset rules out can never be proved; say so now rather than one by one
+	if disallowed := merkleTree.disallowedPatterns(substrings); len(disallowed) > 0 {
+		logger.Warn("Patterns with characters outside the charset will be reported as invalid",
+			"charset", charset, "count", len(disallowed), "first", disallowed[0])
+	}
+	var unexpressible []string
+	for _, pattern := range substrings {
+		if pattern != "" && merkleTree.checkPatternLabels(normalize.Apply(pattern)) != nil {
+			unexpressible = append(unexpressible, pattern)
+		}
+	}
+	if len(unexpressible) > 0 {
+		logger.Warn("Patterns that are not whole labels will be reported as invalid",
+			"leafMode", leafMode, "count", len(unexpressible), "first", unexpressible[0])
+	}
+
+	// Proofs are against the MiMC root, or the RFC 6962 root of the same leaves with -rfc6962
+	var rfcTree *RFC6962Tree
+	if *rfc6962 {
+		rfcTree = NewRFC6962Tree(merkleTree.patternsByIndex())
+		logger.Info("RFC 6962 tree built", "root", hex.EncodeToString(rfcTree.Root[:]))
+	}
+
+	// Compile the circuit for the tree's hash, so a proof can never use a different one
+	// Sized to the tree's height, so no constraints are spent on levels it does not have
+	breakdown := &constraintBreakdown{}
+	sized := SubstringCircuit{hash: merkleTree.Hash, breakdown: breakdown, unusedLevels: merkleTree.unusedLevels()}
+	var circuit frontend.Circuit = &sized
+	switch {
+	case rfcTree != nil:
+		circuit, breakdown = &RFC6962Circuit{}, nil
+	case *batchSize > 1:
+		circuit, breakdown = newMultiPatternCircuit(*batchSize, merkleTree.Hash), nil
+	case *bundleDir != "":
+		circuit = &CommittedPatternCircuit{SubstringCircuit: sized}
+	case *listVersion >= 0:
+		circuit = &VersionedRootCircuit{SubstringCircuit: sized}
+	}
+	compileStart := time.Now()
+	logger.Info("Compiling circuit...", "backend", cfg.Backend)
+	builder := r1cs.NewBuilder
+	if usePlonk {
+		builder = scs.NewBuilder
+	}
+	ccs, err := frontend.Compile(fieldModulus, builder, circuit)
+	if err != nil {
+		return fmt.Errorf("compile circuit: %w", err)
+	}
+	stats.CircuitCompileTime = time.Since(compileStart)
+	stats.Circuit = logCompiled("Circuit compiled", ccs, stats.CircuitCompileTime, breakdown)
+	stats.Breakdown = breakdown
+
+	// Setup proving/verifying keys, reusing cached keys so cached proofs stay valid
+	logger.Info("Setting up proving and verifying keys...")
+	setupStart := time.Now()
+	var cache *proofCache
+	var pk groth16.ProvingKey
+	var vk groth16.VerifyingKey
+	var plonkKeys *PlonkKeys
+	switch {
+	case usePlonk:
+		// Proofs are only cached for groth16; PLONK keys are still cached unless -no-cache
+		plonkKeys, err = loadOrSetupPlonkKeys(ccs, keysDir, !*noCache)
+	case *noCache:
+		pk, vk, err = groth16.Setup(ccs)
+	default:
+		cache = newProofCache(*cacheDir)
+		cache.keysDir = keysDir
+		pk, vk, err = cache.LoadOrSetupKeys(ccs)
+	}
+	if err != nil {
+		return fmt.Errorf("set up keys: %w", err)
+	}
+	stats.SetupTime = time.Since(setupStart)
+	logger.Info("Keys setup completed", "elapsed", stats.SetupTime)
+
+	// Process each substring
+	logger.Info("Processing substrings...", "count", len(substrings))
+	// Stop cleanly on Ctrl-C, keeping the stats of the substrings handled so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := ProcessOptions{Cache: cache, RFC6962: rfcTree, BatchSize: *batchSize, BatchVerify: *batchVerify, BundleDir: *bundleDir, Workers: *workers, Plonk: plonkKeys, TextIndex: index}
+	if *bundleDir != "" {
+		// Each proof commits to a fresh salt, so cached proofs never match; keys are still cached
+		opts.Cache = nil
+	}
+	if *listVersion >= 0 {
+		opts.ListVersion = big.NewInt(*listVersion)
+	}
+	if *estimate {
+		est, err := EstimateProvingTime(ctx, substrings, merkleTree, pk, vk, ccs, opts)
+		if err != nil {
+			return fmt.Errorf("estimate proving time: %w", err)
+		}
+		if est.Proofs == 0 {
+			fmt.Println("No substring is in the Merkle tree, nothing to prove")
+			return nil
+		}
+		fmt.Printf("Proved %q in %v; %d proofs would take about %v after the %v setup\n",
+			est.Pattern, est.PerProof.Round(time.Millisecond), est.Proofs, est.Total.Round(time.Millisecond), stats.SetupTime.Round(time.Millisecond))
+		return nil
+	}
+	processed, err := ProcessSubstrings(ctx, substrings, merkleTree, pk, vk, ccs, opts)
+	switch {
+	case errors.Is(err, context.Canceled):
+		logger.Warn("Interrupted, statistics cover only the substrings processed so far", "processed", processed.ProcessedPatterns)
+	case err != nil:
+		return fmt.Errorf("process substrings: %w", err)
+	}
+	processed.TreeBuildTime, processed.CircuitCompileTime, processed.SetupTime = stats.TreeBuildTime, stats.CircuitCompileTime, stats.SetupTime
+	stats = processed
+	printFinalStats(stats, totalStartTime)
+	return nil
+}
+
+// profiler holds the profiles started for -cpuprofile, -memprofile and -pprof-addr
+type profiler struct {
+	cpuFile    *os.File
+	memProfile string
+	listener   net.Listener
+}
+
+// startProfiling starts the CPU profile and the net/http/pprof listener, each disabled by
+// an empty argument. Stop writes the profiles and must be called however the run ends.
+func startProfiling(cpuProfile, memProfile, pprofAddr string) (*profiler, error) {
+	p := &profiler{}
+	if pprofAddr != "" {
+		listener, err := net.Listen("tcp", pprofAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.listener = listener
+		// net/http/pprof registers its handlers on the default mux
+		go http.Serve(listener, nil)
+		logger.Info("Serving pprof", "url", "http://"+listener.Addr().String()+"/debug/pprof/")
+	}
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err == nil {
+			err = pprof.StartCPUProfile(f)
+			if err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			p.Stop()
+			return nil, err
+		}
+		p.cpuFile = f
+	}
+	p.memProfile = memProfile
+	return p, nil
+}
+
+// Stop ends the CPU profile, writes the heap profile and closes the pprof listener
+func (p *profiler) Stop() error {
+	var errs []error
+	if p.cpuFile != nil {
+		pprof.StopCPUProfile()
+		errs = append(errs, p.cpuFile.Close())
+	}
+	if p.memProfile != "" {
+		errs = append(errs, writeHeapProfile(p.memProfile))
+	}
+	if p.listener != nil {
+		errs = append(errs, p.listener.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// writeHeapProfile writes a heap profile to filename after a GC, so it shows live memory
+func writeHeapProfile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// memSample is one reading of runtime.MemStats during a run
+type memSample struct {
+	Elapsed   time.Duration // Since the sampler started
+	HeapAlloc uint64        // Bytes of allocated heap objects
+	Sys       uint64        // Bytes obtained from the OS
+}
+
+// MarshalJSON emits the elapsed time in milliseconds
+func (m memSample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ElapsedMs float64 `json:"elapsedMs"`
+		HeapAlloc uint64  `json:"heapAlloc"`
+		Sys       uint64  `json:"sys"`
+	}{durationMillis(m.Elapsed), m.HeapAlloc, m.Sys})
+}
+
+// memSampler logs and records runtime.MemStats at a fixed interval on its own goroutine
+type memSampler struct {
+	start   time.Time
+	samples []memSample
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startMemSampler starts sampling every interval until Stop
+func startMemSampler(interval time.Duration) *memSampler {
+	s := &memSampler{start: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *memSampler) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	sample := memSample{Elapsed: time.Since(s.start), HeapAlloc: m.HeapAlloc, Sys: m.Sys}
+	s.samples = append(s.samples, sample)
+	logger.Info("Memory", "heapAlloc", sample.HeapAlloc, "sys", sample.Sys)
+}
+
+// Stop ends sampling and returns the samples, with a last one taken now
+func (s *memSampler) Stop() []memSample {
+	close(s.done)
+	<-s.stopped
+	s.sample()
+	return s.samples
+}
+
+// ProcessOptions selects how ProcessSubstrings proves each pattern
+type ProcessOptions struct {
+	Cache       *proofCache  // Reuse and store proofs; nil always proves
+	RFC6962     *RFC6962Tree // Prove against this tree's root instead of the MiMC root
+	BatchSize   int          // Patterns per MultiPatternCircuit proof; 0 or 1 proves each separately
+	BatchVerify bool         // Verify new proofs with one VerifyBundles call after the loop
+	BundleDir   string       // Prove CommittedPatternCircuit and write verified bundles here for the aggregate command
+	Workers     int          // Goroutines proving patterns at once; 0 or 1 proves them in order
+	Plonk       *PlonkKeys   // Prove with PLONK instead of the groth16 keys; ccs must come from scs.NewBuilder
+	ListVersion *big.Int     // Prove VersionedRootCircuit for this allow-list version; nil proves SubstringCircuit
+	TextIndex   *TextIndex   // Report patterns missing from the indexed superstring before looking them up; nil looks every pattern up
+}
+
+// PlonkKeys are the PLONK proving and verifying keys for one compiled circuit
+type PlonkKeys struct {
+	PK plonk.ProvingKey
+	VK plonk.VerifyingKey
+}
+
+// loadOrSetupPlonkKeys loads PLONK keys cached in keysDir for this circuit shape, or runs
+// plonk.Setup with a test SRS from unsafekzg, saving the keys when cacheKeys is set.
+// The SRS toxic waste is known to this process, so the keys are only fit for benchmarks.
+func loadOrSetupPlonkKeys(ccs constraint.ConstraintSystem, keysDir string, cacheKeys bool) (*PlonkKeys, error) {
+	base := filepath.Join(keysDir, "plonk-"+circuitShapeHash(ccs))
+	version, err := circuitVersion(ccs)
+	if err != nil {
+		return nil, err
+	}
+	keys := &PlonkKeys{PK: plonk.NewProvingKey(ecc.BN254), VK: plonk.NewVerifyingKey(ecc.BN254)}
+	if cacheKeys {
+		err := readCachedKeys(base, version, keys.PK, keys.VK)
+		if err == nil {
+			logger.Info("Loaded cached PLONK proving and verifying keys", "path", base)
+			return keys, nil
+		}
+		if errors.Is(err, ErrCircuitMismatch) {
+			logger.Warn("Discarding cached PLONK keys", "path", base, "err", err)
+		}
+	}
+
+	srs, srsLagrange, err := unsafekzg.NewSRS(ccs)
+	if err != nil {
+		return nil, fmt.Errorf("kzg srs: %w", err)
+	}
+	if keys.PK, keys.VK, err = plonk.Setup(ccs, srs, srsLagrange); err != nil {
+		return nil, err
+	}
+	if !cacheKeys {
+		return keys, nil
+	}
+	if err := writeCachedKeys(base, version, keys.PK, keys.VK); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ProcessSubstrings proves and verifies every non-empty pattern against tree with the keys
+// for ccs, which must be compiled for the circuit opts selects. Per-pattern failures are
+// recorded in the returned stats; the error is for unusable arguments, or ctx.Err() when
+// ctx is done before every pattern is handled, in which case the stats cover the patterns
+// handled so far. The tree, compile and setup times are left for the caller to fill in.
+func ProcessSubstrings(ctx context.Context, patterns []string, tree *MerkleTree, pk groth16.ProvingKey, vk groth16.VerifyingKey,
+	ccs constraint.ConstraintSystem, opts ProcessOptions) (ProcessingStats, error) {
+	var stats ProcessingStats
+	if tree == nil {
+		return stats, errors.New("no Merkle tree")
+	}
+	if opts.BatchSize > 1 && opts.RFC6962 != nil {
+		return stats, errors.New("batching is not supported for RFC 6962 proofs")
+	}
+	if opts.BatchVerify && (opts.BatchSize > 1 || opts.RFC6962 != nil) {
+		return stats, errors.New("batch verification is only supported for SubstringCircuit proofs")
+	}
+	if opts.BundleDir != "" && (opts.BatchSize > 1 || opts.RFC6962 != nil || opts.Cache != nil) {
+		return stats, errors.New("bundles are only written for uncached single-pattern proofs")
+	}
+	if opts.Workers > 1 && opts.BatchSize > 1 {
+		return stats, errors.New("workers are not supported for batched proofs")
+	}
+	if opts.ListVersion != nil && (opts.BatchSize > 1 || opts.RFC6962 != nil || opts.BatchVerify || opts.BundleDir != "") {
+		return stats, errors.New("list versions are only bound into unbundled single-pattern proofs verified one at a time")
+	}
+	if opts.Plonk != nil && (opts.BatchSize > 1 || opts.BatchVerify || opts.BundleDir != "" || opts.Cache != nil) {
+		return stats, errors.New("PLONK proofs are not batched, batch verified, bundled or cached")
+	}
+
+	// Proofs are against the MiMC root, or the RFC 6962 root of the same leaves
+	proofRoot := tree.Root
+	if opts.RFC6962 != nil {
+		proofRoot = new(big.Int).SetBytes(opts.RFC6962.Root[:])
+	}
+
+	// Prove the spelling the tree holds, so patterns differing only in case, a trailing dot
+	// or punycode are the same pattern; results name the normalized form
+	patterns = tree.normalize.ApplyAll(patterns)
+
+	// Prove each distinct pattern once: repeats are blanked so the loops below skip them like
+	// empty entries, keeping every index, and get their first occurrence's result afterwards
+	firstOf := firstOccurrences(patterns)
+	distinct := make([]string, len(patterns))
+	for idx, first := range firstOf {
+		if first == idx {
+			distinct[idx] = patterns[idx]
+		}
+	}
+
+	totalPatterns := len(patterns)
+	proofStartTime := time.Now()
+	if opts.BatchSize > 1 {
+		err := proveInBatches(ctx, ccs, pk, vk, tree, distinct, opts.BatchSize, &stats)
+		stats.TotalProofTime = time.Since(proofStartTime)
+		stats.Results, stats.DuplicatesSkipped = withRepeats(stats.Results, patterns, firstOf)
+		return stats, err
+	}
+	sp := &substringProver{tree: tree, pk: pk, vk: vk, ccs: ccs, opts: opts, proofRoot: proofRoot, total: totalPatterns}
+	if opts.BundleDir != "" {
+		version, err := circuitVersion(ccs)
+		if err != nil {
+			return stats, fmt.Errorf("circuit version: %w", err)
+		}
+		sp.circuitVersion = version
+	}
+	if opts.ListVersion != nil {
+		sp.listCommitment = commitListVersion(proofRoot, opts.ListVersion)
+		logger.Info("Binding proofs to the allow-list version", "version", opts.ListVersion, "commitment", sp.listCommitment)
+	}
+	var pending []pendingProof // Proofs left for VerifyBundles with opts.BatchVerify
+	if opts.Workers > 1 {
+		pending = sp.processConcurrently(ctx, distinct, &stats)
+	} else {
+		progress := newProgressBar(totalPatterns)
+		for idx, substring := range distinct {
+			if ctx.Err() != nil {
+				break
+			}
+			if substring == "" {
+				continue
+			}
+			result, p := sp.process(idx, substring)
+			recordResult(&stats, &pending, result, p)
+			progress.Update(idx+1, &stats)
+		}
+	}
+	// Proofs already made are still verified when ctx is done
+	if len(pending) > 0 {
+		verifyPending(pending, vk, opts.Cache, opts.BundleDir, &stats)
+	}
+
+	stats.TotalProofTime = time.Since(proofStartTime)
+	stats.Results, stats.DuplicatesSkipped = withRepeats(stats.Results, patterns, firstOf)
+	return stats, ctx.Err()
+}
+
+// ProvingEstimate is what EstimateProvingTime measured and extrapolated
+type ProvingEstimate struct {
+	Pattern  string        // The representative pattern that was proved
+	PerProof time.Duration // Building, proving and verifying its proof
+	Proofs   int           // Proofs a full run would make, one per batch with BatchSize > 1
+	Total    time.Duration // PerProof for every proof, the proofs shared among the workers
+}
+
+// EstimateProvingTime proves and verifies a single representative pattern, the first one
+// the tree holds, the way ProcessSubstrings would with opts, and extrapolates the time to
+// every distinct pattern the tree holds. Nothing is cached, so the estimate is for a run
+// without cached proofs; bundles go to a directory removed afterwards. Patterns that would
+// not be proved are not counted, and with none left the estimate is zero.
+func EstimateProvingTime(ctx context.Context, patterns []string, tree *MerkleTree, pk groth16.ProvingKey, vk groth16.VerifyingKey,
+	ccs constraint.ConstraintSystem, opts ProcessOptions) (ProvingEstimate, error) {
+	var estimate ProvingEstimate
+	if tree == nil {
+		return estimate, errors.New("no Merkle tree")
+	}
+	patterns = tree.normalize.ApplyAll(patterns)
+	firstOf := firstOccurrences(patterns)
+	found := 0
+	for idx, pattern := range patterns {
+		if firstOf[idx] != idx || pattern == "" || checkPatternLength(pattern) != nil || tree.checkPatternChars(pattern) != nil {
+			continue
+		}
+		if len(tree.PatternToIndex[pattern]) == 0 {
+			continue
+		}
+		if found == 0 {
+			estimate.Pattern = pattern
+		}
+		found++
+	}
+	if found == 0 {
+		return estimate, nil
+	}
+
+	// Measured alone, as the workers' share of the proofs is worked out below
+	workers := max(opts.Workers, 1)
+	opts.Cache, opts.Workers = nil, 1
+	if opts.BundleDir != "" {
+		dir, err := os.MkdirTemp("", "estimate-bundles")
+		if err != nil {
+			return estimate, err
+		}
+		defer os.RemoveAll(dir)
+		opts.BundleDir = dir
+	}
+	stats, err := ProcessSubstrings(ctx, []string{estimate.Pattern}, tree, pk, vk, ccs, opts)
+	if err != nil {
+		return estimate, err
+	}
+	if stats.SuccessfulProofs != 1 {
+		if len(stats.Results) == 1 && stats.Results[0].Err != nil {
+			return estimate, fmt.Errorf("prove %q: %w", estimate.Pattern, stats.Results[0].Err)
+		}
+		return estimate, fmt.Errorf("prove %q: proof failed", estimate.Pattern)
+	}
+
+	estimate.PerProof = stats.TotalProofTime
+	estimate.Proofs = found
+	if opts.BatchSize > 1 {
+		estimate.Proofs = (found + opts.BatchSize - 1) / opts.BatchSize
+	}
+	rounds := (estimate.Proofs + workers - 1) / workers
+	estimate.Total = estimate.PerProof * time.Duration(rounds)
+	return estimate, nil
+}
+
+// firstOccurrences returns, for each entry of patterns, the index of its first occurrence
+func firstOccurrences(patterns []string) []int {
+	first := make(map[string]int, len(patterns))
+	firstOf := make([]int, len(patterns))
+	for idx, pattern := range patterns {
+		if _, ok := first[pattern]; !ok {
+			first[pattern] = idx
+		}
+		firstOf[idx] = first[pattern]
+	}
+	return firstOf
+}
+
+// withRepeats expands results, one per distinct pattern, to one per non-empty entry of
+// patterns in input order. A repeat gets a copy of its first occurrence's result without
+// the prove and verify times it did not spend, and the repeats are counted.
+func withRepeats(results []SubstringResult, patterns []string, firstOf []int) ([]SubstringResult, int) {
+	byPattern := make(map[string]SubstringResult, len(results))
+	for _, result := range results {
+		byPattern[result.Pattern] = result
+	}
+	expanded := make([]SubstringResult, 0, len(results))
+	repeats := 0
+	for idx, pattern := range patterns {
+		result, ok := byPattern[pattern]
+		if pattern == "" || !ok {
+			continue // Empty, or not reached before ctx was done
+		}
+		result.Entry, result.ProofEntry = idx, firstOf[idx]
+		if firstOf[idx] != idx {
+			result.ProveTime, result.VerifyTime = 0, 0
+			repeats++
+		}
+		expanded = append(expanded, result)
+	}
+	return expanded, repeats
+}
+
+// substringProver holds what every pattern of a ProcessSubstrings run is proved with. It is
+// only read while proving, so workers can share it: groth16.Prove and groth16.Verify only
+// read the keys and constraint system, solving each witness in its own solver.
+type substringProver struct {
+	tree      *MerkleTree
+	pk        groth16.ProvingKey
+	vk        groth16.VerifyingKey
+	ccs       constraint.ConstraintSystem
+	opts      ProcessOptions
+	proofRoot *big.Int
+	total     int // Patterns in the run, for log messages
+
+	listCommitment *big.Int // commitListVersion of proofRoot and opts.ListVersion, when set
+	circuitVersion string   // circuitVersion of ccs, recorded in bundles written with opts.BundleDir
+}
+
+// process proves and verifies the non-empty pattern at index idx of the run. With
+// BatchVerify a new proof is returned unverified for VerifyBundles instead.
+func (sp *substringProver) process(idx int, substring string) (SubstringResult, *pendingProof) {
+	tree, vk, cache, rfcTree, opts := sp.tree, sp.vk, sp.opts.Cache, sp.opts.RFC6962, sp.opts
+	result := SubstringResult{Pattern: substring}
+
+	// Log the substring being processed
+	logger.Debug("Processing substring", "index", idx+1, "total", sp.total, "substring", substring)
+
+	// Generate Merkle proof and the witness with actual values
+	var witness frontend.Circuit
+	var salt, commitment *big.Int               // Set with opts.BundleDir
+	witnessErr := checkPatternLength(substring) // Refuse patterns patternToStr1 would truncate
+	if witnessErr == nil {
+		witnessErr = tree.checkPatternChars(substring)
+	}
+	if witnessErr == nil {
+		witnessErr = tree.checkPatternLabels(substring)
+	}
+	switch {
+	case errors.Is(witnessErr, ErrDisallowedChars):
+		result.Err = witnessErr
+		logger.Warn("Pattern contains disallowed characters", "substring", substring, "err", witnessErr)
+		return result, nil
+	case errors.Is(witnessErr, ErrNotExpressible):
+		result.Err = witnessErr
+		logger.Warn("Pattern is not whole labels, which the tree's leaf mode needs", "substring", substring, "err", witnessErr)
+		return result, nil
+	case witnessErr != nil:
+	case opts.TextIndex != nil && !opts.TextIndex.Contains(substring):
+		logger.Info("Substring does not occur in the decoded entries", "substring", substring)
+		return result, nil
+	case rfcTree != nil:
+		assignment, err := rfcTree.GenerateWitness(substring)
+		switch {
+		case err == nil:
+			witness = assignment
+		case !errors.Is(err, ErrPatternNotFound):
+			witnessErr = err
+		}
+	default:
+		proof, err := tree.GenerateProof(substring)
+		switch {
+		case errors.Is(err, ErrPatternNotFound):
+		case err != nil:
+			witnessErr = err
+		case !tree.VerifyPath(proof, computeHashOffCircuit(substring, tree.Hash)):
+			// Caught here rather than as an opaque solver error minutes into groth16.Prove
+			witnessErr = fmt.Errorf("%q at leaf %d: %w", substring, proof.LeafIndex, ErrBadProofPath)
+		default:
+			assignment, err := buildWitness(substring, proof, tree.Root)
+			switch {
+			case err != nil:
+				witnessErr = err
+			case opts.BundleDir != "":
+				if salt, witnessErr = newPatternSalt(); witnessErr == nil {
+					commitment = commitPattern(salt, substring)
+					witness = &CommittedPatternCircuit{SubstringCircuit: assignment, Salt: salt, PatternCommitment: commitment}
+				}
+			case opts.ListVersion != nil:
+				witness = &VersionedRootCircuit{SubstringCircuit: assignment, ListVersion: opts.ListVersion, ListCommitment: sp.listCommitment}
+			default:
+				witness = &assignment
+			}
+		}
+	}
+	if witnessErr != nil {
+		result.Err = witnessErr
+		logger.Warn("Cannot build witness", "substring", substring, "err", witnessErr)
+		return result, nil
+	}
+
+	// Skip if the substring has no proof
+	if witness == nil {
+		logger.Info("Substring not found in the Merkle tree", "substring", substring)
+		return result, nil
+	}
+	result.Found = true
+
+	// Create witness instance
+	witnessInstance, err := frontend.NewWitness(witness, fieldModulus)
+	if err != nil {
+		result.Err = fmt.Errorf("create witness: %w", err)
+		logger.Warn("Failed to create witness", "substring", substring, "err", err)
+		return result, nil
+	}
+
+	publicWitness, err := witnessInstance.Public()
+	if err != nil {
+		result.Err = fmt.Errorf("public witness: %w", err)
+		logger.Warn("Failed to create public witness", "substring", substring, "err", err)
+		return result, nil
+	}
+
+	// Reuse a cached proof if it still verifies against the current keys and root
+	if cache != nil {
+		if cached, ok := cache.Load(sp.proofRoot, substring); ok {
+			verifyStart := time.Now()
+			err = groth16.Verify(cached, vk, publicWitness)
+			result.VerifyTime = time.Since(verifyStart)
+			if err == nil {
+				result.Cached = true
+				if result.ProofBytes, err = proofSize(cached); err != nil {
+					logger.Warn("Failed to measure proof size", "substring", substring, "err", err)
+				}
+				result.ProofFile = cache.proofPath(sp.proofRoot, substring)
+				logger.Info("✅ Cached proof verified successfully", "substring", substring)
+				return result, nil
+			}
+			logger.Debug("Discarding stale cached proof", "substring", substring, "err", err)
+		}
+	}
+
+	if opts.Plonk != nil {
+		return sp.provePlonk(result, witnessInstance, publicWitness), nil
+	}
+
+	// Generate proof
+	proveStart := time.Now()
+	proof, err := groth16.Prove(sp.ccs, sp.pk, witnessInstance)
+	result.ProveTime = time.Since(proveStart)
+	if err != nil {
+		result.Err = fmt.Errorf("prove: %w", err)
+		logger.Warn("Proof generation failed", "substring", substring, "err", err)
+		return result, nil
+	}
+	if result.ProofBytes, err = proofSize(proof); err != nil {
+		logger.Warn("Failed to measure proof size", "substring", substring, "err", err)
+	}
+
+	if opts.BatchVerify {
+		// Counted once VerifyBundles has checked it after the loop
+		return result, &pendingProof{
+			name:   fmt.Sprintf("%05d", idx),
+			bundle: ProofBundle{Proof: proof, MerkleRoot: sp.proofRoot, PatternCommitment: commitment, CircuitVersion: sp.circuitVersion},
+			salt:   salt,
+		}
+	}
+
+	// Verify proof
+	verifyStart := time.Now()
+	err = groth16.Verify(proof, vk, publicWitness)
+	result.VerifyTime = time.Since(verifyStart)
+	if err != nil {
+		result.Err = fmt.Errorf("verify: %w", err)
+		logger.Warn("❌ Verification failed", "substring", substring, "err", err)
+		return result, nil
+	}
+	logger.Info("✅ Proof verified successfully", "substring", substring)
+	// The cache and bundle files are per pattern, so concurrent workers write distinct files
+	if cache != nil {
+		if err := cache.Store(sp.proofRoot, substring, proof); err != nil {
+			logger.Warn("Failed to cache proof", "substring", substring, "err", err)
+		} else {
+			result.ProofFile = cache.proofPath(sp.proofRoot, substring)
+		}
+	}
+	if opts.BundleDir != "" {
+		bundle := ProofBundle{Proof: proof, MerkleRoot: sp.proofRoot, PatternCommitment: commitment, CircuitVersion: sp.circuitVersion}
+		name := fmt.Sprintf("%05d", idx)
+		if err := writeBundle(opts.BundleDir, name, bundle, substring, salt); err != nil {
+			logger.Warn("Failed to write proof bundle", "substring", substring, "err", err)
+		} else {
+			result.ProofFile = bundlePath(opts.BundleDir, name)
+		}
+	}
+	return result, nil
+}
+
+// provePlonk proves and verifies one witness with the PLONK keys in opts
+func (sp *substringProver) provePlonk(result SubstringResult, witnessInstance, publicWitness witness.Witness) SubstringResult {
+	proveStart := time.Now()
+	proof, err := plonk.Prove(sp.ccs, sp.opts.Plonk.PK, witnessInstance)
+	result.ProveTime = time.Since(proveStart)
+	if err != nil {
+		result.Err = fmt.Errorf("prove: %w", err)
+		logger.Warn("Proof generation failed", "substring", result.Pattern, "err", err)
+		return result
+	}
+	if result.ProofBytes, err = proofSize(proof); err != nil {
+		logger.Warn("Failed to measure proof size", "substring", result.Pattern, "err", err)
+	}
+
+	verifyStart := time.Now()
+	err = plonk.Verify(proof, sp.opts.Plonk.VK, publicWitness)
+	result.VerifyTime = time.Since(verifyStart)
+	if err != nil {
+		result.Err = fmt.Errorf("verify: %w", err)
+		logger.Warn("❌ Verification failed", "substring", result.Pattern, "err", err)
+		return result
+	}
+	logger.Info("✅ Proof verified successfully", "substring", result.Pattern, "backend", "plonk")
+	return result
+}
+
+// recordResult counts one processed pattern in stats, holding its proof in pending when
+// process left it for VerifyBundles
+func recordResult(stats *ProcessingStats, pending *[]pendingProof, result SubstringResult, p *pendingProof) {
+	stats.ProcessedPatterns++
+	stats.VerificationTime += result.VerifyTime
+	stats.addProofSize(result.ProofBytes)
+	switch {
+	case p != nil:
+		p.result = len(stats.Results)
+		*pending = append(*pending, *p)
+	case errors.Is(result.Err, ErrDisallowedChars), errors.Is(result.Err, ErrNotExpressible):
+		stats.InvalidPatterns++
+	case errors.Is(result.Err, ErrBadProofPath):
+		stats.BadProofPaths++
+	case result.Err != nil:
+		stats.FailedProofs++
+	case !result.Found:
+		stats.NotFoundPatterns++
+	case result.Cached:
+		stats.CachedProofs++
+	default:
+		stats.SuccessfulProofs++
+	}
+	stats.Results = append(stats.Results, result)
+}
+
+// processConcurrently proves the non-empty patterns on opts.Workers goroutines, recording
+// results in stats under a mutex in the order they finish. Once ctx is done no further
+// patterns are handed out and the workers finish the ones they hold.
+func (sp *substringProver) processConcurrently(ctx context.Context, patterns []string, stats *ProcessingStats) []pendingProof {
+	nonEmpty := 0
+	for _, substring := range patterns {
+		if substring != "" {
+			nonEmpty++
+		}
+	}
+	progress := newProgressBar(nonEmpty)
+
+	var mu sync.Mutex
+	var pending []pendingProof
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < sp.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				result, p := sp.process(idx, patterns[idx])
+				mu.Lock()
+				recordResult(stats, &pending, result, p)
+				progress.Update(stats.ProcessedPatterns, stats)
+				mu.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for idx, substring := range patterns {
+		if substring == "" {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return pending
+}
+
+// pendingProof is a proof ProcessSubstrings has made but not yet verified
+type pendingProof struct {
+	result int    // Index into ProcessingStats.Results
+	name   string // Bundle file name with BundleDir
+	bundle ProofBundle
+	salt   *big.Int // Opens bundle.PatternCommitment with BundleDir
+}
+
+// verifyPending checks the pending proofs with one VerifyBundles call and records each one as
+// successful or failed, caching or writing out the successful ones
+func verifyPending(pending []pendingProof, vk groth16.VerifyingKey, cache *proofCache, bundleDir string, stats *ProcessingStats) {
+	bundles := make([]ProofBundle, len(pending))
+	for i, p := range pending {
+		bundles[i] = p.bundle
+	}
+	verifyStart := time.Now()
+	err := VerifyBundles(bundles, vk)
+	stats.BatchVerifyTime = time.Since(verifyStart)
+	stats.VerificationTime += stats.BatchVerifyTime
+	logger.Info("Batch verification completed", "proofs", len(pending), "elapsed", stats.BatchVerifyTime)
+
+	failed := make(map[int]error)
+	var batchErr *BatchVerifyError
+	if errors.As(err, &batchErr) {
+		for i, index := range batchErr.Indices {
+			failed[index] = batchErr.Errs[i]
+		}
+	} else if err != nil {
+		for i := range pending {
+			failed[i] = err
+		}
+	}
+	for i, p := range pending {
+		result := &stats.Results[p.result]
+		if err, ok := failed[i]; ok {
+			stats.FailedProofs++
+			stats.BatchVerifyFailed = append(stats.BatchVerifyFailed, result.Pattern)
+			result.Err = fmt.Errorf("verify: %w", err)
+			logger.Warn("❌ Verification failed", "substring", result.Pattern, "err", err)
+			continue
+		}
+		stats.SuccessfulProofs++
+		if cache != nil {
+			if err := cache.Store(p.bundle.MerkleRoot, result.Pattern, p.bundle.Proof); err != nil {
+				logger.Warn("Failed to cache proof", "substring", result.Pattern, "err", err)
+			} else {
+				result.ProofFile = cache.proofPath(p.bundle.MerkleRoot, result.Pattern)
+			}
+		}
+		if bundleDir != "" {
+			if err := writeBundle(bundleDir, p.name, p.bundle, result.Pattern, p.salt); err != nil {
+				logger.Warn("Failed to write proof bundle", "substring", result.Pattern, "err", err)
+			} else {
+				result.ProofFile = bundlePath(bundleDir, p.name)
+			}
+		}
+	}
+}
+
+// errBatchUnsupported is returned by batchPairingCheck for keys or proofs it cannot combine
+var errBatchUnsupported = errors.New("batch pairing check needs BN254 proofs without commitments")
+
+// BatchVerifyError lists the proofs a batch verification rejected, in order
+type BatchVerifyError struct {
+	Indices []int
+	Errs    []error
+}
+
+func (e *BatchVerifyError) Error() string {
+	return fmt.Sprintf("%d proofs rejected, first proof %d: %v", len(e.Indices), e.Indices[0], e.Errs[0])
+}
+
+func (e *BatchVerifyError) Unwrap() []error {
+	return e.Errs
+}
+
+// VerifyBundles verifies every bundle against vk with VerifyBatch, returning a
+// *BatchVerifyError listing every bundle that does not verify
+func VerifyBundles(bundles []ProofBundle, vk groth16.VerifyingKey) error {
+	failed := make(map[int]error)
+	var proofs []groth16.Proof
+	var publicWitnesses []witness.Witness
+	var indices []int // Bundle index of each entry of proofs
+	for i := range bundles {
+		publicWitness, err := bundles[i].publicWitness()
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		proofs = append(proofs, bundles[i].Proof)
+		publicWitnesses = append(publicWitnesses, publicWitness)
+		indices = append(indices, i)
+	}
+
+	var batchErr *BatchVerifyError
+	if err := VerifyBatch(proofs, vk, publicWitnesses); errors.As(err, &batchErr) {
+		for j, index := range batchErr.Indices {
+			failed[indices[index]] = batchErr.Errs[j]
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	batchErr = &BatchVerifyError{}
+	for i := range bundles {
+		if err, ok := failed[i]; ok {
+			batchErr.Indices = append(batchErr.Indices, i)
+			batchErr.Errs = append(batchErr.Errs, err)
+		}
+	}
+	return batchErr
+}
+
+// VerifyBatch verifies every proof against vk and its public witness. BN254 proofs
+// without commitments are checked together with one randomised pairing product of
+// len(proofs)+3 pairings instead of 4 per proof; when that check fails or cannot be used
+// the proofs are verified one by one, and the failures are returned as a *BatchVerifyError
+// whose first index is the first proof that does not verify.
+func VerifyBatch(proofs []groth16.Proof, vk groth16.VerifyingKey, publicWitnesses []witness.Witness) error {
+	if len(proofs) != len(publicWitnesses) {
+		return fmt.Errorf("%d proofs but %d public witnesses", len(proofs), len(publicWitnesses))
+	}
+	if ok, err := batchPairingCheck(proofs, vk, publicWitnesses); err == nil && ok {
+		return nil
+	} else if err != nil && !errors.Is(err, errBatchUnsupported) {
+		logger.Debug("Batch pairing check failed, verifying proofs one by one", "err", err)
+	}
+	batchErr := &BatchVerifyError{}
+	for i := range proofs {
+		if err := groth16.Verify(proofs[i], vk, publicWitnesses[i]); err != nil {
+			batchErr.Indices = append(batchErr.Indices, i)
+			batchErr.Errs = append(batchErr.Errs, err)
+		}
+	}
+	if len(batchErr.Indices) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// batchPairingCheck checks the Groth16 equations e(A, B) = e(α, β)·e(L, γ)·e(C, δ) of all
+// proofs at once, each scaled by a random r so that a bad proof cannot be cancelled out:
+//
+//	Π e(rᵢAᵢ, Bᵢ) · e(-Σrᵢ·α, β) · e(-Σrᵢ·Lᵢ, γ) · e(-Σrᵢ·Cᵢ, δ) = 1
+//
+// Lᵢ = K₀ + Σⱼ xᵢⱼKⱼ is linear in the public inputs, so Σrᵢ·Lᵢ is a single multi-exponentiation.
+func batchPairingCheck(proofs []groth16.Proof, vk groth16.VerifyingKey, publicWitnesses []witness.Witness) (bool, error) {
+	bnVK, ok := vk.(*groth16bn254.VerifyingKey)
+	if !ok || len(bnVK.CommitmentKeys) > 0 {
+		return false, errBatchUnsupported
+	}
+	P := make([]bn254.G1Affine, 0, len(proofs)+3)
+	Q := make([]bn254.G2Affine, 0, len(proofs)+3)
+	kScalars := make(fr.Vector, len(bnVK.G1.K)) // Σrᵢ for K₀, Σrᵢxᵢⱼ for Kⱼ
+	cPoints := make([]bn254.G1Affine, len(proofs))
+	rs := make(fr.Vector, len(proofs))
+	for i := range proofs {
+		proof, ok := proofs[i].(*groth16bn254.Proof)
+		if !ok || len(proof.Commitments) > 0 {
+			return false, errBatchUnsupported
+		}
+		if !proof.Ar.IsInSubGroup() || !proof.Bs.IsInSubGroup() || !proof.Krs.IsInSubGroup() {
+			return false, nil
+		}
+		public, ok := publicWitnesses[i].Vector().(fr.Vector)
+		if !ok || len(public) != len(bnVK.G1.K)-1 {
+			return false, fmt.Errorf("public witness %d does not match the verifying key", i)
+		}
+		if _, err := rs[i].SetRandom(); err != nil {
+			return false, err
+		}
+
+		kScalars[0].Add(&kScalars[0], &rs[i])
+		for j := range public {
+			var term fr.Element
+			term.Mul(&rs[i], &public[j])
+			kScalars[j+1].Add(&kScalars[j+1], &term)
+		}
+		var a bn254.G1Affine
+		a.ScalarMultiplication(&proof.Ar, rs[i].BigInt(new(big.Int)))
+		P = append(P, a)
+		Q = append(Q, proof.Bs)
+		cPoints[i] = proof.Krs
+	}
+
+	var alpha, l, c bn254.G1Affine
+	alpha.ScalarMultiplication(&bnVK.G1.Alpha, kScalars[0].BigInt(new(big.Int)))
+	if _, err := l.MultiExp(bnVK.G1.K, kScalars, ecc.MultiExpConfig{}); err != nil {
+		return false, err
+	}
+	if _, err := c.MultiExp(cPoints, rs, ecc.MultiExpConfig{}); err != nil {
+		return false, err
+	}
+	alpha.Neg(&alpha)
+	l.Neg(&l)
+	c.Neg(&c)
+	P = append(P, alpha, l, c)
+	Q = append(Q, bnVK.G2.Beta, bnVK.G2.Gamma, bnVK.G2.Delta)
+	return bn254.PairingCheck(P, Q)
+}
+
+// AggregatorCircuit proves that every inner CommittedPatternCircuit proof in Proofs
+// verifies for the public MerkleRoot and its pattern commitment, and that
+// PatternSetCommitment is the MiMC hash of those commitments in order. The inner verifying
+// key is fixed when compiling rather than being a witness, so a prover cannot swap in the
+// key of another circuit. BN254 is verified inside BN254 with field emulation, which costs
+// millions of constraints per inner proof.
+type AggregatorCircuit struct {
+	Proofs               []stdgroth16.Proof[sw_bn254.G1Affine, sw_bn254.G2Affine] `gnark:"proofs,secret"`
+	PatternCommitments   []emulated.Element[sw_bn254.ScalarField]                 `gnark:"patternCommitments,secret"`
+	MerkleRoot           emulated.Element[sw_bn254.ScalarField]                   `gnark:"merkleRoot,public"`
+	PatternSetCommitment frontend.Variable                                        `gnark:"patternSetCommitment,public"`
+
+	innerVK stdgroth16.VerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl] `gnark:"-"`
+}
+
+// newAggregatorCircuit returns an AggregatorCircuit for nbProofs proofs of innerCcs,
+// with innerVK fixed into it
+func newAggregatorCircuit(innerCcs constraint.ConstraintSystem, innerVK groth16.VerifyingKey, nbProofs int) (*AggregatorCircuit, error) {
+	vk, err := stdgroth16.ValueOfVerifyingKeyFixed[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](innerVK)
+	if err != nil {
+		return nil, err
+	}
+	circuit := &AggregatorCircuit{
+		Proofs:             make([]stdgroth16.Proof[sw_bn254.G1Affine, sw_bn254.G2Affine], nbProofs),
+		PatternCommitments: make([]emulated.Element[sw_bn254.ScalarField], nbProofs),
+		innerVK:            vk,
+	}
+	for i := range circuit.Proofs {
+		circuit.Proofs[i] = stdgroth16.PlaceholderProof[sw_bn254.G1Affine, sw_bn254.G2Affine](innerCcs)
+	}
+	return circuit, nil
+}
+
+func (circuit *AggregatorCircuit) Define(api frontend.API) error {
+	if len(circuit.Proofs) != len(circuit.PatternCommitments) {
+		return fmt.Errorf("%d proofs but %d pattern commitments", len(circuit.Proofs), len(circuit.PatternCommitments))
+	}
+	verifier, err := stdgroth16.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return err
+	}
+	scalars, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return err
+	}
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	for i := range circuit.Proofs {
+		// Public inputs of CommittedPatternCircuit, in declaration order
+		innerWitness := stdgroth16.Witness[sw_bn254.ScalarField]{
+			Public: []emulated.Element[sw_bn254.ScalarField]{circuit.MerkleRoot, circuit.PatternCommitments[i]},
+		}
+		if err := verifier.AssertProof(circuit.innerVK, circuit.Proofs[i], innerWitness); err != nil {
+			return fmt.Errorf("inner proof %d: %w", i, err)
+		}
+		// The scalar field is the native one, so the canonical bits give the same value
+		hFunc.Write(api.FromBinary(scalars.ToBitsCanonical(&circuit.PatternCommitments[i])...))
+	}
+	api.AssertIsEqual(hFunc.Sum(), circuit.PatternSetCommitment)
+	return nil
+}
+
+// patternSetCommitment computes the PatternSetCommitment of AggregatorCircuit
+func patternSetCommitment(commitments []*big.Int) *big.Int {
+	return hashFieldElements(mimcHash.NewMiMC(), commitments...)
+}
+
+// aggregatorAssignment returns the AggregatorCircuit assignment for inner, which must all
+// be CommittedPatternCircuit bundles for the same root
+func aggregatorAssignment(inner []ProofBundle) (*AggregatorCircuit, error) {
+	if len(inner) == 0 {
+		return nil, errors.New("no proofs to aggregate")
+	}
+	root := inner[0].MerkleRoot
+	assignment := &AggregatorCircuit{MerkleRoot: emulated.ValueOf[sw_bn254.ScalarField](root)}
+	var commitments []*big.Int
+	for i := range inner {
+		if inner[i].MerkleRoot.Cmp(root) != 0 {
+			return nil, fmt.Errorf("inner proof %d is for another Merkle root", i)
+		}
+		if inner[i].PatternCommitment == nil {
+			return nil, fmt.Errorf("inner proof %d has no pattern commitment", i)
+		}
+		proof, err := stdgroth16.ValueOfProof[sw_bn254.G1Affine, sw_bn254.G2Affine](inner[i].Proof)
+		if err != nil {
+			return nil, fmt.Errorf("inner proof %d: %w", i, err)
+		}
+		assignment.Proofs = append(assignment.Proofs, proof)
+		assignment.PatternCommitments = append(assignment.PatternCommitments, emulated.ValueOf[sw_bn254.ScalarField](inner[i].PatternCommitment))
+		commitments = append(commitments, inner[i].PatternCommitment)
+	}
+	assignment.PatternSetCommitment = patternSetCommitment(commitments)
+	return assignment, nil
+}
+
+// Aggregator turns a fixed number of CommittedPatternCircuit proofs against one Merkle root
+// into a single AggregatorCircuit proof
+type Aggregator struct {
+	ccs      constraint.ConstraintSystem
+	pk       groth16.ProvingKey
+	vk       groth16.VerifyingKey
+	nbProofs int
+}
+
+// NewAggregator compiles and sets up the AggregatorCircuit for nbProofs proofs of
+// innerCcs with innerVK. This is slow and memory hungry; see AggregatorCircuit.
+func NewAggregator(innerCcs constraint.ConstraintSystem, innerVK groth16.VerifyingKey, nbProofs int) (*Aggregator, error) {
+	circuit, err := newAggregatorCircuit(innerCcs, innerVK, nbProofs)
+	if err != nil {
+		return nil, err
+	}
+	compileStart := time.Now()
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, circuit)
+	if err != nil {
+		return nil, err
+	}
+	logCompiled(fmt.Sprintf("Aggregator circuit for %d proofs compiled", nbProofs), ccs, time.Since(compileStart), nil)
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		return nil, err
+	}
+	return &Aggregator{ccs: ccs, pk: pk, vk: vk, nbProofs: nbProofs}, nil
+}
+
+// ProveAggregate returns one proof that all inner bundles verify for their shared root and
+// that their pattern commitments hash to patternSetCommitment of them
+func (a *Aggregator) ProveAggregate(inner []ProofBundle) (groth16.Proof, error) {
+	if len(inner) != a.nbProofs {
+		return nil, fmt.Errorf("got %d inner proofs, aggregator takes %d", len(inner), a.nbProofs)
+	}
+	assignment, err := aggregatorAssignment(inner)
+	if err != nil {
+		return nil, err
+	}
+	witness, err := frontend.NewWitness(assignment, fieldModulus)
+	if err != nil {
+		return nil, err
+	}
+	return groth16.Prove(a.ccs, a.pk, witness)
+}
+
+// Verify checks an aggregate proof against root and the commitment to its pattern set
+func (a *Aggregator) Verify(proof groth16.Proof, root, setCommitment *big.Int) error {
+	assignment := &AggregatorCircuit{
+		MerkleRoot:           emulated.ValueOf[sw_bn254.ScalarField](root),
+		PatternSetCommitment: setCommitment,
+	}
+	publicWitness, err := frontend.NewWitness(assignment, fieldModulus, frontend.PublicOnly())
+	if err != nil {
+		return err
+	}
+	return groth16.Verify(proof, a.vk, publicWitness)
+}
+
+// aggregateStatement is the JSON written next to each aggregate proof: its public inputs
+// and the bundles it covers
+type aggregateStatement struct {
+	MerkleRoot           string   `json:"merkleRoot"`
+	PatternSetCommitment string   `json:"patternSetCommitment"`
+	Bundles              []string `json:"bundles"`
+}
+
+// runAggregate implements the aggregate command: it reads the bundle files written with
+// -bundle-dir, checks them against the inner keys cached in keysDir and proves them fanIn at a time,
+// writing each aggregate proof and its statement to outDir. A short last group is padded
+// by repeating its last bundle.
+func runAggregate(files []string, hash HashFunc, keysDir, outDir string, fanIn int) error {
+	if len(files) == 0 {
+		return errors.New("no bundle files given")
+	}
+	if fanIn < 1 {
+		return fmt.Errorf("fan-in %d must be at least 1", fanIn)
+	}
+	compileStart := time.Now()
+	breakdown := &constraintBreakdown{}
+	innerCcs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &CommittedPatternCircuit{SubstringCircuit: SubstringCircuit{hash: hash, breakdown: breakdown}})
+	if err != nil {
+		return err
+	}
+	logCompiled("Inner circuit compiled", innerCcs, time.Since(compileStart), breakdown)
+	_, innerVK, err := (&proofCache{keysDir: keysDir}).LoadOrSetupKeys(innerCcs)
+	if err != nil {
+		return err
+	}
+	innerVersion, err := circuitVersion(innerCcs)
+	if err != nil {
+		return err
+	}
+	bundles := make([]ProofBundle, len(files))
+	for i, file := range files {
+		if err := readFromFile(file, &bundles[i]); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if err := bundles[i].checkCircuit(innerVersion); err != nil {
+			return fmt.Errorf("%s cannot be aggregated with the current inner circuit: %w", file, err)
+		}
+		if err := bundles[i].Verify(innerVK); err != nil {
+			return fmt.Errorf("%s does not verify with the keys in %s: %w", file, keysDir, err)
+		}
+	}
+
+	aggregator, err := NewAggregator(innerCcs, innerVK, fanIn)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	if err := writeToFile(filepath.Join(outDir, "aggregator.vk"), aggregator.vk); err != nil {
+		return err
+	}
+	for start, n := 0, 0; start < len(bundles); start, n = start+fanIn, n+1 {
+		end := min(start+fanIn, len(bundles))
+		group := append([]ProofBundle(nil), bundles[start:end]...)
+		for len(group) < fanIn {
+			group = append(group, group[len(group)-1])
+		}
+		proveStart := time.Now()
+		proof, err := aggregator.ProveAggregate(group)
+		if err != nil {
+			return fmt.Errorf("aggregate %d: %w", n, err)
+		}
+		var commitments []*big.Int
+		for _, bundle := range group {
+			commitments = append(commitments, bundle.PatternCommitment)
+		}
+		statement := aggregateStatement{
+			MerkleRoot:           group[0].MerkleRoot.Text(16),
+			PatternSetCommitment: patternSetCommitment(commitments).Text(16),
+			Bundles:              files[start:end],
+		}
+		if err := aggregator.Verify(proof, group[0].MerkleRoot, patternSetCommitment(commitments)); err != nil {
+			return fmt.Errorf("aggregate %d does not verify: %w", n, err)
+		}
+		base := filepath.Join(outDir, fmt.Sprintf("aggregate_%03d", n))
+		if err := writeToFile(base+".proof", proof); err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(statement, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(base+".json", append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		logger.Info("✅ Aggregate proof verified", "path", base+".proof", "bundles", end-start, "elapsed", time.Since(proveStart))
+	}
+	return nil
+}
+
+// proveInBatches proves substrings batchSize at a time with MultiPatternCircuit. Patterns
+// without a leaf are recorded as not found and left out, since one absent pattern would
+// fail its whole batch. When ctx is done it stops before the next batch, leaving the
+// unproved patterns out of stats, and returns ctx.Err().
+func proveInBatches(ctx context.Context, ccs constraint.ConstraintSystem, pk groth16.ProvingKey, vk groth16.VerifyingKey,
+	mt *MerkleTree, substrings []string, batchSize int, stats *ProcessingStats) error {
+	var provable []string
+	for _, substring := range substrings {
+		if substring == "" {
+			continue
+		}
+		stats.ProcessedPatterns++
+		if err := checkPatternLength(substring); err != nil {
+			stats.FailedProofs++
+			stats.Results = append(stats.Results, SubstringResult{Pattern: substring, Err: err})
+			logger.Warn("Cannot build witness", "substring", substring, "err", err)
+			continue
+		}
+		if err := mt.checkPatternChars(substring); err != nil {
+			stats.InvalidPatterns++
+			stats.Results = append(stats.Results, SubstringResult{Pattern: substring, Err: err})
+			logger.Warn("Pattern contains disallowed characters", "substring", substring, "err", err)
+			continue
+		}
+		if _, ok := mt.PatternToIndex[substring]; !ok {
+			stats.NotFoundPatterns++
+			stats.Results = append(stats.Results, SubstringResult{Pattern: substring})
+			logger.Info("Substring not found in the Merkle tree", "substring", substring)
+			continue
+		}
+		provable = append(provable, substring)
+	}
+
+	logger.Info("Proving in batches", "patterns", len(provable), "batchSize", batchSize)
+	progress := newProgressBar(len(provable))
+	for start := 0; start < len(provable); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			stats.ProcessedPatterns -= len(provable) - start
+			return err
+		}
+		group := provable[start:min(start+batchSize, len(provable))]
+		batch := proveBatch(ccs, pk, vk, mt, group, batchSize)
+		stats.Batches = append(stats.Batches, batch)
+		stats.addProofSize(batch.ProofBytes)
+		stats.VerificationTime += batch.VerifyTime
+		if batch.Err != nil {
+			logger.Warn("❌ Batch proof failed", "first", group[0], "patterns", len(group), "err", batch.Err)
+		} else {
+			logger.Info("✅ Batch proof verified successfully", "first", group[0], "patterns", len(group))
+		}
+
+		// Per-substring times are the batch times amortised over its patterns
+		for _, pattern := range group {
+			result := SubstringResult{
+				Pattern:    pattern,
+				Found:      true,
+				ProveTime:  batch.ProveTime / time.Duration(len(group)),
+				VerifyTime: batch.VerifyTime / time.Duration(len(group)),
+				Err:        batch.Err,
+			}
+			if batch.Err != nil {
+				stats.FailedProofs++
 			} else {
-				witness.ProofPath[i] = 0
-				witness.ProofPathDir[i] = 0
+				stats.SuccessfulProofs++
+			}
+			stats.Results = append(stats.Results, result)
+		}
+		progress.Update(start+len(group), stats)
+	}
+	return nil
+}
+
+// proveBatch proves and verifies one MultiPatternCircuit over group
+func proveBatch(ccs constraint.ConstraintSystem, pk groth16.ProvingKey, vk groth16.VerifyingKey,
+	mt *MerkleTree, group []string, batchSize int) BatchResult {
+	batch := BatchResult{Patterns: group, Padded: batchSize - len(group)}
+	assignment, err := buildBatchWitness(mt, group, batchSize)
+	if err != nil {
+		batch.Err = fmt.Errorf("build witness: %w", err)
+		return batch
+	}
+	witness, err := frontend.NewWitness(assignment, fieldModulus)
+	if err != nil {
+		batch.Err = fmt.Errorf("create witness: %w", err)
+		return batch
+	}
+	publicWitness, err := witness.Public()
+	if err != nil {
+		batch.Err = fmt.Errorf("public witness: %w", err)
+		return batch
+	}
+
+	proveStart := time.Now()
+	proof, err := groth16.Prove(ccs, pk, witness)
+	batch.ProveTime = time.Since(proveStart)
+	if err != nil {
+		batch.Err = fmt.Errorf("prove: %w", err)
+		return batch
+	}
+	if batch.ProofBytes, err = proofSize(proof); err != nil {
+		logger.Warn("Failed to measure proof size", "patterns", batch.Patterns, "err", err)
+	}
+
+	verifyStart := time.Now()
+	if err := groth16.Verify(proof, vk, publicWitness); err != nil {
+		batch.Err = fmt.Errorf("verify: %w", err)
+	}
+	batch.VerifyTime = time.Since(verifyStart)
+	return batch
+}
+
+// printFinalStats prints the run summary to stdout
+func printFinalStats(stats ProcessingStats, totalStartTime time.Time) {
+	totalTime := time.Since(totalStartTime)
+	fmt.Fprintln(os.Stderr)
+	fmt.Printf("\nFinal Statistics:\n")
+	fmt.Printf("Total Time: %s\n", totalTime)
+	fmt.Printf("Tree Build Time: %s\n", stats.TreeBuildTime)
+	fmt.Printf("Circuit Compilation Time: %s\n", stats.CircuitCompileTime)
+	fmt.Printf("Total Proof Generation Time: %s\n", stats.TotalProofTime)
+	if verified := stats.SuccessfulProofs + stats.CachedProofs + stats.FailedProofs; verified > 0 {
+		fmt.Printf("Average Verification Time: %s\n", stats.VerificationTime/time.Duration(verified))
+	}
+	if stats.SizedProofs > 0 {
+		fmt.Printf("Average Proof Size: %d bytes over %d proofs\n", stats.AverageProofBytes(), stats.SizedProofs)
+	}
+	fmt.Printf("Successful Proofs: %d\n", stats.SuccessfulProofs)
+	fmt.Printf("Cached Proofs: %d\n", stats.CachedProofs)
+	fmt.Printf("Failed Proofs: %d\n", stats.FailedProofs)
+	fmt.Printf("Patterns Not Found: %d\n", stats.NotFoundPatterns)
+	fmt.Printf("Patterns With Disallowed Characters: %d\n", stats.InvalidPatterns)
+	if stats.BadProofPaths > 0 {
+		fmt.Printf("Proofs Failing the Off-Circuit Path Check: %d\n", stats.BadProofPaths)
+	}
+	if stats.DuplicatesSkipped > 0 {
+		fmt.Printf("Repeated Patterns Sharing a Proof: %d\n", stats.DuplicatesSkipped)
+	}
+	if len(stats.Batches) > 0 {
+		fmt.Printf("Batches: %d\n", len(stats.Batches))
+	}
+	if stats.BatchVerifyTime > 0 {
+		fmt.Printf("Batch Verification Time: %s\n", stats.BatchVerifyTime)
+		fmt.Printf("Batch Verification Failures: %d\n", len(stats.BatchVerifyFailed))
+	}
+}
+
+// buildSuperString joins entries with entrySeparator, keeping at most maxBytes bytes and
+// never splitting a UTF-8 sequence, without materialising the full join: a first pass
+// sizes the result, a second copies into it
+func buildSuperString(entries []string, maxBytes int) string {
+	size := 0
+	for i, entry := range entries {
+		if i > 0 {
+			if size == maxBytes {
+				break
+			}
+			size++ // entrySeparator
+		}
+		if size+len(entry) > maxBytes {
+			size += len(utf8Prefix(entry, maxBytes-size))
+			break
+		}
+		size += len(entry)
+	}
+
+	var b strings.Builder
+	b.Grow(size)
+	for i, entry := range entries {
+		if i > 0 {
+			if b.Len() == size {
+				break
+			}
+			b.WriteByte(entrySeparator)
+		}
+		if b.Len()+len(entry) > size {
+			b.WriteString(entry[:size-b.Len()])
+			break
+		}
+		b.WriteString(entry)
+	}
+	return b.String()
+}
+
+// utf8Prefix returns the longest prefix of s of at most n bytes that ends on a rune boundary
+func utf8Prefix(s string, n int) string {
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Helper function to load JSON data: a JSON array of strings, or JSON Lines as described
+// at openEntries
+func loadJSONFile(filename string) ([]string, error) {
+	entries, err := openEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer entries.Close()
+	return readAllEntries(entries)
+}
+
+// entryReader streams the strings of a JSON array or of JSON Lines one at a time, so a
+// multi-gigabyte export never has to be held as a slice
+type entryReader struct {
+	dec   *json.Decoder // JSON array input
+	lines *bufio.Reader // JSON Lines input
+	line  int           // JSON Lines read so far, for error messages
+	close func() error
+
+	started, done bool
+	null          bool // The input was the JSON literal null rather than an array
+}
+
+// openEntries opens filename for streaming with Next. Files named .jsonl or .ndjson, with
+// or without a further .gz, hold JSON Lines: one JSON string per line, blank lines
+// ignored. Anything else holds one JSON array of strings. Gzip input is decompressed
+// transparently, recognised by its extension or magic bytes.
+func openEntries(filename string) (*entryReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(file)
+	var r io.Reader = buffered
+	closeInput := file.Close
+	if magic, _ := buffered.Peek(2); strings.HasSuffix(filename, ".gz") || (len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		r = gz
+		closeInput = func() error {
+			gz.Close()
+			return file.Close()
+		}
+	}
+
+	var er *entryReader
+	switch ext := filepath.Ext(strings.TrimSuffix(filename, ".gz")); ext {
+	case ".jsonl", ".ndjson":
+		er = newJSONLinesReader(r)
+	default:
+		er = newJSONArrayReader(r)
+	}
+	er.close = closeInput
+	return er, nil
+}
+
+// newJSONArrayReader streams the elements of the JSON array of strings in r
+func newJSONArrayReader(r io.Reader) *entryReader {
+	return &entryReader{dec: json.NewDecoder(r)}
+}
+
+// newJSONLinesReader streams the strings of the JSON Lines in r
+func newJSONLinesReader(r io.Reader) *entryReader {
+	return &entryReader{lines: bufio.NewReader(r)}
+}
+
+// Next returns the next string, or io.EOF after the last one. A malformed JSON line is
+// reported with its line number.
+func (er *entryReader) Next() (string, error) {
+	if er.lines != nil {
+		return er.nextLine()
+	}
+	if er.done {
+		return "", io.EOF
+	}
+	if !er.started {
+		er.started = true
+		tok, err := er.dec.Token()
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF // Empty input is not a JSON value
+		}
+		if err != nil {
+			return "", err
+		}
+		if tok == nil {
+			er.null, er.done = true, true
+			if err := checkJSONEnd(er.dec); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return "", &json.UnmarshalTypeError{Value: fmt.Sprint(tok), Type: reflect.TypeOf([]string(nil)), Offset: er.dec.InputOffset()}
+		}
+	}
+	if er.dec.More() {
+		var entry string
+		if err := er.dec.Decode(&entry); err != nil {
+			return "", err
+		}
+		return entry, nil
+	}
+	if _, err := er.dec.Token(); err != nil { // Closing ']'
+		return "", err
+	}
+	if err := checkJSONEnd(er.dec); err != nil {
+		return "", err
+	}
+	er.done = true
+	return "", io.EOF
+}
+
+// nextLine returns the string on the next non-blank line
+func (er *entryReader) nextLine() (string, error) {
+	for {
+		line, err := er.lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("line %d: %w", er.line+1, err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			return "", io.EOF
+		}
+		er.line++
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry string
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return "", fmt.Errorf("line %d: %w", er.line, err)
+		}
+		return entry, nil
+	}
+}
+
+// Close closes the file openEntries opened
+func (er *entryReader) Close() error {
+	if er.close == nil {
+		return nil
+	}
+	return er.close()
+}
+
+// readAllEntries collects the remaining strings of er. Like json.Unmarshal into a
+// []string, a null array yields nil.
+func readAllEntries(er *entryReader) ([]string, error) {
+	data := []string{}
+	for {
+		entry, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, entry)
+	}
+	if er.null {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// decodeStringArray decodes a JSON array of strings one element at a time, so the raw
+// input is never held in memory alongside the result. Like json.Unmarshal into a
+// []string, null yields nil and anything other than one array of strings is an error.
+func decodeStringArray(r io.Reader) ([]string, error) {
+	return readAllEntries(newJSONArrayReader(r))
+}
+
+// EntrySource is one entry file a superstring was read from
+type EntrySource struct {
+	Path    string
+	Entries int // Entries read from the file, which stops once the superstring is full
+}
+
+const (
+	maxEntrySources    = 1 << 20 // Bounds the entry sources LoadMerkleTree reads
+	maxEntrySourcePath = 4096    // Bounds the length of each of their paths
+)
+
+// totalEntries sums the entries read from sources
+func totalEntries(sources []EntrySource) int {
+	total := 0
+	for _, source := range sources {
+		total += source.Entries
+	}
+	return total
+}
+
+// expandEntryPaths expands an -entries value, a comma-separated list of files and glob
+// patterns, into the files to read. The matches of each pattern are sorted by name, so
+// shards such as entries-000.json, entries-001.json, ... are read in order; list items
+// keep their order and a file named twice is read once. Every item that matches nothing
+// is named in the error.
+func expandEntryPaths(spec string) ([]string, error) {
+	var paths, unmatched []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		matches, err := filepath.Glob(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", item, err)
+		}
+		if len(matches) == 0 {
+			unmatched = append(unmatched, item)
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				paths = append(paths, match)
+			}
+		}
+	}
+	if len(unmatched) > 0 {
+		return nil, fmt.Errorf("no entry files match %s", strings.Join(unmatched, ", "))
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no entry files given")
+	}
+	return paths, nil
+}
+
+// readSuperString streams the entries of filenames in order, each normalized with
+// normalize, into the string buildSuperString would make of them all, separators included, and stops reading
+// once maxBytes are filled. It also returns how many entries were read from each file;
+// files after the one that filled the text are listed with none.
+func readSuperString(filenames []string, maxBytes int, normalize Normalization) (string, []EntrySource, error) {
+	text := newSuperStringReader(filenames, maxBytes, normalize)
+	defer text.Close()
+	b, err := io.ReadAll(text)
+	if err != nil {
+		return "", text.Sources(), err
+	}
+	return string(b), text.Sources(), nil
+}
+
+// superStringReader reads the text readSuperString returns without holding more than one
+// entry of it, opening each entry file only when the text reaches it
+type superStringReader struct {
+	filenames []string
+	maxBytes  int
+	normalize Normalization
+	sources   []EntrySource
+
+	file    int          // Index of the file being read
+	entries *entryReader // Open reader of filenames[file], nil between files
+	pending string       // Rest of the current entry, after the entrySeparator joining it to the previous one
+	n       int          // Bytes of text taken so far, pending included
+	started bool         // An entry was taken, so the next one needs a separator
+	full    bool         // The text reached maxBytes, or as close as a character boundary allows
+}
+
+// newSuperStringReader returns a reader of the text of filenames; Close it when done
+func newSuperStringReader(filenames []string, maxBytes int, normalize Normalization) *superStringReader {
+	sources := make([]EntrySource, len(filenames))
+	for i, filename := range filenames {
+		sources[i].Path = filename
+	}
+	return &superStringReader{filenames: filenames, maxBytes: maxBytes, normalize: normalize, sources: sources}
+}
+
+func (sr *superStringReader) Read(p []byte) (int, error) {
+	for sr.pending == "" {
+		if sr.full {
+			sr.Close()
+			return 0, io.EOF
+		}
+		if err := sr.nextEntry(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sr.pending)
+	sr.pending = sr.pending[n:]
+	return n, nil
+}
+
+// nextEntry takes the next entry as pending, normalized and cut to the bytes left, and
+// marks the text full after the last entry of the last file
+func (sr *superStringReader) nextEntry() error {
+	for {
+		if sr.entries == nil {
+			if sr.file == len(sr.filenames) {
+				sr.full = true
+				return nil
 			}
+			entries, err := openEntries(sr.filenames[sr.file])
+			if err != nil {
+				return fmt.Errorf("%s: %w", sr.filenames[sr.file], err)
+			}
+			sr.entries = entries
+		}
+		entry, err := sr.entries.Next()
+		if err == io.EOF {
+			sr.entries.Close()
+			sr.entries = nil
+			sr.file++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", sr.filenames[sr.file], err)
+		}
+		sr.sources[sr.file].Entries++
+		entry = sr.normalize.Apply(entry)
+		if sr.started {
+			entry = string(entrySeparator) + entry
 		}
+		sr.started = true
+		if left := sr.maxBytes - sr.n; len(entry) >= left {
+			entry = utf8Prefix(entry, left)
+			sr.full = true
+		}
+		sr.n += len(entry)
+		sr.pending = entry
+		return nil
+	}
+}
+
+// Sources returns how many entries have been read from each file
+func (sr *superStringReader) Sources() []EntrySource {
+	return sr.sources
+}
+
+// Close closes the entry file being read, if any
+func (sr *superStringReader) Close() {
+	if sr.entries != nil {
+		sr.entries.Close()
+		sr.entries = nil
+	}
+}
+
+// checkJSONEnd returns an error if anything but whitespace follows the decoded value
+func checkJSONEnd(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("json: unexpected data after top-level value at offset %d", dec.InputOffset())
+	}
+	return nil
+}
+
+// progressBar renders proving progress with elapsed time, throughput and ETA.
+// On a terminal it redraws a single line; otherwise it falls back to periodic log lines.
+type progressBar struct {
+	total       int
+	start       time.Time
+	out         io.Writer // Where the terminal bar is drawn
+	isTTY       bool
+	width       int
+	minInterval time.Duration
+	lastDraw    time.Time
+}
+
+const (
+	progressWindow      = 20                     // Number of recent results used for the ETA moving average
+	ttyRedrawInterval   = 200 * time.Millisecond // Minimum time between terminal redraws
+	logProgressInterval = 30 * time.Second       // Minimum time between progress log lines when not on a terminal
+)
+
+// newProgressBar creates a progress bar for total items, writing to stderr
+func newProgressBar(total int) *progressBar {
+	return newProgressBarOn(os.Stderr, isTerminal(os.Stderr), total)
+}
+
+// newProgressBarOn creates a progress bar for total items that redraws on out when isTTY
+// and logs progress lines otherwise
+func newProgressBarOn(out io.Writer, isTTY bool, total int) *progressBar {
+	interval := logProgressInterval
+	if isTTY {
+		interval = ttyRedrawInterval
+	}
+	return &progressBar{
+		total:       total,
+		start:       time.Now(),
+		out:         out,
+		isTTY:       isTTY,
+		width:       terminalWidth(),
+		minInterval: interval,
+	}
+}
+
+// isTerminal reports whether f is attached to a character device
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the width from $COLUMNS, defaulting to 80
+func terminalWidth() int {
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols
+	}
+	return 80
+}
+
+// recentAverage returns the moving average of the per-proof time over the last window results
+func recentAverage(results []SubstringResult, window int) time.Duration {
+	if len(results) > window {
+		results = results[len(results)-window:]
+	}
+	if len(results) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, r := range results {
+		sum += r.ProveTime + r.VerifyTime
+	}
+	return sum / time.Duration(len(results))
+}
+
+// estimateRemaining extrapolates the time left for the remaining items from the average per-item time
+func estimateRemaining(avg time.Duration, current, total int) time.Duration {
+	if current >= total {
+		return 0
+	}
+	return avg * time.Duration(total-current)
+}
+
+// throughputPerMinute returns how many items per minute were completed in elapsed
+func throughputPerMinute(current int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(current) / elapsed.Minutes()
+}
 
-		witness.MerkleRoot = merkleTree.Root
+// Update redraws the progress bar, rate limited unless current == total
+func (p *progressBar) Update(current int, stats *ProcessingStats) {
+	now := time.Now()
+	if current < p.total && now.Sub(p.lastDraw) < p.minInterval {
+		return
+	}
+	p.lastDraw = now
 
-		// Create witness instance
-		witnessInstance, err := frontend.NewWitness(&witness, fieldModulus)
-		if err != nil {
-			log.Printf("Failed to create witness for '%s': %v\n", substring, err)
-			continue
+	elapsed := now.Sub(p.start)
+	rate := throughputPerMinute(current, elapsed)
+	eta := estimateRemaining(recentAverage(stats.Results, progressWindow), current, p.total)
+
+	if !p.isTTY {
+		logger.Info("Progress", "done", current, "total", p.total, "elapsed", elapsed.Round(time.Second),
+			"proofsPerMin", fmt.Sprintf("%.1f", rate), "eta", eta.Round(time.Second))
+		return
+	}
+
+	// Fit the bar to the terminal, leaving room for the label and suffix
+	barLength := p.width - len("\rProgress: []") - len(progressSuffix(current, p.total, elapsed, eta))
+	if barLength > 50 {
+		barLength = 50
+	}
+	if barLength < 10 {
+		barLength = 10
+	}
+	fmt.Fprintf(p.out, "\rProgress: %s", formatProgress(current, p.total, barLength, elapsed, eta))
+}
+
+// formatProgress renders the bar and its suffix, e.g.
+// "[===-----] 42.00% (420/1000) 7m0s 60.0 proofs/min ETA 15s"
+func formatProgress(current, total, barLength int, elapsed, eta time.Duration) string {
+	filledLength := int(float64(current) / float64(total) * float64(barLength))
+	bar := strings.Repeat("=", filledLength) + strings.Repeat("-", barLength-filledLength)
+	return "[" + bar + "]" + progressSuffix(current, total, elapsed, eta)
+}
+
+// progressSuffix renders the percentage, counts, elapsed time, throughput and ETA
+func progressSuffix(current, total int, elapsed, eta time.Duration) string {
+	return fmt.Sprintf(" %.2f%% (%d/%d) %s %.1f proofs/min ETA %s",
+		float64(current)/float64(total)*100, current, total, elapsed.Round(time.Second),
+		throughputPerMinute(current, elapsed), eta.Round(time.Second))
+}
+
+// writeStatsJSON writes the stats, including per-substring records, as JSON to filename
+func writeStatsJSON(filename string, stats ProcessingStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// reportDuration is a duration written to the -report JSON as a string such as "1.5s"
+type reportDuration time.Duration
+
+func (d reportDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *reportDuration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = reportDuration(parsed)
+	return nil
+}
+
+// Report is the -report view of ProcessingStats, with human-readable durations and
+// per-substring outcomes only when verbose
+type Report struct {
+	TotalTime          reportDuration  `json:"totalTime"`
+	TreeBuildTime      reportDuration  `json:"treeBuildTime"`
+	CircuitCompileTime reportDuration  `json:"circuitCompileTime"`
+	SetupTime          reportDuration  `json:"setupTime"`
+	TotalProofTime     reportDuration  `json:"totalProofTime"`
+	VerificationTime   reportDuration  `json:"verificationTime"`
+	AvgProofBytes      int64           `json:"avgProofBytes"`
+	ProcessedPatterns  int             `json:"processed"`
+	SuccessfulProofs   int             `json:"successful"`
+	CachedProofs       int             `json:"cached"`
+	FailedProofs       int             `json:"failed"`
+	NotFoundPatterns   int             `json:"notFound"`
+	InvalidPatterns    int             `json:"invalid"`
+	BadProofPaths      int             `json:"badProofPaths"`
+	DuplicatesSkipped  int             `json:"duplicatesSkipped"`
+	Substrings         []ReportOutcome `json:"substrings,omitempty"`
+}
+
+// ReportOutcome is one substring's record in a verbose Report
+type ReportOutcome struct {
+	Pattern    string         `json:"pattern"`
+	Entry      int            `json:"entry"`
+	ProofEntry int            `json:"proofEntry"` // Earlier than entry for a repeated pattern
+	Outcome    string         `json:"outcome"`    // proved, cached, not found, invalid, bad path or failed
+	ProveTime  reportDuration `json:"proveTime"`
+	ProofFile  string         `json:"proofFile,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// newReport summarises stats, including every substring's outcome when verbose
+func newReport(stats ProcessingStats, verbose bool) Report {
+	report := Report{
+		TotalTime:          reportDuration(stats.TotalTime),
+		TreeBuildTime:      reportDuration(stats.TreeBuildTime),
+		CircuitCompileTime: reportDuration(stats.CircuitCompileTime),
+		SetupTime:          reportDuration(stats.SetupTime),
+		TotalProofTime:     reportDuration(stats.TotalProofTime),
+		VerificationTime:   reportDuration(stats.VerificationTime),
+		AvgProofBytes:      stats.AverageProofBytes(),
+		ProcessedPatterns:  stats.ProcessedPatterns,
+		SuccessfulProofs:   stats.SuccessfulProofs,
+		CachedProofs:       stats.CachedProofs,
+		FailedProofs:       stats.FailedProofs,
+		NotFoundPatterns:   stats.NotFoundPatterns,
+		InvalidPatterns:    stats.InvalidPatterns,
+		BadProofPaths:      stats.BadProofPaths,
+		DuplicatesSkipped:  stats.DuplicatesSkipped,
+	}
+	if !verbose {
+		return report
+	}
+	for _, r := range stats.Results {
+		outcome := ReportOutcome{Pattern: r.Pattern, Entry: r.Entry, ProofEntry: r.ProofEntry,
+			ProveTime: reportDuration(r.ProveTime), ProofFile: r.ProofFile}
+		switch {
+		case errors.Is(r.Err, ErrDisallowedChars), errors.Is(r.Err, ErrNotExpressible):
+			outcome.Outcome, outcome.Error = "invalid", r.Err.Error()
+		case errors.Is(r.Err, ErrBadProofPath):
+			outcome.Outcome, outcome.Error = "bad path", r.Err.Error()
+		case r.Err != nil:
+			outcome.Outcome, outcome.Error = "failed", r.Err.Error()
+		case !r.Found:
+			outcome.Outcome = "not found"
+		case r.Cached:
+			outcome.Outcome = "cached"
+		default:
+			outcome.Outcome = "proved"
 		}
+		report.Substrings = append(report.Substrings, outcome)
+	}
+	return report
+}
 
-		// Generate proof
-		proof, err := groth16.Prove(ccs, pk, witnessInstance)
-		if err != nil {
-			log.Printf("Proof generation failed for '%s': %v\n", substring, err)
-			continue
+// writeReport writes the -report JSON for stats to filename
+func writeReport(filename string, stats ProcessingStats, verbose bool) error {
+	data, err := json.MarshalIndent(newReport(stats, verbose), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// readReport reads a report written by writeReport
+func readReport(filename string) (Report, error) {
+	var report Report
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+// benchNaiveCircuit mirrors sizedSubstringCircuit in main.go without wildcards: the
+// secret Text is bound to the public MiMC digest TextDigest and every window is compared
+// character by character
+type benchNaiveCircuit struct {
+	Pattern    []frontend.Variable
+	Text       []frontend.Variable
+	TextDigest frontend.Variable `gnark:",public"`
+}
+
+func (circuit *benchNaiveCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	for _, c := range circuit.Text {
+		bits.ToBinary(api, c, bits.WithNbDigits(8))
+	}
+	hFunc.Write(packStr1(api, circuit.Text)...)
+	api.AssertIsEqual(hFunc.Sum(), circuit.TextDigest)
+
+	found := frontend.Variable(0)
+	for i := 0; i <= len(circuit.Text)-len(circuit.Pattern); i++ {
+		found = api.Or(found, benchWindowEquals(api, circuit.Pattern, circuit.Text[i:]))
+	}
+	api.AssertIsEqual(found, 1)
+	return nil
+}
+
+// benchTextDigest computes the digest checked by benchNaiveCircuit off-circuit, packing
+// text charsPerElement characters per element like packStr1
+func benchTextDigest(text string) *big.Int {
+	hFunc := mimcHash.NewMiMC()
+	for start := 0; start < len(text); start += charsPerElement {
+		var elem fr.Element
+		elem.SetBytes([]byte(text[start:min(start+charsPerElement, len(text))]))
+		b := elem.Bytes()
+		hFunc.Write(b[:])
+	}
+	return new(big.Int).SetBytes(hFunc.Sum(nil))
+}
+
+// benchRabinKarpCircuit mirrors matchCircuit in rabin_karp_circuit.go without an anchor:
+// a rolling hash plus a character comparison for every window of the public Text, with
+// the index of the first match public
+type benchRabinKarpCircuit struct {
+	Pattern    []frontend.Variable
+	Text       []frontend.Variable `gnark:",public"`
+	MatchIndex frontend.Variable   `gnark:",public"`
+}
+
+func (circuit *benchRabinKarpCircuit) Define(api frontend.API) error {
+	const base = 256
+	const prime = 997
+	pattern, text := circuit.Pattern, circuit.Text
+	mod := func(a frontend.Variable) frontend.Variable {
+		return api.Sub(a, api.Mul(api.Div(a, prime), prime))
+	}
+
+	patternHash, currentHash := frontend.Variable(0), frontend.Variable(0)
+	for i := range pattern {
+		patternHash = mod(api.Add(api.Mul(patternHash, base), pattern[i]))
+		currentHash = mod(api.Add(api.Mul(currentHash, base), text[i]))
+	}
+	basePow := new(big.Int).Exp(big.NewInt(base), big.NewInt(int64(len(pattern)-1)), big.NewInt(prime))
+
+	found, firstIndex := frontend.Variable(0), frontend.Variable(0)
+	lastWindow := len(text) - len(pattern)
+	for i := 0; i <= lastWindow; i++ {
+		windowMatch := api.And(api.IsZero(api.Sub(currentHash, patternHash)), benchWindowEquals(api, pattern, text[i:]))
+		firstIndex = api.Add(firstIndex, api.Mul(api.And(windowMatch, api.Sub(1, found)), i))
+		found = api.Or(found, windowMatch)
+		if i < lastWindow {
+			currentHash = mod(api.Sub(currentHash, api.Mul(text[i], basePow)))
+			currentHash = mod(api.Mul(currentHash, base))
+			currentHash = mod(api.Add(currentHash, text[i+len(pattern)]))
 		}
+	}
+	api.AssertIsEqual(found, 1)
+	api.AssertIsEqual(firstIndex, circuit.MatchIndex)
+	return nil
+}
+
+// benchWindowEquals returns 1 if the window of text starting at its first character
+// equals pattern, 0 otherwise
+func benchWindowEquals(api frontend.API, pattern, text []frontend.Variable) frontend.Variable {
+	match := frontend.Variable(1)
+	for j := range pattern {
+		match = api.And(match, api.IsZero(api.Sub(text[j], pattern[j])))
+	}
+	return match
+}
+
+// benchMerkleCircuit is SubstringCircuit over a proof of len(ProofPath) levels. Leaves
+// always hash maxStr1Len characters, so only the depth changes its size.
+type benchMerkleCircuit struct {
+	Str1         [maxStr1Len]frontend.Variable
+	Length       frontend.Variable
+	ProofPath    []frontend.Variable
+	ProofPathDir []frontend.Variable
+	ProofLength  frontend.Variable
+	MerkleRoot   frontend.Variable `gnark:",public"`
+}
+
+func (circuit *benchMerkleCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	patternHash := hashPatternInCircuit(api, &hFunc, circuit.Str1[:], circuit.Length)
+	levels := proofLevels(api, circuit.ProofLength, len(circuit.ProofPath))
+	api.AssertIsEqual(merkleRootInCircuit(api, &hFunc, patternHash, circuit.ProofPath, circuit.ProofPathDir, levels), circuit.MerkleRoot)
+	return nil
+}
+
+// benchRow is one circuit at one size in the bench compare table
+type benchRow struct {
+	Circuit                       string // naive, rabin-karp, merkle or entries
+	PatternLen, TextLen           int
+	Depth                         int // Height of the Merkle tree over the text's substrings or entries; 0 for the other circuits
+	Leaves                        int // Leaves of that tree, its size; 0 for the other circuits
+	Size                          circuitSize
+	Compile, Setup, Prove, Verify time.Duration
+}
+
+var benchHeader = []string{"circuit", "patternLen", "textLen", "depth", "leaves", "constraints", "compileMs", "setupMs", "proveMs", "verifyMs"}
+
+// benchEntryLen is the length of the entries the bench text is cut into for the entries
+// circuit, about that of a certificate's common name
+const benchEntryLen = 32
+
+func (r benchRow) fields() []string {
+	return []string{
+		r.Circuit,
+		strconv.Itoa(r.PatternLen),
+		strconv.Itoa(r.TextLen),
+		strconv.Itoa(r.Depth),
+		strconv.Itoa(r.Leaves),
+		strconv.Itoa(r.Size.NbConstraints),
+		strconv.FormatFloat(durationMillis(r.Compile), 'f', 3, 64),
+		strconv.FormatFloat(durationMillis(r.Setup), 'f', 3, 64),
+		strconv.FormatFloat(durationMillis(r.Prove), 'f', 3, 64),
+		strconv.FormatFloat(durationMillis(r.Verify), 'f', 3, 64),
+	}
+}
 
-		// Verify proof
-		publicWitness, err := witnessInstance.Public()
+// parseIntList parses a comma-separated list of positive integers such as "4,8,16"
+func parseIntList(s string) ([]int, error) {
+	var list []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
 		if err != nil {
-			log.Printf("Failed to create public witness for '%s': %v\n", substring, err)
-			continue
+			return nil, err
 		}
+		if n < 1 {
+			return nil, fmt.Errorf("%d is not positive", n)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
 
-		verifyStart := time.Now()
-		err = groth16.Verify(proof, vk, publicWitness)
-		stats.VerificationTime += time.Since(verifyStart)
-		if err != nil {
-			stats.FailedProofs++
-			fmt.Printf("\n❌ Verification failed for substring '%s': %v\n", substring, err)
-			log.Printf("Verification failed for substring '%s': %v", substring, err)
-		} else {
-			stats.SuccessfulProofs++
-			fmt.Printf("\n✅ Proof verified successfully for substring '%s'\n", substring)
-			log.Printf("Proof verified successfully for substring '%s'", substring)
+// benchText returns a deterministic lowercase text of n characters, varied enough that
+// the number of distinct substrings, and so the Merkle tree depth, grows with n
+func benchText(n int) string {
+	rng := rand.New(rand.NewSource(int64(n)))
+	text := make([]byte, n)
+	for i := range text {
+		text[i] = byte('a' + rng.Intn(26))
+	}
+	return string(text)
+}
+
+// runBenchCompare benchmarks the naive, Rabin-Karp, Merkle and entry tree circuits for
+// every pattern and text length, proving that the text's first patternLen characters occur
+// in it. The Merkle tree holds every substring of the text up to patternLen characters;
+// the entry tree holds the text cut into entries of benchEntryLen characters, or
+// patternLen when longer, and EntryMatchCircuit searches one of them. Its size only
+// depends on the tree's depth, so it is compiled and set up once per depth.
+func runBenchCompare(patternLens, textLens []int) ([]benchRow, error) {
+	var rows []benchRow
+	entrySetups := make(map[int]*benchSetup)
+	for _, patternLen := range patternLens {
+		for _, textLen := range textLens {
+			if patternLen > textLen || patternLen > maxStr1Len {
+				return nil, fmt.Errorf("pattern length %d must be at most the text length %d and %d", patternLen, textLen, maxStr1Len)
+			}
+			text := benchText(textLen)
+			pattern := toBenchVariables(text[:patternLen])
+			textVars := toBenchVariables(text)
+
+			naive := benchNaiveCircuit{Pattern: pattern, Text: textVars, TextDigest: benchTextDigest(text)}
+			row, err := benchCircuit(&benchNaiveCircuit{Pattern: make([]frontend.Variable, patternLen), Text: make([]frontend.Variable, textLen)}, &naive)
+			if err != nil {
+				return nil, fmt.Errorf("naive circuit, pattern %d, text %d: %w", patternLen, textLen, err)
+			}
+			row.Circuit, row.PatternLen, row.TextLen = "naive", patternLen, textLen
+			rows = append(rows, row)
+
+			rabinKarp := benchRabinKarpCircuit{Pattern: pattern, Text: textVars, MatchIndex: 0}
+			row, err = benchCircuit(&benchRabinKarpCircuit{Pattern: make([]frontend.Variable, patternLen), Text: make([]frontend.Variable, textLen)}, &rabinKarp)
+			if err != nil {
+				return nil, fmt.Errorf("Rabin-Karp circuit, pattern %d, text %d: %w", patternLen, textLen, err)
+			}
+			row.Circuit, row.PatternLen, row.TextLen = "rabin-karp", patternLen, textLen
+			rows = append(rows, row)
+
+			tree := NewMerkleTree(text, patternLen)
+			proof, err := tree.GenerateProof(text[:patternLen])
+			if err != nil {
+				return nil, err
+			}
+			w, err := buildWitness(text[:patternLen], proof, tree.Root)
+			if err != nil {
+				return nil, err
+			}
+			depth := proof.Depth
+			merkle := benchMerkleCircuit{Str1: w.Str1, Length: w.Length, ProofPath: w.ProofPath[:depth],
+				ProofPathDir: w.ProofPathDir[:depth], ProofLength: depth, MerkleRoot: tree.Root}
+			row, err = benchCircuit(&benchMerkleCircuit{ProofPath: make([]frontend.Variable, depth), ProofPathDir: make([]frontend.Variable, depth)}, &merkle)
+			if err != nil {
+				return nil, fmt.Errorf("Merkle circuit, pattern %d, text %d: %w", patternLen, textLen, err)
+			}
+			row.Circuit, row.PatternLen, row.TextLen, row.Depth, row.Leaves = "merkle", patternLen, textLen, depth, len(tree.Leaves)
+			rows = append(rows, row)
+
+			var entries []string
+			for start, size := 0, max(benchEntryLen, patternLen); start < textLen; start += size {
+				entries = append(entries, text[start:min(start+size, textLen)])
+			}
+			entryTree, err := NewEntryTree(entries)
+			if err != nil {
+				return nil, err
+			}
+			entryMatch, err := entryTree.GenerateWitness(text[:patternLen])
+			if err != nil {
+				return nil, err
+			}
+			shape := entryTree.newCircuit()
+			setup := entrySetups[shape.unusedLevels]
+			if setup == nil {
+				if setup, err = newBenchSetup(shape); err != nil {
+					return nil, fmt.Errorf("entry tree circuit, pattern %d, text %d: %w", patternLen, textLen, err)
+				}
+				entrySetups[shape.unusedLevels] = setup
+			}
+			row, err = setup.prove(entryMatch)
+			if err != nil {
+				return nil, fmt.Errorf("entry tree circuit, pattern %d, text %d: %w", patternLen, textLen, err)
+			}
+			row.Circuit, row.PatternLen, row.TextLen = "entries", patternLen, textLen
+			row.Depth, row.Leaves = RequiredProofLen(len(entries)), entryTree.Leaves()
+			rows = append(rows, row)
 		}
+	}
+	return rows, nil
+}
 
-		// Update progress bar
-		printProgressBar(idx+1, totalSubstrings)
+// toBenchVariables converts an ASCII string to one variable per character
+func toBenchVariables(s string) []frontend.Variable {
+	v := make([]frontend.Variable, len(s))
+	for i := range s {
+		v[i] = int(s[i])
 	}
+	return v
+}
 
-	stats.TotalProofTime = time.Since(proofStartTime)
+// benchCircuit compiles shape with groth16 and times setup, proving and verifying assignment
+func benchCircuit(shape, assignment frontend.Circuit) (benchRow, error) {
+	setup, err := newBenchSetup(shape)
+	if err != nil {
+		return benchRow{}, err
+	}
+	return setup.prove(assignment)
+}
 
-	totalTime := time.Since(totalStartTime)
-	fmt.Printf("\n\nFinal Statistics:\n")
-	fmt.Printf("Total Time: %s\n", totalTime)
-	fmt.Printf("Tree Build Time: %s\n", stats.TreeBuildTime)
-	fmt.Printf("Circuit Compilation Time: %s\n", stats.CircuitCompileTime)
-	fmt.Printf("Total Proof Generation Time: %s\n", stats.TotalProofTime)
-	fmt.Printf("Average Verification Time: %s\n", stats.VerificationTime/time.Duration(stats.SuccessfulProofs+stats.FailedProofs))
-	fmt.Printf("Successful Proofs: %d\n", stats.SuccessfulProofs)
-	fmt.Printf("Failed Proofs: %d\n", stats.FailedProofs)
-	fmt.Printf("Patterns Not Found: %d\n", stats.NotFoundPatterns)
+// benchSetup is a compiled circuit with its groth16 keys and the time both took, so rows
+// of the same shape can share them
+type benchSetup struct {
+	ccs            constraint.ConstraintSystem
+	pk             groth16.ProvingKey
+	vk             groth16.VerifyingKey
+	compile, setup time.Duration
 }
 
-// Helper function to load JSON data
-func loadJSONFile(filename string) ([]string, error) {
-	file, err := os.Open(filename)
+// newBenchSetup compiles shape and runs the groth16 setup, timing both
+func newBenchSetup(shape frontend.Circuit) (*benchSetup, error) {
+	start := time.Now()
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, shape)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	compile := time.Since(start)
 
-	var data []string
-	bytes, err := ioutil.ReadAll(file)
+	start = time.Now()
+	pk, vk, err := groth16.Setup(ccs)
 	if err != nil {
 		return nil, err
 	}
+	return &benchSetup{ccs: ccs, pk: pk, vk: vk, compile: compile, setup: time.Since(start)}, nil
+}
+
+// prove times proving and verifying assignment, reporting the setup's compile and setup times
+func (s *benchSetup) prove(assignment frontend.Circuit) (benchRow, error) {
+	ccs, pk, vk := s.ccs, s.pk, s.vk
+	row := benchRow{Size: sizeOf(ccs), Compile: s.compile, Setup: s.setup}
+
+	fullWitness, err := frontend.NewWitness(assignment, fieldModulus)
+	if err != nil {
+		return row, err
+	}
+	publicWitness, err := fullWitness.Public()
+	if err != nil {
+		return row, err
+	}
+	start := time.Now()
+	proof, err := groth16.Prove(ccs, pk, fullWitness)
+	if err != nil {
+		return row, err
+	}
+	row.Prove = time.Since(start)
+
+	start = time.Now()
+	if err := groth16.Verify(proof, vk, publicWitness); err != nil {
+		return row, err
+	}
+	row.Verify = time.Since(start)
+	return row, nil
+}
+
+// writeBenchTable writes rows to w as CSV or as a markdown table
+func writeBenchTable(w io.Writer, rows []benchRow, format string) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(benchHeader)
+		for _, r := range rows {
+			cw.Write(r.fields())
+		}
+		cw.Flush()
+		return cw.Error()
+	case "markdown":
+		var b strings.Builder
+		b.WriteString("| " + strings.Join(benchHeader, " | ") + " |\n")
+		b.WriteString(strings.Repeat("| --- ", len(benchHeader)) + "|\n")
+		for _, r := range rows {
+			b.WriteString("| " + strings.Join(r.fields(), " | ") + " |\n")
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	default:
+		return fmt.Errorf("unknown bench format %q (want csv or markdown)", format)
+	}
+}
+
+// writeStatsCSV writes one row per processed substring to filename
+func writeStatsCSV(filename string, stats ProcessingStats) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"pattern", "found", "cached", "proveMs", "verifyMs", "proofBytes", "error", "entry", "proofEntry", "proofFile"})
+	for _, r := range stats.Results {
+		errMsg := ""
+		if r.Err != nil {
+			errMsg = r.Err.Error()
+		}
+		w.Write([]string{
+			r.Pattern,
+			strconv.FormatBool(r.Found),
+			strconv.FormatBool(r.Cached),
+			strconv.FormatFloat(durationMillis(r.ProveTime), 'f', 3, 64),
+			strconv.FormatFloat(durationMillis(r.VerifyTime), 'f', 3, 64),
+			strconv.FormatInt(r.ProofBytes, 10),
+			errMsg,
+			strconv.Itoa(r.Entry),
+			strconv.Itoa(r.ProofEntry),
+			r.ProofFile,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// parseLogLevel maps a level name to its slog level
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
 
-	if err := json.Unmarshal(bytes, &data); err != nil {
+// setupLogger points the package logger at stderr filtered by levelName and,
+// when logFilePath is set, also appends every message to that file at debug level
+func setupLogger(levelName, logFilePath string) (*os.File, error) {
+	level, err := parseLogLevel(levelName)
+	if err != nil {
 		return nil, err
 	}
+	var logFile *os.File
+	if logFilePath != "" {
+		logFile, err = os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		logger = newLogger(os.Stderr, level, logFile)
+	} else {
+		logger = newLogger(os.Stderr, level, nil)
+	}
+	return logFile, nil
+}
 
-	return data, nil
+// newLogger returns a logger writing messages of at least level to console and, when
+// logFile is not nil, every message with its source location to logFile
+func newLogger(console io.Writer, level slog.Level, logFile io.Writer) *slog.Logger {
+	handlers := []slog.Handler{slog.NewTextHandler(console, &slog.HandlerOptions{Level: level})}
+	if logFile != nil {
+		handlers = append(handlers, slog.NewTextHandler(logFile, &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true}))
+	}
+	return slog.New(multiHandler(handlers))
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
-// Helper function to print a progress bar
-func printProgressBar(current, total int) {
-	percent := float64(current) / float64(total)
-	barLength := 50
-	filledLength := int(percent * float64(barLength))
+// multiHandler fans each log record out to every handler that accepts its level
+type multiHandler []slog.Handler
 
-	bar := strings.Repeat("=", filledLength) + strings.Repeat("-", barLength-filledLength)
-	fmt.Printf("\rProgress: [%s] %.2f%% (%d/%d)", bar, percent*100, current, total)
+func (h multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, handler := range h {
+		if handler.Enabled(ctx, record.Level) {
+			if err := handler.Handle(ctx, record.Clone()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// proofCache persists proving keys and proofs on disk so identical runs can skip groth16.Prove.
+// Proofs are keyed by hash(root || pattern || paramHash), where paramHash covers the circuit
+// parameters and the verifying key, so a new root, new circuit shape or new keys invalidate them.
+type proofCache struct {
+	dir       string
+	keysDir   string // Where LoadOrSetupKeys keeps keys, dir/keys unless set otherwise
+	paramHash []byte
+}
+
+// newProofCache returns a cache rooted at dir
+func newProofCache(dir string) *proofCache {
+	return &proofCache{dir: dir, keysDir: filepath.Join(dir, "keys")}
+}
+
+// circuitShapeHash identifies the compiled circuit so keys for a different shape are never reused
+func circuitShapeHash(ccs constraint.ConstraintSystem) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "maxStr1Len=%d;maxProofLen=%d;constraints=%d;public=%d;secret=%d",
+		maxStr1Len, maxProofLen, ccs.GetNbConstraints(), ccs.GetNbPublicVariables(), ccs.GetNbSecretVariables())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// circuitVersion identifies the compiled circuit by a hash of its field and serialized
+// constraint system, so any change to its constraints gives a new version, not only a
+// change of size. Compiling the same circuit always gives the same version.
+func circuitVersion(ccs constraint.ConstraintSystem) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "field=%s;", ccs.Field())
+	if _, err := ccs.WriteTo(h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readCachedKeys reads the keys saved at base by writeCachedKeys into pk and vk. It
+// returns ErrCircuitMismatch when they were saved for another circuit version, or
+// before versions were recorded, and an os.ErrNotExist error when none were saved.
+func readCachedKeys(base, version string, pk, vk io.ReaderFrom) error {
+	saved, err := os.ReadFile(base + ".version")
+	switch {
+	case os.IsNotExist(err):
+		if _, statErr := os.Stat(base + ".pk"); statErr == nil {
+			return fmt.Errorf("%s: keys without a circuit version: %w", base, ErrCircuitMismatch)
+		}
+		return err
+	case err != nil:
+		return err
+	case string(saved) != version:
+		return fmt.Errorf("%s: keys for circuit %.12s, not %.12s: %w", base, saved, version, ErrCircuitMismatch)
+	}
+	if err := readFromFile(base+".pk", pk); err != nil {
+		return err
+	}
+	return readFromFile(base+".vk", vk)
+}
+
+// writeCachedKeys saves pk and vk at base with the circuit version readCachedKeys checks,
+// writing the version last so keys left half written are never taken as current
+func writeCachedKeys(base, version string, pk, vk io.WriterTo) error {
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+	os.Remove(base + ".version")
+	if err := writeToFile(base+".pk", pk); err != nil {
+		return err
+	}
+	if err := writeToFile(base+".vk", vk); err != nil {
+		return err
+	}
+	return os.WriteFile(base+".version", []byte(version), 0644)
+}
+
+// LoadOrSetupKeys loads keys cached for this circuit, running groth16.Setup and saving
+// the result when none are present or they were made for another circuit version
+func (c *proofCache) LoadOrSetupKeys(ccs constraint.ConstraintSystem) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	base := filepath.Join(c.keysDir, circuitShapeHash(ccs))
+	version, err := circuitVersion(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pk := groth16.NewProvingKey(ecc.BN254)
+	vk := groth16.NewVerifyingKey(ecc.BN254)
+	err = readCachedKeys(base, version, pk, vk)
+	if err == nil {
+		logger.Info("Loaded cached proving and verifying keys", "path", base)
+	} else {
+		if errors.Is(err, ErrCircuitMismatch) {
+			logger.Warn("Discarding cached keys", "path", base, "err", err)
+		}
+		pk, vk, err = groth16.Setup(ccs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeCachedKeys(base, version, pk, vk); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Proofs are filed under the circuit version too, so they are never read for another circuit
+	h := sha256.New()
+	fmt.Fprintf(h, "maxStr1Len=%d;maxProofLen=%d;circuit=%s;", maxStr1Len, maxProofLen, version)
+	if _, err := vk.WriteTo(h); err != nil {
+		return nil, nil, err
+	}
+	c.paramHash = h.Sum(nil)
+	return pk, vk, nil
+}
+
+// proofPath returns the cache file for a proof of pattern against root
+func (c *proofCache) proofPath(root *big.Int, pattern string) string {
+	h := sha256.New()
+	h.Write(root.Bytes())
+	h.Write([]byte{0})
+	h.Write([]byte(pattern))
+	h.Write([]byte{0})
+	h.Write(c.paramHash)
+	return filepath.Join(c.dir, "proofs", hex.EncodeToString(h.Sum(nil))+".proof")
+}
+
+// Load returns the cached proof for pattern against root, if any
+func (c *proofCache) Load(root *big.Int, pattern string) (groth16.Proof, bool) {
+	proof := groth16.NewProof(ecc.BN254)
+	if err := readFromFile(c.proofPath(root, pattern), proof); err != nil {
+		return nil, false
+	}
+	return proof, true
+}
+
+// Store saves proof for pattern against root
+func (c *proofCache) Store(root *big.Int, pattern string, proof groth16.Proof) error {
+	path := c.proofPath(root, pattern)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeToFile(path, proof)
+}
+
+// writeToFile serializes v into filename
+func writeToFile(filename string, v io.WriterTo) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := v.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readFromFile deserializes v from filename
+func readFromFile(filename string, v io.ReaderFrom) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = v.ReadFrom(file)
+	return err
 }
@@ -0,0 +1,4030 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	edbn254 "github.com/consensys/gnark-crypto/ecc/bn254/twistededwards"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	groth16bn254 "github.com/consensys/gnark/backend/groth16/bn254"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/math/uints"
+	"github.com/consensys/gnark/test"
+)
+
+// TestCommittedPattern checks that a proof for one pattern verifies against its own
+// commitment but not against another pattern's, and that the salt must match
+func TestCommittedPattern(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	newAssignment := func(pattern string, salt *big.Int) (*CommittedPatternCircuit, error) {
+		proof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := buildWitness(pattern, proof, tree.Root)
+		if err != nil {
+			return nil, err
+		}
+		return &CommittedPatternCircuit{SubstringCircuit: leaf, Salt: salt, PatternCommitment: commitPattern(salt, pattern)}, nil
+	}
+	salt, err := newPatternSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := newAssignment("exa", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCommitment := commitPattern(salt, "com")
+
+	circuit := &CommittedPatternCircuit{SubstringCircuit: SubstringCircuit{hash: tree.Hash}}
+	if err := test.IsSolved(circuit, assignment, fieldModulus); err != nil {
+		t.Fatalf("pattern rejected against its own commitment: %v", err)
+	}
+	forged := *assignment
+	forged.PatternCommitment = otherCommitment
+	if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+		t.Fatal("pattern accepted against another pattern's commitment")
+	}
+	forged = *assignment
+	forged.Salt = new(big.Int).Add(salt, big.NewInt(1))
+	if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+		t.Fatal("pattern accepted with the wrong salt")
+	}
+
+	// A real proof for "exa" must not verify when presented with the commitment to "com"
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witness, err := frontend.NewWitness(assignment, fieldModulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := groth16.Prove(ccs, pk, witness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := ProofBundle{Proof: proof, MerkleRoot: tree.Root, PatternCommitment: commitPattern(salt, "exa")}
+	if err := bundle.Verify(vk); err != nil {
+		t.Fatalf("bundle rejected: %v", err)
+	}
+	bundle.PatternCommitment = otherCommitment
+	if bundle.Verify(vk) == nil {
+		t.Fatal("proof for one pattern verified against another pattern's commitment")
+	}
+}
+
+// TestEstimate checks that the estimate proves one pattern, counts only the distinct
+// patterns the tree holds, shares them among the workers and is zero with nothing to prove
+func TestEstimate(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	circuit := &SubstringCircuit{hash: tree.Hash, unusedLevels: tree.unusedLevels()}
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns := []string{"zzz", "exa", "mpl", "exa", "", ".co", "toolongforthetree"}
+	est, err := EstimateProvingTime(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.PerProof <= 0 || est.Total <= 0 {
+		t.Fatalf("estimate of %v per proof and %v in total, want positive durations", est.PerProof, est.Total)
+	}
+	if est.Pattern != "exa" || est.Proofs != 3 || est.Total != 3*est.PerProof {
+		t.Fatalf("estimated %d proofs from %q taking %v, want 3 from \"exa\" taking 3 x %v", est.Proofs, est.Pattern, est.Total, est.PerProof)
+	}
+
+	shared, err := EstimateProvingTime(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared.Proofs != 3 || shared.Total != 2*shared.PerProof {
+		t.Fatalf("2 workers: %d proofs taking %v, want 3 taking 2 x %v", shared.Proofs, shared.Total, shared.PerProof)
+	}
+
+	none, err := EstimateProvingTime(context.Background(), []string{"zzz"}, tree, pk, vk, ccs, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if none.Proofs != 0 || none.Total != 0 {
+		t.Fatalf("no pattern in the tree: %d proofs taking %v, want none", none.Proofs, none.Total)
+	}
+}
+
+// TestListVersion checks that a proof verifies against the version and commitment it was
+// made for, and that a newer version, with or without its own commitment, invalidates it
+func TestListVersion(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	proof, err := tree.GenerateProof("exa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := buildWitness("exa", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldVersion, newVersion := big.NewInt(1), big.NewInt(2)
+	oldCommitment, newCommitment := commitListVersion(tree.Root, oldVersion), commitListVersion(tree.Root, newVersion)
+	assignment := &VersionedRootCircuit{SubstringCircuit: leaf, ListVersion: oldVersion, ListCommitment: oldCommitment}
+
+	circuit := &VersionedRootCircuit{SubstringCircuit: SubstringCircuit{hash: tree.Hash, unusedLevels: tree.unusedLevels()}}
+	if err := test.IsSolved(circuit, assignment, fieldModulus); err != nil {
+		t.Fatalf("pattern rejected against its list version: %v", err)
+	}
+	forged := *assignment
+	forged.ListVersion = newVersion
+	if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+		t.Fatal("pattern accepted with a version its commitment does not hold")
+	}
+
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := frontend.NewWitness(assignment, fieldModulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groth16Proof, err := groth16.Prove(ccs, pk, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(version, commitment *big.Int) error {
+		public, err := frontend.NewWitness(&VersionedRootCircuit{
+			SubstringCircuit: SubstringCircuit{MerkleRoot: tree.Root},
+			ListVersion:      version,
+			ListCommitment:   commitment,
+		}, fieldModulus, frontend.PublicOnly())
+		if err != nil {
+			return err
+		}
+		return groth16.Verify(groth16Proof, vk, public)
+	}
+	if err := verify(oldVersion, oldCommitment); err != nil {
+		t.Fatalf("proof rejected against its own list version: %v", err)
+	}
+	if verify(newVersion, newCommitment) == nil {
+		t.Fatal("proof for version 1 verified against version 2")
+	}
+	if verify(newVersion, oldCommitment) == nil {
+		t.Fatal("proof for version 1 verified as version 2 under the old commitment")
+	}
+
+	// ProcessSubstrings proves and verifies the same circuit with ListVersion set
+	stats, err := ProcessSubstrings(context.Background(), []string{"exa", "zzz"}, tree, pk, vk, ccs, ProcessOptions{ListVersion: oldVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SuccessfulProofs != 1 || stats.FailedProofs != 0 {
+		t.Fatalf("processing with a list version: %d successful, %d failed proofs, want 1 and 0", stats.SuccessfulProofs, stats.FailedProofs)
+	}
+	if _, err := ProcessSubstrings(context.Background(), []string{"exa"}, tree, pk, vk, ccs, ProcessOptions{ListVersion: oldVersion, BatchVerify: true}); err == nil {
+		t.Fatal("list version accepted with batch verification")
+	}
+}
+
+// patternHashCircuit exposes the in-circuit pattern hash so it can be checked against computeHashOffCircuit
+type patternHashCircuit struct {
+	Str1   [maxStr1Len]frontend.Variable `gnark:"str1,secret"`
+	Length frontend.Variable             `gnark:"length,secret"`
+	Hash   frontend.Variable             `gnark:"hash,public"`
+}
+
+func (circuit *patternHashCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(hashPatternInCircuit(api, &hFunc, circuit.Str1[:], circuit.Length), circuit.Hash)
+	return nil
+}
+
+// unpackedHashCircuit absorbs one character per MiMC call, as leaf format 1 did; it is
+// only compiled to measure the saving of packing
+type unpackedHashCircuit struct {
+	Str1 [maxStr1Len]frontend.Variable `gnark:"str1,secret"`
+	Hash frontend.Variable             `gnark:"hash,public"`
+}
+
+func (circuit *unpackedHashCircuit) Define(api frontend.API) error {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	hFunc.Write(circuit.Str1[:]...)
+	api.AssertIsEqual(hFunc.Sum(), circuit.Hash)
+	return nil
+}
+
+// proverCase is an assignment for assertProver and whether it satisfies the circuit
+type proverCase struct {
+	name       string
+	assignment frontend.Circuit
+	valid      bool
+}
+
+// assertProver runs each case in its own subtest through gnark's test assertions on BN254
+// with Groth16, expecting ProverSucceeded for the valid ones and ProverFailed for the rest
+func assertProver(t *testing.T, circuit frontend.Circuit, cases []proverCase) {
+	assert := test.NewAssert(t)
+	for _, c := range cases {
+		assert.Run(func(assert *test.Assert) {
+			if c.valid {
+				assert.ProverSucceeded(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			} else {
+				assert.ProverFailed(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			}
+		}, c.name)
+	}
+}
+
+// TestMerkleCircuit checks that SubstringCircuit is satisfied by a valid proof of a
+// present pattern and unsatisfiable when an absent pattern reuses that proof, or when the
+// proof is tampered with
+func TestMerkleCircuit(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	proof, err := tree.GenerateProof("mple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every generated proof must reproduce the root off-circuit
+	for pattern := range tree.PatternToIndex {
+		other, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit(pattern, other); !ok {
+			t.Fatalf("proof for %q reaches root %s instead of %s", pattern, root, tree.Root)
+		}
+	}
+
+	present, err := buildWitness("mple", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Over-long patterns must be refused before any witness is built
+	tooLong := strings.Repeat("m", maxStr1Len+1)
+	if _, err := buildWitness(tooLong, proof, tree.Root); !errors.Is(err, ErrPatternTooLong) {
+		t.Fatalf("pattern of length %d: got %v, want %v", len(tooLong), err, ErrPatternTooLong)
+	}
+
+	absent, err := buildWitness("zzzz", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A right child's direction bit of 2 would still select it as the right child
+	rightLevel := slices.IndexFunc(proof.Dirs[:proof.Depth], func(d *big.Int) bool { return d.Sign() != 0 })
+	if rightLevel < 0 {
+		t.Fatal(`"mple" is a left child at every level`)
+	}
+
+	// A length that is not one of 0..maxProofLen must not turn into a partial level
+	var halfLength fr.Element
+	halfLength.SetInt64(int64(2*proof.Depth - 1))
+	halfLength.Halve()
+
+	tampered := []struct {
+		name   string
+		tamper func(w *SubstringCircuit)
+	}{
+		{"corrupted proof path", func(w *SubstringCircuit) { w.ProofPath[0] = new(big.Int).Add(proof.Path[0], big.NewInt(1)) }},
+		{"wrong root", func(w *SubstringCircuit) { w.MerkleRoot = new(big.Int).Add(tree.Root, big.NewInt(1)) }},
+		{"flipped direction bit", func(w *SubstringCircuit) { w.ProofPathDir[0] = 1 - proof.Dirs[0].Int64() }},
+		{"non-boolean direction bit", func(w *SubstringCircuit) { w.ProofPathDir[rightLevel] = 2 }},
+		{"sibling beyond proof length", func(w *SubstringCircuit) { w.ProofPath[proof.Depth] = 1 }},
+		{"direction beyond proof length", func(w *SubstringCircuit) { w.ProofPathDir[proof.Depth] = 1 }},
+		{"shortened proof length", func(w *SubstringCircuit) { w.ProofLength = proof.Depth - 1 }},
+		{"proof length beyond maxProofLen", func(w *SubstringCircuit) { w.ProofLength = maxProofLen + 1 }},
+		{"fractional proof length", func(w *SubstringCircuit) { w.ProofLength = halfLength }},
+		{"negative proof length", func(w *SubstringCircuit) { w.ProofLength = -1 }},
+	}
+	cases := []proverCase{{"present", &present, true}, {"absent", &absent, false}}
+	for _, c := range tampered {
+		w := present
+		c.tamper(&w)
+		cases = append(cases, proverCase{c.name, &w, false})
+	}
+	assertProver(t, &SubstringCircuit{}, cases)
+}
+
+// TestProofLengths checks SubstringCircuit against every leaf of trees with 2, 4 and 16
+// leaves, whose proofs use 1, 2 and 4 of the maxProofLen levels, and that a proof length
+// one level off in either direction is rejected
+func TestProofLengths(t *testing.T) {
+	for _, c := range []struct {
+		text   string
+		height int
+	}{{"ab", 1}, {"abcd", 2}, {"abcdefghijklmnop", 4}} {
+		text, height := c.text, c.height
+		tree := NewMerkleTree(text, 1)
+		if len(tree.PatternToIndex) != len(text) {
+			t.Fatalf("tree over %q has %d leaves, want %d", text, len(tree.PatternToIndex), len(text))
+		}
+		for pattern := range tree.PatternToIndex {
+			proof, err := tree.GenerateProof(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proof.Depth != height {
+				t.Fatalf("%d-leaf tree: proof for %q has %d levels, want %d", len(text), pattern, proof.Depth, height)
+			}
+			assignment, err := buildWitness(pattern, proof, tree.Root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+				t.Fatalf("%d-leaf tree: %q rejected: %v", len(text), pattern, err)
+			}
+			for _, length := range []int{height - 1, height + 1} {
+				assignment.ProofLength = length
+				if test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus) == nil {
+					t.Fatalf("%d-leaf tree: %q accepted with proof length %d", len(text), pattern, length)
+				}
+			}
+		}
+	}
+}
+
+// TestRequiredProofLen checks RequiredProofLen for 1, 2, 1000 and 1<<20 leaves and
+// against the proof lengths of small trees, and that SubstringCircuit sized to a
+// 1000-leaf tree accepts its proofs with fewer constraints but no value in unused levels
+func TestRequiredProofLen(t *testing.T) {
+	for numLeaves, want := range map[int]int{1: 0, 2: 1, 3: 2, 1000: 10, 1024: 10, 1025: 11, 1 << 20: 20} {
+		if got := RequiredProofLen(numLeaves); got != want {
+			t.Fatalf("RequiredProofLen(%d) = %d, want %d", numLeaves, got, want)
+		}
+	}
+	var patterns []string
+	for numLeaves := 1; numLeaves <= 17; numLeaves++ {
+		patterns = append(patterns, fmt.Sprintf("p%02d", numLeaves))
+		tree := NewMerkleTreeFromLeaves(patterns)
+		proof, err := tree.GenerateProof(patterns[numLeaves-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.Depth != RequiredProofLen(numLeaves) {
+			t.Fatalf("%d-leaf tree: proof of %d levels, RequiredProofLen says %d", numLeaves, proof.Depth, RequiredProofLen(numLeaves))
+		}
+	}
+
+	patterns = patterns[:0]
+	for i := range 1000 {
+		patterns = append(patterns, fmt.Sprintf("p%03d", i))
+	}
+	tree := NewMerkleTreeFromLeaves(patterns)
+	sized := &SubstringCircuit{unusedLevels: tree.unusedLevels()}
+	proof, err := tree.GenerateProof("p777")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := buildWitness("p777", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(sized, &assignment, fieldModulus); err != nil {
+		t.Fatalf("sized circuit rejects a 1000-leaf proof: %v", err)
+	}
+	assignment.ProofPath[maxProofLen-1] = 1
+	if test.IsSolved(sized, &assignment, fieldModulus) == nil {
+		t.Fatal("sized circuit accepts a value in a level above the tree")
+	}
+	full, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, sized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.GetNbConstraints() >= full.GetNbConstraints() {
+		t.Fatalf("sized circuit has %d constraints, the %d-level one %d", small.GetNbConstraints(), maxProofLen, full.GetNbConstraints())
+	}
+	logger.Info("Circuit sized to the tree", "leaves", len(tree.Leaves), "levels", RequiredProofLen(len(tree.Leaves)),
+		"constraints", small.GetNbConstraints(), "fullConstraints", full.GetNbConstraints())
+}
+
+// TestMerkleProofs checks that GenerateProof reports a missing pattern as
+// ErrPatternNotFound, and that the first and last leaves of a tree and the only leaf of a
+// single-leaf tree get proofs SubstringCircuit accepts
+func TestMerkleProofs(t *testing.T) {
+	tree := NewMerkleTreeFromLeaves([]string{"aaa", "bbb", "ccc", "ddd", "eee"})
+	if _, err := tree.GenerateProof("zzz"); !errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("missing pattern: got %v, want %v", err, ErrPatternNotFound)
+	}
+	if _, err := tree.proofForLeaf(5); err == nil || errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("leaf index past the tree: got %v, want an index error", err)
+	}
+
+	cases := []struct {
+		tree      *MerkleTree
+		pattern   string
+		leafIndex int
+		depth     int
+	}{
+		{tree, "aaa", 0, 3},
+		{tree, "eee", 4, 3},
+		{NewMerkleTreeFromLeaves([]string{"only"}), "only", 0, 0},
+	}
+	for _, c := range cases {
+		proof, err := c.tree.GenerateProof(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.LeafIndex != c.leafIndex || proof.Depth != c.depth {
+			t.Fatalf("%q: proof opens leaf %d at depth %d, want leaf %d at depth %d",
+				c.pattern, proof.LeafIndex, proof.Depth, c.leafIndex, c.depth)
+		}
+		for i, m := range proof.Mask {
+			want := 0
+			if i < c.depth {
+				want = 1
+			}
+			if m != want {
+				t.Fatalf("%q: mask level %d is %d, want %d", c.pattern, i, m, want)
+			}
+		}
+		if ok, root := c.tree.VerifyProofOffCircuit(c.pattern, proof); !ok {
+			t.Fatalf("%q: proof reaches root %s instead of %s", c.pattern, root, c.tree.Root)
+		}
+		assignment, err := buildWitness(c.pattern, proof, c.tree.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+			t.Fatalf("%q rejected: %v", c.pattern, err)
+		}
+	}
+}
+
+// TestVerifyPath checks that VerifyPath and SubstringCircuit agree on a valid proof and
+// on proofs with a corrupted sibling, a non-boolean direction or a sibling beyond the
+// proof's depth, and that ProcessSubstrings skips a pattern whose proof fails VerifyPath
+func TestVerifyPath(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	proof, err := tree.GenerateProof("mple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := computeHashOffCircuit("mple", tree.Hash)
+
+	cases := []struct {
+		name   string
+		tamper func(p *MerkleProof)
+		valid  bool
+	}{
+		{"valid proof", func(p *MerkleProof) {}, true},
+		{"corrupted sibling", func(p *MerkleProof) { p.Path[1] = new(big.Int).Add(p.Path[1], big.NewInt(1)) }, false},
+		{"non-boolean direction", func(p *MerkleProof) { p.Dirs[0] = big.NewInt(2) }, false},
+		{"sibling beyond depth", func(p *MerkleProof) { p.Path[p.Depth] = big.NewInt(1) }, false},
+	}
+	for _, c := range cases {
+		p := *proof
+		c.tamper(&p)
+		if got := tree.VerifyPath(&p, leaf); got != c.valid {
+			t.Fatalf("%s: VerifyPath = %t, want %t", c.name, got, c.valid)
+		}
+		assignment, err := buildWitness("mple", &p, tree.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// buildWitness drops levels beyond Depth; put them back for the circuit to see
+		for i := range p.Path {
+			assignment.ProofPath[i], assignment.ProofPathDir[i] = p.Path[i], p.Dirs[i]
+		}
+		if solved := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus) == nil; solved != c.valid {
+			t.Fatalf("%s: circuit satisfied = %t, VerifyPath = %t", c.name, solved, c.valid)
+		}
+	}
+	if tree.VerifyPath(proof, computeHashOffCircuit("exam", tree.Hash)) {
+		t.Fatal(`proof for "mple" accepted for the leaf of "exam"`)
+	}
+
+	// A tree whose stored sibling is wrong hands out a bad proof, which must be skipped
+	// without reaching the prover: no keys are passed, so proving would fail differently
+	index := tree.PatternToIndex["mple"][0]
+	tree.Nodes[0][index^1] = big.NewInt(1)
+	stats, err := ProcessSubstrings(context.Background(), []string{"mple"}, tree, nil, nil, nil, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BadProofPaths != 1 || stats.FailedProofs != 0 || !errors.Is(stats.Results[0].Err, ErrBadProofPath) {
+		t.Fatalf("bad proof: %d bad paths, %d failed, err %v; want 1, 0, %v",
+			stats.BadProofPaths, stats.FailedProofs, stats.Results[0].Err, ErrBadProofPath)
+	}
+}
+
+// TestDuplicatePatterns builds a tree where "abc" is at leaves 0 and 2, proves both
+// occurrences, and checks that Save and LoadMerkleTree keep both leaf indices and that
+// RemovePatterns tombstones both leaves
+func TestDuplicatePatterns(t *testing.T) {
+	tree := NewMerkleTreeFromLeaves([]string{"abc", "xyz", "abc", "mno"})
+	if got := tree.PatternToIndex["abc"]; !slices.Equal(got, []int{0, 2}) {
+		t.Fatalf(`"abc" is at leaves %v, want [0 2]`, got)
+	}
+	var leaves []int
+	for occurrence := range 2 {
+		proof, err := tree.GenerateOccurrenceProof("abc", occurrence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit("abc", proof); !ok {
+			t.Fatalf("occurrence %d reaches root %s instead of %s", occurrence, root, tree.Root)
+		}
+		assignment, err := buildWitness("abc", proof, tree.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+			t.Fatalf("occurrence %d rejected: %v", occurrence, err)
+		}
+		leaves = append(leaves, proof.LeafIndex)
+	}
+	if !slices.Equal(leaves, []int{0, 2}) {
+		t.Fatalf("occurrences opened leaves %v, want [0 2]", leaves)
+	}
+	if _, err := tree.GenerateOccurrenceProof("abc", 2); !errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("third occurrence: got %v, want %v", err, ErrPatternNotFound)
+	}
+
+	dir, err := os.MkdirTemp("", "duplicate-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tree.bin")
+	if err := tree.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(filename, tree.SourceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.PatternToIndex, tree.PatternToIndex) {
+		t.Fatalf("loaded leaf indices %v, want %v", loaded.PatternToIndex, tree.PatternToIndex)
+	}
+
+	if _, err := tree.RemovePatterns([]string{"abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Leaves[0].Sign() != 0 || tree.Leaves[2].Sign() != 0 {
+		t.Fatal("removing a repeated pattern left one of its leaves")
+	}
+}
+
+// TestInsert inserts a pattern into trees of 1 to 9 leaves and checks that the root and
+// every level match a tree rebuilt from all the leaves, including when the new leaf makes
+// the tree taller (4 to 5 leaves), that the new leaf proves to the new root and that
+// inserting an existing pattern is refused
+func TestInsert(t *testing.T) {
+	patterns := make([]string, 10)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("leaf%d.example", i)
+	}
+	for n := 1; n < len(patterns); n++ {
+		tree := NewMerkleTreeFromLeaves(patterns[:n])
+		height := tree.Height()
+		if err := tree.Insert(patterns[n]); err != nil {
+			t.Fatal(err)
+		}
+		rebuilt := NewMerkleTreeFromLeaves(patterns[:n+1])
+		if tree.Root.Cmp(rebuilt.Root) != 0 {
+			t.Fatalf("%d leaves plus one: root differs from rebuilding all %d", n, n+1)
+		}
+		if tree.Height() != rebuilt.Height() {
+			t.Fatalf("%d leaves plus one: height %d, rebuilt %d", n, tree.Height(), rebuilt.Height())
+		}
+		for level := range rebuilt.Nodes {
+			if !slices.EqualFunc(tree.Nodes[level], rebuilt.Nodes[level], func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+				t.Fatalf("%d leaves plus one: level %d differs from the rebuilt tree", n, level)
+			}
+		}
+		if n == 4 && (height != 2 || tree.Height() != 3) {
+			t.Fatalf("inserting a fifth leaf grew the height from %d to %d, want 2 to 3", height, tree.Height())
+		}
+		proof, err := tree.GenerateProof(patterns[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := tree.VerifyProofOffCircuit(patterns[n], proof); !ok || proof.LeafIndex != n {
+			t.Fatalf("inserted leaf %d does not prove to the new root", n)
+		}
+	}
+	tree := NewMerkleTreeFromLeaves(patterns[:4])
+	if err := tree.Insert(patterns[0]); !errors.Is(err, ErrPatternExists) {
+		t.Fatalf("inserting an existing pattern: got %v, want %v", err, ErrPatternExists)
+	}
+}
+
+// TestIncrementalUpdates adds patterns to a tree, removes some and adds more again,
+// including a removed one, and after each step checks that the root and every level kept
+// up by recomputePath equal buildLevels over the same leaves, removed ones as zero, and
+// that the remaining patterns prove to the new root
+func TestIncrementalUpdates(t *testing.T) {
+	tree := NewMerkleTreeFromLeaves([]string{"a.example", "b.example", "c.example", "d.example", "e.example", "f.example"})
+	steps := []struct {
+		add, remove []string
+	}{
+		{add: []string{"g.example", "h.example", "i.example", "j.example", "k.example"}},
+		{remove: []string{"a.example", "h.example", "k.example"}},
+		{add: []string{"l.example", "h.example", "m.example"}},
+		{remove: []string{"absent.example", "l.example"}, add: []string{"a.example", "b.example"}},
+	}
+	for step, s := range steps {
+		if _, err := tree.RemovePatterns(s.remove); err != nil {
+			t.Fatal(err)
+		}
+		root, err := tree.AddPatterns(s.add)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebuilt := &MerkleTree{Leaves: slices.Clone(tree.Leaves), Hash: tree.Hash}
+		rebuilt.buildLevels()
+		if root.Cmp(rebuilt.Root) != 0 || tree.Root.Cmp(rebuilt.Root) != 0 {
+			t.Fatalf("step %d: root differs from buildLevels over the same %d leaves", step, len(tree.Leaves))
+		}
+		if len(tree.Nodes) != len(rebuilt.Nodes) {
+			t.Fatalf("step %d: %d levels, rebuilt %d", step, len(tree.Nodes), len(rebuilt.Nodes))
+		}
+		for level := range rebuilt.Nodes {
+			if !slices.EqualFunc(tree.Nodes[level], rebuilt.Nodes[level], func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+				t.Fatalf("step %d: level %d differs from the rebuilt tree", step, level)
+			}
+		}
+		for _, pattern := range s.remove {
+			if _, err := tree.GenerateProof(pattern); !errors.Is(err, ErrPatternNotFound) {
+				t.Fatalf("step %d: removed %q: got %v, want %v", step, pattern, err, ErrPatternNotFound)
+			}
+		}
+		for pattern := range tree.PatternToIndex {
+			proof, err := tree.GenerateProof(pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, _ := tree.VerifyProofOffCircuit(pattern, proof); !ok {
+				t.Fatalf("step %d: %q does not prove to the new root", step, pattern)
+			}
+		}
+	}
+	if len(tree.Leaves) != 15 || len(tree.PatternToIndex) != 11 {
+		t.Fatalf("%d leaves for %d patterns, want 15 for 11", len(tree.Leaves), len(tree.PatternToIndex))
+	}
+}
+
+// sameMerkleProof reports whether two proofs open the same leaf with the same siblings
+// and directions over the same depth
+func sameMerkleProof(a, b *MerkleProof) bool {
+	equal := func(x, y *big.Int) bool { return x.Cmp(y) == 0 }
+	return a.LeafIndex == b.LeafIndex && a.Depth == b.Depth && a.Mask == b.Mask &&
+		slices.EqualFunc(a.Path[:], b.Path[:], equal) && slices.EqualFunc(a.Dirs[:], b.Dirs[:], equal)
+}
+
+// TestTreeRoundTrip checks that a tree saved and loaded again has the same Root, leaves
+// and PatternToIndex as the freshly built one and gives identical proofs for every
+// pattern, one of which SubstringCircuit accepts against the loaded root, and that a
+// tree file is refused for another source hash
+func TestTreeRoundTrip(t *testing.T) {
+	text := buildSuperString([]string{"www.example.com", "mail.example.org", "cdn.example.co.uk"}, maxStr2Len)
+	tree := NewMerkleTree(text, 8)
+	dir, err := os.MkdirTemp("", "tree-round-trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tree.bin")
+	if err := tree.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(filename, tree.SourceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Root.Cmp(tree.Root) != 0 || loaded.Hash != tree.Hash || loaded.SourceHash != tree.SourceHash {
+		t.Fatal("loaded tree has another root, hash function or source hash")
+	}
+	if !slices.EqualFunc(loaded.Leaves, tree.Leaves, func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+		t.Fatal("loaded tree has other leaves")
+	}
+	if !reflect.DeepEqual(loaded.PatternToIndex, tree.PatternToIndex) {
+		t.Fatalf("loaded tree indexes %d patterns differently from the %d built", len(loaded.PatternToIndex), len(tree.PatternToIndex))
+	}
+	for pattern := range tree.PatternToIndex {
+		want, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loaded.GenerateProof(pattern)
+		if err != nil {
+			t.Fatalf("loaded tree: %v", err)
+		}
+		if !sameMerkleProof(got, want) {
+			t.Fatalf("%q: loaded tree gives another proof", pattern)
+		}
+	}
+	proof, err := loaded.GenerateProof("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := buildWitness("example", proof, loaded.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+		t.Fatalf("proof from the loaded tree rejected: %v", err)
+	}
+	if _, err := LoadMerkleTree(filename, NewMerkleTree(text, 7).SourceHash); !errors.Is(err, ErrStaleTree) {
+		t.Fatalf("tree for maxPatternLen 8 loaded for 7: got %v, want %v", err, ErrStaleTree)
+	}
+
+	// The hash byte follows the magic and the source hash; a file naming a hash with no
+	// hasher is refused rather than loaded
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []HashFunc{HashPoseidon2, HashPedersen + 1, 255} {
+		data[len(treeFileMagic)+len(tree.SourceHash)] = byte(h)
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadMerkleTree(filename, tree.SourceHash); !errors.Is(err, ErrUnsupportedHash) {
+			t.Fatalf("tree file with hash byte %d: got %v, want %v", uint8(h), err, ErrUnsupportedHash)
+		}
+	}
+}
+
+// TestCircuitStats compiles SubstringCircuit twice while counting its breakdown, and
+// checks that the counts are non-zero, identical across compiles and within the total,
+// and that the stats JSON carries them
+func TestCircuitStats(t *testing.T) {
+	var sizes [2]circuitSize
+	var breakdowns [2]constraintBreakdown
+	for i := range sizes {
+		ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{breakdown: &breakdowns[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = sizeOf(ccs)
+	}
+	size, breakdown := sizes[0], breakdowns[0]
+	if sizes[1] != size || breakdowns[1] != breakdown {
+		t.Fatalf("recompiling changed %+v %+v to %+v %+v", size, breakdown, sizes[1], breakdowns[1])
+	}
+	if size.NbConstraints == 0 || size.NbPublic == 0 || size.NbSecret == 0 || size.NbInternal == 0 ||
+		breakdown.PatternHash == 0 || breakdown.ProofPath == 0 {
+		t.Fatalf("zero count in %+v %+v", size, breakdown)
+	}
+	if breakdown.PatternHash+breakdown.ProofPath > size.NbConstraints {
+		t.Fatalf("breakdown %+v exceeds %d constraints", breakdown, size.NbConstraints)
+	}
+
+	raw, err := json.Marshal(ProcessingStats{Circuit: size, Breakdown: &breakdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Circuit circuitStatsJSON `json:"circuit"`
+	}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	want := circuitStatsJSON{size.NbConstraints, size.NbPublic, size.NbSecret, size.NbInternal,
+		size.EstimatedProverBytes(), breakdown.PatternHash, breakdown.ProofPath}
+	if decoded.Circuit != want || want.EstimatedProverBytes == 0 {
+		t.Fatalf("stats JSON has circuit %+v, want %+v", decoded.Circuit, want)
+	}
+}
+
+// TestMultiPatternCircuit checks that a padded batch of present patterns is accepted and
+// that the whole batch fails when one of its patterns is absent
+func TestMultiPatternCircuit(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	const batchSize = 4
+	assignment, err := buildBatchWitness(tree, []string{"mple", "exa", "com"}, batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(newMultiPatternCircuit(batchSize, HashMiMC), assignment, fieldModulus); err != nil {
+		t.Fatalf("batch of present patterns rejected: %v", err)
+	}
+
+	if _, err := buildBatchWitness(tree, []string{"mple", "zzzz"}, batchSize); !errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("batch with an absent pattern: got %v, want %v", err, ErrPatternNotFound)
+	}
+	// Swap an absent pattern into the batch, keeping the present pattern's opening
+	assignment.Proofs[1].Str1 = patternToStr1("zzz")
+	if test.IsSolved(newMultiPatternCircuit(batchSize, HashMiMC), assignment, fieldModulus) == nil {
+		t.Fatal("batch with an absent pattern accepted")
+	}
+}
+
+// TestSparseCircuit checks that NonMembershipCircuit accepts an absent pattern and
+// rejects a present one opened as if its leaf were empty
+func TestSparseCircuit(t *testing.T) {
+	tree := NewSparseMerkleTree([]string{"example.com", "example.org", "test"})
+
+	siblings, err := tree.GenerateNonMembershipProof("absent.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	absent := NonMembershipCircuit{Str1: patternToStr1("absent.net"), Length: patternLength("absent.net"), Root: tree.Root}
+	for i := range siblings {
+		absent.Siblings[i] = siblings[i]
+	}
+	if err := test.IsSolved(&NonMembershipCircuit{}, &absent, fieldModulus); err != nil {
+		t.Fatalf("absent pattern rejected: %v", err)
+	}
+
+	if _, err := tree.GenerateNonMembershipProof("test"); !errors.Is(err, ErrPatternPresent) {
+		t.Fatalf("non-membership proof generated for a present pattern")
+	}
+	forged := NonMembershipCircuit{Str1: patternToStr1("test"), Length: patternLength("test"), Root: tree.Root}
+	siblings = tree.siblings(smtKey(computeHashOffCircuit("test", HashMiMC)))
+	for i := range siblings {
+		forged.Siblings[i] = siblings[i]
+	}
+	if test.IsSolved(&NonMembershipCircuit{}, &forged, fieldModulus) == nil {
+		t.Fatal("present pattern accepted as absent")
+	}
+}
+
+// TestNonInclusionCircuit checks NonInclusionCircuit for patterns below the first leaf,
+// between two leaves and above the last leaf, and that a present pattern is rejected
+func TestNonInclusionCircuit(t *testing.T) {
+	tree := NewMerkleTree("example.com", 3)
+	for _, pattern := range []string{"-", "exz", "zzz"} {
+		assignment, err := tree.GenerateNonInclusionProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.IsSolved(&NonInclusionCircuit{}, assignment, fieldModulus); err != nil {
+			t.Fatalf("absent pattern %q rejected: %v", pattern, err)
+		}
+	}
+
+	// Reuse the neighbours of "exz" but claim a pattern equal to one of them
+	forged, err := tree.GenerateNonInclusionProof("exz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Str1 = forged.Low
+	if test.IsSolved(&NonInclusionCircuit{}, forged, fieldModulus) == nil {
+		t.Fatal("present pattern accepted as absent")
+	}
+}
+
+// TestUnicodePatterns checks multi-byte patterns end to end: the tree holds substrings
+// that never split a rune and fit maxPatternLen in bytes, multi-byte patterns present in
+// the text prove both off-circuit and in SubstringCircuit, an absent one proves absent,
+// and a Str1 holding a code point instead of its UTF-8 bytes is rejected
+func TestUnicodePatterns(t *testing.T) {
+	charset, err := ParseCharset(`regexp:[\p{L}\p{N}./-]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := NewMerkleTree("bücher.de/日本", 10, WithCharset(charset))
+	for pattern := range tree.PatternToIndex {
+		if !utf8.ValidString(pattern) || len(pattern) > 10 {
+			t.Fatalf("tree holds %q, which splits a rune or exceeds 10 bytes", pattern)
+		}
+	}
+	for _, absent := range []string{"bücher.de/", "e.de/日本"} {
+		if _, ok := tree.PatternToIndex[absent]; ok {
+			t.Fatalf("tree holds %q, longer than 10 bytes", absent)
+		}
+	}
+
+	for _, pattern := range []string{"bücher.de", "ü", "日本", "e/日"} {
+		proof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit(pattern, proof); !ok {
+			t.Fatalf("%q: proof reaches root %s instead of %s", pattern, root, tree.Root)
+		}
+		assignment, err := buildWitness(pattern, proof, tree.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assignment.Length != len(pattern) {
+			t.Fatalf("%q: length %v, want its %d bytes", pattern, assignment.Length, len(pattern))
+		}
+		if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+			t.Fatalf("%q rejected: %v", pattern, err)
+		}
+	}
+
+	absent, err := tree.GenerateNonInclusionProof("日本語")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(&NonInclusionCircuit{}, absent, fieldModulus); err != nil {
+		t.Fatalf("absent pattern \"日本語\" rejected: %v", err)
+	}
+	// A code point in a single element instead of its UTF-8 bytes is out of range
+	absent.Str1 = patternToStr1("本")
+	absent.Str1[0] = uint64('日')
+	if test.IsSolved(&NonInclusionCircuit{}, absent, fieldModulus) == nil {
+		t.Fatal("code point accepted as a Str1 character")
+	}
+}
+
+// rfc6962Vectors are the leaves and roots of every prefix of the reference tree used by the
+// Certificate Transparency implementations
+var (
+	rfc6962VectorLeaves = []string{
+		"", "\x00", "\x10", "\x20\x21", "\x30\x31", "\x40\x41\x42\x43",
+		"\x50\x51\x52\x53\x54\x55\x56\x57",
+		"\x60\x61\x62\x63\x64\x65\x66\x67\x68\x69\x6a\x6b\x6c\x6d\x6e\x6f",
+	}
+	rfc6962VectorRoots = []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+)
+
+// TestRFC6962 checks NewRFC6962Tree against the reference roots, then RFC6962Circuit
+// against an unbalanced tree for a present leaf and a forged one
+func TestRFC6962(t *testing.T) {
+	for n, want := range rfc6962VectorRoots {
+		tree := NewRFC6962Tree(rfc6962VectorLeaves[:n+1])
+		if got := hex.EncodeToString(tree.Root[:]); got != want {
+			t.Fatalf("root of the first %d leaves is %s, want %s", n+1, got, want)
+		}
+	}
+
+	tree := NewRFC6962Tree(rfc6962VectorLeaves[:7])
+	assignment, err := tree.GenerateWitness(rfc6962VectorLeaves[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(&RFC6962Circuit{}, assignment, fieldModulus); err != nil {
+		t.Fatalf("present leaf rejected: %v", err)
+	}
+	assignment.Leaf[0] = uints.NewU8(0x41)
+	if test.IsSolved(&RFC6962Circuit{}, assignment, fieldModulus) == nil {
+		t.Fatal("altered leaf accepted")
+	}
+}
+
+// TestPacking checks that packPattern maps distinct patterns to distinct elements,
+// including patterns that only differ across a chunk boundary, and that packing cuts the
+// constraints of the pattern hash
+func TestPacking(t *testing.T) {
+	patterns := []string{strings.Repeat("a", charsPerElement), strings.Repeat("a", charsPerElement+1),
+		strings.Repeat("a", charsPerElement-1) + "b", strings.Repeat("a", charsPerElement) + "b"}
+	for substr := range NewMerkleTree("ab-c.example.com", 6).PatternToIndex {
+		patterns = append(patterns, substr)
+	}
+	seen := make(map[string]string, len(patterns))
+	for _, pattern := range patterns {
+		var key strings.Builder
+		for _, val := range packPattern(pattern) {
+			key.WriteString(val.Text(16) + "/")
+		}
+		if other, dup := seen[key.String()]; dup && other != pattern {
+			t.Fatalf("%q and %q pack to the same elements", other, pattern)
+		}
+		seen[key.String()] = pattern
+	}
+
+	packed, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &patternHashCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpacked, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &unpackedHashCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Pattern hash constraints", "packed", packed.GetNbConstraints(), "unpacked", unpacked.GetNbConstraints())
+	if packed.GetNbConstraints() >= unpacked.GetNbConstraints() {
+		t.Fatal("packing does not reduce the pattern hash constraints")
+	}
+}
+
+// TestHashSelection checks that SubstringCircuit refuses to compile for a hash function
+// it has no gadget for, rather than silently falling back to MiMC, and that in-circuit and
+// off-circuit SHA-256 agree on the root of a small tree
+func TestHashSelection(t *testing.T) {
+	_, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: HashPoseidon2})
+	if !errors.Is(err, ErrUnsupportedHash) {
+		t.Fatalf("compiling for %s: got %v, want %v", HashPoseidon2, err, ErrUnsupportedHash)
+	}
+
+	// The SHA-256 tree must differ from the MiMC one and its root must be reproduced
+	// both by every off-circuit proof and by the circuit
+	tree := NewMerkleTree("example.com", 4, WithHash(HashSHA256))
+	mimcRoot := NewMerkleTree("example.com", 4).Root
+	if tree.Root.Cmp(mimcRoot) == 0 {
+		t.Fatal("SHA-256 and MiMC trees have the same root")
+	}
+	if tree.Root.Cmp(fieldModulus) >= 0 {
+		t.Fatal("SHA-256 root is not reduced into the field")
+	}
+	for pattern := range tree.PatternToIndex {
+		proof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit(pattern, proof); !ok {
+			t.Fatalf("SHA-256 proof for %q reaches root %s instead of %s", pattern, root, tree.Root)
+		}
+	}
+	proof, err := tree.GenerateProof("mple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := buildWitness("mple", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuit := &SubstringCircuit{hash: HashSHA256}
+	if err := test.IsSolved(circuit, &assignment, fieldModulus); err != nil {
+		t.Fatalf("SHA-256 circuit rejects the off-circuit root: %v", err)
+	}
+	assignment.MerkleRoot = mimcRoot
+	if test.IsSolved(circuit, &assignment, fieldModulus) == nil {
+		t.Fatal("SHA-256 circuit accepts the MiMC root")
+	}
+}
+
+// TestPedersen checks the Pedersen generators, that the element count keeps a trailing
+// zero from colliding, that non-canonical input is refused, and that a Pedersen tree's
+// proofs verify both off-circuit and in SubstringCircuit, which rejects the MiMC root
+func TestPedersen(t *testing.T) {
+	pedersenOnce.Do(pedersenSetup)
+	params := edbn254.GetEdwardsCurve()
+	for i, g := range pedersenGens {
+		var check edbn254.PointAffine
+		check.ScalarMultiplication(&g, &params.Order)
+		if !g.IsOnCurve() || g.IsZero() || !check.IsZero() {
+			t.Fatalf("generator %d is not a point of the prime-order subgroup", i)
+		}
+	}
+
+	var one fr.Element
+	one.SetOne()
+	if a, b := pedersenHash([]fr.Element{one}), pedersenHash([]fr.Element{one, {}}); a.Equal(&b) {
+		t.Fatal("appending a zero element does not change the Pedersen digest")
+	}
+	modulusBytes := make([]byte, fr.Bytes)
+	fieldModulus.FillBytes(modulusBytes)
+	if _, err := mustOffCircuitHasher(HashPedersen).Write(modulusBytes); err == nil {
+		t.Fatal("Pedersen hasher accepts the field modulus as an element")
+	}
+
+	tree := NewMerkleTree("example.com", 4, WithHash(HashPedersen))
+	mimcRoot := NewMerkleTree("example.com", 4).Root
+	if tree.Root.Cmp(mimcRoot) == 0 {
+		t.Fatal("Pedersen and MiMC trees have the same root")
+	}
+	for pattern := range tree.PatternToIndex {
+		proof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit(pattern, proof); !ok {
+			t.Fatalf("Pedersen proof for %q reaches root %s instead of %s", pattern, root, tree.Root)
+		}
+	}
+	proof, err := tree.GenerateProof("exam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := buildWitness("exam", proof, tree.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuit := &SubstringCircuit{hash: HashPedersen}
+	if err := test.IsSolved(circuit, &assignment, fieldModulus); err != nil {
+		t.Fatalf("Pedersen circuit rejects the off-circuit root: %v", err)
+	}
+	assignment.MerkleRoot = mimcRoot
+	if test.IsSolved(circuit, &assignment, fieldModulus) == nil {
+		t.Fatal("Pedersen circuit accepts the MiMC root")
+	}
+}
+
+// TestHashConsistency verifies that the in-circuit and off-circuit pattern hashes agree
+// for a single character, a maximum-length pattern and a zero-padded pattern, and that a
+// pattern padded with NUL characters no longer collides with the original
+func TestHashConsistency(t *testing.T) {
+	patterns := []string{"a", strings.Repeat("z", maxStr1Len), "example.com",
+		strings.Repeat("y", charsPerElement), strings.Repeat("x", charsPerElement+1)}
+	for _, pattern := range patterns {
+		assignment := patternHashCircuit{
+			Str1:   patternToStr1(pattern),
+			Length: patternLength(pattern),
+			Hash:   computeHashOffCircuit(pattern, HashMiMC),
+		}
+		if err := test.IsSolved(&patternHashCircuit{}, &assignment, fieldModulus); err != nil {
+			t.Fatalf("hash mismatch for %q (length %d): %v", pattern, len(pattern), err)
+		}
+	}
+
+	// Zero padding used to make "abc" and "abc\x00" collide; the length prefix separates
+	// them and the circuit refuses a length that disagrees with the padding
+	if computeHashOffCircuit("abc", HashMiMC).Cmp(computeHashOffCircuit("abc\x00", HashMiMC)) == 0 {
+		t.Fatal(`"abc" and "abc\x00" hash identically`)
+	}
+	forgeries := []patternHashCircuit{
+		{Str1: patternToStr1("abc"), Length: 4, Hash: computeHashOffCircuit("abc\x00", HashMiMC)},
+		{Str1: patternToStr1("abc"), Length: 3, Hash: computeHashOffCircuit("abc\x00", HashMiMC)},
+		{Str1: patternToStr1("abc\x00"), Length: 4, Hash: computeHashOffCircuit("abc\x00", HashMiMC)},
+	}
+	for _, forged := range forgeries {
+		if test.IsSolved(&patternHashCircuit{}, &forged, fieldModulus) == nil {
+			t.Fatalf("padded pattern accepted with length %v", forged.Length)
+		}
+	}
+}
+
+// TestTextIndex checks TextIndex against strings.Contains over random texts and
+// patterns, that ProcessSubstrings reports patterns missing from the text without the
+// tree or keys, and that a queried tree holds exactly the queried leaves a full tree has
+func TestTextIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []byte("ab.-\x01")
+	randomString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return string(b)
+	}
+	for round := 0; round < 50; round++ {
+		text := randomString(rng.Intn(200))
+		index := NewTextIndex([]byte(text))
+		for q := 0; q < 100; q++ {
+			var pattern string
+			if q%2 == 0 && len(text) > 0 {
+				start := rng.Intn(len(text))
+				pattern = text[start:min(len(text), start+1+rng.Intn(8))]
+			} else {
+				pattern = randomString(rng.Intn(8))
+			}
+			if got, want := index.Contains(pattern), strings.Contains(text, pattern); got != want {
+				t.Fatalf("Contains(%q) in %q = %t, strings.Contains says %t", pattern, text, got, want)
+			}
+		}
+	}
+
+	// Missing patterns never reach the tree, so a nil tree lookup or missing keys cannot matter
+	text := buildSuperString([]string{"www.example.com", "mail.example.org"}, maxStr2Len)
+	tree := NewMerkleTree(text, 8)
+	index := NewTextIndex([]byte(text))
+	start := time.Now()
+	stats, err := ProcessSubstrings(context.Background(), []string{"absent", "example.net", "comm"}, tree, nil, nil, nil,
+		ProcessOptions{TextIndex: index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NotFoundPatterns != 3 || stats.ProcessedPatterns != 3 {
+		t.Fatalf("%d of %d patterns not found, want all 3", stats.NotFoundPatterns, stats.ProcessedPatterns)
+	}
+	logger.Debug("Reported missing patterns from the text index", "count", 3, "elapsed", time.Since(start))
+
+	// "mail.example.org" occurs but is longer than the tree's 8 bytes; "ple.c" spans no separator
+	queried := []string{"example", "EXAMPLE", "ple.c", "absent", "mail.example.org", "ple.c", ""}
+	restricted, err := NewQueriedMerkleTree(queried, index, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restricted.patternsByIndex(); !slices.Equal(got, []string{"example", "ple.c"}) {
+		t.Fatalf("queried tree holds %q, want example and ple.c", got)
+	}
+	for _, pattern := range []string{"example", "ple.c"} {
+		if _, ok := tree.PatternToIndex[pattern]; !ok {
+			t.Fatalf("queried leaf %q is not in the full tree", pattern)
+		}
+		proof, err := restricted.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !restricted.VerifyPath(proof, computeHashOffCircuit(pattern, restricted.Hash)) {
+			t.Fatalf("queried tree proof for %q does not verify", pattern)
+		}
+	}
+	if _, err := NewQueriedMerkleTree([]string{"absent"}, index, 8); err == nil {
+		t.Fatal("queried tree built with no pattern in the text")
+	}
+	if _, err := NewQueriedMerkleTree(queried, index, 8, WithLeafMode(LeafLabels)); err == nil {
+		t.Fatal("queried tree built in a label mode")
+	}
+}
+
+// TestBloomFilter checks that a filter over every leaf of a tree has no false negatives,
+// that its false-positive rate and size are near what it was sized for, that it survives
+// a save and load tied to the tree, and that GenerateProof consults it
+func TestBloomFilter(t *testing.T) {
+	text := buildSuperString([]string{"www.example.com", "mail.example.org", "login.test-site.net",
+		"cdn.assets.example.co.uk", "api.service.internal"}, maxStr2Len)
+	tree := NewMerkleTree(text, 16)
+	const fpRate = 0.01
+	bf, err := newTreeBloomFilter(tree, fpRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pattern := range tree.PatternToIndex {
+		if !bf.MayContain(pattern) {
+			t.Fatalf("false negative for %q", pattern)
+		}
+	}
+	falsePositives, trials := 0, 20000
+	for i := 0; i < trials; i++ {
+		absent := fmt.Sprintf("absent-%d", i)
+		if bf.MayContain(absent) {
+			falsePositives++
+		}
+	}
+	measured := float64(falsePositives) / float64(trials)
+	bitsPerPattern := float64(bf.SizeBytes()*8) / float64(len(tree.PatternToIndex))
+	logger.Debug("Bloom filter size", "patterns", len(tree.PatternToIndex), "bytes", bf.SizeBytes(),
+		"bitsPerPattern", bitsPerPattern, "hashes", bf.hashes, "falsePositiveRate", measured)
+	if measured > 3*fpRate {
+		t.Fatalf("false-positive rate %.4f, sized for %.2f", measured, fpRate)
+	}
+	// -ln(0.01)/ln(2)^2 is 9.59 bits per pattern, plus rounding up to a whole word
+	if bitsPerPattern < 9.5 || bitsPerPattern > 10 {
+		t.Fatalf("%.2f bits per pattern, want about 9.6", bitsPerPattern)
+	}
+	if _, err := NewBloomFilter(10, 1); err == nil {
+		t.Fatal("false-positive rate of 1 accepted")
+	}
+
+	dir, err := os.MkdirTemp("", "bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	treeFile := filepath.Join(dir, "tree.bin")
+	if _, err := loadOrBuildBloomFilter(treeFile, tree, fpRate); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBloomFilter(bloomFilterPath(treeFile), tree.SourceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded.words, bf.words) || loaded.hashes != bf.hashes || loaded.fpRate != fpRate {
+		t.Fatal("saved Bloom filter read back differently")
+	}
+	if _, err := LoadBloomFilter(bloomFilterPath(treeFile), NewMerkleTree("example.com", 4).SourceHash); !errors.Is(err, ErrStaleTree) {
+		t.Fatalf("filter for another tree loaded as %v, want %v", err, ErrStaleTree)
+	}
+
+	// GenerateProof answers through the filter, and inserted patterns are added to it
+	tree.bloom = loaded
+	if _, err := tree.GenerateProof("example"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.GenerateProof("absent-0"); !errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("absent pattern: got %v, want %v", err, ErrPatternNotFound)
+	}
+	if err := tree.Insert("inserted.example"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.GenerateProof("inserted.example"); err != nil {
+		t.Fatalf("inserted pattern: %v", err)
+	}
+}
+
+// parallelHashBenchLeaves is the number of leaves BenchmarkParallelHashing hashes
+const parallelHashBenchLeaves = 20000
+
+// benchPatterns returns n distinct patterns to hash
+func benchPatterns(n int) []string {
+	patterns := make([]string, n)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("p%d.example", i)
+	}
+	return patterns
+}
+
+// TestParallelHashing checks that hashLeaves gives the leaves and root of the sequential
+// path on any number of workers, for leaf counts that do not divide evenly among them
+func TestParallelHashing(t *testing.T) {
+	patterns := benchPatterns(1001)
+	for _, h := range []HashFunc{HashMiMC, HashSHA256} {
+		for _, n := range []int{0, 1, 5, 97, 1001} {
+			sequential := hashLeaves(patterns[:n], h, 1)
+			for _, workers := range []int{2, 3, 4, 7, runtime.NumCPU()} {
+				leaves := hashLeaves(patterns[:n], h, workers)
+				if !slices.EqualFunc(leaves, sequential, func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+					t.Fatalf("%s, %d leaves on %d workers: leaves differ from the sequential path", h, n, workers)
+				}
+				if n == 0 {
+					continue
+				}
+				want := &MerkleTree{Leaves: sequential, Hash: h}
+				want.buildLevels()
+				got := &MerkleTree{Leaves: leaves, Hash: h}
+				got.buildLevels()
+				if got.Root.Cmp(want.Root) != 0 {
+					t.Fatalf("%s, %d leaves on %d workers: root differs from the sequential path", h, n, workers)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkParallelHashing hashes parallelHashBenchLeaves leaves with MiMC on 1 worker
+// and on one per CPU, at least 2
+func BenchmarkParallelHashing(b *testing.B) {
+	patterns := benchPatterns(parallelHashBenchLeaves)
+	for _, workers := range []int{1, max(runtime.NumCPU(), 2)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hashLeaves(patterns, HashMiMC, workers)
+			}
+		})
+	}
+}
+
+// nodeHashCircuit hashes two elements with newCircuitHasher, so hashFieldElements can be
+// checked against the circuit's node hash
+type nodeHashCircuit struct {
+	Left   frontend.Variable `gnark:"left,secret"`
+	Right  frontend.Variable `gnark:"right,secret"`
+	Parent frontend.Variable `gnark:"parent,public"`
+
+	hash HashFunc
+}
+
+func (circuit *nodeHashCircuit) Define(api frontend.API) error {
+	hFunc, err := newCircuitHasher(api, circuit.hash)
+	if err != nil {
+		return err
+	}
+	hFunc.Write(circuit.Left, circuit.Right)
+	api.AssertIsEqual(hFunc.Sum(), circuit.Parent)
+	return nil
+}
+
+// fieldWriteRecorder is a hash.Hash that keeps what is written to it, to see the exact
+// bytes hashFieldElements absorbs
+type fieldWriteRecorder struct {
+	written []byte
+}
+
+func (r *fieldWriteRecorder) Write(p []byte) (int, error) {
+	r.written = append(r.written, p...)
+	return len(p), nil
+}
+
+// Sum returns the bytes written so far, so the digest is the encoding itself
+func (r *fieldWriteRecorder) Sum(b []byte) []byte { return append(b, r.written...) }
+
+func (r *fieldWriteRecorder) Reset() { r.written = nil }
+
+func (r *fieldWriteRecorder) Size() int { return fr.Bytes }
+
+func (r *fieldWriteRecorder) BlockSize() int { return fr.Bytes }
+
+// TestFieldEncoding pins the bytes hashFieldElements absorbs and a SHA-256 node hash
+// computed independently from them, and checks that the circuit's node hash under every
+// hash function agrees with hashNodePair, for values at and beyond the field's edge
+func TestFieldEncoding(t *testing.T) {
+	modulusMinusOne := new(big.Int).Sub(fieldModulus, big.NewInt(1))
+	modulusPlusTwo := new(big.Int).Add(fieldModulus, big.NewInt(2))
+
+	// Each value is 32 big-endian bytes of its reduction, nil is zero, and nothing else is written
+	recorder := &fieldWriteRecorder{written: []byte("stale")}
+	hashFieldElements(recorder, big.NewInt(1), nil, modulusPlusTwo, modulusMinusOne)
+	want := make([]byte, 4*fr.Bytes)
+	want[fr.Bytes-1] = 1
+	want[3*fr.Bytes-1] = 2
+	modulusMinusOne.FillBytes(want[3*fr.Bytes:])
+	if !bytes.Equal(recorder.written, want) {
+		t.Fatalf("absorbed %x, want %x", recorder.written, want)
+	}
+
+	// sha256(be32(left) || be32(right)) mod p, computed outside this program; both digests exceed p
+	for _, c := range []struct {
+		left, right *big.Int
+		parent      string
+	}{
+		{big.NewInt(1), big.NewInt(2), "1529595e73ccab6b37ea20aa9971bf903130a7d57d4ee0e3f58b038854e4116b"},
+		{modulusMinusOne, nil, "04cd8f2bb90394d69a2514de0219f6212d6a2c94d1c95e7dbdbaf1280c7fdb7e"},
+	} {
+		got := hashNodePair(sha256.New(), c.left, c.right)
+		if want, _ := new(big.Int).SetString(c.parent, 16); got.Cmp(want) != 0 {
+			t.Fatalf("sha256 node of %v and %v = %x, want %s", c.left, c.right, got, c.parent)
+		}
+	}
+
+	pairs := [][2]*big.Int{
+		{big.NewInt(1), big.NewInt(2)},
+		{modulusMinusOne, big.NewInt(0)},
+		{big.NewInt(5), modulusPlusTwo},
+	}
+	for _, h := range []HashFunc{HashMiMC, HashSHA256, HashPedersen} {
+		for _, pair := range pairs {
+			parent := hashNodePair(mustOffCircuitHasher(h), pair[0], pair[1])
+			if parent.Cmp(fieldModulus) >= 0 {
+				t.Fatalf("%s: node hash %v is not reduced", h, parent)
+			}
+			// A witness holds field elements, so the circuit is given the reduced values
+			left, right := new(big.Int).Mod(pair[0], fieldModulus), new(big.Int).Mod(pair[1], fieldModulus)
+			assignment := &nodeHashCircuit{Left: left, Right: right, Parent: parent}
+			if err := test.IsSolved(&nodeHashCircuit{hash: h}, assignment, fieldModulus); err != nil {
+				t.Fatalf("%s: circuit rejects the node hash of %v and %v: %v", h, pair[0], pair[1], err)
+			}
+		}
+		// A leaf is the same encoding of its length and packed characters
+		pattern := "example.com"
+		fields := append([]*big.Int{big.NewInt(int64(len(pattern)))}, packPattern(pattern)...)
+		if hashFieldElements(mustOffCircuitHasher(h), fields...).Cmp(computeHashOffCircuit(pattern, h)) != 0 {
+			t.Fatalf("%s: leaf hash is not hashFieldElements of its length and packed characters", h)
+		}
+	}
+}
+
+// TestHashPair checks that hashPair gives the result of hashing inline with a fresh
+// hasher for known pairs under every hash, a nil right child included, and that it still
+// does when many goroutines call it at once
+func TestHashPair(t *testing.T) {
+	modulusMinusOne := new(big.Int).Sub(fieldModulus, big.NewInt(1))
+	pairs := [][2]*big.Int{
+		{big.NewInt(0), big.NewInt(0)},
+		{big.NewInt(1), big.NewInt(2)},
+		{big.NewInt(2), big.NewInt(1)},
+		{big.NewInt(42), nil},
+		{modulusMinusOne, big.NewInt(7)},
+	}
+	for _, h := range []HashFunc{HashMiMC, HashSHA256, HashPedersen} {
+		mt := &MerkleTree{Hash: h}
+		want := make([]*big.Int, len(pairs))
+		for i, pair := range pairs {
+			want[i] = hashNodePair(mustOffCircuitHasher(h), pair[0], pair[1])
+			if got := mt.hashPair(pair[0], pair[1]); got.Cmp(want[i]) != 0 {
+				t.Fatalf("%s: hashPair(%v, %v) = %v, want %v", h, pair[0], pair[1], got, want[i])
+			}
+		}
+
+		errs := make(chan error, 8)
+		var wg sync.WaitGroup
+		for g := 0; g < cap(errs); g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for round := 0; round < 50; round++ {
+					i := (g + round) % len(pairs)
+					if got := mt.hashPair(pairs[i][0], pairs[i][1]); got.Cmp(want[i]) != 0 {
+						errs <- fmt.Errorf("%s: concurrent hashPair of pair %d = %v, want %v", h, i, got, want[i])
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestLevelRoots checks Height against RequiredProofLen, that LevelRoot of every level,
+// LevelRoot(Height()) included, equals Root for full and compact trees, that Level
+// recomputes dropped levels and returns copies, that levels outside the tree are refused
+// and that altering a node changes LevelRoot only at its level
+func TestLevelRoots(t *testing.T) {
+	for _, numLeaves := range []int{1, 2, 13, 3000} {
+		patterns := make([]string, numLeaves)
+		for i := range patterns {
+			patterns[i] = fmt.Sprintf("p%04d", i)
+		}
+		full := NewMerkleTreeFromLeaves(patterns)
+		compact := NewMerkleTreeFromLeaves(patterns, WithCompactStorage())
+		if full.Height() != RequiredProofLen(numLeaves) || compact.Height() != full.Height() {
+			t.Fatalf("%d leaves: height %d and %d compact, want %d", numLeaves, full.Height(), compact.Height(), RequiredProofLen(numLeaves))
+		}
+		for _, tree := range []*MerkleTree{full, compact} {
+			for level := 0; level <= tree.Height(); level++ {
+				root, err := tree.LevelRoot(level)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if root.Cmp(tree.Root) != 0 {
+					t.Fatalf("%d leaves, compact=%v: LevelRoot(%d) differs from Root", numLeaves, tree.compact, level)
+				}
+				nodes, err := tree.Level(level)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.EqualFunc(nodes, full.Nodes[level], func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+					t.Fatalf("%d leaves, compact=%v: Level(%d) differs from the stored level", numLeaves, tree.compact, level)
+				}
+			}
+			for _, level := range []int{-1, tree.Height() + 1} {
+				if _, err := tree.LevelRoot(level); !errors.Is(err, ErrLevelOutOfRange) {
+					t.Fatalf("%d leaves: LevelRoot(%d) returned %v", numLeaves, level, err)
+				}
+				if _, err := tree.Level(level); !errors.Is(err, ErrLevelOutOfRange) {
+					t.Fatalf("%d leaves: Level(%d) returned %v", numLeaves, level, err)
+				}
+			}
+		}
+	}
+
+	tree := NewMerkleTreeFromLeaves([]string{"a", "b", "c", "d", "e"})
+	leaves, _ := tree.Level(0)
+	leaves[0].SetInt64(1)
+	if tree.Leaves[0].Cmp(leaves[0]) == 0 {
+		t.Fatal("Level returned the tree's own nodes")
+	}
+	tree.Nodes[1][2] = big.NewInt(1) // Parent of "e"
+	for level := 0; level <= tree.Height(); level++ {
+		root, _ := tree.LevelRoot(level)
+		if matches := root.Cmp(tree.Root) == 0; matches != (level != 1) {
+			t.Fatalf("after altering level 1: LevelRoot(%d) matches Root = %v", level, matches)
+		}
+	}
+}
+
+// compactBenchLeaves is the number of leaves BenchmarkCompactStorage builds both storage modes over
+const compactBenchLeaves = 1 << 20
+
+// TestCompactStorage builds full and compact trees over the same leaves, checks that
+// compact storage never holds the large levels, neither once built nor after loading a
+// saved full tree, and that both give the same root and proofs
+func TestCompactStorage(t *testing.T) {
+	const nbLeaves = 4*compactCachedNodes + 3
+	leaves := hashLeaves(benchPatterns(nbLeaves), HashMiMC, runtime.NumCPU())
+	full := &MerkleTree{Leaves: leaves}
+	full.buildLevels()
+	compact := &MerkleTree{Leaves: leaves, compact: true}
+	compact.buildLevels()
+
+	if compact.Root.Cmp(full.Root) != 0 {
+		t.Fatal("compact tree has another root")
+	}
+	for level, nodes := range compact.Nodes {
+		if level > 0 && len(nodes) > compactCachedNodes {
+			t.Fatalf("compact tree holds level %d of %d nodes", level, len(nodes))
+		}
+	}
+	for _, index := range []int{0, 1, 1234, nbLeaves / 2, nbLeaves - 1} {
+		want, _ := full.proofForLeaf(index)
+		got, err := compact.proofForLeaf(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.EqualFunc(got.Path[:], want.Path[:], func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+			t.Fatalf("leaf %d: compact proof differs", index)
+		}
+	}
+
+	// A full tree loaded with compact storage skips the levels compact storage drops
+	dir, err := os.MkdirTemp("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	smallPatterns := make([]string, 3*compactCachedNodes)
+	for i := range smallPatterns {
+		smallPatterns[i] = fmt.Sprintf("p%05d", i)
+	}
+	small := NewMerkleTreeFromLeaves(smallPatterns)
+	if len(small.Leaves) <= compactCachedNodes {
+		t.Fatalf("%d leaves leave no level to drop", len(small.Leaves))
+	}
+	filename := filepath.Join(dir, "tree.bin")
+	if err := small.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(filename, small.SourceHash, WithCompactStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.compact || loaded.Nodes[1] != nil || loaded.Root.Cmp(small.Root) != 0 {
+		t.Fatal("saved full tree loaded with compact storage kept its large levels")
+	}
+	want, _ := small.proofForLeaf(len(small.Leaves) - 1)
+	got, err := loaded.proofForLeaf(len(small.Leaves) - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(got.Path[:], want.Path[:], func(a, b *big.Int) bool { return a.Cmp(b) == 0 }) {
+		t.Fatal("compact loaded tree gives another proof")
+	}
+}
+
+// BenchmarkCompactStorage builds full and compact trees over compactBenchLeaves leaves,
+// reporting the peak heap of each build and the node memory each tree retains, and times
+// proofs for sampled leaves of each
+func BenchmarkCompactStorage(b *testing.B) {
+	patterns := make([]string, compactBenchLeaves)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("s%07d", i)
+	}
+	leaves := hashLeaves(patterns, HashMiMC, runtime.NumCPU())
+	patterns = nil
+	sampled := []int{0, 1, 12345, compactBenchLeaves / 2, compactBenchLeaves - 1}
+	// Collect garbage early so the sampled heap follows the live nodes, not hashing garbage
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	for _, compact := range []bool{false, true} {
+		name := "full"
+		if compact {
+			name = "compact"
+		}
+		var tree *MerkleTree
+		b.Run(name+"/build", func(b *testing.B) {
+			var peak, retained uint64
+			for i := 0; i < b.N; i++ {
+				tree = nil
+				var m runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&m)
+				before := m.HeapAlloc
+				tree = &MerkleTree{Leaves: leaves, compact: compact}
+				built, _ := peakHeap(func() error {
+					tree.buildLevels()
+					return nil
+				})
+				runtime.GC()
+				runtime.ReadMemStats(&m)
+				peak, retained = max(peak, built), m.HeapAlloc-min(before, m.HeapAlloc)
+			}
+			b.ReportMetric(float64(peak), "peak-B")
+			b.ReportMetric(float64(retained), "retained-B")
+		})
+		b.Run(name+"/proof", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := tree.proofForLeaf(sampled[i%len(sampled)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestHashCache checks that a warm hash cache reproduces the root of a cold build, that
+// the warm build really reads the cache, and that a cache written under other parameters
+// is ignored
+func TestHashCache(t *testing.T) {
+	const superString = "ab-c.example.com"
+	const maxPatternLen = 6
+	dir, err := os.MkdirTemp("", "hashcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "hashes.bin")
+
+	uncached := NewMerkleTree(superString, maxPatternLen)
+	cold := NewMerkleTree(superString, maxPatternLen, WithHashCache(filename))
+	warm := NewMerkleTree(superString, maxPatternLen, WithHashCache(filename))
+	if cold.Root.Cmp(uncached.Root) != 0 || warm.Root.Cmp(uncached.Root) != 0 {
+		t.Fatal("cached builds changed the root")
+	}
+	params := newHashCacheParams(HashMiMC)
+	hashes := loadHashCache(filename, params)
+	if len(hashes) != len(uncached.Leaves) {
+		t.Fatalf("cache holds %d hashes, want %d", len(hashes), len(uncached.Leaves))
+	}
+
+	// A tampered entry changes the root only if the warm build reads it
+	hashes["exa"] = big.NewInt(1)
+	if err := saveHashCache(filename, params, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if NewMerkleTree(superString, maxPatternLen, WithHashCache(filename)).Root.Cmp(uncached.Root) == 0 {
+		t.Fatal("warm build did not use the cache")
+	}
+
+	// The same tampered entries under another leaf format must be discarded
+	stale := params
+	stale.LeafFormat--
+	if err := saveHashCache(filename, stale, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if NewMerkleTree(superString, maxPatternLen, WithHashCache(filename)).Root.Cmp(uncached.Root) != 0 {
+		t.Fatal("cache from another leaf format was used")
+	}
+}
+
+// TestLeafModes checks that label trees find the same full hostnames as a substring tree
+// with a tenth of its leaves, hold registrable domains only in registrable mode, and report
+// patterns cut at a dot as ErrNotExpressible
+func TestLeafModes(t *testing.T) {
+	entries := []string{"www.example.com", "mail.example.co.uk", "api.test-site.org", "example.com", "bad..host"}
+	text := buildSuperString(entries, maxStr2Len)
+	const maxPatternLen = 24
+	substrings := NewMerkleTree(text, maxPatternLen)
+	labels := NewMerkleTree(text, maxPatternLen, WithLeafMode(LeafLabels))
+	registrable := NewMerkleTree(text, maxPatternLen, WithLeafMode(LeafRegistrable))
+
+	has := func(tree *MerkleTree, pattern string) bool {
+		_, err := tree.GenerateProof(pattern)
+		return err == nil
+	}
+	for _, host := range []string{"www.example.com", "mail.example.co.uk", "api.test-site.org", "example.com", "www.example.org", "example.net"} {
+		want := has(substrings, host)
+		for _, tree := range []*MerkleTree{labels, registrable} {
+			if has(tree, host) != want {
+				t.Fatalf("%s tree has %s: %t, substring tree: %t", tree.leafMode, host, !want, want)
+			}
+		}
+	}
+	for _, c := range []struct {
+		pattern             string
+		labels, registrable bool
+	}{
+		{"mail", true, true},
+		{"test-site", true, true},
+		{"xampl", false, false},        // Part of a label
+		{"example.co.uk", false, true}, // Registrable domain of mail.example.co.uk
+		{"co.uk", false, false},        // A public suffix
+		{"bad", true, true},            // Label of a run that is not a hostname
+		{"bad..host", false, false},    // Not a hostname
+	} {
+		if has(labels, c.pattern) != c.labels || has(registrable, c.pattern) != c.registrable {
+			t.Fatalf("%q: in labels %t and registrable %t, want %t and %t",
+				c.pattern, has(labels, c.pattern), has(registrable, c.pattern), c.labels, c.registrable)
+		}
+	}
+	if len(labels.Leaves)*10 > len(substrings.Leaves) || len(registrable.Leaves) <= len(labels.Leaves) {
+		t.Fatalf("%d label, %d registrable and %d substring leaves, want labels under a tenth of substrings",
+			len(labels.Leaves), len(registrable.Leaves), len(substrings.Leaves))
+	}
+
+	// Patterns cut at a dot are reported as such, not as missing, and only by label trees
+	for _, pattern := range []string{".example.com", "www.", "www..com"} {
+		_, err := labels.GenerateProof(pattern)
+		if !errors.Is(err, ErrNotExpressible) || !errors.Is(err, ErrPatternNotFound) {
+			t.Fatalf("%q in a label tree: got %v, want %v", pattern, err, ErrNotExpressible)
+		}
+		if err := substrings.checkPatternLabels(pattern); err != nil {
+			t.Fatalf("%q in a substring tree: %v", pattern, err)
+		}
+	}
+	var stats ProcessingStats
+	var pending []pendingProof
+	recordResult(&stats, &pending, SubstringResult{Pattern: "www.", Err: labels.checkPatternLabels("www.")}, nil)
+	if stats.InvalidPatterns != 1 {
+		t.Fatal("pattern cut at a dot not counted as invalid")
+	}
+
+	// A full hostname proves against the label tree through the usual circuit
+	proof, err := labels.GenerateProof("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := buildWitness("www.example.com", proof, labels.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuit := &SubstringCircuit{hash: labels.Hash, unusedLevels: labels.unusedLevels()}
+	if err := test.IsSolved(circuit, &assignment, fieldModulus); err != nil {
+		t.Fatalf("hostname rejected against the label tree: %v", err)
+	}
+
+	// The leaf mode is part of the source hash, and streaming builds the same tree
+	if labels.SourceHash == substrings.SourceHash || labels.SourceHash == registrable.SourceHash {
+		t.Fatal("leaf modes share a source hash")
+	}
+	streamed, err := NewMerkleTreeFromReader(strings.NewReader(text), maxPatternLen, WithLeafMode(LeafRegistrable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.Root.Cmp(registrable.Root) != 0 || streamed.SourceHash != registrable.SourceHash {
+		t.Fatal("streamed registrable tree differs from the one built from a string")
+	}
+
+	for spec, want := range map[string]LeafMode{"": LeafSubstrings, "substrings": LeafSubstrings, "Labels": LeafLabels, "registrable": LeafRegistrable} {
+		if mode, err := ParseLeafMode(spec); err != nil || mode != want {
+			t.Fatalf("ParseLeafMode(%q) = %v, %v, want %v", spec, mode, err, want)
+		}
+	}
+	if _, err := ParseLeafMode("words"); err == nil {
+		t.Fatal("unknown leaf mode accepted")
+	}
+}
+
+// TestNormalization checks parsing and the steps themselves, then that the Unicode and
+// punycode spellings of a name, in any case and with or without a trailing dot, prove
+// against a tree built from either spelling, through ProcessSubstrings' normalization,
+// and that the steps are recorded in the source hash and the saved tree
+func TestNormalization(t *testing.T) {
+	for spec, want := range map[string]string{
+		"":                                "none",
+		"none":                            "none",
+		"all":                             "lowercase,trailing-dot,punycode",
+		"punycode, Lowercase":             "lowercase,punycode",
+		"trailing-dot":                    "trailing-dot",
+		"lowercase,trailing-dot,punycode": "lowercase,trailing-dot,punycode",
+	} {
+		n, err := ParseNormalization(spec)
+		if err != nil {
+			t.Fatalf("%q: %v", spec, err)
+		}
+		if n.String() != want {
+			t.Fatalf("%q parses to %s, want %s", spec, n, want)
+		}
+	}
+	if _, err := ParseNormalization("lowercase,nfc"); err == nil {
+		t.Fatal("unknown step accepted")
+	}
+
+	all, _ := ParseNormalization("all")
+	spellings := []string{"WWW.Bücher.DE.", "www.xn--bcher-kva.de"}
+	for _, s := range spellings {
+		if got := all.Apply(s); got != "www.xn--bcher-kva.de" {
+			t.Fatalf("%q normalizes to %q", s, got)
+		}
+	}
+	if got := (Normalization{Lowercase: true}).Apply("WWW.Bücher.DE."); got != "www.bücher.de." {
+		t.Fatalf("lowercase only gives %q", got)
+	}
+
+	for _, source := range spellings {
+		entries := all.ApplyAll([]string{"example.com", source, "example.org"})
+		tree := NewMerkleTree(buildSuperString(entries, maxStr2Len), 24, WithNormalization(all))
+		for _, query := range all.ApplyAll(spellings) {
+			proof, err := tree.GenerateProof(query)
+			if err != nil {
+				t.Fatalf("tree from %q: %v", source, err)
+			}
+			assignment, err := buildWitness(query, proof, tree.Root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.IsSolved(&SubstringCircuit{}, &assignment, fieldModulus); err != nil {
+				t.Fatalf("tree from %q: %q rejected: %v", source, query, err)
+			}
+		}
+
+		// Unnormalized, the Unicode spelling is refused by the charset; normalized, both
+		// spellings are one pattern found in the tree, so a wrong root shows up as a bad
+		// path before anything is proved
+		tree.Root = new(big.Int).Add(tree.Root, big.NewInt(1))
+		stats, err := ProcessSubstrings(context.Background(), spellings, tree, nil, nil, nil, ProcessOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.BadProofPaths != 1 || stats.InvalidPatterns != 0 || stats.DuplicatesSkipped != 1 {
+			t.Fatalf("tree from %q: %d bad paths, %d invalid, %d duplicates, want 1, 0 and 1",
+				source, stats.BadProofPaths, stats.InvalidPatterns, stats.DuplicatesSkipped)
+		}
+	}
+
+	tree := NewMerkleTree("example.com", 4, WithNormalization(all))
+	if tree.SourceHash == NewMerkleTree("example.com", 4).SourceHash {
+		t.Fatal("normalization is not part of the source hash")
+	}
+	dir, err := os.MkdirTemp("", "normalized-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tree.bin")
+	if err := tree.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(filename, tree.SourceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.normalize != all {
+		t.Fatalf("loaded tree normalizes with %s, want %s", loaded.normalize, all)
+	}
+}
+
+// TestCharset checks which runes each preset and two custom charsets admit, that a tree
+// holds substrings with '_' or ':' only under a charset allowing them and reports the
+// others as ErrDisallowedChars, and that the charset is part of the tree's source hash
+func TestCharset(t *testing.T) {
+	cases := []struct {
+		spec    string
+		allowed string
+		refused string
+	}{
+		{"dns", "aZ09-._*", ":/~ %\xe9\x00日"},
+		{"url", "aZ09-._~:/?#[]@!$&'()*+,;=%", " \"<>\\^`{|}\xe9日"},
+		{"ascii-printable", " ~aZ09_:\"{}", "\x00\t\x7f\xe9日"},
+		{"chars:ab_", "ab_", "cA:.日"},
+		{"chars:aü日", "aü日", "bu本"},
+		{"regexp:[a-c:]", "abc:", "dA_日"},
+		{"regexp:\\p{Han}", "日本", "aü"},
+		{"", "aZ09-._*", ":日"},
+	}
+	for _, c := range cases {
+		charset := Charset{}
+		if c.spec != "" {
+			var err error
+			if charset, err = ParseCharset(c.spec); err != nil {
+				t.Fatalf("%q: %v", c.spec, err)
+			}
+		}
+		for _, r := range c.allowed {
+			if !charset.Allows(r) {
+				t.Fatalf("charset %s refuses %q", charset, r)
+			}
+		}
+		for _, r := range c.refused {
+			if charset.Allows(r) {
+				t.Fatalf("charset %s allows %q", charset, r)
+			}
+		}
+	}
+	for _, bad := range []string{"emoji", "chars:", "regexp:", "regexp:["} {
+		if _, err := ParseCharset(bad); err == nil {
+			t.Fatalf("charset %q accepted", bad)
+		}
+	}
+
+	text := "srv_a.example:443"
+	sourceHashes := make(map[[32]byte]bool)
+	for _, c := range []struct {
+		charset      Charset
+		present      string
+		disallowed   string
+		wantHasColon bool
+	}{
+		{CharsetDNS, "srv_a", "e:4", false},
+		{CharsetURL, "e:4", "", true},
+		{CharsetASCIIPrintable, "e:4", "a\tb", true},
+	} {
+		tree := NewMerkleTree(text, 5, WithCharset(c.charset))
+		if _, ok := tree.PatternToIndex[c.present]; !ok {
+			t.Fatalf("%s tree lacks %q", c.charset, c.present)
+		}
+		if _, ok := tree.PatternToIndex[":"]; ok != c.wantHasColon {
+			t.Fatalf("%s tree has \":\" %t, want %t", c.charset, ok, c.wantHasColon)
+		}
+		if c.disallowed != "" && !errors.Is(tree.checkPatternChars(c.disallowed), ErrDisallowedChars) {
+			t.Fatalf("%s tree: %q not reported as disallowed", c.charset, c.disallowed)
+		}
+		if got := tree.disallowedPatterns([]string{c.present, "", c.disallowed}); c.disallowed != "" && !slices.Equal(got, []string{c.disallowed}) {
+			t.Fatalf("%s tree: disallowed patterns %q, want [%q]", c.charset, got, c.disallowed)
+		}
+		if tree.SourceHash != treeSourceHash(text, 5, c.charset, Normalization{}, LeafSubstrings) || sourceHashes[tree.SourceHash] {
+			t.Fatalf("%s tree: source hash does not follow the charset", c.charset)
+		}
+		sourceHashes[tree.SourceHash] = true
+	}
+}
+
+// TestForest checks a forest over entries of very different sizes, an empty one
+// included: every pattern is proved in the first entry holding it, off-circuit and in
+// ForestCircuit against the single forest root, a claimed entry or subtree depth other
+// than the path's is rejected, and a real proof verifies against the root
+func TestForest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	long := make([]byte, 1500)
+	for i := range long {
+		long[i] = "abcdefghij.-"[rng.Intn(12)]
+	}
+	entries := []string{"a", "", "example.com", string(long), "b.io"}
+	forest := NewMerkleForest(4)
+	if err := forest.BuildFromEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+	if forest.Trees[1] != nil || forest.Top.Leaves[1].Sign() != 0 {
+		t.Fatal("empty entry has a subtree")
+	}
+	if got, want := forest.Height(), forest.Trees[3].Height()+RequiredProofLen(len(entries)); got != want {
+		t.Fatalf("forest height %d, want %d", got, want)
+	}
+
+	circuit := forest.newCircuit()
+	var assignments []*ForestCircuit
+	for _, pattern := range []string{"a", "exam", "e.co", string(long[700:704]), "b.io", "o"} {
+		proof, err := forest.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := slices.IndexFunc(entries, func(entry string) bool { return strings.Contains(entry, pattern) })
+		if proof.Entry != want || proof.SubtreeDepth != forest.Trees[want].Height() {
+			t.Fatalf("%q: proof in entry %d at subtree depth %d, want entry %d at %d", pattern, proof.Entry, proof.SubtreeDepth, want, forest.Trees[want].Height())
+		}
+		if !forest.VerifyProofOffCircuit(pattern, proof) {
+			t.Fatalf("%q: proof does not reach the forest root off-circuit", pattern)
+		}
+		assignment, err := buildForestWitness(pattern, proof, forest.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.IsSolved(circuit, assignment, fieldModulus); err != nil {
+			t.Fatalf("%q in entry %d rejected: %v", pattern, proof.Entry, err)
+		}
+		for _, entry := range []int{proof.Entry + 1, proof.Entry + len(entries), -1} {
+			forged := *assignment
+			forged.EntryIndex = entry
+			if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+				t.Fatalf("%q in entry %d accepted as entry %d", pattern, proof.Entry, entry)
+			}
+		}
+		assignments = append(assignments, assignment)
+	}
+	if _, err := forest.GenerateProof("zzzz"); !errors.Is(err, ErrPatternNotFound) {
+		t.Fatalf("absent pattern: got %v, want %v", err, ErrPatternNotFound)
+	}
+
+	// The top levels are the path's last ones, whatever split the proof claims
+	proof, err := forest.GenerateProof("b.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortened := *proof
+	shortened.SubtreeDepth++
+	if forest.VerifyProofOffCircuit("b.io", &shortened) {
+		t.Fatal("proof accepted with a subtree depth other than its path's")
+	}
+
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := frontend.NewWitness(assignments[3], fieldModulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groth16Proof, err := groth16.Prove(ccs, pk, full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := frontend.NewWitness(&ForestCircuit{SubstringCircuit: SubstringCircuit{MerkleRoot: forest.Root}}, fieldModulus, frontend.PublicOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := groth16.Verify(groth16Proof, vk, public); err != nil {
+		t.Fatalf("proof rejected against the forest root: %v", err)
+	}
+	public, err = frontend.NewWitness(&ForestCircuit{SubstringCircuit: SubstringCircuit{MerkleRoot: forest.Trees[3].Root}}, fieldModulus, frontend.PublicOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groth16.Verify(groth16Proof, vk, public) == nil {
+		t.Fatal("proof verified against the entry's subtree root")
+	}
+}
+
+// TestEntryTree checks EntryMatchCircuit over entries of very different lengths: a
+// pattern is proved in the first entry holding it, also as a multi-byte character or at
+// an entry's very end, while a pattern spanning two entries, one longer than the opened
+// entry, an empty one and a tampered entry are rejected
+func TestEntryTree(t *testing.T) {
+	entries := []string{"example.com", "a", "", "bücher.de", strings.Repeat("ab", 100) + "z"}
+	tree, err := NewEntryTree(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Leaves() != len(entries) {
+		t.Fatalf("%d leaves for %d entries", tree.Leaves(), len(entries))
+	}
+	circuit := tree.newCircuit()
+	for _, c := range []struct {
+		pattern string
+		entry   int
+	}{
+		{"ple.c", 0},
+		{"example.com", 0},
+		{"a", 0},
+		{"ü", 3},
+		{"r.de", 3},
+		{"babz", 4},
+		{strings.Repeat("ab", maxStr1Len/2), 4},
+	} {
+		assignment, err := tree.GenerateWitness(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := assignment.EntryLength; got != len(entries[c.entry]) {
+			t.Fatalf("%q: opened an entry of %v bytes, want entry %d", c.pattern, got, c.entry)
+		}
+		if err := test.IsSolved(circuit, assignment, fieldModulus); err != nil {
+			t.Fatalf("%q in entry %d rejected: %v", c.pattern, c.entry, err)
+		}
+	}
+
+	for _, pattern := range []string{"com.a", ".coma", "zz"} {
+		if _, err := tree.GenerateWitness(pattern); !errors.Is(err, ErrPatternNotFound) {
+			t.Fatalf("%q: got %v, want %v", pattern, err, ErrPatternNotFound)
+		}
+	}
+	if _, err := tree.GenerateWitness(""); err == nil {
+		t.Fatal("empty pattern accepted")
+	}
+	for _, c := range []struct {
+		name    string
+		pattern string
+		entry   int
+	}{
+		{"pattern longer than the entry", "ab", 1},
+		{"pattern in the empty entry", "a", 2},
+		{"pattern only in another entry", "ple", 3},
+		{"pattern running past the entry's end", "bzz", 4},
+		{"empty pattern", "", 0},
+	} {
+		assignment, err := tree.witnessFor(c.pattern, c.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.IsSolved(circuit, assignment, fieldModulus) == nil {
+			t.Fatalf("%s accepted", c.name)
+		}
+	}
+	tampered, err := tree.GenerateWitness("ple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Entry[3] = 'q'
+	if test.IsSolved(circuit, tampered, fieldModulus) == nil {
+		t.Fatal("tampered entry accepted")
+	}
+
+	for _, bad := range [][]string{{strings.Repeat("a", maxEntryLen+1)}, {"a\x00b"}, nil} {
+		if _, err := NewEntryTree(bad); err == nil {
+			t.Fatalf("entries %q accepted", bad)
+		}
+	}
+}
+
+// TestConfigFlags parses a representative command line and checks the resulting config,
+// the defaults and that invalid values are refused
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("merkle_tree", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg := registerConfigFlags(fs)
+	err := fs.Parse([]string{"-entries", "ct/entries.json.gz", "-patterns=names.json", "-max-pattern-len", "32",
+		"-max-text-len", "100000", "-backend", "plonk", "-keys-dir", "/var/cache/keys", "-charset", "chars:ab_", "-normalize", "lowercase,punycode", "-leaf-mode", "labels", "-no-such-flag"})
+	if err == nil || !strings.Contains(err.Error(), "no-such-flag") {
+		t.Fatalf("unknown flag: got %v, want an error naming it", err)
+	}
+	want := runConfig{Entries: "ct/entries.json.gz", Patterns: "names.json", MaxPatternLen: 32,
+		MaxTextLen: 100000, Backend: "plonk", KeysDir: "/var/cache/keys", Charset: "chars:ab_", Normalize: "lowercase,punycode", LeafMode: "labels"}
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Fatalf("parsed %+v, want %+v", *cfg, want)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := registerConfigFlags(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	if defaults.Entries != "combined_raw_decoded_entries.json" || defaults.MaxPatternLen != maxStr1Len ||
+		defaults.MaxTextLen != maxStr2Len || defaults.Backend != "groth16" || defaults.Charset != "dns" ||
+		defaults.Normalize != "none" || defaults.LeafMode != "substrings" || defaults.validate() != nil {
+		t.Fatalf("unexpected defaults %+v", *defaults)
+	}
+	for _, bad := range []runConfig{
+		{Entries: "e.json", MaxPatternLen: maxStr1Len + 1, MaxTextLen: 1, Backend: "groth16", Charset: "dns"},
+		{Entries: "e.json", MaxPatternLen: 1, MaxTextLen: 0, Backend: "groth16", Charset: "dns"},
+		{Entries: "e.json", MaxPatternLen: 1, MaxTextLen: 1, Backend: "stark", Charset: "dns"},
+		{Entries: "e.json", MaxPatternLen: 1, MaxTextLen: 1, Backend: "groth16", Charset: "emoji"},
+		{Entries: "e.json", MaxPatternLen: 1, MaxTextLen: 1, Backend: "groth16", Charset: "dns", Normalize: "uppercase"},
+		{Entries: " , ", MaxPatternLen: 1, MaxTextLen: 1, Backend: "groth16", Charset: "dns"},
+		{Entries: "e.json", MaxPatternLen: 1, MaxTextLen: 1, Backend: "groth16", Charset: "dns", LeafMode: "words"},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("%+v accepted", bad)
+		}
+	}
+}
+
+// TestProfiling starts every profile and the memory sampler around some leaf hashing,
+// fetches the heap profile over HTTP, and checks that stopping writes both profiles,
+// closes the listener and yields samples that reach the stats JSON
+func TestProfiling(t *testing.T) {
+	dir, err := os.MkdirTemp("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpuProfile, memProfile := filepath.Join(dir, "cpu.pprof"), filepath.Join(dir, "mem.pprof")
+	prof, err := startProfiling(cpuProfile, memProfile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + prof.listener.Addr().String() + "/debug/pprof/heap?debug=1"
+	// Without keep-alives the last request needs a new connection, which Stop must refuse
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	sampler := startMemSampler(5 * time.Millisecond)
+	hashLeaves(uniqueSubstrings("https://www.example.com/index.html", 8, DefaultCharset), HashMiMC, 1)
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := client.Get(url)
+	if err != nil {
+		prof.Stop()
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		prof.Stop()
+		t.Fatalf("pprof heap: %s", resp.Status)
+	}
+
+	samples := sampler.Stop()
+	if err := prof.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{cpuProfile, memProfile} {
+		if info, err := os.Stat(filename); err != nil || info.Size() == 0 {
+			t.Fatalf("profile %s not written: %v", filepath.Base(filename), err)
+		}
+	}
+	if _, err := client.Get(url); err == nil {
+		t.Fatal("pprof listener still serving after Stop")
+	}
+
+	if len(samples) < 2 {
+		t.Fatalf("got %d memory samples, want a periodic one and the final one", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.HeapAlloc == 0 || sample.Sys < sample.HeapAlloc {
+			t.Fatalf("implausible memory sample %+v", sample)
+		}
+	}
+	data, err := json.Marshal(ProcessingStats{Memory: samples})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"memory":[{"elapsedMs":`)) {
+		t.Fatalf("stats JSON without memory samples: %s", data)
+	}
+}
+
+// writerToFunc adapts a function to io.WriterTo
+type writerToFunc func(io.Writer) (int64, error)
+
+func (f writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return f(w)
+}
+
+// TestProcessSubstrings checks that ProcessSubstrings accounts for every non-empty pattern
+// exactly once: proved, not found or failed. Every proof of the fixed circuit must have the
+// same positive size, in one run and the next, and a proof that fails to serialize has
+// none.
+func TestProcessSubstrings(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns := []string{"mple", "", "exa", "zzzz", strings.Repeat("a", maxStr1Len+1), "com", "e.com/"}
+	stats, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.ProcessedPatterns != len(patterns)-1 || len(stats.Results) != stats.ProcessedPatterns {
+		t.Fatalf("processed %d patterns with %d results, want %d", stats.ProcessedPatterns, len(stats.Results), len(patterns)-1)
+	}
+	if sum := stats.SuccessfulProofs + stats.CachedProofs + stats.FailedProofs + stats.NotFoundPatterns + stats.InvalidPatterns + stats.BadProofPaths; sum != stats.ProcessedPatterns {
+		t.Fatalf("outcomes add up to %d, want %d", sum, stats.ProcessedPatterns)
+	}
+	if stats.SuccessfulProofs != 3 || stats.NotFoundPatterns != 1 || stats.FailedProofs != 1 || stats.InvalidPatterns != 1 {
+		t.Fatalf("got %d successful, %d not found, %d failed, %d invalid; want 3, 1, 1, 1",
+			stats.SuccessfulProofs, stats.NotFoundPatterns, stats.FailedProofs, stats.InvalidPatterns)
+	}
+	// "e.com/" is reported as invalid because of "/", not as absent
+	if last := stats.Results[len(stats.Results)-1]; !errors.Is(last.Err, ErrDisallowedChars) || !strings.Contains(last.Err.Error(), `"/"`) {
+		t.Fatalf("e.com/: got %v, want %v naming \"/\"", last.Err, ErrDisallowedChars)
+	}
+	if err := tree.checkPatternChars("e.com/"); !errors.Is(err, ErrDisallowedChars) {
+		t.Fatalf("checkPatternChars(e.com/) = %v, want %v", err, ErrDisallowedChars)
+	}
+	if err := tree.checkPatternChars("zzzz"); err != nil {
+		t.Fatalf("checkPatternChars(zzzz) = %v, want nil", err)
+	}
+	if _, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{RFC6962: &RFC6962Tree{}, BatchSize: 2}); err == nil {
+		t.Fatal("batched RFC 6962 processing accepted")
+	}
+	batched, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{BatchVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := stats.AverageProofBytes()
+	if size <= 0 || stats.SizedProofs != 3 || stats.ProofBytes != 3*size {
+		t.Fatalf("proof sizes total %d bytes over %d proofs, want 3 positive equal sizes", stats.ProofBytes, stats.SizedProofs)
+	}
+	for _, r := range append(stats.Results, batched.Results...) {
+		if r.Err == nil && r.Found && r.ProofBytes != size {
+			t.Fatalf("%q: proof of %d bytes, others have %d", r.Pattern, r.ProofBytes, size)
+		}
+	}
+	if batched.AverageProofBytes() != size {
+		t.Fatalf("second run averages %d bytes per proof, first %d", batched.AverageProofBytes(), size)
+	}
+	failing := writerToFunc(func(w io.Writer) (int64, error) {
+		n, _ := w.Write(make([]byte, 10))
+		return int64(n), io.ErrShortWrite
+	})
+	if n, err := proofSize(failing); n != 0 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("proof failing to serialize: size %d, err %v; want 0, %v", n, err, io.ErrShortWrite)
+	}
+	if batched.SuccessfulProofs != 3 || batched.FailedProofs != 1 || len(batched.BatchVerifyFailed) != 0 || batched.BatchVerifyTime == 0 {
+		t.Fatalf("with -batch-verify got %d successful, %d failed, batch failures %q; want 3, 1, none",
+			batched.SuccessfulProofs, batched.FailedProofs, batched.BatchVerifyFailed)
+	}
+
+	// Cancelled after two iteration boundaries: "mple" is proved, "" skipped, then it stops
+	partial, err := ProcessSubstrings(&countdownContext{Context: context.Background(), remaining: 2}, patterns, tree, pk, vk, ccs, ProcessOptions{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled run returned %v, want %v", err, context.Canceled)
+	}
+	if partial.ProcessedPatterns != 1 || len(partial.Results) != 1 || partial.SuccessfulProofs != 1 {
+		t.Fatalf("cancelled run processed %d patterns with %d results, want 1", partial.ProcessedPatterns, len(partial.Results))
+	}
+}
+
+// TestStatsFiles writes the stats of a cold and a warm proof-cache run over present,
+// absent, invalid and too long patterns with writeStatsJSON and writeStatsCSV, then reads
+// both back: the JSON outcome counters must add up to processed with one substring record
+// each, and the CSV must hold a header and one row per processed pattern, in result order
+func TestStatsFiles(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := newProofCache(filepath.Join(dir, "cache"))
+	pk, vk, err := cache.LoadOrSetupKeys(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{"exa", "zzzz", "com", "e.com/", strings.Repeat("a", maxStr1Len+1)}
+	for run, want := range []struct{ successful, cached int }{{2, 0}, {0, 2}} {
+		stats, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{Cache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonFile := filepath.Join(dir, fmt.Sprintf("stats%d.json", run))
+		csvFile := filepath.Join(dir, fmt.Sprintf("stats%d.csv", run))
+		if err := writeStatsJSON(jsonFile, stats); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeStatsCSV(csvFile, stats); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(jsonFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed struct {
+			Processed     int `json:"processed"`
+			Successful    int `json:"successful"`
+			Cached        int `json:"cached"`
+			Failed        int `json:"failed"`
+			NotFound      int `json:"notFound"`
+			Invalid       int `json:"invalid"`
+			BadProofPaths int `json:"badProofPaths"`
+			Substrings    []struct {
+				Pattern string `json:"pattern"`
+			} `json:"substrings"`
+		}
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			t.Fatalf("run %d: %s: %v", run, jsonFile, err)
+		}
+		if parsed.Processed != len(patterns) || len(parsed.Substrings) != parsed.Processed {
+			t.Fatalf("run %d: JSON has %d processed with %d substrings, want %d", run, parsed.Processed, len(parsed.Substrings), len(patterns))
+		}
+		if sum := parsed.Successful + parsed.Cached + parsed.Failed + parsed.NotFound + parsed.Invalid + parsed.BadProofPaths; sum != parsed.Processed {
+			t.Fatalf("run %d: JSON outcomes add up to %d, want %d", run, sum, parsed.Processed)
+		}
+		if parsed.Successful != want.successful || parsed.Cached != want.cached || parsed.NotFound != 1 || parsed.Invalid != 1 || parsed.Failed != 1 {
+			t.Fatalf("run %d: JSON has %d successful, %d cached, %d not found, %d invalid, %d failed; want %d, %d, 1, 1, 1",
+				run, parsed.Successful, parsed.Cached, parsed.NotFound, parsed.Invalid, parsed.Failed, want.successful, want.cached)
+		}
+
+		file, err := os.Open(csvFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(file).ReadAll()
+		file.Close()
+		if err != nil {
+			t.Fatalf("run %d: %s: %v", run, csvFile, err)
+		}
+		if len(records) != parsed.Processed+1 || records[0][0] != "pattern" {
+			t.Fatalf("run %d: CSV has %d records, want a header and %d rows", run, len(records), parsed.Processed)
+		}
+		for i, r := range stats.Results {
+			if records[i+1][0] != r.Pattern || parsed.Substrings[i].Pattern != r.Pattern {
+				t.Fatalf("run %d: row %d is %q in the CSV and %q in the JSON, want %q",
+					run, i, records[i+1][0], parsed.Substrings[i].Pattern, r.Pattern)
+			}
+		}
+	}
+}
+
+// TestDuplicateSubstrings checks that a pattern listed three times among others is proved
+// once, sequentially and on workers, with every entry reported in input order against the
+// first one's cached proof file
+func TestDuplicateSubstrings(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "duplicates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	patterns := []string{"exa", "com", "exa", "", "exa"}
+	for _, workers := range []int{1, 2} {
+		cache := newProofCache(filepath.Join(dir, strconv.Itoa(workers)))
+		if _, _, err := cache.LoadOrSetupKeys(ccs); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs,
+			ProcessOptions{Cache: cache, Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// "exa" and "com" each take one Prove call
+		if stats.SuccessfulProofs != 2 || stats.ProcessedPatterns != 2 || stats.DuplicatesSkipped != 2 {
+			t.Fatalf("%d workers: %d proofs for %d patterns with %d duplicates, want 2, 2, 2",
+				workers, stats.SuccessfulProofs, stats.ProcessedPatterns, stats.DuplicatesSkipped)
+		}
+		wantEntries, wantProofEntries := []int{0, 1, 2, 4}, []int{0, 1, 0, 0}
+		if len(stats.Results) != len(wantEntries) {
+			t.Fatalf("%d workers: %d results, want %d", workers, len(stats.Results), len(wantEntries))
+		}
+		exaFile := stats.Results[0].ProofFile
+		for i, r := range stats.Results {
+			if r.Pattern != patterns[wantEntries[i]] || r.Entry != wantEntries[i] || r.ProofEntry != wantProofEntries[i] {
+				t.Fatalf("%d workers: result %d is %q entry %d proof entry %d, want %q entry %d proof entry %d", workers, i,
+					r.Pattern, r.Entry, r.ProofEntry, patterns[wantEntries[i]], wantEntries[i], wantProofEntries[i])
+			}
+			if r.Pattern == "exa" && (r.ProofFile != exaFile || !r.Found || r.Err != nil) {
+				t.Fatalf("%d workers: entry %d does not share the first proof %s: %+v", workers, r.Entry, exaFile, r)
+			}
+			if r.Entry != r.ProofEntry && r.ProveTime != 0 {
+				t.Fatalf("%d workers: repeated entry %d reports a prove time", workers, r.Entry)
+			}
+		}
+		if _, err := os.Stat(exaFile); err != nil {
+			t.Fatalf("%d workers: shared proof file: %v", workers, err)
+		}
+	}
+}
+
+// TestProofCacheReuse checks that a second run over the same patterns and root, in order
+// and on workers, makes no groth16.Prove call: every found pattern is a re-verified cached
+// proof, counted as cached and not as successful, with no prove time. Another root, or a
+// cached proof file that no longer verifies, is proved again.
+func TestProofCacheReuse(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "proof-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := newProofCache(dir)
+	pk, vk, err := cache.LoadOrSetupKeys(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{"exa", "com", "mple", "zzzz"}
+	cold, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cold.SuccessfulProofs != 3 || cold.CachedProofs != 0 {
+		t.Fatalf("cold run: %d proved, %d cached, want 3, 0", cold.SuccessfulProofs, cold.CachedProofs)
+	}
+	for _, workers := range []int{1, 2} {
+		warm, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{Cache: cache, Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warm.SuccessfulProofs != 0 || warm.CachedProofs != 3 || warm.NotFoundPatterns != 1 {
+			t.Fatalf("warm run on %d workers: %d proved, %d cached, %d not found; want 0, 3, 1",
+				workers, warm.SuccessfulProofs, warm.CachedProofs, warm.NotFoundPatterns)
+		}
+		for _, r := range warm.Results {
+			if r.ProveTime != 0 || (r.Found && (!r.Cached || r.ProofFile == "")) {
+				t.Fatalf("warm run on %d workers: %q was proved again: %+v", workers, r.Pattern, r)
+			}
+		}
+	}
+
+	// Proofs are filed under the root, so another tree over the same circuit proves anew
+	other := NewMerkleTree("example.org", 4)
+	stats, err := ProcessSubstrings(context.Background(), []string{"exa"}, other, pk, vk, ccs, ProcessOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SuccessfulProofs != 1 || stats.CachedProofs != 0 {
+		t.Fatalf("another root: %d proved, %d cached, want 1, 0", stats.SuccessfulProofs, stats.CachedProofs)
+	}
+
+	// A cached proof that fails verification, here one made for the other root, is
+	// discarded and proved again
+	proof, ok := cache.Load(other.Root, "exa")
+	if !ok {
+		t.Fatal("no cached proof of exa for the other root")
+	}
+	if err := cache.Store(tree.Root, "exa", proof); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = ProcessSubstrings(context.Background(), []string{"exa"}, tree, pk, vk, ccs, ProcessOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SuccessfulProofs != 1 || stats.CachedProofs != 0 || stats.Results[0].ProveTime == 0 {
+		t.Fatalf("stale cached proof: %d proved, %d cached, want 1, 0", stats.SuccessfulProofs, stats.CachedProofs)
+	}
+}
+
+// concurrentPatterns are the patterns TestConcurrentProcessing and
+// BenchmarkConcurrentProcessing prove against a tree over "example.com"
+var concurrentPatterns = []string{"exa", "xam", "amp", "mpl", "ple", "le.", "e.c", ".co", "com", "zzzz", ""}
+
+// setupConcurrentProcessing builds the tree over "example.com" and Groth16 keys for it
+func setupConcurrentProcessing(tb testing.TB) (*MerkleTree, groth16.ProvingKey, groth16.VerifyingKey, constraint.ConstraintSystem) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tree, pk, vk, ccs
+}
+
+// TestConcurrentProcessing checks that proving on several workers gives the same outcomes
+// as proving in order
+func TestConcurrentProcessing(t *testing.T) {
+	tree, pk, vk, ccs := setupConcurrentProcessing(t)
+	patterns := concurrentPatterns
+	workers := max(runtime.NumCPU(), 2) // At least 2 so the concurrent path runs on one core too
+
+	sequential, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	concurrent, err := ProcessSubstrings(context.Background(), patterns, tree, pk, vk, ccs, ProcessOptions{Workers: workers})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if concurrent.ProcessedPatterns != sequential.ProcessedPatterns || len(concurrent.Results) != len(sequential.Results) ||
+		concurrent.SuccessfulProofs != sequential.SuccessfulProofs || concurrent.NotFoundPatterns != sequential.NotFoundPatterns ||
+		concurrent.FailedProofs != 0 {
+		t.Fatalf("%d workers: %d processed, %d successful, %d not found, %d failed; in order: %d, %d, %d, %d",
+			workers, concurrent.ProcessedPatterns, concurrent.SuccessfulProofs, concurrent.NotFoundPatterns, concurrent.FailedProofs,
+			sequential.ProcessedPatterns, sequential.SuccessfulProofs, sequential.NotFoundPatterns, sequential.FailedProofs)
+	}
+}
+
+// BenchmarkConcurrentProcessing proves and verifies concurrentPatterns in order and on
+// one worker per CPU, at least 2
+func BenchmarkConcurrentProcessing(b *testing.B) {
+	tree, pk, vk, ccs := setupConcurrentProcessing(b)
+	for _, workers := range []int{1, max(runtime.NumCPU(), 2)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessSubstrings(context.Background(), concurrentPatterns, tree, pk, vk, ccs, ProcessOptions{Workers: workers}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestPlonkProcessing checks that ProcessSubstrings proves with PLONK keys, and that the
+// keys saved in the keys directory are loaded back and still verify
+func TestPlonkProcessing(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, scs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysDir, err := os.MkdirTemp("", "plonk-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	if _, err := loadOrSetupPlonkKeys(ccs, keysDir, true); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadOrSetupPlonkKeys(ccs, keysDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{"exa", "zzzz", ""}
+	stats, err := ProcessSubstrings(context.Background(), patterns, tree, nil, nil, ccs, ProcessOptions{Plonk: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ProcessedPatterns != 2 || stats.SuccessfulProofs != 1 || stats.NotFoundPatterns != 1 {
+		t.Fatalf("got %d processed, %d successful, %d not found; want 2, 1, 1",
+			stats.ProcessedPatterns, stats.SuccessfulProofs, stats.NotFoundPatterns)
+	}
+	if _, err := ProcessSubstrings(context.Background(), patterns, tree, nil, nil, ccs, ProcessOptions{Plonk: keys, BatchVerify: true}); err == nil {
+		t.Fatal("batch verification of PLONK proofs accepted")
+	}
+}
+
+// countdownContext is cancelled once Err has been asked remaining times, so a test can
+// stop a loop at a known iteration boundary
+type countdownContext struct {
+	context.Context
+	remaining int
+}
+
+func (c *countdownContext) Err() error {
+	if c.remaining == 0 {
+		return context.Canceled
+	}
+	c.remaining--
+	return nil
+}
+
+// TestAggregator checks that AggregatorCircuit accepts the two bundles ProcessSubstrings
+// writes with BundleDir for their root and pattern set, and rejects them against another
+// tree's root or a reordered set
+func TestAggregator(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	innerCircuit := &CommittedPatternCircuit{SubstringCircuit: SubstringCircuit{hash: tree.Hash}}
+	innerCcs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, innerCircuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerPK, innerVK, err := groth16.Setup(innerCcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "bundle-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	patterns := []string{"exa", "zzzz", "com"}
+	if _, err := ProcessSubstrings(context.Background(), patterns, tree, innerPK, innerVK, innerCcs, ProcessOptions{BundleDir: dir, BatchVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrote %d bundles, want 2", len(files))
+	}
+	inner := make([]ProofBundle, len(files))
+	for i, file := range files {
+		if err := readFromFile(file, &inner[i]); err != nil {
+			t.Fatal(err)
+		}
+		if err := inner[i].Verify(innerVK); err != nil {
+			t.Fatalf("%s rejected: %v", file, err)
+		}
+		data, err := os.ReadFile(strings.TrimSuffix(file, ".bundle") + ".opening.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opening bundleOpening
+		if err := json.Unmarshal(data, &opening); err != nil {
+			t.Fatal(err)
+		}
+		salt, ok := new(big.Int).SetString(opening.Salt, 16)
+		if !ok || commitPattern(salt, opening.Pattern).Cmp(inner[i].PatternCommitment) != 0 {
+			t.Fatalf("%s: opening does not match the commitment", file)
+		}
+	}
+
+	circuit, err := newAggregatorCircuit(innerCcs, innerVK, len(inner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := aggregatorAssignment(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(circuit, assignment, fieldModulus); err != nil {
+		t.Fatalf("inner proofs rejected: %v", err)
+	}
+	forged := *assignment
+	forged.MerkleRoot = emulated.ValueOf[sw_bn254.ScalarField](NewMerkleTree("example.org", 4).Root)
+	if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+		t.Fatal("inner proofs accepted against another root")
+	}
+	forged = *assignment
+	forged.PatternSetCommitment = patternSetCommitment([]*big.Int{inner[1].PatternCommitment, inner[0].PatternCommitment})
+	if test.IsSolved(circuit, &forged, fieldModulus) == nil {
+		t.Fatal("inner proofs accepted against a reordered pattern set")
+	}
+}
+
+// TestCircuitVersion checks that the circuit version is stable across compiles and
+// changes with the circuit's size, that cached keys are reused for the same circuit and
+// replaced when saved for another, and that bundles carry the version they were proved
+// with, older bundles included
+func TestCircuitVersion(t *testing.T) {
+	compile := func(unusedLevels int) (constraint.ConstraintSystem, string, error) {
+		ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: HashMiMC, unusedLevels: unusedLevels})
+		if err != nil {
+			return nil, "", err
+		}
+		version, err := circuitVersion(ccs)
+		return ccs, version, err
+	}
+	small, smallVersion, err := compile(maxProofLen - 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, again, err := compile(maxProofLen - 2); err != nil || again != smallVersion {
+		t.Fatalf("recompiling gave version %.12s, want %.12s (%v)", again, smallVersion, err)
+	}
+	large, largeVersion, err := compile(maxProofLen - 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largeVersion == smallVersion {
+		t.Fatal("a circuit with one more Merkle level has the same version")
+	}
+
+	dir, err := os.MkdirTemp("", "circuit-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyBytes := func(vk groth16.VerifyingKey) []byte {
+		var buf bytes.Buffer
+		vk.WriteTo(&buf)
+		return buf.Bytes()
+	}
+	cache := &proofCache{keysDir: dir}
+	_, smallVK, err := cache.LoadOrSetupKeys(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loadedVK, err := cache.LoadOrSetupKeys(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keyBytes(loadedVK), keyBytes(smallVK)) {
+		t.Fatal("cached keys for the same circuit were not reused")
+	}
+
+	// The small circuit's keys where the large circuit's belong, as if the circuit had
+	// changed without changing its shape hash
+	smallBase, largeBase := filepath.Join(dir, circuitShapeHash(small)), filepath.Join(dir, circuitShapeHash(large))
+	for _, ext := range []string{".pk", ".vk", ".version"} {
+		data, err := os.ReadFile(smallBase + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(largeBase+ext, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = readCachedKeys(largeBase, largeVersion, groth16.NewProvingKey(ecc.BN254), groth16.NewVerifyingKey(ecc.BN254))
+	if !errors.Is(err, ErrCircuitMismatch) {
+		t.Fatalf("keys for the smaller circuit loaded as %v, want %v", err, ErrCircuitMismatch)
+	}
+	_, largeVK, err := cache.LoadOrSetupKeys(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(keyBytes(largeVK), keyBytes(smallVK)) {
+		t.Fatal("keys for the smaller circuit used for the larger one")
+	}
+	if saved, err := os.ReadFile(largeBase + ".version"); err != nil || string(saved) != largeVersion {
+		t.Fatalf("replaced keys saved with version %.12s, want %.12s (%v)", saved, largeVersion, err)
+	}
+	if err := os.Remove(smallBase + ".version"); err != nil {
+		t.Fatal(err)
+	}
+	err = readCachedKeys(smallBase, smallVersion, groth16.NewProvingKey(ecc.BN254), groth16.NewVerifyingKey(ecc.BN254))
+	if !errors.Is(err, ErrCircuitMismatch) {
+		t.Fatalf("keys without a version loaded as %v, want %v", err, ErrCircuitMismatch)
+	}
+
+	// A bundle keeps its version through a file, and one from before versions has none
+	cubeCcs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &cubeCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cubePK, _, err := groth16.Setup(cubeCcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cubeWitness, err := frontend.NewWitness(&cubeCircuit{X: 3, Y: 27}, fieldModulus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := groth16.Prove(cubeCcs, cubePK, cubeWitness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written bytes.Buffer
+	if _, err := (&ProofBundle{Proof: proof, MerkleRoot: big.NewInt(7), CircuitVersion: smallVersion}).WriteTo(&written); err != nil {
+		t.Fatal(err)
+	}
+	encoded := written.Bytes()
+	var bundle ProofBundle
+	if _, err := bundle.ReadFrom(bytes.NewReader(encoded)); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.CircuitVersion != smallVersion || bundle.checkCircuit(smallVersion) != nil {
+		t.Fatalf("bundle read back with version %.12s, want %.12s", bundle.CircuitVersion, smallVersion)
+	}
+	if err := bundle.checkCircuit(largeVersion); !errors.Is(err, ErrCircuitMismatch) {
+		t.Fatalf("bundle for the small circuit checked against the large one: %v, want %v", err, ErrCircuitMismatch)
+	}
+	versionEnd := len(bundleFileMagic) + 1 + len(smallVersion)
+	v1 := append([]byte(bundleFileMagicV1), encoded[versionEnd:]...)
+	if _, err := bundle.ReadFrom(bytes.NewReader(v1)); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.MerkleRoot.Int64() != 7 || !errors.Is(bundle.checkCircuit(smallVersion), ErrCircuitMismatch) {
+		t.Fatal("bundle without a circuit version accepted or misread")
+	}
+}
+
+// cubeCircuit is a tiny circuit for producing many proofs quickly: X³ = Y
+type cubeCircuit struct {
+	X frontend.Variable `gnark:"x,secret"`
+	Y frontend.Variable `gnark:"y,public"`
+}
+
+func (circuit *cubeCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(circuit.X, circuit.X, circuit.X), circuit.Y)
+	return nil
+}
+
+// nbBatchProofs is the number of proofs TestVerifyBatch and the verification benchmarks check
+const nbBatchProofs = 100
+
+// cubeProofs proves x³ = y for nbBatchProofs values of x, returning the proofs, the
+// verifying key and the public witnesses
+func cubeProofs(tb testing.TB) ([]groth16.Proof, groth16.VerifyingKey, []witness.Witness) {
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &cubeCircuit{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	proofs := make([]groth16.Proof, nbBatchProofs)
+	publicWitnesses := make([]witness.Witness, nbBatchProofs)
+	for i := range proofs {
+		full, err := frontend.NewWitness(&cubeCircuit{X: i + 2, Y: (i + 2) * (i + 2) * (i + 2)}, fieldModulus)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if proofs[i], err = groth16.Prove(ccs, pk, full); err != nil {
+			tb.Fatal(err)
+		}
+		if publicWitnesses[i], err = full.Public(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return proofs, vk, publicWitnesses
+}
+
+// TestVerifyBatch checks that VerifyBatch accepts 100 valid proofs and reports the index
+// of a proof paired with the wrong public witness
+func TestVerifyBatch(t *testing.T) {
+	proofs, vk, publicWitnesses := cubeProofs(t)
+	if err := VerifyBatch(proofs, vk, publicWitnesses); err != nil {
+		t.Fatalf("valid proofs rejected: %v", err)
+	}
+	const badIndex = 37
+	swapped := append([]witness.Witness(nil), publicWitnesses...)
+	swapped[badIndex], swapped[badIndex+1] = publicWitnesses[badIndex+1], publicWitnesses[badIndex]
+	var batchErr *BatchVerifyError
+	if err := VerifyBatch(proofs, vk, swapped); !errors.As(err, &batchErr) || batchErr.Indices[0] != badIndex {
+		t.Fatalf("swapped public witnesses: got %v, want a failure at proof %d", err, badIndex)
+	}
+}
+
+// BenchmarkVerifyBatch verifies nbBatchProofs proofs with one VerifyBatch call
+func BenchmarkVerifyBatch(b *testing.B) {
+	proofs, vk, publicWitnesses := cubeProofs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := VerifyBatch(proofs, vk, publicWitnesses); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkVerifySequential verifies the same proofs as BenchmarkVerifyBatch one
+// groth16.Verify call at a time
+func BenchmarkVerifySequential(b *testing.B) {
+	proofs, vk, publicWitnesses := cubeProofs(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range proofs {
+			if err := groth16.Verify(proofs[j], vk, publicWitnesses[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestVerifyBundles checks that VerifyBundles accepts SubstringCircuit bundles for one root
+// and singles out the one whose proof was corrupted
+func TestVerifyBundles(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundles []ProofBundle
+	for _, pattern := range []string{"exa", "com", "mpl", "e.c"} {
+		merkleProof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignment, err := buildWitness(pattern, merkleProof, tree.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := frontend.NewWitness(&assignment, fieldModulus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof, err := groth16.Prove(ccs, pk, full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundles = append(bundles, ProofBundle{Proof: proof, MerkleRoot: tree.Root})
+	}
+	if err := VerifyBundles(bundles, vk); err != nil {
+		t.Fatalf("valid bundles rejected: %v", err)
+	}
+
+	const badIndex = 2
+	corrupted, ok := bundles[badIndex].Proof.(*groth16bn254.Proof)
+	if !ok {
+		t.Fatal("not a BN254 proof")
+	}
+	bad := *corrupted
+	bad.Krs.Add(&bad.Krs, &bad.Ar)
+	bundles[badIndex].Proof = &bad
+	var batchErr *BatchVerifyError
+	if err := VerifyBundles(bundles, vk); !errors.As(err, &batchErr) || len(batchErr.Indices) != 1 || batchErr.Indices[0] != badIndex {
+		t.Fatalf("corrupted proof: got %v, want a failure at bundle %d only", err, badIndex)
+	}
+}
+
+// superStringEntries returns the entries TestSuperString and BenchmarkSuperString join,
+// and a limit keeping half their text, so joining materialises bytes that streaming never
+// copies
+func superStringEntries() ([]string, int) {
+	entries := make([]string, 20000)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("%d.example.com/é/", i)
+	}
+	return entries, len(strings.Join(entries, string(entrySeparator))) / 2
+}
+
+// joinAndTruncate is how superstrings were built before buildSuperString: joining every
+// entry, then truncating the result
+func joinAndTruncate(entries []string, limit int) string {
+	return utf8Prefix(strings.Join(entries, string(entrySeparator)), limit)
+}
+
+// TestSuperString checks that buildSuperString never splits a multi-byte character and
+// gives the same string as joining and truncating the entries
+func TestSuperString(t *testing.T) {
+	if got := buildSuperString([]string{"ab", "日本"}, 5); got != "ab\x01" {
+		t.Fatalf("superstring cut to 5 bytes is %q, want \"ab\\x01\"", got)
+	}
+	entries, limit := superStringEntries()
+	if joinAndTruncate(entries, limit) != buildSuperString(entries, limit) {
+		t.Fatal("streamed superstring differs from the joined one")
+	}
+}
+
+// BenchmarkSuperString builds the same superstring by joining and truncating the entries
+// and with buildSuperString, reporting the allocations of each
+func BenchmarkSuperString(b *testing.B) {
+	entries, limit := superStringEntries()
+	b.Run("join", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			joinAndTruncate(entries, limit)
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buildSuperString(entries, limit)
+		}
+	})
+}
+
+// fuzzPatterns seeds the pattern fuzz targets with multi-byte UTF-8, invalid UTF-8, a
+// NUL byte and patterns of maxStr1Len and maxStr1Len+1 bytes
+var fuzzPatterns = []string{"", "a", "example.com", "bücher.de", "日本語", "😀", "\xff\xfe", "a\x00b",
+	strings.Repeat("a", maxStr1Len), strings.Repeat("a", maxStr1Len) + "b",
+	strings.Repeat("ü", maxStr1Len/2), strings.Repeat("ü", maxStr1Len/2) + "b"}
+
+// FuzzPatternToStr1 checks that every pattern converts to Str1 without truncation, zero
+// padded, or is refused with ErrPatternTooLong when it is longer than maxStr1Len bytes
+func FuzzPatternToStr1(f *testing.F) {
+	for _, pattern := range fuzzPatterns {
+		f.Add(pattern)
+	}
+	root := NewMerkleTree("example.com", 4).Root
+	f.Fuzz(func(t *testing.T, pattern string) {
+		_, err := buildWitness(pattern, nil, root)
+		if len(pattern) > maxStr1Len {
+			if !errors.Is(err, ErrPatternTooLong) {
+				t.Fatalf("%q with %d bytes: got %v, want %v", pattern, len(pattern), err, ErrPatternTooLong)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", pattern, err)
+		}
+		for i, v := range patternToStr1(pattern) {
+			want := frontend.Variable(0)
+			if i < len(pattern) {
+				want = uint64(pattern[i])
+			}
+			if v != want {
+				t.Fatalf("%q: Str1[%d] = %v, want %v", pattern, i, v, want)
+			}
+		}
+	})
+}
+
+// FuzzComputeHashOffCircuit checks that every pattern hashes deterministically below the
+// field modulus with each hash, and once inserted into a tree proves back to its root
+// off-circuit
+func FuzzComputeHashOffCircuit(f *testing.F) {
+	for _, pattern := range fuzzPatterns {
+		f.Add(pattern)
+	}
+	f.Fuzz(func(t *testing.T, pattern string) {
+		for _, h := range []HashFunc{HashMiMC, HashSHA256, HashPedersen} {
+			digest := computeHashOffCircuit(pattern, h)
+			if digest.Sign() < 0 || digest.Cmp(fieldModulus) >= 0 {
+				t.Fatalf("%q: %s hash %s is not below the field modulus", pattern, h, digest)
+			}
+			if digest.Cmp(computeHashOffCircuit(pattern, h)) != 0 {
+				t.Fatalf("%q: %s hash is not deterministic", pattern, h)
+			}
+		}
+
+		tree := NewMerkleTree("example.com", 4)
+		if _, err := tree.AddPatterns([]string{pattern}); err != nil {
+			t.Fatal(err)
+		}
+		proof, err := tree.GenerateProof(pattern)
+		if err != nil {
+			t.Fatalf("inserted pattern has no proof: %v", err)
+		}
+		if ok, root := tree.VerifyProofOffCircuit(pattern, proof); !ok {
+			t.Fatalf("%q: proof reaches %s instead of the root %s", pattern, root, tree.Root)
+		}
+	})
+}
+
+// FuzzLoadJSONFile checks that decodeStringArray, and loadJSONFile on the same document
+// written to a file, decode exactly what json.Unmarshal does and fail exactly when it does
+func FuzzLoadJSONFile(f *testing.F) {
+	for _, document := range []string{``, `["a","b"]`, `[]`, `["bücher.de","\u00fc\ud83d\ude00"]`, `null`, `["a",`, `["\xff"]`} {
+		f.Add(document)
+	}
+	for _, pattern := range fuzzPatterns {
+		if document, err := json.Marshal([]string{pattern}); err == nil {
+			f.Add(string(document))
+		}
+	}
+	f.Fuzz(func(t *testing.T, document string) {
+		var want []string
+		wantErr := json.Unmarshal([]byte(document), &want)
+		got, gotErr := decodeStringArray(strings.NewReader(document))
+		if (gotErr == nil) != (wantErr == nil) || !slices.Equal(got, want) {
+			t.Fatalf("%q: got %q, %v; json.Unmarshal gives %q, %v", document, got, gotErr, want, wantErr)
+		}
+		filename := filepath.Join(t.TempDir(), "document.json")
+		if err := os.WriteFile(filename, []byte(document), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fromFile, fileErr := loadJSONFile(filename)
+		if (fileErr == nil) != (wantErr == nil) || !slices.Equal(fromFile, want) {
+			t.Fatalf("%q from a file: got %q, %v; json.Unmarshal gives %q, %v", document, fromFile, fileErr, want, wantErr)
+		}
+	})
+}
+
+// TestEntrySeparator checks that entries are joined with entrySeparator, also across
+// entry files, and that a pattern only found across the boundary of two entries is not
+// in the tree, even under a charset admitting every rune, while the separator itself is
+// a disallowed character
+func TestEntrySeparator(t *testing.T) {
+	entries := []string{"foo.com", "bar.org", "", "baz.net"}
+	text := buildSuperString(entries, maxStr2Len)
+	if want := "foo.com\x01bar.org\x01\x01baz.net"; text != want {
+		t.Fatalf("superstring %q, want %q", text, want)
+	}
+	if got := buildSuperString(entries, 8); got != "foo.com\x01" {
+		t.Fatalf("superstring cut to 8 bytes is %q", got)
+	}
+
+	dir, err := os.MkdirTemp("", "entry-separator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var filenames []string
+	for i, shard := range [][]string{entries[:1], entries[1:]} {
+		data, _ := json.Marshal(shard)
+		filenames = append(filenames, filepath.Join(dir, fmt.Sprintf("entries-%d.json", i)))
+		if err := os.WriteFile(filenames[i], data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _, err := readSuperString(filenames, maxStr2Len, Normalization{}); err != nil || got != text {
+		t.Fatalf("read %q across files, %v; want %q", got, err, text)
+	}
+
+	anyRune := NewCharsetFunc("any", func(rune) bool { return true })
+	for _, charset := range []Charset{DefaultCharset, anyRune} {
+		tree := NewMerkleTree(text, 8, WithCharset(charset))
+		if _, err := tree.GenerateProof("bar.org"); err != nil {
+			t.Fatalf("charset %s: %v", charset, err)
+		}
+		for _, spanning := range []string{"combar", "m.bar", "orgbaz"} {
+			if _, err := tree.GenerateProof(spanning); !errors.Is(err, ErrPatternNotFound) {
+				t.Fatalf("charset %s: %q across a boundary: got %v, want %v", charset, spanning, err, ErrPatternNotFound)
+			}
+		}
+		stats, err := ProcessSubstrings(context.Background(), []string{"combar", "m\x01bar"}, tree, nil, nil, nil, ProcessOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.NotFoundPatterns != 1 || stats.InvalidPatterns != 1 || !errors.Is(stats.Results[1].Err, ErrDisallowedChars) {
+			t.Fatalf("charset %s: %d not found and %d invalid, want 1 and 1", charset, stats.NotFoundPatterns, stats.InvalidPatterns)
+		}
+	}
+}
+
+// TestStreamedTree checks that enumerating substrings block by block finds exactly what
+// uniqueSubstrings finds, across block boundaries and multi-byte characters, with the
+// same source hash, and that one tree built from a repetitive entry file both ways has
+// the same root
+func TestStreamedTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []rune("abc.-_é日")
+	text := make([]rune, 3*textBlockSize/2)
+	for i := range text {
+		text[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	for _, c := range []struct {
+		text          string
+		maxPatternLen int
+		charset       Charset
+	}{
+		{string(text), 7, DefaultCharset},
+		{string(text), 1, DefaultCharset},
+		{string(text), 9, NewCharsetFunc("any", func(rune) bool { return true })},
+		{"", 4, DefaultCharset},
+		{"short.example", 32, DefaultCharset},
+	} {
+		want := uniqueSubstrings(c.text, c.maxPatternLen, c.charset)
+		source := newSourceHasher(c.maxPatternLen, c.charset, Normalization{}, LeafSubstrings)
+		got, err := uniqueSubstringsFrom(strings.NewReader(c.text), c.maxPatternLen, c.charset, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("%d-byte text, max %d: %d streamed substrings, want %d", len(c.text), c.maxPatternLen, len(got), len(want))
+		}
+		if source.Sum() != treeSourceHash(c.text, c.maxPatternLen, c.charset, Normalization{}, LeafSubstrings) {
+			t.Fatalf("%d-byte text, max %d: streamed source hash differs", len(c.text), c.maxPatternLen)
+		}
+	}
+
+	filenames := writeRepetitiveEntries(t)
+	joined, err := buildJoinedTree(filenames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := buildStreamedTree(filenames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.Root.Cmp(joined.Root) != 0 || streamed.SourceHash != joined.SourceHash {
+		t.Fatal("streamed tree differs from the one built from the joined text")
+	}
+}
+
+// Text limit and pattern length of the trees built from writeRepetitiveEntries
+const streamedTreeMaxBytes, streamedTreeMaxPatternLen = 1 << 20, 6
+
+// writeRepetitiveEntries writes an entry file in which, as in CT logs, the same names
+// repeat over and over, so most blocks add no new substring
+func writeRepetitiveEntries(tb testing.TB) []string {
+	entries := make([]string, 60000)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("www%d.example.com", i%300)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	filenames := []string{filepath.Join(tb.TempDir(), "entries.json")}
+	if err := os.WriteFile(filenames[0], data, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return filenames
+}
+
+// buildJoinedTree reads the entry files into one superstring, then builds its tree
+func buildJoinedTree(filenames []string) (*MerkleTree, error) {
+	superString, _, err := readSuperString(filenames, streamedTreeMaxBytes, Normalization{})
+	if err != nil {
+		return nil, err
+	}
+	return NewMerkleTree(superString, streamedTreeMaxPatternLen), nil
+}
+
+// buildStreamedTree builds the tree of the entry files block by block
+func buildStreamedTree(filenames []string) (*MerkleTree, error) {
+	text := newSuperStringReader(filenames, streamedTreeMaxBytes, Normalization{})
+	defer text.Close()
+	return NewMerkleTreeFromReader(bufio.NewReader(text), streamedTreeMaxPatternLen)
+}
+
+// BenchmarkStreamedTree builds the tree of a repetitive entry file from the joined
+// superstring and block by block, reporting the peak heap of each
+func BenchmarkStreamedTree(b *testing.B) {
+	filenames := writeRepetitiveEntries(b)
+	for _, c := range []struct {
+		name  string
+		build func([]string) (*MerkleTree, error)
+	}{{"joined", buildJoinedTree}, {"streamed", buildStreamedTree}} {
+		b.Run(c.name, func(b *testing.B) {
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				built, err := peakHeap(func() error {
+					_, err := c.build(filenames)
+					return err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				peak = max(peak, built)
+			}
+			b.ReportMetric(float64(peak), "peak-B")
+		})
+	}
+}
+
+// peakHeap runs f after a garbage collection and returns the most heap, beyond what was
+// live before, that sampling every millisecond saw in use while it ran
+func peakHeap(f func() error) (uint64, error) {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base, peak := m.HeapAlloc, m.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			peak = max(peak, m.HeapAlloc)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	err := f()
+	close(done)
+	<-sampled
+	return peak - base, err
+}
+
+// copiedSubstrings is the substring enumeration uniqueSubstrings replaced: it converts
+// superString to runes and copies every candidate substring into a new string before
+// deduplicating. It is kept to check uniqueSubstrings against on valid UTF-8.
+func copiedSubstrings(superString string, maxPatternLen int, charset Charset) []string {
+	substrSet := make(map[string]struct{})
+	runes := []rune(superString)
+	for start := range runes {
+		for end := start + 1; end <= len(runes) && charset.Allows(runes[end-1]); end++ {
+			substr := string(runes[start:end])
+			if len(substr) > maxPatternLen {
+				break
+			}
+			substrSet[substr] = struct{}{}
+		}
+	}
+	return sortedSubstrings(substrSet)
+}
+
+// TestSubstringSlicing checks that uniqueSubstrings, which keys its set with slices of
+// the superstring, finds the same substrings as copying each one did, for ASCII and
+// multi-byte text with disallowed characters
+func TestSubstringSlicing(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	alphabet := []rune("abc.-é日😀 /")
+	random := make([]rune, 5000)
+	for i := range random {
+		random[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	hostnames := buildSuperString([]string{"www.example.com", "mail.example.org", "bücher.de", "日本語.jp", "😀.example"}, maxStr2Len)
+	for _, c := range []struct {
+		text          string
+		maxPatternLen int
+		charset       Charset
+	}{
+		{hostnames, 1, DefaultCharset},
+		{hostnames, 8, DefaultCharset},
+		{hostnames, 70, DefaultCharset},
+		{hostnames, 8, NewCharsetFunc("any", func(rune) bool { return true })},
+		{string(random), 3, DefaultCharset},
+		{string(random), 12, DefaultCharset},
+		{"", 4, DefaultCharset},
+	} {
+		want := copiedSubstrings(c.text, c.maxPatternLen, c.charset)
+		if got := uniqueSubstrings(c.text, c.maxPatternLen, c.charset); !slices.Equal(got, want) {
+			t.Fatalf("%d-byte text, max %d, charset %s: %d sliced substrings, %d copied",
+				len(c.text), c.maxPatternLen, c.charset, len(got), len(want))
+		}
+	}
+}
+
+// BenchmarkSubstringSlicing enumerates the substrings of 2000 hostnames up to 16 bytes
+// by copying each one and with uniqueSubstrings, reporting the allocations of each
+func BenchmarkSubstringSlicing(b *testing.B) {
+	entries := make([]string, 2000)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("host%d.example.com", i)
+	}
+	text := buildSuperString(entries, maxStr2Len)
+	const maxPatternLen = 16
+	b.Run("copied", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			copiedSubstrings(text, maxPatternLen, DefaultCharset)
+		}
+	})
+	b.Run("sliced", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			uniqueSubstrings(text, maxPatternLen, DefaultCharset)
+		}
+	})
+}
+
+// TestEntryFiles checks that sharded entry files named by a glob or a comma-separated
+// list build the same superstring and root as one file holding their concatenation, that
+// per-file counts are recorded and survive Save and LoadMerkleTree, and that a path
+// matching nothing is named in the error
+func TestEntryFiles(t *testing.T) {
+	dir, err := os.MkdirTemp("", "entry-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) (string, error) {
+		filename := filepath.Join(dir, name)
+		return filename, os.WriteFile(filename, data, 0o644)
+	}
+
+	// Shards written out of order, in all three formats, plus the manual concatenation
+	shards := [][]string{{"example.com", "mail.example.com"}, {"cdn.example.net"}, {"*.example.org", "example.io", "a.b"}}
+	names := []string{"entries-002.jsonl.gz", "entries-000.json", "entries-001.jsonl"}
+	contents := [][]byte{nil, nil, nil}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	for _, entry := range shards[2] {
+		fmt.Fprintf(zw, "%q\n", entry)
+	}
+	zw.Close()
+	contents[0] = gz.Bytes()
+	if contents[1], err = json.Marshal(shards[0]); err != nil {
+		t.Fatal(err)
+	}
+	contents[2] = []byte(fmt.Sprintf("%q\n\n%q\n", shards[1][0], "")) // An empty entry adds nothing to the text
+	shards[1] = append(shards[1], "")
+	for i, name := range names {
+		if _, err := write(name, contents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	combined, err := json.Marshal(slices.Concat(shards...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	combinedFile, err := write("combined.json", combined)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantText, _, err := readSuperString([]string{combinedFile}, 1000, Normalization{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRoot := NewMerkleTree(wantText, 4).Root
+	ordered := []string{filepath.Join(dir, "entries-000.json"), filepath.Join(dir, "entries-001.jsonl"), filepath.Join(dir, "entries-002.jsonl.gz")}
+	for _, spec := range []string{
+		filepath.Join(dir, "entries-*"),
+		strings.Join(ordered, ","),
+		filepath.Join(dir, "entries-00[01]*") + " , " + ordered[2] + "," + ordered[0],
+	} {
+		paths, err := expandEntryPaths(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if !slices.Equal(paths, ordered) {
+			t.Fatalf("%s: expanded to %q, want %q", spec, paths, ordered)
+		}
+		text, sources, err := readSuperString(paths, 1000, Normalization{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []EntrySource{{ordered[0], 2}, {ordered[1], 2}, {ordered[2], 3}}
+		if text != wantText || !slices.Equal(sources, want) {
+			t.Fatalf("%s: read %q from %v, want %q from %v", spec, text, sources, wantText, want)
+		}
+		if root := NewMerkleTree(text, 4).Root; root.Cmp(wantRoot) != 0 {
+			t.Fatalf("%s: root differs from the concatenated file's", spec)
+		}
+	}
+
+	// Files after the text fills are not read
+	_, sources, err := readSuperString(ordered, 12, Normalization{})
+	if err != nil || sources[0].Entries != 2 || sources[1].Entries != 0 || sources[2].Entries != 0 {
+		t.Fatalf("stopping at 12 bytes: read %v, %v", sources, err)
+	}
+
+	missing := filepath.Join(dir, "missing.json")
+	_, err = expandEntryPaths(ordered[0] + "," + missing + "," + filepath.Join(dir, "shard-*"))
+	if err == nil || !strings.Contains(err.Error(), missing) || !strings.Contains(err.Error(), "shard-*") {
+		t.Fatalf("unmatched paths: got %v, want an error naming both", err)
+	}
+	if _, err := expandEntryPaths(" , "); err == nil {
+		t.Fatal("empty list accepted")
+	}
+
+	tree := NewMerkleTree(wantText, 4, WithEntrySources(sources))
+	treeFile := filepath.Join(dir, "tree.bin")
+	if err := tree.Save(treeFile); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMerkleTree(treeFile, tree.SourceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(loaded.Sources, sources) {
+		t.Fatalf("loaded sources %v, want %v", loaded.Sources, sources)
+	}
+}
+
+// TestGzipJSON writes the same entries as plain and gzipped JSON, with and without a
+// .gz extension, and checks loadJSONFile returns identical results for all of them
+func TestGzipJSON(t *testing.T) {
+	dir, err := os.MkdirTemp("", "json-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []string{"example.com", "*.example.org", "test-123.net"}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "entries.json")
+	if err := os.WriteFile(plain, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var compressed strings.Builder
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzipped := filepath.Join(dir, "entries.json.gz")
+	unlabelled := filepath.Join(dir, "entries-compressed.json")
+	for _, name := range []string{gzipped, unlabelled} {
+		if err := os.WriteFile(name, []byte(compressed.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{plain, gzipped, unlabelled} {
+		got, err := loadJSONFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("%s: got %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+// TestEntryFormats checks that a JSON array, JSON Lines and gzipped JSON Lines load the
+// same entries, that a malformed line is reported with its line number, that corrupted
+// and truncated gzip streams are errors, and that readSuperString matches buildSuperString
+// and stops reading once the text is full
+func TestEntryFormats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "entry-formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) (string, error) {
+		filename := filepath.Join(dir, name)
+		return filename, os.WriteFile(filename, data, 0644)
+	}
+	gzipped := func(data []byte) []byte {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(data)
+		gz.Close()
+		return b.Bytes()
+	}
+
+	want := []string{"example.com", "WWW.Bücher.DE.", "line\nbreak", "", "*.example.org"}
+	array, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines bytes.Buffer
+	for i, entry := range want {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines.Write(encoded)
+		if i == 1 {
+			lines.WriteString("\r\n\n  \n") // CRLF and blank lines
+		} else if i < len(want)-1 {
+			lines.WriteByte('\n')
+		}
+	}
+	var files []string
+	for name, data := range map[string][]byte{
+		"entries.json":        array,
+		"entries.jsonl":       lines.Bytes(),
+		"entries.ndjson":      lines.Bytes(),
+		"entries.jsonl.gz":    gzipped(lines.Bytes()),
+		"entries.json.gz":     gzipped(array),
+		"compressed.jsonl":    gzipped(lines.Bytes()),
+		"empty-entries.jsonl": nil,
+	} {
+		filename, err := write(name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+	}
+	for _, filename := range files {
+		got, err := loadJSONFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(filename), err)
+		}
+		expected := want
+		if strings.HasPrefix(filepath.Base(filename), "empty") {
+			expected = []string{}
+		}
+		if !slices.Equal(got, expected) {
+			t.Fatalf("%s: got %q, want %q", filepath.Base(filename), got, expected)
+		}
+	}
+
+	malformed, err := write("malformed.jsonl.gz", gzipped([]byte("\"a\"\n\n\"b\"\n[\"c\"]\n\"d\"\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJSONFile(malformed); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("malformed line 4: got %v, want an error naming the line", err)
+	}
+	compressed := gzipped(lines.Bytes())
+	corrupted := slices.Clone(compressed)
+	corrupted[len(corrupted)-8] ^= 0xff // CRC-32 in the gzip trailer
+	for name, data := range map[string][]byte{
+		"corrupted.jsonl.gz": corrupted,
+		"truncated.jsonl.gz": compressed[:len(compressed)/2],
+		"truncated.json.gz":  gzipped(array)[:20],
+	} {
+		filename, err := write(name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadJSONFile(filename); err == nil {
+			t.Fatalf("%s loaded without an error", name)
+		}
+	}
+
+	all, _ := ParseNormalization("all")
+	for _, maxBytes := range []int{1, 13, 20, 1000} {
+		for _, filename := range files {
+			if strings.HasPrefix(filepath.Base(filename), "empty") {
+				continue
+			}
+			got, sources, err := readSuperString([]string{filename}, maxBytes, all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantText, count := buildSuperString(all.ApplyAll(want), maxBytes), sources[0].Entries; got != wantText || count == 0 {
+				t.Fatalf("%d bytes: read %q from %d entries, want %q", maxBytes, got, count, wantText)
+			}
+		}
+	}
+	// Entries past the limit are never read, so a later malformed line goes unnoticed
+	got, sources, err := readSuperString([]string{malformed}, 1, Normalization{})
+	if err != nil || got != "a" || sources[0].Entries != 1 {
+		t.Fatalf("stopping at 1 byte: got %q from %v, %v", got, sources, err)
+	}
+}
+
+// TestJSONDecoding checks decodeStringArray against json.Unmarshal on valid and invalid
+// inputs
+func TestJSONDecoding(t *testing.T) {
+	for _, input := range []string{`["a","b"]`, ` [ ] `, `null`, `{}`, `[1]`, `["a"] x`, `["a"`, `"a"`} {
+		var want []string
+		wantErr := json.Unmarshal([]byte(input), &want)
+		got, gotErr := decodeStringArray(strings.NewReader(input))
+		if (gotErr == nil) != (wantErr == nil) || strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("%s: got %q, %v; json.Unmarshal gives %q, %v", input, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+// BenchmarkJSONDecoding reads a file of 100000 entries, over 3MB, with loadJSONFile and
+// by reading the whole file and unmarshalling it, reporting the allocations of each
+func BenchmarkJSONDecoding(b *testing.B) {
+	entries := make([]string, 100000)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("certificate-%06d.example.com", i)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		b.Fatal(err)
+	}
+	filename := filepath.Join(b.TempDir(), "entries.json")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.Run("readAll", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			raw, err := os.ReadFile(filename)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var decoded []string
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("stream", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := loadJSONFile(filename); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestProgressFormat checks the progress line for a known elapsed time and ETA
+func TestProgressFormat(t *testing.T) {
+	const want = "[===-----] 42.00% (420/1000) 7m0s 60.0 proofs/min ETA 15s"
+	if got := formatProgress(420, 1000, 8, 7*time.Minute, 15*time.Second); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// TestProgressBar checks the moving-average ETA, that a terminal gets a redrawn bar and
+// anything else a "Progress" log line with nothing drawn, that updates within the redraw
+// interval are skipped but the last one never is, and that a regular file is no terminal
+func TestProgressBar(t *testing.T) {
+	var results []SubstringResult
+	for i := 0; i < 25; i++ {
+		d := time.Second
+		if i < 5 {
+			d = 10 * time.Second
+		}
+		results = append(results, SubstringResult{ProveTime: d - 200*time.Millisecond, VerifyTime: 200 * time.Millisecond})
+	}
+	if avg := recentAverage(results, progressWindow); avg != time.Second {
+		t.Fatalf("average over the last %d of 25 results is %v, want 1s", progressWindow, avg)
+	}
+	if avg := recentAverage(results[:3], progressWindow); avg != 10*time.Second {
+		t.Fatalf("average over 3 results is %v, want 10s", avg)
+	}
+	if avg := recentAverage(nil, progressWindow); avg != 0 {
+		t.Fatalf("average over no results is %v, want 0", avg)
+	}
+	if eta := estimateRemaining(time.Second, 25, 100); eta != 75*time.Second {
+		t.Fatalf("ETA for 75 items at 1s is %v, want 75s", eta)
+	}
+	if eta := estimateRemaining(time.Second, 100, 100); eta != 0 {
+		t.Fatalf("ETA when done is %v, want 0", eta)
+	}
+	if rate := throughputPerMinute(30, 30*time.Second); rate != 60 {
+		t.Fatalf("30 items in 30s is %.1f per minute, want 60", rate)
+	}
+
+	stats := &ProcessingStats{Results: results[20:]}
+	var out bytes.Buffer
+	tty := newProgressBarOn(&out, true, 10)
+	tty.Update(1, stats)
+	if !strings.HasPrefix(out.String(), "\rProgress: [") || !strings.Contains(out.String(), "(1/10)") || !strings.Contains(out.String(), "ETA 9s") {
+		t.Fatalf("terminal bar drew %q", out.String())
+	}
+	drawn := out.Len()
+	tty.Update(2, stats)
+	if out.Len() != drawn {
+		t.Fatal("terminal bar redrawn within the redraw interval")
+	}
+	tty.Update(10, stats)
+	if last := out.String()[drawn:]; !strings.Contains(last, "100.00% (10/10)") || !strings.Contains(last, "ETA 0s") {
+		t.Fatalf("final terminal update drew %q", last)
+	}
+
+	var logged bytes.Buffer
+	defer func(saved *slog.Logger) { logger = saved }(logger)
+	logger = slog.New(slog.NewTextHandler(&logged, nil))
+	out.Reset()
+	plain := newProgressBarOn(&out, false, 10)
+	plain.Update(1, stats)
+	plain.Update(2, stats)
+	plain.Update(10, stats)
+	if out.Len() != 0 {
+		t.Fatalf("progress off a terminal drew %q", out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "msg=Progress done=1 total=10") || !strings.Contains(lines[1], "done=10 total=10") {
+		t.Fatalf("progress off a terminal logged %q, want lines for 1 and 10 of 10", lines)
+	}
+
+	file, err := os.CreateTemp("", "progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if isTerminal(file) {
+		t.Fatalf("%s taken for a terminal", file.Name())
+	}
+}
+
+// TestReportRoundTrip checks that a written report reads back unchanged, with per-substring
+// outcomes only in verbose mode
+func TestReportRoundTrip(t *testing.T) {
+	stats := ProcessingStats{
+		TotalTime:         90 * time.Second,
+		TreeBuildTime:     1500 * time.Millisecond,
+		TotalProofTime:    80 * time.Second,
+		VerificationTime:  3 * time.Millisecond,
+		ProcessedPatterns: 4,
+		SuccessfulProofs:  1,
+		CachedProofs:      1,
+		FailedProofs:      1,
+		NotFoundPatterns:  1,
+		Results: []SubstringResult{
+			{Pattern: "example", Found: true, ProveTime: 750 * time.Millisecond},
+			{Pattern: "cached", Found: true, Cached: true},
+			{Pattern: "absent"},
+			{Pattern: "failed", Found: true, Err: ErrPatternTooLong},
+		},
+	}
+	dir, err := os.MkdirTemp("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "report.json")
+	for _, verbose := range []bool{false, true} {
+		if err := writeReport(filename, stats, verbose); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readReport(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := newReport(stats, verbose); !reflect.DeepEqual(got, want) {
+			t.Fatalf("verbose=%v: read back %+v, want %+v", verbose, got, want)
+		}
+		if verbose != (len(got.Substrings) == len(stats.Results)) || !verbose && len(got.Substrings) > 0 {
+			t.Fatalf("verbose=%v: %d substring outcomes for %d results", verbose, len(got.Substrings), len(stats.Results))
+		}
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"treeBuildTime": "1.5s"`) {
+		t.Fatal("durations are not human-readable")
+	}
+}
+
+// TestBenchCompare runs a small bench compare and checks that the table has one row per
+// circuit and configuration, in both formats, that the sliding-window circuits grow
+// strictly with the text length and that the entry tree is smaller than the substring tree
+func TestBenchCompare(t *testing.T) {
+	patternLens, textLens := []int{2, 4}, []int{8, 16, 32}
+	rows, err := runBenchCompare(patternLens, textLens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuits := []string{"naive", "rabin-karp", "merkle", "entries"}
+	want := len(circuits) * len(patternLens) * len(textLens)
+	if len(rows) != want {
+		t.Fatalf("%d rows, want %d", len(rows), want)
+	}
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		key := fmt.Sprintf("%s/%d/%d", r.Circuit, r.PatternLen, r.TextLen)
+		if seen[key] || !slices.Contains(circuits, r.Circuit) || r.Size.NbConstraints == 0 {
+			t.Fatalf("unexpected row %+v", r)
+		}
+		seen[key] = true
+	}
+	for i, r := range rows {
+		if r.Circuit == "entries" && (rows[i-1].Circuit != "merkle" || r.Leaves >= rows[i-1].Leaves || r.Leaves != (r.TextLen+benchEntryLen-1)/benchEntryLen) {
+			t.Fatalf("entry tree of %d leaves for text %d, substring tree of %d", r.Leaves, r.TextLen, rows[i-1].Leaves)
+		}
+	}
+
+	for _, circuit := range circuits[:2] {
+		for _, patternLen := range patternLens {
+			prev := 0
+			for _, r := range rows {
+				if r.Circuit != circuit || r.PatternLen != patternLen {
+					continue
+				}
+				if r.Size.NbConstraints <= prev {
+					t.Fatalf("%s circuit, pattern %d: %d constraints for text %d, not above %d", circuit, patternLen, r.Size.NbConstraints, r.TextLen, prev)
+				}
+				prev = r.Size.NbConstraints
+			}
+		}
+	}
+
+	var csvOut, markdownOut bytes.Buffer
+	if err := writeBenchTable(&csvOut, rows, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&csvOut).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != want+1 || !slices.Equal(records[0], benchHeader) {
+		t.Fatalf("CSV has %d records, want a header and %d rows", len(records), want)
+	}
+	if err := writeBenchTable(&markdownOut, rows, "markdown"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(markdownOut.String(), "\n"); lines != want+2 {
+		t.Fatalf("markdown table has %d lines, want %d", lines, want+2)
+	}
+	if writeBenchTable(io.Discard, rows, "tsv") == nil {
+		t.Fatal("unknown bench format accepted")
+	}
+}
+
+// TestLogLevels processes a present and an absent pattern with the console at warn and
+// at info: at warn it must show no info line, none of the per-substring ones included,
+// while the log file still receives them; at info they reach the console
+func TestLogLevels(t *testing.T) {
+	tree := NewMerkleTree("example.com", 4)
+	ccs, err := frontend.Compile(fieldModulus, r1cs.NewBuilder, &SubstringCircuit{hash: tree.Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *slog.Logger) { logger = saved }(logger)
+
+	perSubstring := []string{"Proof verified successfully", "Substring not found in the Merkle tree"}
+	for _, levelName := range []string{"warn", "info"} {
+		level, err := parseLogLevel(levelName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var console, logFile bytes.Buffer
+		logger = newLogger(&console, level, &logFile)
+		stats, err := ProcessSubstrings(context.Background(), []string{"exa", "zzzz"}, tree, pk, vk, ccs, ProcessOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.SuccessfulProofs != 1 || stats.NotFoundPatterns != 1 {
+			t.Fatalf("-log-level %s: %d proved and %d not found, want 1 and 1", levelName, stats.SuccessfulProofs, stats.NotFoundPatterns)
+		}
+		for _, msg := range perSubstring {
+			if !strings.Contains(logFile.String(), msg) {
+				t.Fatalf("-log-level %s: log file lacks %q", levelName, msg)
+			}
+			if shown := strings.Contains(console.String(), msg); shown != (level <= slog.LevelInfo) {
+				t.Fatalf("-log-level %s: console shows %q: %t", levelName, msg, shown)
+			}
+		}
+		if level > slog.LevelInfo && strings.Contains(console.String(), "level=INFO") {
+			t.Fatalf("-log-level %s: console has info lines:\n%s", levelName, console.String())
+		}
+	}
+}
@@ -1,57 +1,74 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/big"
 	"math/rand"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
 )
 
-// EvaluateBezoutCircuit checks that (a(x)*s(x) + b(x)*t(x)) = 1 for given polynomials a,s,b,t and a witness x.
+// EvaluateBezoutCircuit checks that (a(x)*s(x) + b(x)*t(x)) = 1 for given polynomials a,s,b,t
+// at the public point x. The verifier sets x to bezoutChallenge of the coefficients instead of
+// letting the prover choose it, so the check fails w.h.p. unless the identity holds for all x.
 type EvaluateBezoutCircuit struct {
 	A []frontend.Variable `gnark:"a,public"` // coefficients of A(x)
 	S []frontend.Variable `gnark:"s,public"` // coefficients of S(x)
 	B []frontend.Variable `gnark:"b,public"` // coefficients of B(x)
 	T []frontend.Variable `gnark:"t,public"` // coefficients of T(x)
-	X frontend.Variable   `gnark:"x"`        // witness where we evaluate the polynomials
+	X frontend.Variable   `gnark:"x,public"` // point where we evaluate the polynomials
+
+	powers bool // Evaluate with running powers of x instead of Horner's rule, for comparison
 }
 
-func (c *EvaluateBezoutCircuit) Define(api frontend.API) error {
-	// Evaluate a(x)
-	aVal := frontend.Variable(0)
-	xPow := frontend.Variable(1)
-	for i := 0; i < len(c.A); i++ {
-		aVal = api.Add(aVal, api.Mul(c.A[i], xPow))
-		xPow = api.Mul(xPow, c.X)
+// evalHorner evaluates the polynomial with the given coefficients (lowest degree first)
+// at x using Horner's rule, costing one multiplication per coefficient.
+func evalHorner(api frontend.API, coeffs []frontend.Variable, x frontend.Variable) frontend.Variable {
+	acc := frontend.Variable(0)
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		acc = api.Add(api.Mul(acc, x), coeffs[i])
 	}
+	return acc
+}
 
-	// Evaluate s(x)
-	sVal := frontend.Variable(0)
-	xPow = frontend.Variable(1)
-	for i := 0; i < len(c.S); i++ {
-		sVal = api.Add(sVal, api.Mul(c.S[i], xPow))
-		xPow = api.Mul(xPow, c.X)
+// evalPowers evaluates the polynomial at x as the sum of coeffs[i]*x^i, keeping a running
+// power of x: two multiplications per coefficient. It is kept to compare against evalHorner.
+func evalPowers(api frontend.API, coeffs []frontend.Variable, x frontend.Variable) frontend.Variable {
+	acc := frontend.Variable(0)
+	xPow := frontend.Variable(1)
+	for i := range coeffs {
+		acc = api.Add(acc, api.Mul(coeffs[i], xPow))
+		xPow = api.Mul(xPow, x)
 	}
+	return acc
+}
 
-	// Evaluate b(x)
-	bVal := frontend.Variable(0)
-	xPow = frontend.Variable(1)
-	for i := 0; i < len(c.B); i++ {
-		bVal = api.Add(bVal, api.Mul(c.B[i], xPow))
-		xPow = api.Mul(xPow, c.X)
+func (c *EvaluateBezoutCircuit) Define(api frontend.API) error {
+	eval := evalHorner
+	if c.powers {
+		eval = evalPowers
 	}
 
-	// Evaluate t(x)
-	tVal := frontend.Variable(0)
-	xPow = frontend.Variable(1)
-	for i := 0; i < len(c.T); i++ {
-		tVal = api.Add(tVal, api.Mul(c.T[i], xPow))
-		xPow = api.Mul(xPow, c.X)
-	}
+	// Evaluate a(x), s(x), b(x), t(x)
+	aVal := eval(api, c.A, c.X)
+	sVal := eval(api, c.S, c.X)
+	bVal := eval(api, c.B, c.X)
+	tVal := eval(api, c.T, c.X)
 
 	// Compute a(x)*s(x) + b(x)*t(x)
 	lhs := api.Add(api.Mul(aVal, sVal), api.Mul(bVal, tVal))
@@ -62,73 +79,382 @@ func (c *EvaluateBezoutCircuit) Define(api frontend.API) error {
 	return nil
 }
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
+// errNotCoprime is returned by bezout when A and B share a non-constant factor
+var errNotCoprime = errors.New("polynomials are not coprime")
 
-	// Example degrees:
-	degAs := []int{100000, 200000, 300000, 400000, 500000, 600000}
-	degBs := []int{100, 200, 400, 800, 1000}
+// polyTrim drops zero leading coefficients, so the empty slice is the zero polynomial
+func polyTrim(p []fr.Element) []fr.Element {
+	for len(p) > 0 && p[len(p)-1].IsZero() {
+		p = p[:len(p)-1]
+	}
+	return p
+}
 
-	fmt.Println("degA,degB,time_compile_ms,time_witness_ms,time_total_ms")
+// polyMulSub returns a - q*b
+func polyMulSub(a, q, b []fr.Element) []fr.Element {
+	res := make([]fr.Element, max(len(a), len(q)+len(b)-1))
+	copy(res, a)
+	var term fr.Element
+	for i := range q {
+		if q[i].IsZero() {
+			continue
+		}
+		for j := range b {
+			term.Mul(&q[i], &b[j])
+			res[i+j].Sub(&res[i+j], &term)
+		}
+	}
+	return polyTrim(res)
+}
 
-	for _, degA := range degAs {
-		lenA := degA + 1
-		lenS := lenA
+// polyDivMod divides a by the non-zero polynomial b, returning quotient and remainder
+func polyDivMod(a, b []fr.Element) ([]fr.Element, []fr.Element) {
+	b = polyTrim(b)
+	r := append([]fr.Element(nil), polyTrim(a)...)
+	if len(r) < len(b) {
+		return nil, r
+	}
+	q := make([]fr.Element, len(r)-len(b)+1)
+	var lead, term fr.Element
+	lead.Inverse(&b[len(b)-1])
+	for i := len(q) - 1; i >= 0; i-- {
+		q[i].Mul(&r[i+len(b)-1], &lead)
+		for j := range b {
+			term.Mul(&q[i], &b[j])
+			r[i+j].Sub(&r[i+j], &term)
+		}
+	}
+	return q, polyTrim(r[:len(b)-1])
+}
 
-		for _, degB := range degBs {
-			lenB := degB + 1
-			lenT := lenB
-
-			// Generate random coefficients for A,S,B,T
-			A := make([]frontend.Variable, lenA)
-			S := make([]frontend.Variable, lenS)
-			B := make([]frontend.Variable, lenB)
-			T := make([]frontend.Variable, lenT)
-
-			for i := 0; i < lenA; i++ {
-				A[i] = rand.Int63()
-				S[i] = rand.Int63()
-			}
-			for i := 0; i < lenB; i++ {
-				B[i] = rand.Int63()
-				T[i] = rand.Int63()
-			}
+// bezout runs the extended Euclidean algorithm over fr, returning S and T with
+// A*S + B*T = 1, deg S < deg B and deg T < deg A
+func bezout(A, B []fr.Element) ([]fr.Element, []fr.Element, error) {
+	r0, r1 := polyTrim(A), polyTrim(B)
+	if len(r0) == 0 || len(r1) == 0 {
+		return nil, nil, errNotCoprime
+	}
+	s0, s1 := []fr.Element{fr.One()}, []fr.Element(nil)
+	t0, t1 := []fr.Element(nil), []fr.Element{fr.One()}
+	for len(r1) > 0 {
+		q, r := polyDivMod(r0, r1)
+		r0, r1 = r1, r
+		s0, s1 = s1, polyMulSub(s0, q, s1)
+		t0, t1 = t1, polyMulSub(t0, q, t1)
+	}
+	// r0 is the gcd; only a non-zero constant can be scaled to 1
+	if len(r0) != 1 {
+		return nil, nil, errNotCoprime
+	}
+	var inv fr.Element
+	inv.Inverse(&r0[0])
+	for i := range s0 {
+		s0[i].Mul(&s0[i], &inv)
+	}
+	for i := range t0 {
+		t0[i].Mul(&t0[i], &inv)
+	}
+	return s0, t0, nil
+}
+
+// randomPoly returns a polynomial of exactly the given degree with coefficients drawn from
+// rng, so a sweep run with the same seed proves the same polynomials
+func randomPoly(degree int, rng *rand.Rand) []fr.Element {
+	p := make([]fr.Element, degree+1)
+	for i := range p {
+		randomElement(&p[i], rng)
+	}
+	for p[degree].IsZero() {
+		randomElement(&p[degree], rng)
+	}
+	return p
+}
+
+// randomElement sets e to a field element drawn uniformly with rng
+func randomElement(e *fr.Element, rng *rand.Rand) {
+	e.SetBigInt(new(big.Int).Rand(rng, fr.Modulus()))
+}
+
+// padCoeffs returns coeffs extended with zero coefficients to n
+func padCoeffs(coeffs []fr.Element, n int) []fr.Element {
+	padded := make([]fr.Element, n)
+	copy(padded, coeffs)
+	return padded
+}
+
+// toVariables returns coeffs as circuit variables
+func toVariables(coeffs []fr.Element) []frontend.Variable {
+	vars := make([]frontend.Variable, len(coeffs))
+	for i := range coeffs {
+		vars[i] = coeffs[i]
+	}
+	return vars
+}
+
+// bezoutChallenge derives the evaluation point from the coefficients exactly as the
+// circuit receives them, Fiat-Shamir style: each polynomial's length and 32-byte
+// coefficients are hashed to the field, so S and T cannot be picked after the point.
+func bezoutChallenge(A, S, B, T []fr.Element) (fr.Element, error) {
+	msg := make([]byte, 0, 8*4+fr.Bytes*(len(A)+len(S)+len(B)+len(T)))
+	for _, p := range [][]fr.Element{A, S, B, T} {
+		msg = binary.BigEndian.AppendUint64(msg, uint64(len(p)))
+		for i := range p {
+			b := p[i].Bytes()
+			msg = append(msg, b[:]...)
+		}
+	}
+	x, err := fr.Hash(msg, []byte("EvaluateBezoutCircuit.X"), 1)
+	if err != nil {
+		return fr.Element{}, err
+	}
+	return x[0], nil
+}
+
+// circuitSize is the size of a compiled constraint system
+type circuitSize struct {
+	NbConstraints, NbPublic, NbSecret, NbInternal int
+}
 
-			// Generate a random witness x
-			x := rand.Int63()
+// sizeOf returns the size of ccs
+func sizeOf(ccs constraint.ConstraintSystem) circuitSize {
+	return circuitSize{
+		NbConstraints: ccs.GetNbConstraints(),
+		NbPublic:      ccs.GetNbPublicVariables(),
+		NbSecret:      ccs.GetNbSecretVariables(),
+		NbInternal:    ccs.GetNbInternalVariables(),
+	}
+}
 
-			var circuit EvaluateBezoutCircuit
-			circuit.A = append([]frontend.Variable(nil), A...)
-			circuit.S = append([]frontend.Variable(nil), S...)
-			circuit.B = append([]frontend.Variable(nil), B...)
-			circuit.T = append([]frontend.Variable(nil), T...)
-			circuit.X = x
+// bezoutTimings are the milliseconds spent in each stage of proving one configuration,
+// and the size of its compiled circuit
+type bezoutTimings struct {
+	Compile, Witness, Setup, Prove, Verify int64
+	circuitSize
+}
 
-			startCompile := time.Now()
-			_, err := frontend.Compile(fr.Modulus(), r1cs.NewBuilder, &circuit)
+// stages returns the stage timings in CSV column order, followed by their total
+func (t bezoutTimings) stages() []int64 {
+	return []int64{t.Compile, t.Witness, t.Setup, t.Prove, t.Verify, t.Compile + t.Witness + t.Setup + t.Prove + t.Verify}
+}
+
+// proveBezout compiles EvaluateBezoutCircuit for A and B with S and T padded to
+// len(B)-1 and len(A)-1 coefficients, then proves the identity at bezoutChallenge, or at
+// proverX when set, and verifies it as a verifier would: at bezoutChallenge of the
+// public coefficients. The verification time includes deriving the challenge. With powers
+// the circuit evaluates the polynomials with evalPowers instead of evalHorner.
+func proveBezout(A, S, B, T []fr.Element, proverX *fr.Element, powers bool) (bezoutTimings, error) {
+	var timings bezoutTimings
+	lenA, lenB := len(A), len(B)
+	lenS, lenT := max(lenB-1, 1), max(lenA-1, 1)
+	if len(S) > lenS || len(T) > lenT {
+		return timings, fmt.Errorf("S and T have %d and %d coefficients, want at most %d and %d", len(S), len(T), lenS, lenT)
+	}
+	S, T = padCoeffs(S, lenS), padCoeffs(T, lenT)
+
+	circuit := EvaluateBezoutCircuit{
+		A:      make([]frontend.Variable, lenA),
+		S:      make([]frontend.Variable, lenS),
+		B:      make([]frontend.Variable, lenB),
+		T:      make([]frontend.Variable, lenT),
+		powers: powers,
+	}
+	startCompile := time.Now()
+	ccs, err := frontend.Compile(fr.Modulus(), r1cs.NewBuilder, &circuit)
+	if err != nil {
+		return timings, fmt.Errorf("circuit compilation failed: %w", err)
+	}
+	timings.Compile = time.Since(startCompile).Milliseconds()
+	timings.circuitSize = sizeOf(ccs)
+
+	startWitness := time.Now()
+	x, err := bezoutChallenge(A, S, B, T)
+	if err != nil {
+		return timings, fmt.Errorf("failed to derive x: %w", err)
+	}
+	if proverX != nil {
+		x = *proverX
+	}
+	assignment := EvaluateBezoutCircuit{A: toVariables(A), S: toVariables(S), B: toVariables(B), T: toVariables(T), X: x}
+	witness, err := frontend.NewWitness(&assignment, fr.Modulus())
+	if err != nil {
+		return timings, fmt.Errorf("failed to create witness: %w", err)
+	}
+	timings.Witness = time.Since(startWitness).Milliseconds()
+
+	startSetup := time.Now()
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		return timings, fmt.Errorf("setup failed: %w", err)
+	}
+	timings.Setup = time.Since(startSetup).Milliseconds()
+
+	startProve := time.Now()
+	proof, err := groth16.Prove(ccs, pk, witness)
+	if err != nil {
+		return timings, fmt.Errorf("proving failed: %w", err)
+	}
+	timings.Prove = time.Since(startProve).Milliseconds()
+
+	startVerify := time.Now()
+	verifierX, err := bezoutChallenge(A, S, B, T)
+	if err != nil {
+		return timings, fmt.Errorf("failed to derive x: %w", err)
+	}
+	statement := EvaluateBezoutCircuit{A: toVariables(A), S: toVariables(S), B: toVariables(B), T: toVariables(T), X: verifierX}
+	publicWitness, err := frontend.NewWitness(&statement, fr.Modulus(), frontend.PublicOnly())
+	if err != nil {
+		return timings, fmt.Errorf("failed to create public witness: %w", err)
+	}
+	if err := groth16.Verify(proof, vk, publicWitness); err != nil {
+		return timings, fmt.Errorf("verification failed: %w", err)
+	}
+	timings.Verify = time.Since(startVerify).Milliseconds()
+	return timings, nil
+}
+
+// resultsHeader names the CSV columns runSweep writes: the evaluation strategy, the
+// circuit size, the mean and standard deviation of each stage over the repeats, and the
+// peak RSS after the last one
+var resultsHeader = []string{"degA", "degB", "eval", "nbConstraints", "nbPublic", "nbSecret", "nbInternal", "repeat",
+	"time_compile_ms_mean", "time_compile_ms_stddev", "time_witness_ms_mean", "time_witness_ms_stddev",
+	"time_setup_ms_mean", "time_setup_ms_stddev", "time_prove_ms_mean", "time_prove_ms_stddev",
+	"time_verify_ms_mean", "time_verify_ms_stddev", "time_total_ms_mean", "time_total_ms_stddev", "peak_rss_kb"}
+
+// runSweep proves every (degA, degB) configuration repeat times with random coprime
+// polynomials drawn from seed, writing one row per configuration as soon as it is done, so
+// a sweep with the same seed proves the same polynomials. With powers the circuit uses
+// evalPowers instead of evalHorner.
+func runSweep(results *csv.Writer, degAs, degBs []int, repeat int, powers bool, seed int64) error {
+	if err := writeRow(results, resultsHeader); err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(seed))
+	for _, degA := range degAs {
+		for _, degB := range degBs {
+			// Random A and B are coprime with overwhelming probability; bezout reports if not
+			A, B := randomPoly(degA, rng), randomPoly(degB, rng)
+			S, T, err := bezout(A, B)
 			if err != nil {
-				log.Fatal("circuit compilation failed:", err)
+				return fmt.Errorf("compute Bezout coefficients: %w", err)
 			}
-			timeCompile := time.Since(startCompile).Milliseconds()
-
-			startWitness := time.Now()
-			witness := EvaluateBezoutCircuit{
-				A: A,
-				S: S,
-				B: B,
-				T: T,
-				X: x,
+
+			// runs[stage][i] is the stage's time in the i-th repeat
+			runs := make([][]int64, len(bezoutTimings{}.stages()))
+			var timings bezoutTimings
+			for i := 0; i < repeat; i++ {
+				if timings, err = proveBezout(A, S, B, T, nil, powers); err != nil {
+					return fmt.Errorf("degA=%d degB=%d: %w", degA, degB, err)
+				}
+				for stage, ms := range timings.stages() {
+					runs[stage] = append(runs[stage], ms)
+				}
 			}
 
-			_, err = frontend.NewWitness(&witness, fr.Modulus())
-			if err != nil {
-				log.Fatal("Failed to create witness:", err)
+			eval := "horner"
+			if powers {
+				eval = "powers"
+			}
+			record := []string{strconv.Itoa(degA), strconv.Itoa(degB), eval, strconv.Itoa(timings.NbConstraints),
+				strconv.Itoa(timings.NbPublic), strconv.Itoa(timings.NbSecret), strconv.Itoa(timings.NbInternal), strconv.Itoa(repeat)}
+			for _, ms := range runs {
+				mean, stddev := meanStddev(ms)
+				record = append(record, strconv.FormatFloat(mean, 'f', 1, 64), strconv.FormatFloat(stddev, 'f', 1, 64))
+			}
+			record = append(record, strconv.FormatInt(peakRSSKB(), 10))
+			if err := writeRow(results, record); err != nil {
+				return fmt.Errorf("write results: %w", err)
 			}
-			timeWitness := time.Since(startWitness).Milliseconds()
+		}
+	}
+	return nil
+}
 
-			timeTotal := timeCompile + timeWitness
+// meanStddev returns the mean and sample standard deviation of xs, with a zero deviation
+// for a single value
+func meanStddev(xs []int64) (mean, stddev float64) {
+	for _, x := range xs {
+		mean += float64(x)
+	}
+	mean /= float64(len(xs))
+	if len(xs) < 2 {
+		return mean, 0
+	}
+	var sumSq float64
+	for _, x := range xs {
+		sumSq += (float64(x) - mean) * (float64(x) - mean)
+	}
+	return mean, math.Sqrt(sumSq / float64(len(xs)-1))
+}
+
+// peakRSSKB returns the process's peak resident set size in KiB from /proc/self/status,
+// or 0 where that is unavailable
+func peakRSSKB() int64 {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if rest, ok := strings.CutPrefix(line, "VmHWM:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "kB")), 10, 64)
+			return kb
+		}
+	}
+	return 0
+}
 
-			fmt.Printf("%d,%d,%d,%d,%d\n", degA, degB, timeCompile, timeWitness, timeTotal)
+// openResultsWriter returns a CSV writer that writes to outPath (if set) and echoes
+// to stdout unless quiet, along with a function that closes the output file.
+func openResultsWriter(outPath string, quiet bool) (*csv.Writer, func() error, error) {
+	var writers []io.Writer
+	closeFn := func() error { return nil }
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return nil, nil, err
 		}
+		writers = append(writers, file)
+		closeFn = file.Close
+	}
+	if !quiet || outPath == "" {
+		writers = append(writers, os.Stdout)
+	}
+	return csv.NewWriter(io.MultiWriter(writers...)), closeFn, nil
+}
+
+// writeRow writes a single CSV row and flushes it so partial sweeps are recoverable
+func writeRow(w *csv.Writer, record []string) error {
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func main() {
+	outPath := flag.String("out", "", "Write benchmark results as CSV to this file")
+	quiet := flag.Bool("quiet", false, "Do not echo results to stdout when -out is set")
+	repeat := flag.Int("repeat", 1, "Prove each configuration this many times and report the mean and standard deviation")
+	eval := flag.String("eval", "horner", "Polynomial evaluation in the circuit: horner, or powers for the two-multiplication comparison")
+	seed := flag.Int64("seed", 1, "Seed for the random polynomials; the same seed proves the same polynomials")
+	flag.Parse()
+
+	if *repeat < 1 {
+		log.Fatalf("Invalid -repeat %d: must be at least 1", *repeat)
+	}
+	if *eval != "horner" && *eval != "powers" {
+		log.Fatalf("Invalid -eval %q: must be horner or powers", *eval)
+	}
+	results, closeResults, err := openResultsWriter(*outPath, *quiet)
+	if err != nil {
+		log.Fatal("Failed to open results file:", err)
+	}
+	defer closeResults()
+
+	// Example degrees:
+	degAs := []int{100000, 200000, 300000, 400000, 500000, 600000}
+	degBs := []int{100, 200, 400, 800, 1000}
+
+	if err := runSweep(results, degAs, degBs, *repeat, *eval == "powers", *seed); err != nil {
+		log.Fatal(err)
 	}
 }
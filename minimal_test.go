@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+)
+
+// TestRandomPoly checks that randomPoly draws the same polynomial for the same seed and a
+// different one for another seed
+func TestRandomPoly(t *testing.T) {
+	a := randomPoly(8, rand.New(rand.NewSource(7)))
+	b := randomPoly(8, rand.New(rand.NewSource(7)))
+	other := randomPoly(8, rand.New(rand.NewSource(8)))
+	if !slices.Equal(a, b) {
+		t.Fatal("seed 7 gave two different polynomials")
+	}
+	if slices.Equal(a, other) {
+		t.Fatal("seeds 7 and 8 gave the same polynomial")
+	}
+}
+
+// polyOf builds a polynomial from small integer coefficients, lowest degree first
+func polyOf(coeffs ...int64) []fr.Element {
+	p := make([]fr.Element, len(coeffs))
+	for i, c := range coeffs {
+		p[i].SetInt64(c)
+	}
+	return p
+}
+
+// TestBezout checks bezout on hand-computed polynomials and on a non-coprime pair, and
+// proves the identity of a random coprime pair.
+// x²+1 = (x-1)(x+1) + 2, so (x²+1)·½ + (x+1)·(1-x)/2 = 1; x²-1 and x-1 share x-1.
+func TestBezout(t *testing.T) {
+	var half, minusHalf fr.Element
+	half.SetInt64(2)
+	half.Inverse(&half)
+	minusHalf.Neg(&half)
+
+	A, B := polyOf(1, 0, 1), polyOf(1, 1)
+	S, T, err := bezout(A, B)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(S) != 1 || !S[0].Equal(&half) {
+		t.Fatalf("S = %v, want [1/2]", S)
+	}
+	if len(T) != 2 || !T[0].Equal(&half) || !T[1].Equal(&minusHalf) {
+		t.Fatalf("T = %v, want [1/2, -1/2]", T)
+	}
+	if _, _, err := bezout(polyOf(-1, 0, 1), polyOf(-1, 1)); !errors.Is(err, errNotCoprime) {
+		t.Fatalf("x²-1 and x-1: got %v, want %v", err, errNotCoprime)
+	}
+
+	// Random polynomials are coprime with overwhelming probability
+	rng := rand.New(rand.NewSource(1))
+	A, B = randomPoly(12, rng), randomPoly(5, rng)
+	if S, T, err = bezout(A, B); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proveBezout(A, S, B, T, nil, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// proverCase is an assignment for assertProver and whether it satisfies the circuit
+type proverCase struct {
+	name       string
+	assignment frontend.Circuit
+	valid      bool
+}
+
+// assertProver runs each case in its own subtest through gnark's test assertions on BN254
+// with Groth16, expecting ProverSucceeded for the valid ones and ProverFailed for the rest
+func assertProver(t *testing.T, circuit frontend.Circuit, cases []proverCase) {
+	assert := test.NewAssert(t)
+	for _, c := range cases {
+		assert.Run(func(assert *test.Assert) {
+			if c.valid {
+				assert.ProverSucceeded(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			} else {
+				assert.ProverFailed(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			}
+		}, c.name)
+	}
+}
+
+// bezoutShape is an EvaluateBezoutCircuit sized for the given polynomials
+func bezoutShape(A, S, B, T []fr.Element) *EvaluateBezoutCircuit {
+	return &EvaluateBezoutCircuit{
+		A: make([]frontend.Variable, len(A)),
+		S: make([]frontend.Variable, len(S)),
+		B: make([]frontend.Variable, len(B)),
+		T: make([]frontend.Variable, len(T)),
+	}
+}
+
+// TestEvaluateBezoutCircuit checks that EvaluateBezoutCircuit accepts the identity
+// A·S + B·T = 1 of x²+1 and x+1 at its challenge point, and rejects it after any one
+// coefficient is changed
+func TestEvaluateBezoutCircuit(t *testing.T) {
+	A, B := polyOf(1, 0, 1), polyOf(1, 1)
+	S, T, err := bezout(A, B)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := bezoutChallenge(A, S, B, T)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []proverCase{
+		{"bezout coefficients", &EvaluateBezoutCircuit{A: toVariables(A), S: toVariables(S), B: toVariables(B), T: toVariables(T), X: x}, true},
+	}
+	var one fr.Element
+	one.SetOne()
+	polys := [][]fr.Element{A, S, B, T}
+	for p := range polys {
+		for i := range polys[p] {
+			tampered := make([][]fr.Element, len(polys))
+			for q := range polys {
+				tampered[q] = slices.Clone(polys[q])
+			}
+			tampered[p][i].Add(&tampered[p][i], &one)
+			cases = append(cases, proverCase{
+				name: fmt.Sprintf("coefficient %d of %c changed", i, "ASBT"[p]),
+				assignment: &EvaluateBezoutCircuit{
+					A: toVariables(tampered[0]),
+					S: toVariables(tampered[1]),
+					B: toVariables(tampered[2]),
+					T: toVariables(tampered[3]),
+					X: x,
+				},
+			})
+		}
+	}
+	assertProver(t, bezoutShape(A, S, B, T), cases)
+}
+
+// evalBig evaluates the polynomial at x as the sum of coeffs[i]*x^i in math/big, reducing
+// modulo the field only at the end, independently of fr and of the circuit's evaluation
+func evalBig(coeffs []fr.Element, x *big.Int) *big.Int {
+	sum, xPow, term := new(big.Int), big.NewInt(1), new(big.Int)
+	for i := range coeffs {
+		coeffs[i].BigInt(term)
+		sum.Add(sum, term.Mul(term, xPow))
+		xPow.Mul(xPow, x)
+	}
+	return sum.Mod(sum, fr.Modulus())
+}
+
+// TestBigIntEvaluation checks the circuit against a plain big.Int evaluation of
+// A·S + B·T at the challenge point: it accepts random coprime polynomials whose big.Int
+// value is 1 and rejects them once a coefficient of S is changed, which moves the big.Int
+// value off 1. It also checks that the constraint count dropped from the four separate
+// running powers of x the circuit started with, two multiplications per coefficient, to at
+// most one per coefficient.
+func TestBigIntEvaluation(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	A, B := randomPoly(20, rng), randomPoly(7, rng)
+	S, T, err := bezout(A, B)
+	if err != nil {
+		t.Fatal(err)
+	}
+	circuit := bezoutShape(A, S, B, T)
+	var one fr.Element
+	one.SetOne()
+	tamperedS := slices.Clone(S)
+	tamperedS[0].Add(&tamperedS[0], &one)
+	var cases []proverCase
+	for _, c := range []struct {
+		name  string
+		S     []fr.Element
+		valid bool
+	}{{"bezout coefficients", S, true}, {"S changed", tamperedS, false}} {
+		x, err := bezoutChallenge(A, c.S, B, T)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xBig := x.BigInt(new(big.Int))
+		lhs := new(big.Int).Mul(evalBig(A, xBig), evalBig(c.S, xBig))
+		lhs.Add(lhs, new(big.Int).Mul(evalBig(B, xBig), evalBig(T, xBig)))
+		if isOne := lhs.Mod(lhs, fr.Modulus()).Cmp(big.NewInt(1)) == 0; isOne != c.valid {
+			t.Fatalf("%s: big.Int A·S + B·T = 1 is %v, want %v", c.name, isOne, c.valid)
+		}
+		assignment := EvaluateBezoutCircuit{A: toVariables(A), S: toVariables(c.S), B: toVariables(B), T: toVariables(T), X: x}
+		cases = append(cases, proverCase{c.name, &assignment, c.valid})
+	}
+	assertProver(t, circuit, cases)
+
+	coefficients := len(A) + len(S) + len(B) + len(T)
+	var counts [2]int
+	for i, powers := range []bool{false, true} {
+		shape := *circuit
+		shape.powers = powers
+		ccs, err := frontend.Compile(fr.Modulus(), r1cs.NewBuilder, &shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[i] = sizeOf(ccs).NbConstraints
+	}
+	// The two products and the final assertion come on top of the per-coefficient work
+	if counts[0] > coefficients+2 || counts[1] < 2*coefficients-8 {
+		t.Fatalf("%d coefficients: %d constraints, %d with separate powers; want at most %d and about %d",
+			coefficients, counts[0], counts[1], coefficients+2, 2*coefficients)
+	}
+	fmt.Printf("%d coefficients: %d constraints, %d with separate powers of x\n", coefficients, counts[0], counts[1])
+}
+
+// TestNonCoprime checks that A = (x-1)(x+2) and B = (x-1)(x+3), which share x-1, cannot be
+// proven. With S = 1 and T = -1, A·S + B·T = 1 - x, which is 1 at x = 0: a prover free to
+// pick x could prove it, but the derived point is a root with probability 1/|fr|.
+func TestNonCoprime(t *testing.T) {
+	A, B := polyOf(-2, 1, 1), polyOf(-3, 2, 1)
+	if _, _, err := bezout(A, B); !errors.Is(err, errNotCoprime) {
+		t.Fatalf("(x-1)(x+2) and (x-1)(x+3): got %v, want %v", err, errNotCoprime)
+	}
+	S, T := polyOf(1, 0), polyOf(-1, 0)
+	x, err := bezoutChallenge(A, S, B, T)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheating := EvaluateBezoutCircuit{A: toVariables(A), S: toVariables(S), B: toVariables(B), T: toVariables(T), X: 0}
+	derived := cheating
+	derived.X = x
+	assertProver(t, bezoutShape(A, S, B, T), []proverCase{
+		{"prover's chosen x = 0", &cheating, true},
+		{"derived point", &derived, false},
+	})
+
+	// A proof at x = 0 does not verify against the point the verifier derives
+	var zero fr.Element
+	if _, err := proveBezout(A, S, B, T, &zero, false); err == nil {
+		t.Fatal("proof at the prover's chosen x verified")
+	}
+}
+
+// evalAgreementCircuit asserts that evalHorner and evalPowers agree on one polynomial
+type evalAgreementCircuit struct {
+	Coeffs []frontend.Variable
+	X      frontend.Variable
+	Want   frontend.Variable // The polynomial's value at X, computed off-circuit
+}
+
+func (c *evalAgreementCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(evalHorner(api, c.Coeffs, c.X), c.Want)
+	api.AssertIsEqual(evalPowers(api, c.Coeffs, c.X), c.Want)
+	return nil
+}
+
+// TestEvalAgreement checks that both evaluation strategies give the off-circuit value of
+// random polynomials at random points, and that neither accepts a wrong value
+func TestEvalAgreement(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 7, 32} {
+		coeffs := randomPoly(n-1, rng)
+		var x, want, one fr.Element
+		randomElement(&x, rng)
+		for i := len(coeffs) - 1; i >= 0; i-- {
+			want.Mul(&want, &x).Add(&want, &coeffs[i])
+		}
+
+		circuit := evalAgreementCircuit{Coeffs: make([]frontend.Variable, len(coeffs))}
+		assignment := evalAgreementCircuit{Coeffs: toVariables(coeffs), X: x, Want: want}
+		if err := test.IsSolved(&circuit, &assignment, fr.Modulus()); err != nil {
+			t.Fatalf("%d coefficients: strategies disagree with the off-circuit value: %v", len(coeffs), err)
+		}
+		one.SetOne()
+		assignment.Want = *want.Add(&want, &one)
+		if test.IsSolved(&circuit, &assignment, fr.Modulus()) == nil {
+			t.Fatalf("%d coefficients: wrong value accepted", len(coeffs))
+		}
+	}
+}
+
+// TestHornerRegression checks evalHorner against the running-powers evaluation it
+// replaced and against evalBig on random polynomials of random degree, including the empty
+// polynomial and ones padded with zero leading coefficients, which Horner's rule reads
+// first
+func TestHornerRegression(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for trial := 0; trial < 20; trial++ {
+		var coeffs []fr.Element
+		if trial > 0 {
+			coeffs = randomPoly(rng.Intn(40), rng)
+			coeffs = padCoeffs(coeffs, len(coeffs)+rng.Intn(4))
+		}
+		var x fr.Element
+		randomElement(&x, rng)
+		var want fr.Element
+		want.SetBigInt(evalBig(coeffs, x.BigInt(new(big.Int))))
+
+		circuit := evalAgreementCircuit{Coeffs: make([]frontend.Variable, len(coeffs))}
+		assignment := evalAgreementCircuit{Coeffs: toVariables(coeffs), X: x, Want: want}
+		if err := test.IsSolved(&circuit, &assignment, fr.Modulus()); err != nil {
+			t.Fatalf("trial %d, %d coefficients: Horner's rule or running powers differ from big.Int: %v", trial, len(coeffs), err)
+		}
+	}
+}
+
+// TestHornerConstraints compiles the degA=100000, degB=100 circuit with both strategies
+// and checks that Horner's rule needs about half the constraints of running powers
+func TestHornerConstraints(t *testing.T) {
+	const degA, degB = 100000, 100
+	var counts [2]int
+	for i, powers := range []bool{false, true} {
+		circuit := EvaluateBezoutCircuit{
+			A:      make([]frontend.Variable, degA+1),
+			S:      make([]frontend.Variable, degB),
+			B:      make([]frontend.Variable, degB+1),
+			T:      make([]frontend.Variable, degA),
+			powers: powers,
+		}
+		ccs, err := frontend.Compile(fr.Modulus(), r1cs.NewBuilder, &circuit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[i] = sizeOf(ccs).NbConstraints
+	}
+	horner, powers := counts[0], counts[1]
+	if ratio := float64(powers) / float64(horner); ratio < 1.9 || ratio > 2.1 {
+		t.Fatalf("degA=%d: %d constraints with Horner's rule, %d with powers, ratio %.2f, want about 2",
+			degA, horner, powers, ratio)
+	}
+	fmt.Printf("degA=%d degB=%d: %d constraints with Horner's rule, %d with powers\n", degA, degB, horner, powers)
+}
+
+// TestResultsFile runs a small sweep with -repeat 2 -eval powers into a CSV file and checks that the
+// file parses back with the expected header and one row per configuration
+func TestResultsFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bezout-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.csv")
+	results, closeResults, err := openResultsWriter(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	degAs, degBs := []int{4, 6}, []int{2, 3}
+	err = runSweep(results, degAs, degBs, 2, true, 1)
+	if closeErr := closeResults(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("parse %s: %v", path, err)
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(resultsHeader, ",") {
+		t.Fatalf("header %v, want %v", records[0], resultsHeader)
+	}
+	if rows := len(records) - 1; rows != len(degAs)*len(degBs) {
+		t.Fatalf("%d rows, want %d", rows, len(degAs)*len(degBs))
+	}
+	for _, row := range records[1:] {
+		if row[2] != "powers" {
+			t.Fatalf("row %v: eval %q, want powers", row, row[2])
+		}
+		if constraints, err := strconv.Atoi(row[3]); err != nil || constraints <= 0 {
+			t.Fatalf("row %v: nbConstraints %q is not positive", row, row[3])
+		}
+		if row[7] != "2" {
+			t.Fatalf("row %v: repeat %q, want 2", row, row[7])
+		}
+	}
+}
+
+// TestResultsFlushed runs a tiny default sweep into an -out file and, before closing it,
+// checks that the header and one row per configuration, in sweep order, are already on
+// disk, so an interrupted sweep keeps every finished row. Opening a file in a missing
+// directory must fail.
+func TestResultsFlushed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "bezout-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, _, err := openResultsWriter(filepath.Join(dir, "missing", "results.csv"), true); err == nil {
+		t.Fatal("-out in a missing directory accepted")
+	}
+	path := filepath.Join(dir, "results.csv")
+	results, closeResults, err := openResultsWriter(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeResults()
+	degAs, degBs := []int{3}, []int{1, 2}
+	if err := runSweep(results, degAs, degBs, 1, false, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatalf("parse %s before closing it: %v", path, err)
+	}
+	if len(records) != 1+len(degAs)*len(degBs) || strings.Join(records[0], ",") != strings.Join(resultsHeader, ",") {
+		t.Fatalf("%d records on disk before closing, want the header and %d rows", len(records), len(degAs)*len(degBs))
+	}
+	for i, row := range records[1:] {
+		if want := []string{"3", strconv.Itoa(degBs[i]), "horner"}; !slices.Equal(row[:3], want) {
+			t.Fatalf("row %d starts %v, want %v", i, row[:3], want)
+		}
+	}
+}
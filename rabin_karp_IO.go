@@ -1,97 +1,657 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"math/big"
+	mathbits "math/bits"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	mimcHash "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/std/hash"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/math/bits"
 )
 
 const (
-	maxStr1Len = 70     // Max length for Str1, can be large enough to fit any substring
-	maxStr2Len = 500000 // Fixed length for Str2
+	maxStr1Len      = 70     // Max length for Str1, can be large enough to fit any substring
+	maxStr2Len      = 500000 // Fixed length for Str2
+	charsPerElement = 31     // Characters of Str2 packed into each element of the text commitment
+	entrySeparator  = '\x01' // Joins entries in the superstring; no match may contain it
 )
 
+var (
+	// ErrPatternTooLong is returned for patterns that do not fit in Str1
+	ErrPatternTooLong = errors.New("pattern longer than maxStr1Len")
+
+	// ErrNoWindow is returned when no window of the range holds the pattern, so there is no leaf to open
+	ErrNoWindow = errors.New("pattern does not occur in the range")
+
+	// ErrPatternLongerThanText is returned for patterns longer than the text, or the part of
+	// it they are matched in, so the circuit would have no window to check
+	ErrPatternLongerThanText = errors.New("pattern longer than the text")
+)
+
+// Outcome is what became of one pattern of a run
+type Outcome int
+
+const (
+	Proved                Outcome = iota // Proof generated and verified
+	VerificationFailed                   // Proof generated but rejected by the verifier
+	SkippedTooLong                       // Longer than maxStr1Len
+	SkippedTooLongForText                // Longer than the text, or the -entry, it is matched in
+	SkippedNoWindow                      // Not in the range, so -shared-windows has no window to open
+	numOutcomes
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Proved:
+		return "proved"
+	case VerificationFailed:
+		return "verificationFailed"
+	case SkippedTooLong:
+		return "skippedTooLong"
+	case SkippedTooLongForText:
+		return "skippedTooLongForText"
+	case SkippedNoWindow:
+		return "skippedNoWindow"
+	default:
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+}
+
+// skipOutcome returns the outcome of a pattern skipped with err
+func skipOutcome(err error) Outcome {
+	switch {
+	case errors.Is(err, ErrPatternTooLong):
+		return SkippedTooLong
+	case errors.Is(err, ErrPatternLongerThanText):
+		return SkippedTooLongForText
+	default:
+		return SkippedNoWindow
+	}
+}
+
+// outcomeCounts counts the patterns of a run by Outcome
+type outcomeCounts [numOutcomes]int
+
+// String lists the non-zero counts, such as "proved=3 skippedTooLongForText=1"
+func (c *outcomeCounts) String() string {
+	var parts []string
+	for o, n := range c {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", Outcome(o), n))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// checkPatternFitsText returns ErrPatternLongerThanText when pattern is longer than the
+// part of a textLength-byte text that [rangeStart, rangeEnd) covers, so it cannot occur
+// there. Str2's zero padding past textLength does not count as text.
+func checkPatternFitsText(pattern string, textLength, rangeStart, rangeEnd int) error {
+	if available := min(rangeEnd, textLength) - rangeStart; len(pattern) > available {
+		return fmt.Errorf("%q has %d bytes, [%d, %d) of the text only %d: %w",
+			pattern, len(pattern), rangeStart, rangeEnd, max(available, 0), ErrPatternLongerThanText)
+	}
+	return nil
+}
+
 // SubstringCircuit defines the circuit for checking if Str1 is a substring of Str2.
+// Str2 is secret and bound to the public TextCommitment, so verifiers pin the commitment
+// instead of receiving the text. Only occurrences lying entirely within
+// Str2[RangeStart:RangeEnd] count, and there must be at least MinOccurrences of them.
 type SubstringCircuit struct {
 	Str1            [maxStr1Len]frontend.Variable `gnark:"str1,secret"`
-	Str2            [maxStr2Len]frontend.Variable `gnark:"str2,public"`
+	Str2            [maxStr2Len]frontend.Variable `gnark:"str2,secret"`
+	TextCommitment  frontend.Variable             `gnark:"textCommitment,public"`
+	RangeStart      frontend.Variable             `gnark:"rangeStart,public"`
+	RangeEnd        frontend.Variable             `gnark:"rangeEnd,public"`       // Exclusive
+	MinOccurrences  frontend.Variable             `gnark:"minOccurrences,public"` // K: Str1 occurs at least this often, overlaps included
 	EffectiveLength int                           `gnark:"effectiveLength,public"`
 }
 
-// Define specifies the logic of the circuit for substring checking.
+// Define checks the text against its commitment, then the substring relation.
 func (circuit *SubstringCircuit) Define(api frontend.API) error {
-	const base = 2
-	// const prime = 997
-	patternLength := circuit.EffectiveLength
-	textLength := len(circuit.Str2)
-	// fmt.Println(circuit.EffectiveLength)
+	commitment, err := commitTextInCircuit(api, circuit.Str2[:])
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(commitment, circuit.TextCommitment)
 
-	// mod := func(a frontend.Variable, prime int64) frontend.Variable {
-	// 	div := api.Div(a, prime)   // Get quotient
-	// 	mul := api.Mul(div, prime) // Multiply quotient by prime
-	// 	return api.Sub(a, mul)     // Subtract to get remainder
-	// }
+	return assertContains(api, circuit.Str1[:], circuit.Str2[:], circuit.EffectiveLength, circuit.RangeStart, circuit.RangeEnd, circuit.MinOccurrences)
+}
 
-	// Calculate the hash of the pattern (Str1) until the end marker
-	patternHash := frontend.Variable(0)
-	for i := 0; i < circuit.EffectiveLength; i++ {
-		patternHash = api.Add(api.Mul(patternHash, base), circuit.Str1[i])
-		//patternHash = mod(patternHash, prime)
+// commitTextInCircuit returns the MiMC hash of text, padding included, packed
+// charsPerElement characters per element with the first in the lowest byte. Each
+// character is range-checked to 8 bits so that the packing is injective.
+func commitTextInCircuit(api frontend.API, text []frontend.Variable) (frontend.Variable, error) {
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return nil, err
 	}
-
-	// Calculate the initial hash of the text window of size equal to pattern length
-	currentHash := frontend.Variable(0)
-	for i := 0; i < patternLength; i++ {
-		currentHash = api.Add(api.Mul(currentHash, base), circuit.Str2[i])
-		//currentHash = mod(currentHash, prime)
+	for start := 0; start < len(text); start += charsPerElement {
+		packed := frontend.Variable(0)
+		for j, c := range text[start:min(start+charsPerElement, len(text))] {
+			bits.ToBinary(api, c, bits.WithNbDigits(8))
+			packed = api.Add(packed, api.Mul(c, new(big.Int).Lsh(big.NewInt(1), uint(8*j))))
+		}
+		hFunc.Write(packed)
 	}
+	return hFunc.Sum(), nil
+}
 
-	// Variable to indicate if we found a matching substring
-	found := frontend.Variable(0)
+// commitText computes the commitment checked by commitTextInCircuit off-circuit, for s
+// zero-padded to length characters
+func commitText(s string, length int) *big.Int {
+	padded := make([]byte, length)
+	copy(padded, s)
+	hFunc := mimcHash.NewMiMC()
+	for start := 0; start < length; start += charsPerElement {
+		chunk := padded[start:min(start+charsPerElement, length)]
+		packed := make([]byte, len(chunk))
+		for j := range chunk {
+			packed[len(chunk)-1-j] = chunk[j] // SetBytes is big-endian
+		}
+		var elem fr.Element
+		elem.SetBytes(packed)
+		bytes := elem.Bytes()
+		hFunc.Write(bytes[:])
+	}
+	return new(big.Int).SetBytes(hFunc.Sum(nil))
+}
 
-	// Pre-compute base^(patternLength-1) for hash update
-	basePow := big.NewInt(1)
-	baseBig := big.NewInt(base)
-	//primeBig := big.NewInt(prime)
-	for i := 0; i < patternLength-1; i++ {
-		basePow.Mul(basePow, baseBig) //.Mod(basePow, primeBig)
+// assertContains asserts that the first patternLength characters of pattern occur in
+// text[rangeStart:rangeEnd], i.e. at a window i with rangeStart <= i <= rangeEnd-patternLength,
+// and that at least minOccurrences such windows match, overlapping ones included.
+// Every window is compared with the pattern character by character, so no other window
+// can stand in for it. Characters are UTF-8 bytes; callers range check the text, and a
+// pattern character only matches a text character equal to it.
+// A window holding an entrySeparator spans two entries and never matches.
+// It fails for an empty pattern or one longer than text, which leaves no window to check.
+func assertContains(api frontend.API, pattern, text []frontend.Variable, patternLength int, rangeStart, rangeEnd, minOccurrences frontend.Variable) error {
+	textLength := len(text)
+	if patternLength < 1 || patternLength > len(pattern) {
+		return fmt.Errorf("pattern length %d: must be between 1 and %d", patternLength, len(pattern))
+	}
+	if patternLength > textLength {
+		return fmt.Errorf("%w (%d > %d)", ErrPatternLongerThanText, patternLength, textLength)
 	}
-	basePowVar := frontend.Variable(basePow.Int64())
 
-	// Sliding window to compare hashes incrementally
-	for i := 0; i <= textLength-patternLength; i++ {
-		isMatch := api.IsZero(api.Sub(currentHash, patternHash))
-		found = api.Or(found, isMatch)
+	// 0 <= rangeStart <= rangeEnd-patternLength and rangeEnd <= textLength, so both range
+	// ends below are hit exactly once (or the last one not at all when rangeEnd = textLength)
+	nbBits := mathbits.Len(uint(textLength))
+	lastStart := api.Sub(rangeEnd, patternLength)
+	bits.ToBinary(api, rangeStart, bits.WithNbDigits(nbBits))
+	bits.ToBinary(api, api.Sub(lastStart, rangeStart), bits.WithNbDigits(nbBits))
+	bits.ToBinary(api, api.Sub(textLength, rangeEnd), bits.WithNbDigits(nbBits))
+
+	// sepsBefore[i] counts the separators in text[:i], so a window holds one exactly when
+	// the count changes across it
+	sepsBefore := make([]frontend.Variable, textLength+1)
+	sepsBefore[0] = 0
+	for i, c := range text {
+		sepsBefore[i+1] = api.Add(sepsBefore[i], api.IsZero(api.Sub(c, entrySeparator)))
+	}
 
-		// Debugging: Print current state of the hash comparison
-		// fmt.Printf("Debug: Window Position %d - Current Hash: %v, Pattern Hash: %v, Is Match: %v, Found: %v\n", i, currentHash, patternHash, isMatch, found)
+	// Variable to indicate if we found a matching substring, how many windows matched, and
+	// whether the current window is in range: set at rangeStart, cleared after lastStart
+	found := frontend.Variable(0)
+	matchCount := frontend.Variable(0)
+	inRange := frontend.Variable(0)
 
-		if i < textLength-patternLength {
-			currentHash = api.Sub(currentHash, api.Mul(circuit.Str2[i], basePowVar))
-			//currentHash = mod(currentHash, prime)
-			currentHash = api.Mul(currentHash, base)
-			//currentHash = mod(currentHash, prime)
-			currentHash = api.Add(currentHash, circuit.Str2[i+patternLength])
-			//currentHash = mod(currentHash, prime)
+	for i := 0; i <= textLength-patternLength; i++ {
+		inRange = api.Add(inRange, api.IsZero(api.Sub(rangeStart, i)))
+		if i > 0 {
+			inRange = api.Sub(inRange, api.IsZero(api.Sub(lastStart, i-1)))
 		}
+		charMatch := windowEquals(api, pattern[:patternLength], text[i:])
+		inEntry := api.IsZero(api.Sub(sepsBefore[i+patternLength], sepsBefore[i]))
+		windowMatch := api.And(api.And(charMatch, inRange), inEntry)
+		found = api.Or(found, windowMatch)
+		matchCount = api.Add(matchCount, windowMatch)
 	}
 
 	// Assert that the pattern is found at least once
 	api.AssertIsEqual(found, frontend.Variable(1))
+
+	// Assert matchCount >= minOccurrences. Both fit in nbBits, so their difference does
+	// too unless minOccurrences is larger and the difference wraps around the field.
+	bits.ToBinary(api, minOccurrences, bits.WithNbDigits(nbBits))
+	bits.ToBinary(api, api.Sub(matchCount, minOccurrences), bits.WithNbDigits(nbBits))
+	return nil
+}
+
+// windowEquals returns 1 if the window of text starting at its first character equals
+// pattern, 0 otherwise
+func windowEquals(api frontend.API, pattern, text []frontend.Variable) frontend.Variable {
+	match := frontend.Variable(1)
+	for j := range pattern {
+		match = api.And(match, api.IsZero(api.Sub(text[j], pattern[j])))
+	}
+	return match
+}
+
+// Shared window hashes: instead of every SubstringCircuit hashing all of Str2, a
+// WindowsCircuit proves once per pattern length that WindowRoot commits to one leaf per
+// window of the committed text, and each WindowMatchCircuit only opens its pattern's
+// leaf. Publishing the window hashes themselves would make every verifying key and
+// verification linear in the text length, so they are committed in a Merkle tree.
+
+// windowChunks splits a window of patternLength characters into sub-windows of at most
+// charsPerElement characters, returning the offset and length of each
+func windowChunks(patternLength int) (offsets, lengths []int) {
+	for start := 0; start < patternLength; start += charsPerElement {
+		offsets = append(offsets, start)
+		lengths = append(lengths, min(charsPerElement, patternLength-start))
+	}
+	return offsets, lengths
+}
+
+// packWindow returns the big-endian base-256 value of text[:length], injective because
+// length is at most charsPerElement. In R1CS it is a linear combination, so it is free.
+func packWindow(api frontend.API, text []frontend.Variable, length int) frontend.Variable {
+	packed := frontend.Variable(0)
+	for j := 0; j < length; j++ {
+		packed = api.Add(api.Mul(packed, 256), text[j])
+	}
+	return packed
+}
+
+// windowLeafInCircuit returns the Merkle leaf of the window of patternLength characters
+// at the start of text: the MiMC hash of its packed sub-windows
+func windowLeafInCircuit(api frontend.API, hFunc hash.FieldHasher, text []frontend.Variable, patternLength int) frontend.Variable {
+	offsets, lengths := windowChunks(patternLength)
+	hFunc.Reset()
+	for k := range offsets {
+		hFunc.Write(packWindow(api, text[offsets[k]:], lengths[k]))
+	}
+	return hFunc.Sum()
+}
+
+// windowTreeDepth is the height of the window tree over nbWindows leaves, padded with
+// zero leaves to a power of two
+func windowTreeDepth(nbWindows int) int {
+	return mathbits.Len(uint(nbWindows - 1))
+}
+
+// WindowsCircuit proves that WindowRoot is the root of the window tree for patternLength
+// over the text committed to by TextCommitment. It is proven once per pattern length.
+type WindowsCircuit struct {
+	Str2           []frontend.Variable `gnark:"str2,secret"`
+	TextCommitment frontend.Variable   `gnark:"textCommitment,public"`
+	WindowRoot     frontend.Variable   `gnark:"windowRoot,public"`
+
+	patternLength int
+}
+
+// newWindowsCircuit returns a WindowsCircuit shaped for a text of textLength characters
+func newWindowsCircuit(patternLength, textLength int) *WindowsCircuit {
+	return &WindowsCircuit{Str2: make([]frontend.Variable, textLength), patternLength: patternLength}
+}
+
+func (circuit *WindowsCircuit) Define(api frontend.API) error {
+	nbWindows := len(circuit.Str2) - circuit.patternLength + 1
+	if circuit.patternLength < 1 || nbWindows < 1 {
+		return fmt.Errorf("no window of %d characters in a text of %d", circuit.patternLength, len(circuit.Str2))
+	}
+	commitment, err := commitTextInCircuit(api, circuit.Str2)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(commitment, circuit.TextCommitment)
+
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	level := make([]frontend.Variable, 1<<windowTreeDepth(nbWindows))
+	for i := range level {
+		level[i] = 0
+		if i < nbWindows {
+			level[i] = windowLeafInCircuit(api, &hFunc, circuit.Str2[i:], circuit.patternLength)
+		}
+	}
+	for len(level) > 1 {
+		next := make([]frontend.Variable, len(level)/2)
+		for i := range next {
+			hFunc.Reset()
+			hFunc.Write(level[2*i], level[2*i+1])
+			next[i] = hFunc.Sum()
+		}
+		level = next
+	}
+	api.AssertIsEqual(level[0], circuit.WindowRoot)
 	return nil
 }
 
-func convertStringToFixedArrayZeroPad(s string) [maxStr1Len]frontend.Variable {
+// WindowMatchCircuit proves that the first patternLength characters of Str1 occur in the
+// text behind WindowRoot, at a window i with RangeStart <= i <= RangeEnd-patternLength,
+// by opening leaf i of the window tree. Its size is logarithmic in the text length.
+type WindowMatchCircuit struct {
+	Str1       [maxStr1Len]frontend.Variable `gnark:"str1,secret"`
+	Path       []frontend.Variable           `gnark:"path,secret"`
+	PathDir    []frontend.Variable           `gnark:"pathDir,secret"` // 1 where the opened node is a right child
+	WindowRoot frontend.Variable             `gnark:"windowRoot,public"`
+	RangeStart frontend.Variable             `gnark:"rangeStart,public"`
+	RangeEnd   frontend.Variable             `gnark:"rangeEnd,public"` // Exclusive
+
+	patternLength, textLength int
+}
+
+// newWindowMatchCircuit returns a WindowMatchCircuit shaped for patternLength over a text
+// of textLength characters
+func newWindowMatchCircuit(patternLength, textLength int) *WindowMatchCircuit {
+	depth := windowTreeDepth(textLength - patternLength + 1)
+	return &WindowMatchCircuit{
+		Path:          make([]frontend.Variable, depth),
+		PathDir:       make([]frontend.Variable, depth),
+		patternLength: patternLength,
+		textLength:    textLength,
+	}
+}
+
+func (circuit *WindowMatchCircuit) Define(api frontend.API) error {
+	// Characters above 255 would let two patterns pack to the same leaf, and a separator
+	// would make a window spanning two entries a leaf of the pattern
+	for i := 0; i < circuit.patternLength; i++ {
+		bits.ToBinary(api, circuit.Str1[i], bits.WithNbDigits(8))
+		api.AssertIsDifferent(circuit.Str1[i], entrySeparator)
+	}
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	current := windowLeafInCircuit(api, &hFunc, circuit.Str1[:], circuit.patternLength)
+	index := frontend.Variable(0)
+	for i := range circuit.Path {
+		api.AssertIsBoolean(circuit.PathDir[i])
+		left := api.Select(circuit.PathDir[i], circuit.Path[i], current)
+		right := api.Select(circuit.PathDir[i], current, circuit.Path[i])
+		hFunc.Reset()
+		hFunc.Write(left, right)
+		current = hFunc.Sum()
+		index = api.Add(index, api.Mul(circuit.PathDir[i], 1<<i))
+	}
+	api.AssertIsEqual(current, circuit.WindowRoot)
+
+	// RangeStart <= index <= RangeEnd-patternLength and RangeEnd <= textLength, as in
+	// assertContains; this also keeps index off the zero padding leaves
+	nbBits := mathbits.Len(uint(circuit.textLength))
+	bits.ToBinary(api, api.Sub(index, circuit.RangeStart), bits.WithNbDigits(nbBits))
+	bits.ToBinary(api, api.Sub(circuit.RangeEnd, circuit.patternLength, index), bits.WithNbDigits(nbBits))
+	bits.ToBinary(api, api.Sub(circuit.textLength, circuit.RangeEnd), bits.WithNbDigits(nbBits))
+	return nil
+}
+
+// windowLeaves computes the leaf of every window of text for patternLength off-circuit.
+// Each packed sub-window is rolled along the text, dropping the character that leaves and
+// shifting in the one that enters, so the text is streamed once per sub-window.
+func windowLeaves(text []byte, patternLength int) []fr.Element {
+	nbWindows := len(text) - patternLength + 1
+	offsets, lengths := windowChunks(patternLength)
+	var base fr.Element
+	base.SetUint64(256)
+
+	packed := make([][]fr.Element, len(offsets))
+	for k := range offsets {
+		var top, out, in fr.Element
+		top.Exp(base, big.NewInt(int64(lengths[k]-1))) // Weight of the character that leaves
+		packed[k] = make([]fr.Element, nbWindows)
+		window := text[offsets[k]:]
+		var value fr.Element
+		for j := 0; j < lengths[k]; j++ {
+			in.SetUint64(uint64(window[j]))
+			value.Mul(&value, &base).Add(&value, &in)
+		}
+		for i := 0; i < nbWindows; i++ {
+			packed[k][i] = value
+			if i+1 < nbWindows {
+				out.SetUint64(uint64(window[i]))
+				in.SetUint64(uint64(window[i+lengths[k]]))
+				out.Mul(&out, &top)
+				value.Sub(&value, &out).Mul(&value, &base).Add(&value, &in)
+			}
+		}
+	}
+
+	leaves := make([]fr.Element, nbWindows)
+	hFunc := mimcHash.NewMiMC()
+	for i := range leaves {
+		hFunc.Reset()
+		for k := range packed {
+			b := packed[k][i].Bytes()
+			hFunc.Write(b[:])
+		}
+		leaves[i].SetBytes(hFunc.Sum(nil))
+	}
+	return leaves
+}
+
+// windowTree holds the levels of the tree WindowsCircuit commits to, leaves first
+type windowTree [][]fr.Element
+
+// newWindowTree pads leaves with zeros to a power of two and hashes them pairwise with MiMC
+func newWindowTree(leaves []fr.Element) windowTree {
+	level := make([]fr.Element, 1<<windowTreeDepth(len(leaves)))
+	copy(level, leaves)
+	tree := windowTree{level}
+	hFunc := mimcHash.NewMiMC()
+	for len(level) > 1 {
+		next := make([]fr.Element, len(level)/2)
+		for i := range next {
+			left, right := level[2*i].Bytes(), level[2*i+1].Bytes()
+			hFunc.Reset()
+			hFunc.Write(left[:])
+			hFunc.Write(right[:])
+			next[i].SetBytes(hFunc.Sum(nil))
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+// root returns the root of the tree
+func (t windowTree) root() *big.Int {
+	return t[len(t)-1][0].BigInt(new(big.Int))
+}
+
+// newWindowMatchAssignment returns a WindowMatchCircuit assignment opening the first
+// window of text in [rangeStart, rangeEnd) that holds pattern, or ErrNoWindow. The text
+// must be the one the tree was built from, zero padding included.
+func newWindowMatchAssignment(tree windowTree, text []byte, pattern string, rangeStart, rangeEnd int) (*WindowMatchCircuit, error) {
+	str1, err := convertStringToFixedArrayZeroPad(pattern)
+	if err != nil {
+		return nil, err
+	}
+	offset := strings.Index(string(text[rangeStart:rangeEnd]), pattern)
+	if pattern == "" || offset < 0 {
+		return nil, fmt.Errorf("%q in [%d, %d): %w", pattern, rangeStart, rangeEnd, ErrNoWindow)
+	}
+	assignment := newWindowMatchCircuit(len(pattern), len(text))
+	assignment.Str1 = str1
+	assignment.WindowRoot = tree.root()
+	assignment.RangeStart, assignment.RangeEnd = rangeStart, rangeEnd
+	index := rangeStart + offset
+	for level := range assignment.Path {
+		assignment.Path[level] = tree[level][index^1].BigInt(new(big.Int))
+		assignment.PathDir[level] = index & 1
+		index >>= 1
+	}
+	return assignment, nil
+}
+
+// proveSharedWindows proves every substring against window hashes committed once per
+// pattern length: one WindowsCircuit proof, then one setup of WindowMatchCircuit reused
+// by all patterns of that length. Each pattern's outcome is added to counts.
+func proveSharedWindows(text string, textCommitment *big.Int, substrings []string, rangeStart, rangeEnd int, counts *outcomeCounts) error {
+	field := ecc.BN254.ScalarField()
+	padded := make([]byte, maxStr2Len)
+	copy(padded, text)
+	byLength := make(map[int][]string)
+	for _, substring := range substrings {
+		if substring != "" {
+			byLength[len(substring)] = append(byLength[len(substring)], substring)
+		}
+	}
+	lengths := make([]int, 0, len(byLength))
+	for length := range byLength {
+		lengths = append(lengths, length)
+	}
+	slices.Sort(lengths)
+
+	for _, length := range lengths {
+		if length > maxStr1Len {
+			fmt.Printf("Skipping %d substrings of length %d: %v\n", len(byLength[length]), length, ErrPatternTooLong)
+			counts[SkippedTooLong] += len(byLength[length])
+			continue
+		}
+		if err := checkPatternFitsText(byLength[length][0], len(text), rangeStart, rangeEnd); err != nil {
+			fmt.Printf("Skipping %d substrings of length %d: %v\n", len(byLength[length]), length, err)
+			counts[SkippedTooLongForText] += len(byLength[length])
+			continue
+		}
+		tree := newWindowTree(windowLeaves(padded, length))
+		fmt.Printf("Window root for length %d: %s\n", length, tree.root())
+
+		// Commit the windows once
+		windows := newWindowsCircuit(length, maxStr2Len)
+		windowsCcs, err := frontend.Compile(field, r1cs.NewBuilder, windows)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Windows circuit for length %d: %s\n", length, sizeOf(windowsCcs))
+		assignment := newWindowsCircuit(length, maxStr2Len)
+		for i := range assignment.Str2 {
+			assignment.Str2[i] = int(padded[i])
+		}
+		assignment.TextCommitment, assignment.WindowRoot = textCommitment, tree.root()
+		if err := proveAndVerify(windowsCcs, assignment); err != nil {
+			return fmt.Errorf("windows of length %d: %w", length, err)
+		}
+
+		// Then open one window per pattern
+		matchCcs, err := frontend.Compile(field, r1cs.NewBuilder, newWindowMatchCircuit(length, maxStr2Len))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Window match circuit for length %d: %s\n", length, sizeOf(matchCcs))
+		pk, vk, err := groth16.Setup(matchCcs)
+		if err != nil {
+			return err
+		}
+		for _, substring := range byLength[length] {
+			assignment, err := newWindowMatchAssignment(tree, padded, substring, rangeStart, rangeEnd)
+			if err != nil {
+				fmt.Printf("Skipping substring: %v\n", err)
+				counts[skipOutcome(err)]++
+				continue
+			}
+			witness, err := frontend.NewWitness(assignment, field)
+			if err != nil {
+				return err
+			}
+			publicWitness, err := witness.Public()
+			if err != nil {
+				return err
+			}
+			proof, err := groth16.Prove(matchCcs, pk, witness)
+			if err != nil {
+				return fmt.Errorf("proof generation failed for substring '%s': %w", substring, err)
+			}
+			if groth16.Verify(proof, vk, publicWitness) != nil {
+				fmt.Printf("Verification failed for substring '%s'\n", substring)
+				counts[VerificationFailed]++
+			} else {
+				fmt.Printf("Proof verified successfully for substring '%s'\n", substring)
+				counts[Proved]++
+			}
+		}
+	}
+	return nil
+}
+
+// proveAndVerify sets up ccs, then proves and verifies assignment
+func proveAndVerify(ccs constraint.ConstraintSystem, assignment frontend.Circuit) error {
+	pk, vk, err := groth16.Setup(ccs)
+	if err != nil {
+		return err
+	}
+	witness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		return err
+	}
+	publicWitness, err := witness.Public()
+	if err != nil {
+		return err
+	}
+	proof, err := groth16.Prove(ccs, pk, witness)
+	if err != nil {
+		return err
+	}
+	return groth16.Verify(proof, vk, publicWitness)
+}
+
+// circuitSize is the size of a compiled constraint system
+type circuitSize struct {
+	NbConstraints, NbPublic, NbSecret, NbInternal int
+}
+
+// sizeOf returns the size of ccs
+func sizeOf(ccs constraint.ConstraintSystem) circuitSize {
+	return circuitSize{
+		NbConstraints: ccs.GetNbConstraints(),
+		NbPublic:      ccs.GetNbPublicVariables(),
+		NbSecret:      ccs.GetNbSecretVariables(),
+		NbInternal:    ccs.GetNbInternalVariables(),
+	}
+}
+
+func (s circuitSize) String() string {
+	return fmt.Sprintf("%d constraints, %d public, %d secret and %d internal variables, ~%.1f MiB estimated prover memory",
+		s.NbConstraints, s.NbPublic, s.NbSecret, s.NbInternal, float64(s.EstimatedProverBytes())/(1<<20))
+}
+
+// proverBytesPerConstraint is a rough groth16 prover memory cost per constraint on BN254:
+// the proving key's G1 and G2 points for each wire plus the solver and FFT buffers
+const proverBytesPerConstraint = 512
+
+// EstimatedProverBytes estimates the memory groth16.Setup and Prove need for the circuit,
+// for capacity planning only
+func (s circuitSize) EstimatedProverBytes() int64 {
+	return int64(s.NbConstraints) * proverBytesPerConstraint
+}
+
+// convertStringToFixedArrayZeroPad converts s to a zero-padded Str1 of its UTF-8 bytes, one
+// per element, or returns ErrPatternTooLong rather than truncating it
+func convertStringToFixedArrayZeroPad(s string) ([maxStr1Len]frontend.Variable, error) {
 	var arr [maxStr1Len]frontend.Variable
+	if len(s) > maxStr1Len {
+		return arr, fmt.Errorf("%q has %d bytes: %w", s, len(s), ErrPatternTooLong)
+	}
 	for i := 0; i < maxStr1Len; i++ {
 		if i < len(s) {
 			arr[i] = frontend.Variable(int(s[i]))
@@ -101,10 +661,10 @@ func convertStringToFixedArrayZeroPad(s string) [maxStr1Len]frontend.Variable {
 
 	}
 
-	return arr
+	return arr, nil
 }
 
-// Convert a string to a fixed-size array of `frontend.Variable` for Str2
+// Convert a string to a fixed-size array of `frontend.Variable` for Str2, one UTF-8 byte per element
 func convertStringToFixedArray(s string, maxLen int) [maxStr2Len]frontend.Variable {
 	var arr [maxStr2Len]frontend.Variable
 	for i := 0; i < maxLen && i < len(s); i++ {
@@ -113,33 +673,328 @@ func convertStringToFixedArray(s string, maxLen int) [maxStr2Len]frontend.Variab
 	return arr
 }
 
-// Load JSON data from a file and return it as a slice of strings
+// entryOffsets returns where each entry that fits starts in buildSuperString(entries, maxLen),
+// plus one past the end of the superstring, so entry k spans offsets[k]:offsets[k+1]-1 and
+// is followed by an entrySeparator or the end of the text
+func entryOffsets(entries []string, maxLen int) []int {
+	size := superStringLen(entries, maxLen)
+	offsets := make([]int, 0, len(entries)+1)
+	offset := 0
+	for i, entry := range entries {
+		if i > 0 {
+			if offset == size {
+				break
+			}
+			offset++
+		}
+		offsets = append(offsets, offset)
+		offset = min(offset+len(entry), size)
+	}
+	return append(offsets, offset+1)
+}
+
+// superStringLen returns the length of buildSuperString(entries, maxLen): at most maxLen
+// bytes, cut back to the start of a UTF-8 sequence the limit would split
+func superStringLen(entries []string, maxLen int) int {
+	size := 0
+	for i, entry := range entries {
+		if i > 0 {
+			if size == maxLen {
+				return size
+			}
+			size++
+		}
+		if size+len(entry) > maxLen {
+			cut := maxLen - size
+			for cut > 0 && !utf8.RuneStart(entry[cut]) {
+				cut--
+			}
+			return size + cut
+		}
+		size += len(entry)
+	}
+	return size
+}
+
+// buildSuperString joins entries with entrySeparator into a builder pre-sized to at most
+// maxLen bytes, stopping once it is full instead of joining everything and truncating. A
+// multi-byte character the limit would split is left out whole.
+func buildSuperString(entries []string, maxLen int) string {
+	size := superStringLen(entries, maxLen)
+
+	var b strings.Builder
+	b.Grow(size)
+	for i, entry := range entries {
+		if i > 0 {
+			if b.Len() == size {
+				break
+			}
+			b.WriteByte(entrySeparator)
+		}
+		if b.Len()+len(entry) >= size {
+			b.WriteString(entry[:size-b.Len()])
+			break
+		}
+		b.WriteString(entry)
+	}
+	return b.String()
+}
+
+// Load JSON data from a file and return it as a slice of strings: a JSON array, or JSON
+// Lines as described at openEntries
 func loadJSONFile(filename string) ([]string, error) {
-	file, err := os.Open(filename)
+	entries, err := openEntries(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	defer entries.Close()
+	return readAllEntries(entries)
+}
+
+// entryReader streams the strings of a JSON array or of JSON Lines one at a time, so a
+// multi-gigabyte export never has to be held as a slice
+type entryReader struct {
+	dec   *json.Decoder // JSON array input
+	lines *bufio.Reader // JSON Lines input
+	line  int           // JSON Lines read so far, for error messages
+	close func()
+
+	started, done bool
+	null          bool // The input was the JSON literal null rather than an array
+}
 
-	var data []string
-	bytes, err := ioutil.ReadAll(file)
+// openEntries opens filename for streaming with Next. Files named .jsonl or .ndjson, with
+// or without a further .gz, hold JSON Lines: one JSON string per line, blank lines
+// ignored. Anything else holds one JSON array of strings. Gzip input is decompressed by
+// openInput.
+func openEntries(filename string) (*entryReader, error) {
+	r, closeInput, err := openInput(filename)
 	if err != nil {
 		return nil, err
 	}
+	var er *entryReader
+	switch filepath.Ext(strings.TrimSuffix(filename, ".gz")) {
+	case ".jsonl", ".ndjson":
+		er = &entryReader{lines: bufio.NewReader(r)}
+	default:
+		er = &entryReader{dec: json.NewDecoder(r)}
+	}
+	er.close = closeInput
+	return er, nil
+}
 
-	if err := json.Unmarshal(bytes, &data); err != nil {
-		return nil, err
+// Next returns the next string, or io.EOF after the last one. A malformed JSON line is
+// reported with its line number.
+func (er *entryReader) Next() (string, error) {
+	if er.lines != nil {
+		return er.nextLine()
+	}
+	if er.done {
+		return "", io.EOF
+	}
+	if !er.started {
+		er.started = true
+		tok, err := er.dec.Token()
+		if err != nil {
+			return "", err
+		}
+		if tok == nil {
+			er.null, er.done = true, true
+			if err := checkJSONEnd(er.dec); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return "", &json.UnmarshalTypeError{Value: fmt.Sprint(tok), Type: reflect.TypeOf([]string(nil)), Offset: er.dec.InputOffset()}
+		}
+	}
+	if er.dec.More() {
+		var entry string
+		if err := er.dec.Decode(&entry); err != nil {
+			return "", err
+		}
+		return entry, nil
+	}
+	if _, err := er.dec.Token(); err != nil { // Closing ']'
+		return "", err
 	}
+	if err := checkJSONEnd(er.dec); err != nil {
+		return "", err
+	}
+	er.done = true
+	return "", io.EOF
+}
 
+// nextLine returns the string on the next non-blank line
+func (er *entryReader) nextLine() (string, error) {
+	for {
+		line, err := er.lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("line %d: %w", er.line+1, err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			return "", io.EOF
+		}
+		er.line++
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry string
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return "", fmt.Errorf("line %d: %w", er.line, err)
+		}
+		return entry, nil
+	}
+}
+
+// Close closes the file openEntries opened
+func (er *entryReader) Close() {
+	if er.close != nil {
+		er.close()
+	}
+}
+
+// readAllEntries collects the remaining strings of er. Like json.Unmarshal into a
+// []string, a null array yields nil.
+func readAllEntries(er *entryReader) ([]string, error) {
+	data := []string{}
+	for {
+		entry, err := er.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, entry)
+	}
+	if er.null {
+		return nil, nil
+	}
 	return data, nil
 }
 
+// loadRawFile returns the bytes of filename as the text, so a concatenated log can be
+// proved over without wrapping it in a JSON array. Only the first maxLen bytes are read,
+// cut back to a character boundary as buildSuperString would.
+func loadRawFile(filename string, maxLen int) (string, error) {
+	r, closeInput, err := openInput(filename)
+	if err != nil {
+		return "", err
+	}
+	defer closeInput()
+
+	// One byte past the limit shows whether the limit splits a character
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", filename, err)
+	}
+	return string(data[:superStringLen([]string{string(data)}, maxLen)]), nil
+}
+
+// openInput opens filename for reading, transparently decompressing gzip input recognised
+// by its extension or magic bytes. The returned function closes everything it opened.
+func openInput(filename string) (io.Reader, func(), error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	if magic, _ := buffered.Peek(2); strings.HasSuffix(filename, ".gz") || (len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		return gz, func() { gz.Close(); file.Close() }, nil
+	}
+	return buffered, func() { file.Close() }, nil
+}
+
+// readSuperString reads the text buildSuperString(entries, maxLen) would build from the
+// entries of filename, and the entryOffsets of the entries it holds. Entries are streamed
+// and reading stops once the text is full, so neither the entries past maxLen nor the
+// whole list is ever held. With format "json" the entries are the elements of a JSON
+// array or JSON Lines file; with "raw" the whole file is one entry.
+func readSuperString(filename, format string, maxLen int) (string, []int, error) {
+	switch format {
+	case "json":
+	case "raw":
+		text, err := loadRawFile(filename, maxLen)
+		if err != nil {
+			return "", nil, err
+		}
+		return text, []int{0, len(text) + 1}, nil
+	default:
+		return "", nil, fmt.Errorf("unknown input format %q (want json or raw)", format)
+	}
+
+	entries, err := openEntries(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	defer entries.Close()
+	var b strings.Builder
+	var offsets []int
+	for b.Len() < maxLen {
+		entry, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if len(offsets) > 0 {
+			b.WriteByte(entrySeparator)
+		}
+		offsets = append(offsets, b.Len())
+		if b.Len()+len(entry) > maxLen {
+			entry = entry[:superStringLen([]string{entry}, maxLen-b.Len())]
+			b.WriteString(entry)
+			break
+		}
+		b.WriteString(entry)
+	}
+	return b.String(), append(offsets, b.Len()+1), nil
+}
+
+// decodeStringArray decodes a JSON array of strings one element at a time, so the raw
+// input is never held in memory alongside the result. Like json.Unmarshal into a
+// []string, null yields nil and anything other than one array of strings is an error.
+func decodeStringArray(r io.Reader) ([]string, error) {
+	return readAllEntries(&entryReader{dec: json.NewDecoder(r)})
+}
+
+// checkJSONEnd returns an error if anything but whitespace follows the decoded value
+func checkJSONEnd(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("json: unexpected data after top-level value at offset %d", dec.InputOffset())
+	}
+	return nil
+}
+
 func main() {
-	// Load decoded entries and substrings from JSON files
-	decodedEntriesFile := "combined_raw_decoded_entries.json"
+	entry := flag.Int("entry", -1, "Only count matches inside this decoded entry (-1 for the whole text)")
+	sharedWindows := flag.Bool("shared-windows", false, "Commit the text's window hashes once per pattern length and prove each pattern against them")
+	decodedEntriesFile := flag.String("entries", "combined_raw_decoded_entries.json", "File the text is read from, optionally gzipped")
+	inputFormat := flag.String("input-format", "json", "Format of -entries: json for an array of entries or JSON Lines (.jsonl), raw to use the file's bytes as the text")
+	minOccurrences := flag.Int("min-occurrences", 1, "Prove each pattern occurs at least this many times, overlaps included")
+	flag.Parse()
+
+	if *minOccurrences < 1 {
+		log.Fatalf("Invalid -min-occurrences %d: must be at least 1", *minOccurrences)
+	}
+	if *sharedWindows && *minOccurrences != 1 {
+		log.Fatalf("-shared-windows opens a single window, so it cannot prove -min-occurrences %d", *minOccurrences)
+	}
+
+	// Load decoded entries and substrings; a raw text file is a single entry
 	substringsFile := "c-nimbus24_subj-common-names_1000.json"
 
-	decodedEntries, err := loadJSONFile(decodedEntriesFile)
+	// Concatenate decoded entries into a single string as they are read, stopping at maxStr2Len
+	superLongString, offsets, err := readSuperString(*decodedEntriesFile, *inputFormat, maxStr2Len)
 	if err != nil {
 		log.Fatalf("Failed to load decoded entries file: %v", err)
 	}
@@ -149,14 +1004,29 @@ func main() {
 		log.Fatalf("Failed to load substrings file: %v", err)
 	}
 
-	// Concatenate decoded entries into a single string, truncated to maxStr2Len if necessary
-	superLongString := strings.Join(decodedEntries, "")
-	if len(superLongString) > maxStr2Len {
-		superLongString = superLongString[:maxStr2Len]
+	// Restrict matches to one entry's region of the superstring if requested
+	rangeStart, rangeEnd := 0, maxStr2Len
+	if *entry >= 0 {
+		if *entry >= len(offsets)-1 {
+			log.Fatalf("Invalid -entry %d: only %d decoded entries fit in the text", *entry, len(offsets)-1)
+		}
+		rangeStart, rangeEnd = offsets[*entry], offsets[*entry+1]-1
+		fmt.Printf("Matching inside entry %d: [%d, %d)\n", *entry, rangeStart, rangeEnd)
 	}
 
 	// Convert Str2 to a fixed array
 	str2 := convertStringToFixedArray(superLongString, maxStr2Len)
+	// The text stays secret; verifiers pin this commitment instead
+	textCommitment := commitText(superLongString, maxStr2Len)
+	fmt.Printf("Text commitment: %s\n", textCommitment)
+	var counts outcomeCounts
+	if *sharedWindows {
+		if err := proveSharedWindows(superLongString, textCommitment, substrings, rangeStart, rangeEnd, &counts); err != nil {
+			log.Fatalf("Shared window proving failed: %v", err)
+		}
+		fmt.Printf("Outcomes: %s\n", &counts)
+		return
+	}
 	// fmt.Print(str2)
 	// Process each substring in the list
 	for _, substring := range substrings {
@@ -165,21 +1035,39 @@ func main() {
 		}
 		effectiveLen := len(substring)
 		// Convert Str1 with end marker
-		str1 := convertStringToFixedArrayZeroPad(substring)
+		str1, err := convertStringToFixedArrayZeroPad(substring)
+		if err == nil {
+			// A small text leaves no window for a longer pattern, so it could never be proved
+			err = checkPatternFitsText(substring, len(superLongString), rangeStart, rangeEnd)
+		}
+		if err != nil {
+			fmt.Printf("Skipping substring: %v\n", err)
+			counts[skipOutcome(err)]++
+			continue
+		}
 		// fmt.Print(str2)
 		// fmt.Println(str1)
 		// Create the circuit with Str1 and Str2 initialized
-		circuit := SubstringCircuit{
+		circuit := &SubstringCircuit{
 			Str1:            str1,
 			Str2:            str2,
 			EffectiveLength: effectiveLen,
 		}
+		witness := &SubstringCircuit{
+			Str1:           str1,
+			Str2:           str2,
+			TextCommitment: textCommitment,
+			RangeStart:     rangeStart,
+			RangeEnd:       rangeEnd,
+			MinOccurrences: *minOccurrences,
+		}
 
 		// Compile the circuit
-		ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit)
+		ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
 		if err != nil {
 			log.Fatalf("Circuit compilation failed: %v", err)
 		}
+		fmt.Printf("Circuit size for substring '%s': %s\n", substring, sizeOf(ccs))
 
 		// Set up Groth16
 		pk, vk, err := groth16.Setup(ccs)
@@ -187,13 +1075,7 @@ func main() {
 			log.Fatalf("Setup failed: %v", err)
 		}
 
-		// Create witness
-		witness := SubstringCircuit{
-			Str1: str1,
-			Str2: str2,
-		}
-
-		witnessInstance, err := frontend.NewWitness(&witness, ecc.BN254.ScalarField())
+		witnessInstance, err := frontend.NewWitness(witness, ecc.BN254.ScalarField())
 		if err != nil {
 			log.Fatalf("Failed to create witness for substring '%s': %v", substring, err)
 		}
@@ -213,8 +1095,11 @@ func main() {
 		err = groth16.Verify(proof, vk, publicWitness)
 		if err != nil {
 			fmt.Printf("Verification failed for substring '%s'\n", substring)
+			counts[VerificationFailed]++
 		} else {
 			fmt.Printf("Proof verified successfully for substring '%s'\n", substring)
+			counts[Proved]++
 		}
 	}
+	fmt.Printf("Outcomes: %s\n", &counts)
 }
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+)
+
+// sizedSubstringCircuit is SubstringCircuit over a text of any length, so its size can be
+// compared with the shared window circuits
+type sizedSubstringCircuit struct {
+	Str1           [maxStr1Len]frontend.Variable
+	Str2           []frontend.Variable
+	TextCommitment frontend.Variable `gnark:",public"`
+	RangeStart     frontend.Variable `gnark:",public"`
+	RangeEnd       frontend.Variable `gnark:",public"`
+	MinOccurrences frontend.Variable `gnark:",public"`
+
+	patternLength int
+}
+
+func (circuit *sizedSubstringCircuit) Define(api frontend.API) error {
+	commitment, err := commitTextInCircuit(api, circuit.Str2)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(commitment, circuit.TextCommitment)
+	return assertContains(api, circuit.Str1[:], circuit.Str2, circuit.patternLength, circuit.RangeStart, circuit.RangeEnd, circuit.MinOccurrences)
+}
+
+// proverCase is an assignment for assertProver and whether it satisfies the circuit
+type proverCase struct {
+	name       string
+	assignment frontend.Circuit
+	valid      bool
+}
+
+// assertProver runs each case in its own subtest through gnark's test assertions on BN254
+// with Groth16, expecting ProverSucceeded for the valid ones and ProverFailed for the rest
+func assertProver(t *testing.T, circuit frontend.Circuit, cases []proverCase) {
+	assert := test.NewAssert(t)
+	for _, c := range cases {
+		assert.Run(func(assert *test.Assert) {
+			if c.valid {
+				assert.ProverSucceeded(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			} else {
+				assert.ProverFailed(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			}
+		}, c.name)
+	}
+}
+
+// substringCheckLen is the text length used by TestSubstringCircuit
+const substringCheckLen = 64
+
+// TestSubstringCircuit checks the text commitment and assertContains together over a
+// text short enough to prove in a test. "www" occurs at 8 and 39: it is accepted at
+// least twice in the whole text, and rejected when absent, against another text's
+// commitment, in a range past both occurrences or when claimed three times.
+func TestSubstringCircuit(t *testing.T) {
+	text := "https://www.example.com/a/long/path/to/www.example.org/index.htm"
+	str2 := make([]frontend.Variable, substringCheckLen)
+	for i := range str2 {
+		str2[i] = int(text[i])
+	}
+	commitment := commitText(text, substringCheckLen)
+	assignment := func(pattern string, commitment *big.Int, rangeStart, minOccurrences int) *sizedSubstringCircuit {
+		str1, err := convertStringToFixedArrayZeroPad(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sizedSubstringCircuit{
+			Str1:           str1,
+			Str2:           str2,
+			TextCommitment: commitment,
+			RangeStart:     rangeStart,
+			RangeEnd:       substringCheckLen,
+			MinOccurrences: minOccurrences,
+		}
+	}
+	other := commitText(strings.Replace(text, ".org", ".com", 1), substringCheckLen)
+	assertProver(t, &sizedSubstringCircuit{Str2: make([]frontend.Variable, substringCheckLen), patternLength: 3}, []proverCase{
+		{"present", assignment("www", commitment, 0, 1), true},
+		{"present twice", assignment("www", commitment, 0, 2), true},
+		{"present in range", assignment("www", commitment, 9, 1), true},
+		{"absent", assignment("zzz", commitment, 0, 1), false},
+		{"another text's commitment", assignment("www", other, 0, 1), false},
+		{"range past both occurrences", assignment("www", commitment, 40, 1), false},
+		{"claimed three times", assignment("www", commitment, 0, 3), false},
+	})
+}
+
+// windowSavings compares the constraints needed to prove nbPatterns patterns of
+// patternLength against a text of textLength characters with one SubstringCircuit each,
+// against one WindowsCircuit plus one WindowMatchCircuit per pattern
+type windowSavings struct {
+	PerPattern, Windows, WindowMatch int // Constraints of each circuit
+	NbPatterns                       int
+}
+
+// Separate returns the constraints of proving every pattern with SubstringCircuit
+func (w windowSavings) Separate() int { return w.NbPatterns * w.PerPattern }
+
+// Shared returns the constraints of proving every pattern against shared window hashes
+func (w windowSavings) Shared() int { return w.Windows + w.NbPatterns*w.WindowMatch }
+
+func (w windowSavings) String() string {
+	return fmt.Sprintf("%d patterns: %d constraints separately (%d each), %d shared (%d once + %d each), %.1fx fewer",
+		w.NbPatterns, w.Separate(), w.PerPattern, w.Shared(), w.Windows, w.WindowMatch, float64(w.Separate())/float64(w.Shared()))
+}
+
+// compareWindowSavings compiles the three circuits for the given sizes
+func compareWindowSavings(textLength, patternLength, nbPatterns int) (windowSavings, error) {
+	savings := windowSavings{NbPatterns: nbPatterns}
+	for _, c := range []struct {
+		circuit frontend.Circuit
+		count   *int
+	}{
+		{&sizedSubstringCircuit{Str2: make([]frontend.Variable, textLength), patternLength: patternLength}, &savings.PerPattern},
+		{newWindowsCircuit(patternLength, textLength), &savings.Windows},
+		{newWindowMatchCircuit(patternLength, textLength), &savings.WindowMatch},
+	} {
+		ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, c.circuit)
+		if err != nil {
+			return savings, err
+		}
+		*c.count = ccs.GetNbConstraints()
+	}
+	return savings, nil
+}
+
+// TestCircuitStats compiles textCommitmentCircuit twice and checks that its size and
+// memory estimate are non-zero and identical across compiles
+func TestCircuitStats(t *testing.T) {
+	var sizes [2]circuitSize
+	for i := range sizes {
+		ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &textCommitmentCircuit{Pattern: make([]frontend.Variable, 3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = sizeOf(ccs)
+	}
+	size := sizes[0]
+	fmt.Printf("Text commitment circuit: %s\n", size)
+	if sizes[1] != size {
+		t.Fatalf("recompiling changed %s to %s", size, sizes[1])
+	}
+	if size.NbConstraints == 0 || size.NbPublic == 0 || size.NbSecret == 0 || size.NbInternal == 0 || size.EstimatedProverBytes() == 0 {
+		t.Fatalf("zero count in %s", size)
+	}
+}
+
+// commitmentCheckLen is the text length used by TestTextCommitment, short enough to solve quickly
+const commitmentCheckLen = 64
+
+// textCommitmentCircuit is SubstringCircuit over a short text, so commitTextInCircuit
+// can be checked against commitText quickly
+type textCommitmentCircuit struct {
+	Pattern    []frontend.Variable                   `gnark:"pattern,secret"`
+	Text       [commitmentCheckLen]frontend.Variable `gnark:"text,secret"`
+	Commitment frontend.Variable                     `gnark:"commitment,public"`
+}
+
+func (circuit *textCommitmentCircuit) Define(api frontend.API) error {
+	commitment, err := commitTextInCircuit(api, circuit.Text[:])
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(commitment, circuit.Commitment)
+	return assertContains(api, circuit.Pattern, circuit.Text[:], len(circuit.Pattern), 0, len(circuit.Text), 1)
+}
+
+// TestTextCommitment verifies that the in-circuit text commitment equals commitText for
+// the same text, and that a prover cannot swap in a doctored text, or alias characters
+// through the packing, against the published commitment
+func TestTextCommitment(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	newAssignment := func(pattern, text string) *textCommitmentCircuit {
+		assignment := &textCommitmentCircuit{Pattern: toVariables(pattern)}
+		for i := range assignment.Text {
+			assignment.Text[i] = 0
+			if i < len(text) {
+				assignment.Text[i] = int(text[i])
+			}
+		}
+		return assignment
+	}
+	published := commitText("www.example.com", commitmentCheckLen)
+
+	honest := newAssignment("example", "www.example.com")
+	honest.Commitment = published
+	// 'w'+256 followed by 'w'-1 packs to the same element as "ww"
+	aliased := newAssignment("example", "www.example.com")
+	aliased.Commitment = published
+	aliased.Text[0], aliased.Text[1] = int('w')+256, int('w')-1
+	assertProver(t, &textCommitmentCircuit{Pattern: make([]frontend.Variable, 7)}, []proverCase{
+		{"published text", honest, true},
+		{"out-of-range character", aliased, false},
+	})
+
+	// Prove "org" occurs using a doctored text against the published commitment; it
+	// would only pass with its own commitment
+	doctored := newAssignment("org", "www.example.org")
+	doctored.Commitment = published
+	ownCommitment := *doctored
+	ownCommitment.Commitment = commitText("www.example.org", commitmentCheckLen)
+	assertProver(t, &textCommitmentCircuit{Pattern: make([]frontend.Variable, 3)}, []proverCase{
+		{"doctored text, published commitment", doctored, false},
+		{"doctored text, its own commitment", &ownCommitment, true},
+	})
+}
+
+// rangeCheckLen is the text length used by TestRange
+const rangeCheckLen = 15
+
+// rangeCircuit runs assertContains on a short text so range restrictions and occurrence
+// thresholds solve quickly
+type rangeCircuit struct {
+	Pattern        []frontend.Variable
+	Text           [rangeCheckLen]frontend.Variable
+	RangeStart     frontend.Variable
+	RangeEnd       frontend.Variable
+	MinOccurrences frontend.Variable
+}
+
+func (circuit *rangeCircuit) Define(api frontend.API) error {
+	return assertContains(api, circuit.Pattern, circuit.Text[:], len(circuit.Pattern), circuit.RangeStart, circuit.RangeEnd, circuit.MinOccurrences)
+}
+
+// TestRange checks that a pattern is accepted inside its entry's range and rejected when
+// it only occurs in another entry or straddles the range boundary
+func TestRange(t *testing.T) {
+	entries := []string{"foo", "bar", "baz", "foo"} // 15 bytes with the separators
+	text := buildSuperString(entries, rangeCheckLen)
+	offsets := entryOffsets(entries, rangeCheckLen)
+	cases := []struct {
+		pattern string
+		entry   int
+		want    bool
+	}{
+		{"bar", 1, true},
+		{"ar", 1, true},
+		{"baz", 1, false},    // Only in entry 2
+		{"o\x01b", 1, false}, // Straddles entries 0 and 1
+		{"foo", 3, true},     // Also in entry 0
+		{"foo", 1, false},
+		{"barb", 1, false}, // Longer than the entry
+		{"bp", 1, false},   // 2*'b' + 'p' = 2*'a' + 'r', collides with "ar" in range
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		var assignment rangeCircuit
+		for i := range assignment.Text {
+			assignment.Text[i] = int(text[i])
+		}
+		assignment.Pattern = make([]frontend.Variable, len(c.pattern))
+		for i := range assignment.Pattern {
+			assignment.Pattern[i] = int(c.pattern[i])
+		}
+		assignment.RangeStart, assignment.RangeEnd = offsets[c.entry], offsets[c.entry+1]-1
+		assignment.MinOccurrences = 1
+		shape := rangeCircuit{Pattern: make([]frontend.Variable, len(c.pattern))}
+		if got := test.IsSolved(&shape, &assignment, field) == nil; got != c.want {
+			t.Fatalf("pattern %q in entry %d: accepted=%v, want %v", c.pattern, c.entry, got, c.want)
+		}
+	}
+}
+
+// TestMinOccurrences checks that a pattern occurring 3 times is accepted for K up to 3
+// and rejected above, that only occurrences inside the range count, that a window with
+// the same base-2 hash as the pattern is no occurrence and that a negative K, which is a
+// huge field element, is rejected
+func TestMinOccurrences(t *testing.T) {
+	const text = "abxabxaabxxxb`y" // "ab" at 0, 3 and 7, "b`" (2*'b' + '`' = 2*'a' + 'b') at 12
+	cases := []struct {
+		pattern    string
+		start, end int
+		k          int64
+		want       bool
+	}{
+		{"ab", 0, rangeCheckLen, 2, true},
+		{"ab", 0, rangeCheckLen, 3, true},
+		{"ab", 0, rangeCheckLen, 4, false}, // "b`" does not count
+		{"ab", 3, rangeCheckLen, 2, true},  // The first occurrence is out of range
+		{"ab", 3, rangeCheckLen, 3, false},
+		{"ab", 0, 8, 3, false},              // The last one straddles the range end
+		{"ab", 0, rangeCheckLen, -1, false}, // p-1 in the field, not a small threshold
+		{"xx", 0, rangeCheckLen, 2, true},   // Overlapping occurrences count separately
+		{"xx", 0, rangeCheckLen, 3, false},
+		{"b`", 0, rangeCheckLen, 1, true},
+		{"b`", 0, rangeCheckLen, 2, false}, // Nor do the "ab"
+		{"b`", 0, 12, 1, false},            // Only "ab" in range
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		var assignment rangeCircuit
+		for i := range assignment.Text {
+			assignment.Text[i] = int(text[i])
+		}
+		assignment.Pattern = make([]frontend.Variable, len(c.pattern))
+		for i := range assignment.Pattern {
+			assignment.Pattern[i] = int(c.pattern[i])
+		}
+		assignment.RangeStart, assignment.RangeEnd, assignment.MinOccurrences = c.start, c.end, c.k
+		shape := rangeCircuit{Pattern: make([]frontend.Variable, len(c.pattern))}
+		if got := test.IsSolved(&shape, &assignment, field) == nil; got != c.want {
+			t.Fatalf("pattern %q in [%d, %d) with K=%d: accepted=%v, want %v", c.pattern, c.start, c.end, c.k, got, c.want)
+		}
+	}
+}
+
+// TestTooLongForText checks that patterns longer than a tiny text, or than the entry
+// they are matched in, are skipped as SkippedTooLongForText before a witness is built,
+// and that a circuit shaped with such a pattern fails to compile instead of panicking
+func TestTooLongForText(t *testing.T) {
+	entries := []string{"ab.io", "x.co"} // "ab.io\x01x.co"
+	text := buildSuperString(entries, maxStr2Len)
+	offsets := entryOffsets(entries, maxStr2Len)
+	cases := []struct {
+		pattern    string
+		start, end int
+		want       Outcome
+	}{
+		{"ab.iox.co!", 0, maxStr2Len, Proved}, // As long as the whole text, separator included
+		{"ab.iox.co!!", 0, maxStr2Len, SkippedTooLongForText},
+		{"example.com", 0, maxStr2Len, SkippedTooLongForText},
+		{"x.co", offsets[1], offsets[2] - 1, Proved},
+		{"ab.io", offsets[1], offsets[2] - 1, SkippedTooLongForText}, // Longer than entry 1 alone
+		{strings.Repeat("a", maxStr1Len+1), 0, maxStr2Len, SkippedTooLong},
+	}
+	var counts outcomeCounts
+	for _, c := range cases {
+		_, err := convertStringToFixedArrayZeroPad(c.pattern)
+		if err == nil {
+			err = checkPatternFitsText(c.pattern, len(text), c.start, c.end)
+		}
+		got := Proved
+		if err != nil {
+			got = skipOutcome(err)
+		}
+		if got != c.want {
+			t.Fatalf("pattern %q in [%d, %d): %v (%v), want %v", c.pattern, c.start, c.end, got, err, c.want)
+		}
+		counts[got]++
+	}
+	if got := counts.String(); got != "proved=2 skippedTooLong=1 skippedTooLongForText=3" {
+		t.Fatalf("counts %q", got)
+	}
+
+	// assertContains refuses the shape rather than computing a negative window count
+	_, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &rangeCircuit{Pattern: make([]frontend.Variable, rangeCheckLen+1)})
+	if !errors.Is(err, ErrPatternLongerThanText) {
+		t.Fatalf("compiling a pattern longer than the text: got %v, want %v", err, ErrPatternLongerThanText)
+	}
+}
+
+// TestUnicode checks multi-byte patterns as UTF-8 bytes: they match inside their entry
+// and not across entries, the superstring never ends inside a character, and a pattern
+// character wider than a byte never matches
+func TestUnicode(t *testing.T) {
+	if got := buildSuperString([]string{"ab", "日本"}, 4); got != "ab\x01" {
+		t.Fatalf("superstring cut to 4 bytes is %q, want \"ab\\x01\"", got)
+	}
+	if got := entryOffsets([]string{"ab", "日本"}, 4); !slices.Equal(got, []int{0, 3, 4}) {
+		t.Fatalf("entry offsets %v, want [0 3 4]", got)
+	}
+
+	entries := []string{"bü", "日本", "ab"}
+	text := buildSuperString(entries, rangeCheckLen)
+	offsets := entryOffsets(entries, rangeCheckLen)
+	cases := []struct {
+		pattern string
+		entry   int
+		want    bool
+	}{
+		{"ü", 0, true},
+		{"bü", 0, true},
+		{"日本", 1, true},
+		{"本", 1, true},
+		{"本", 0, false},
+		{"本\x01a", 1, false}, // Straddles entries 1 and 2
+		{"üb", 0, false},
+	}
+	field := ecc.BN254.ScalarField()
+	solve := func(pattern []frontend.Variable, entry int) error {
+		var assignment rangeCircuit
+		for i := range assignment.Text {
+			assignment.Text[i] = 0
+			if i < len(text) {
+				assignment.Text[i] = int(text[i])
+			}
+		}
+		assignment.Pattern = pattern
+		assignment.RangeStart, assignment.RangeEnd, assignment.MinOccurrences = offsets[entry], offsets[entry+1]-1, 1
+		shape := rangeCircuit{Pattern: make([]frontend.Variable, len(pattern))}
+		return test.IsSolved(&shape, &assignment, field)
+	}
+	for _, c := range cases {
+		arr, err := convertStringToFixedArrayZeroPad(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := solve(arr[:len(c.pattern)], c.entry) == nil; got != c.want {
+			t.Fatalf("pattern %q in entry %d: accepted=%v, want %v", c.pattern, c.entry, got, c.want)
+		}
+	}
+	// -1 and 294 are no bytes, though 2*-1 + 294 = 2*'a' + 'b'
+	if solve([]frontend.Variable{-1, 294}, 2) == nil {
+		t.Fatal("pattern character outside a byte accepted")
+	}
+}
+
+// TestEntrySeparator checks that no window spanning two entries matches, even over the
+// whole text: neither a pattern holding the separator nor one that only hashes like such
+// a window
+func TestEntrySeparator(t *testing.T) {
+	text := buildSuperString([]string{"foo", "bar", "baz", "foo"}, rangeCheckLen)
+	cases := []struct {
+		pattern string
+		want    bool
+	}{
+		{"bar", true},
+		{"oob", false},
+		{"o\x01b", false},
+		{"o\x00d", false}, // 4*'o' + 2*0 + 'd' = 4*'o' + 2*1 + 'b', the hash of "o\x01b"
+		{"\x01", false},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		var assignment rangeCircuit
+		for i := range assignment.Text {
+			assignment.Text[i] = int(text[i])
+		}
+		assignment.Pattern = make([]frontend.Variable, len(c.pattern))
+		for i := range assignment.Pattern {
+			assignment.Pattern[i] = int(c.pattern[i])
+		}
+		assignment.RangeStart, assignment.RangeEnd, assignment.MinOccurrences = 0, rangeCheckLen, 1
+		shape := rangeCircuit{Pattern: make([]frontend.Variable, len(c.pattern))}
+		if got := test.IsSolved(&shape, &assignment, field) == nil; got != c.want {
+			t.Fatalf("pattern %q: accepted=%v, want %v", c.pattern, got, c.want)
+		}
+	}
+}
+
+// windowCheckLen is the text length used by TestSharedWindows
+const windowCheckLen = 64
+
+// TestSharedWindows checks the window tree against WindowsCircuit for patterns of one
+// and two sub-windows, that WindowMatchCircuit accepts an occurrence in range and rejects
+// a different pattern or a range that excludes it, and prints the constraint savings
+// for 1000 patterns
+func TestSharedWindows(t *testing.T) {
+	text := []byte("https://www.example.com/a/long/path/to/www.example.org/index.htm")
+	commitment := commitText(string(text), windowCheckLen)
+	for _, pattern := range []string{"www", "www.example.com/a/long/path/to/www.exam"} {
+		tree := newWindowTree(windowLeaves(text, len(pattern)))
+
+		windows := newWindowsCircuit(len(pattern), windowCheckLen)
+		for i := range windows.Str2 {
+			windows.Str2[i] = int(text[i])
+		}
+		windows.TextCommitment, windows.WindowRoot = commitment, tree.root()
+		wrongRoot := *windows
+		wrongRoot.WindowRoot = new(big.Int).Add(tree.root(), big.NewInt(1))
+		assertProver(t, newWindowsCircuit(len(pattern), windowCheckLen), []proverCase{
+			{fmt.Sprintf("windows of %d", len(pattern)), windows, true},
+			{fmt.Sprintf("windows of %d, wrong root", len(pattern)), &wrongRoot, false},
+		})
+
+		match, err := newWindowMatchAssignment(tree, text, pattern, 0, windowCheckLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tampered := func(tamper func(w *WindowMatchCircuit)) *WindowMatchCircuit {
+			w := *match
+			w.Path, w.PathDir = slices.Clone(match.Path), slices.Clone(match.PathDir)
+			tamper(&w)
+			return &w
+		}
+		name := fmt.Sprintf("pattern of %d", len(pattern))
+		// The first occurrence is at 8, a left child at level 0 and a right child at level 3
+		assertProver(t, newWindowMatchCircuit(len(pattern), windowCheckLen), []proverCase{
+			{name, match, true},
+			{name + ", altered pattern", tampered(func(w *WindowMatchCircuit) { w.Str1[1] = int('x') }), false},
+			{name + ", corrupted proof path", tampered(func(w *WindowMatchCircuit) { w.Path[0] = 1 }), false},
+			{name + ", wrong root", tampered(func(w *WindowMatchCircuit) { w.WindowRoot = new(big.Int).Add(tree.root(), big.NewInt(1)) }), false},
+			{name + ", flipped direction bit", tampered(func(w *WindowMatchCircuit) { w.PathDir[0] = 1 }), false},
+			{name + ", non-boolean direction bit", tampered(func(w *WindowMatchCircuit) { w.PathDir[3] = 2 }), false},
+			// A range starting after the occurrence must not accept leaf 8
+			{name + ", out of range", tampered(func(w *WindowMatchCircuit) { w.RangeStart = 9 }), false},
+		})
+	}
+	if _, err := newWindowMatchAssignment(newWindowTree(windowLeaves(text, 3)), text, "zzz", 0, windowCheckLen); !errors.Is(err, ErrNoWindow) {
+		t.Fatalf("absent pattern: got %v, want %v", err, ErrNoWindow)
+	}
+
+	savings, err := compareWindowSavings(1024, 8, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("Text of 1024 characters, %s\n", savings)
+	if savings.Shared() >= savings.Separate() {
+		t.Fatal("shared window hashes do not save constraints")
+	}
+}
+
+// TestPatternLength checks that a pattern one character over maxStr1Len is refused
+// with ErrPatternTooLong instead of being truncated into a witness
+func TestPatternLength(t *testing.T) {
+	if _, err := convertStringToFixedArrayZeroPad(strings.Repeat("a", maxStr1Len)); err != nil {
+		t.Fatalf("pattern of length %d: %v", maxStr1Len, err)
+	}
+	if _, err := convertStringToFixedArrayZeroPad(strings.Repeat("a", maxStr1Len+1)); !errors.Is(err, ErrPatternTooLong) {
+		t.Fatalf("pattern of length %d: got %v, want %v", maxStr1Len+1, err, ErrPatternTooLong)
+	}
+}
+
+// TestEntryFormats checks that a JSON array, JSON Lines and gzipped JSON Lines load the
+// same entries, that a malformed line is reported with its line number and that a
+// corrupted gzip stream is an error
+func TestEntryFormats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "entry-formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gzipped := func(data []byte) []byte {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(data)
+		gz.Close()
+		return b.Bytes()
+	}
+
+	want := []string{"example.com", "bücher.de", "", "*.example.org"}
+	array, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []byte("\"example.com\"\r\n\n\"b\\u00fccher.de\"\n\"\"\n\"*.example.org\"")
+	corrupted := gzipped(lines)
+	corrupted[len(corrupted)-8] ^= 0xff // CRC-32 in the gzip trailer
+	cases := []struct {
+		name string
+		data []byte
+		want string // Error substring, empty when the entries must load
+	}{
+		{"entries.json", array, ""},
+		{"entries.jsonl", lines, ""},
+		{"entries.jsonl.gz", gzipped(lines), ""},
+		{"malformed.jsonl", []byte("\"a\"\n\"b\"\n{}\n"), "line 3"},
+		{"corrupted.jsonl.gz", corrupted, "checksum"},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(dir, c.name)
+		if err := os.WriteFile(filename, c.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadJSONFile(filename)
+		switch {
+		case c.want == "" && err != nil:
+			t.Fatalf("%s: %v", c.name, err)
+		case c.want == "" && !slices.Equal(got, want):
+			t.Fatalf("%s: got %q, want %q", c.name, got, want)
+		case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+			t.Fatalf("%s: got %v, want an error mentioning %q", c.name, err, c.want)
+		}
+	}
+}
+
+// TestRawInput checks that a raw file, also gzipped, yields the same Str2 and commitment
+// as a JSON array holding its contents as the single element
+func TestRawInput(t *testing.T) {
+	dir, err := os.MkdirTemp("", "raw-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	text := "2024-05-01 GET https://www.example.com/\n\"quoted\" \\ bücher.de 日本\ttab\n"
+	rawFile := filepath.Join(dir, "log.txt")
+	if err := os.WriteFile(rawFile, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(text))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzipFile := filepath.Join(dir, "log.txt.gz")
+	if err := os.WriteFile(gzipFile, gzipped.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal([]string{text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(dir, "entries.json")
+	if err := os.WriteFile(jsonFile, encoded, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _, err := readSuperString(jsonFile, "json", maxStr2Len)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantStr2 := convertStringToFixedArray(want, maxStr2Len)
+	for _, filename := range []string{rawFile, gzipFile} {
+		got, offsets, err := readSuperString(filename, "raw", maxStr2Len)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(offsets, []int{0, len(text) + 1}) {
+			t.Fatalf("%s: entry offsets %v", filepath.Base(filename), offsets)
+		}
+		if got != text || convertStringToFixedArray(got, maxStr2Len) != wantStr2 {
+			t.Fatalf("%s: Str2 differs from the JSON array's", filepath.Base(filename))
+		}
+		if commitText(got, maxStr2Len).Cmp(commitText(want, maxStr2Len)) != 0 {
+			t.Fatalf("%s: commitment differs from the JSON array's", filepath.Base(filename))
+		}
+	}
+	if _, _, err := readSuperString(rawFile, "csv", maxStr2Len); err == nil {
+		t.Fatal("unknown input format accepted")
+	}
+
+	// A limit inside "ü" cuts before it, as buildSuperString does
+	limit := strings.Index(text, "ü") + 1
+	for _, input := range []struct{ filename, format string }{{rawFile, "raw"}, {jsonFile, "json"}} {
+		got, _, err := readSuperString(input.filename, input.format, limit)
+		if wantCut := buildSuperString([]string{text}, limit); err != nil || got != wantCut {
+			t.Fatalf("%s cut to %d bytes: got %q, %v, want %q", input.format, limit, got, err, wantCut)
+		}
+	}
+}
+
+// TestStreamedSuperString checks that readSuperString matches buildSuperString and
+// entryOffsets over the entries it reads, and that it stops reading once the text is
+// full, so a malformed entry past the limit goes unnoticed
+func TestStreamedSuperString(t *testing.T) {
+	dir, err := os.MkdirTemp("", "streamed-superstring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entries := []string{"example.com", "", "bücher.de", "日本.jp", "x.org"}
+	lines := ""
+	for _, entry := range entries {
+		encoded, _ := json.Marshal(entry)
+		lines += string(encoded) + "\n"
+	}
+	filename := filepath.Join(dir, "entries.jsonl")
+	if err := os.WriteFile(filename, []byte(lines+"{not json}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	total := len(strings.Join(entries, string(entrySeparator)))
+	for maxLen := 1; maxLen < total; maxLen++ {
+		got, offsets, err := readSuperString(filename, "json", maxLen)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", maxLen, err)
+		}
+		read := entries[:len(offsets)-1]
+		if want := buildSuperString(entries, maxLen); got != want {
+			t.Fatalf("%d bytes: read %q, want %q", maxLen, got, want)
+		}
+		if want := entryOffsets(read, maxLen); !slices.Equal(offsets, want) {
+			t.Fatalf("%d bytes: offsets %v, want %v", maxLen, offsets, want)
+		}
+	}
+	if _, _, err := readSuperString(filename, "json", total+1); err == nil || !strings.Contains(err.Error(), "line 6") {
+		t.Fatalf("reading past the entries: got %v, want the malformed line 6", err)
+	}
+}
@@ -1,26 +1,163 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/big"
+	mathbits "math/bits"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	mimcHash "github.com/consensys/gnark-crypto/ecc/bn254/fr/mimc"
 	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/std/hash/mimc"
+	"github.com/consensys/gnark/std/lookup/logderivlookup"
+	"github.com/consensys/gnark/std/math/bits"
 )
 
+var (
+	// ErrEmptyPattern is returned when compiling a circuit for an empty pattern, which would trivially match
+	ErrEmptyPattern = errors.New("pattern is empty")
+
+	// ErrPatternLongerThanText is returned when the pattern cannot fit in the text, leaving no window to check
+	ErrPatternLongerThanText = errors.New("pattern is longer than the text")
+
+	// ErrInvalidClassPattern is returned for a character-class pattern parseClassPattern cannot read
+	ErrInvalidClassPattern = errors.New("invalid character-class pattern")
+)
+
+// entrySeparator joins the entries of a superstring. A window holding it spans two
+// entries, so findMatch never counts it as a match.
+const entrySeparator = 0x01
+
+// Anchor restricts where in the text a match may occur
+type Anchor int
+
+const (
+	AnchorNone   Anchor = iota // Anywhere in the text
+	AnchorPrefix               // Only at the start of the text
+	AnchorSuffix               // Only at the end of the text
+)
+
+// parseAnchor parses an -anchor flag value
+func parseAnchor(name string) (Anchor, error) {
+	switch name {
+	case "none":
+		return AnchorNone, nil
+	case "prefix":
+		return AnchorPrefix, nil
+	case "suffix":
+		return AnchorSuffix, nil
+	default:
+		return AnchorNone, fmt.Errorf("unknown anchor %q (want none, prefix or suffix)", name)
+	}
+}
+
 type SubstringCircuit struct {
+	Str1           [500]frontend.Variable  `gnark:"str1,secret"`
+	Str2           [2000]frontend.Variable `gnark:"str2,public"`
+	MatchIndex     frontend.Variable       `gnark:"matchIndex,public"`     // index of the first occurrence of Str1 in Str2
+	MinOccurrences frontend.Variable       `gnark:"minOccurrences,public"` // Str1 must occur at least this many times, overlaps included
+
+	anchor Anchor // Fixed when compiling; anchored circuits check a single window
+}
+
+// AbsenceCircuit proves that the secret pattern Str1 does NOT occur anywhere in the public text Str2.
+// Str1 must not hold an entrySeparator, which no window would match.
+type AbsenceCircuit struct {
 	Str1 [500]frontend.Variable  `gnark:"str1,secret"`
 	Str2 [2000]frontend.Variable `gnark:"str2,public"`
+
+	anchor Anchor // With an anchor, only proves Str1 is not at that end of Str2
 }
 
 func (circuit *SubstringCircuit) Define(api frontend.API) error {
+	found, firstIndex, count, err := findMatch(api, circuit.Str1[:], circuit.Str2[:], circuit.anchor)
+	if err != nil {
+		return err
+	}
+
+	// Assert that the pattern is found at least once
+	api.AssertIsEqual(found, frontend.Variable(1))
+
+	// Assert that the committed index is the first occurrence
+	api.AssertIsEqual(firstIndex, circuit.MatchIndex)
+
+	// Assert that MinOccurrences <= count
+	api.AssertIsLessOrEqual(circuit.MinOccurrences, count)
+
+	return nil
+}
+
+func (circuit *AbsenceCircuit) Define(api frontend.API) error {
+	found, _, _, err := findMatch(api, circuit.Str1[:], circuit.Str2[:], circuit.anchor)
+	if err != nil {
+		return err
+	}
+
+	// A separator makes findMatch find nothing, present pattern or not
+	assertNoSeparator(api, circuit.Str1[:])
+
+	// Assert that the pattern never occurs
+	api.AssertIsEqual(found, frontend.Variable(0))
+
+	return nil
+}
+
+// assertNoSeparator asserts that no character of pattern is an entrySeparator
+func assertNoSeparator(api frontend.API, pattern []frontend.Variable) {
+	for _, c := range pattern {
+		api.AssertIsDifferent(c, entrySeparator)
+	}
+}
+
+// findMatch returns found = 1 if pattern occurs in text (0 otherwise), the index of the
+// first occurrence (0 when absent) and the number of matching windows, using a rolling
+// hash plus a character-by-character comparison for every window. Overlapping occurrences
+// are separate windows and count separately. An anchor restricts the windows to the first
+// or last one, which is compared character by character without hashing. A pattern
+// holding an entrySeparator matches no window. It fails for an empty pattern or one longer
+// than text.
+func findMatch(api frontend.API, pattern, text []frontend.Variable, anchor Anchor) (found, firstIndex, count frontend.Variable, err error) {
 	const base = 256  // Base value for hash calculation
 	const prime = 997 // A larger prime number to reduce hash collisions
-	patternLength := len(circuit.Str1)
-	textLength := len(circuit.Str2)
+	patternLength := len(pattern)
+	textLength := len(text)
+	if patternLength == 0 {
+		return nil, nil, nil, ErrEmptyPattern
+	}
+	if patternLength > textLength {
+		return nil, nil, nil, fmt.Errorf("%w (%d > %d)", ErrPatternLongerThanText, patternLength, textLength)
+	}
+
+	// Any window equal to the pattern holds a separator exactly when the pattern does
+	inEntry := frontend.Variable(1)
+	for j := range pattern {
+		inEntry = api.And(inEntry, api.Sub(1, api.IsZero(api.Sub(pattern[j], entrySeparator))))
+	}
+
+	// Range of window start positions to check
+	firstWindow, lastWindow := 0, textLength-patternLength
+	switch anchor {
+	case AnchorPrefix:
+		lastWindow = firstWindow
+	case AnchorSuffix:
+		firstWindow = lastWindow
+	}
+	if firstWindow == lastWindow {
+		// A single window needs no hash to skip mismatches early
+		found = api.And(windowEquals(api, pattern, text[firstWindow:]), inEntry)
+		return found, api.Mul(found, firstWindow), found, nil
+	}
 
 	// Helper modulus function to reduce value within prime field
 	mod := func(a frontend.Variable, prime int64) frontend.Variable {
@@ -32,19 +169,21 @@ func (circuit *SubstringCircuit) Define(api frontend.API) error {
 	// Calculate the hash of the pattern (Str1)
 	patternHash := frontend.Variable(0)
 	for i := 0; i < patternLength; i++ {
-		patternHash = api.Add(api.Mul(patternHash, base), circuit.Str1[i])
+		patternHash = api.Add(api.Mul(patternHash, base), pattern[i])
 		patternHash = mod(patternHash, prime)
 	}
 
 	// Calculate the initial hash of the text window of size equal to pattern length
 	currentHash := frontend.Variable(0)
 	for i := 0; i < patternLength; i++ {
-		currentHash = api.Add(api.Mul(currentHash, base), circuit.Str2[i])
+		currentHash = api.Add(api.Mul(currentHash, base), text[firstWindow+i])
 		currentHash = mod(currentHash, prime)
 	}
 
-	// Variable to indicate if we found a matching substring
-	found := frontend.Variable(0)
+	// Variable to indicate if we found a matching substring, where it first occurred and how often
+	found = frontend.Variable(0)
+	firstIndex = frontend.Variable(0)
+	count = frontend.Variable(0)
 
 	// Pre-compute base^(patternLength-1) % prime to use for hash update
 	basePow := big.NewInt(1)
@@ -57,36 +196,515 @@ func (circuit *SubstringCircuit) Define(api frontend.API) error {
 	basePowVar := frontend.Variable(basePow.Int64())
 
 	// Sliding window to compare hashes
-	for i := 0; i <= textLength-patternLength; i++ {
+	for i := firstWindow; i <= lastWindow; i++ {
 		// If hash matches, do a character-by-character comparison to avoid hash collision false positives
 		isMatch := api.IsZero(api.Sub(currentHash, patternHash))
-		charMatch := frontend.Variable(1) // Assume true initially
-
-		for j := 0; j < patternLength; j++ {
-			charMatch = api.And(charMatch, api.IsZero(api.Sub(circuit.Str2[i+j], circuit.Str1[j])))
-		}
+		charMatch := windowEquals(api, pattern, text[i:])
 
 		// Only set `found` if both the hash and the character-by-character match succeed
-		found = api.Or(found, api.And(isMatch, charMatch))
+		// inside one entry
+		windowMatch := api.And(api.And(isMatch, charMatch), inEntry)
+
+		// Record i only for the first matching window, using `found` as the "already found" flag
+		isFirst := api.And(windowMatch, api.Sub(1, found))
+		firstIndex = api.Add(firstIndex, api.Mul(isFirst, i))
+		found = api.Or(found, windowMatch)
+		count = api.Add(count, windowMatch)
 
 		// Calculate hash for the next window
-		if i < textLength-patternLength {
+		if i < lastWindow {
 			// Update hash: remove the first character, shift left, and add the new character
-			currentHash = api.Sub(currentHash, api.Mul(circuit.Str2[i], basePowVar))
+			currentHash = api.Sub(currentHash, api.Mul(text[i], basePowVar))
 			currentHash = mod(currentHash, prime)
 			currentHash = api.Mul(currentHash, base)
 			currentHash = mod(currentHash, prime)
-			currentHash = api.Add(currentHash, circuit.Str2[i+patternLength])
+			currentHash = api.Add(currentHash, text[i+patternLength])
 			currentHash = mod(currentHash, prime)
 		}
 	}
 
-	// Assert that the pattern is found at least once
-	api.AssertIsEqual(found, frontend.Variable(1))
+	return found, firstIndex, count, nil
+}
+
+// ScanCircuit proves, for each secret pattern Patterns[i], whether it occurs in the public
+// text Text: Found[i] is public and is 1 exactly when findMatch finds the pattern, so one
+// proof answers which of the patterns appear without revealing any of them. The number of
+// patterns and their lengths are fixed when compiling; a slot filled with entrySeparator
+// bytes matches nothing, so fewer patterns than slots can be scanned.
+type ScanCircuit struct {
+	Patterns [][]frontend.Variable `gnark:"patterns,secret"`
+	Text     []frontend.Variable   `gnark:"text,public"`
+	Found    []frontend.Variable   `gnark:"found,public"` // Found[i] is 1 if Patterns[i] occurs in Text, 0 otherwise
+}
+
+// newScanCircuit returns a ScanCircuit shaped for patterns of the given lengths and a
+// text of textLength bytes
+func newScanCircuit(patternLengths []int, textLength int) *ScanCircuit {
+	circuit := &ScanCircuit{
+		Patterns: make([][]frontend.Variable, len(patternLengths)),
+		Text:     make([]frontend.Variable, textLength),
+		Found:    make([]frontend.Variable, len(patternLengths)),
+	}
+	for i, length := range patternLengths {
+		circuit.Patterns[i] = make([]frontend.Variable, length)
+	}
+	return circuit
+}
+
+func (circuit *ScanCircuit) Define(api frontend.API) error {
+	if len(circuit.Patterns) == 0 {
+		return fmt.Errorf("%w: no patterns to scan for", ErrEmptyPattern)
+	}
+	for i, pattern := range circuit.Patterns {
+		found, _, _, err := findMatch(api, pattern, circuit.Text, AnchorNone)
+		if err != nil {
+			return fmt.Errorf("pattern %d: %w", i, err)
+		}
+		api.AssertIsEqual(found, circuit.Found[i])
+	}
+	return nil
+}
+
+// buildScanWitness returns a ScanCircuit assignment for patterns in text, with Found set
+// from countOccurrences
+func buildScanWitness(patterns [][]frontend.Variable, text []frontend.Variable) *ScanCircuit {
+	lengths := make([]int, len(patterns))
+	for i, pattern := range patterns {
+		lengths[i] = len(pattern)
+	}
+	assignment := newScanCircuit(lengths, len(text))
+	for i, pattern := range patterns {
+		copy(assignment.Patterns[i], pattern)
+		assignment.Found[i] = 0
+		if countOccurrences(pattern, text) > 0 {
+			assignment.Found[i] = 1
+		}
+	}
+	copy(assignment.Text, text)
+	return assignment
+}
+
+// scanBitmask packs the found bits of a ScanCircuit assignment, Found[i] into bit i
+func scanBitmask(found []frontend.Variable) uint64 {
+	var mask uint64
+	for i, bit := range found {
+		if bit == 1 {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+// windowEquals returns 1 if the window of text starting at its first character equals
+// pattern, 0 otherwise
+func windowEquals(api frontend.API, pattern, text []frontend.Variable) frontend.Variable {
+	match := frontend.Variable(1)
+	for j := range pattern {
+		match = api.And(match, api.IsZero(api.Sub(text[j], pattern[j])))
+	}
+	return match
+}
+
+// countOccurrences returns the number of windows of text equal to pattern, computed off-circuit
+func countOccurrences(pattern, text []frontend.Variable) int {
+	if hasSeparator(pattern) {
+		return 0
+	}
+	count := 0
+	for i := 0; i+len(pattern) <= len(text); i++ {
+		match := true
+		for j := range pattern {
+			if text[i+j] != pattern[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			count++
+		}
+	}
+	return count
+}
+
+// hasSeparator reports whether pattern holds an entrySeparator, so it can match no window
+func hasSeparator(pattern []frontend.Variable) bool {
+	return slices.Contains(pattern, frontend.Variable(entrySeparator))
+}
+
+// firstMatchIndex returns the index of the first occurrence of pattern in text allowed by
+// anchor, or -1, computed off-circuit
+func firstMatchIndex(pattern, text []frontend.Variable, anchor Anchor) int {
+	if hasSeparator(pattern) {
+		return -1
+	}
+	firstWindow, lastWindow := 0, len(text)-len(pattern)
+	switch anchor {
+	case AnchorPrefix:
+		lastWindow = min(firstWindow, lastWindow)
+	case AnchorSuffix:
+		firstWindow = max(firstWindow, lastWindow)
+	}
+	for i := firstWindow; i <= lastWindow; i++ {
+		match := true
+		for j := range pattern {
+			if text[i+j] != pattern[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// BMHSubstringCircuit proves that Str1 occurs in Str2 at a secret MatchOffset the prover
+// found with Boyer-Moore-Horspool. The bad-character Shift table is a secret witness the
+// circuit validates against Str1; the match itself is checked by comparing Str1 with Str2
+// at MatchOffset only, so the cost grows with len(Str1)+len(Str2) rather than their product.
+type BMHSubstringCircuit struct {
+	Str1        [500]frontend.Variable  `gnark:"str1,secret"`
+	Str2        [2000]frontend.Variable `gnark:"str2,public"`
+	Shift       [256]frontend.Variable  `gnark:"shift,secret"`   // Bad-character shift for each byte
+	LastPos     [256]frontend.Variable  `gnark:"lastPos,secret"` // Last index below len(Str1)-1 holding each byte, unless Absent
+	Absent      [256]frontend.Variable  `gnark:"absent,secret"`  // 1 if the byte does not occur in Str1 before its last position
+	MatchOffset frontend.Variable       `gnark:"matchOffset,secret"`
+}
+
+func (circuit *BMHSubstringCircuit) Define(api frontend.API) error {
+	m := len(circuit.Str1)
+	nbBits := mathbits.Len(uint(len(circuit.Str2))) // Enough for any shift or index
+
+	shiftTable := logderivlookup.New(api)
+	for c := range circuit.Shift {
+		shiftTable.Insert(circuit.Shift[c])
+	}
+	patternTable := logderivlookup.New(api)
+	for j := 0; j < m-1; j++ {
+		patternTable.Insert(circuit.Str1[j])
+	}
+
+	// 1. No shift skips past an occurrence: Shift[Str1[j]] <= m-1-j. The lookup also
+	// rejects characters outside 0..255.
+	shifts := shiftTable.Lookup(circuit.Str1[:m-1]...)
+	for j := range shifts {
+		bits.ToBinary(api, api.Sub(m-1-j, shifts[j]), bits.WithNbDigits(nbBits))
+	}
+
+	// 2. Every shift is exact: m-1-LastPos for a byte at LastPos, or m for an absent byte.
+	// Together with 1 this makes LastPos the last occurrence.
+	atLastPos := patternTable.Lookup(circuit.LastPos[:]...)
+	for c := range circuit.Shift {
+		api.AssertIsBoolean(circuit.Absent[c])
+		present := api.Sub(1, circuit.Absent[c])
+		api.AssertIsEqual(api.Mul(present, api.Sub(atLastPos[c], c)), 0)
+		api.AssertIsEqual(api.Mul(present, api.Sub(circuit.Shift[c], api.Sub(m-1, circuit.LastPos[c]))), 0)
+		api.AssertIsEqual(api.Mul(circuit.Absent[c], api.Sub(circuit.Shift[c], m)), 0)
+	}
+
+	// 3. Str1 matches Str2 at MatchOffset
+	assertMatchAt(api, circuit.Str1[:], circuit.Str2[:], circuit.MatchOffset)
+	return nil
+}
+
+// OffsetMatchCircuit proves that Str1 occurs in Str2 at a secret Offset chosen by the
+// prover. Only that one window is compared, so the cost is linear in len(Str1) plus a
+// single pass to load Str2 into a lookup table, instead of one comparison per window.
+type OffsetMatchCircuit struct {
+	Str1   [500]frontend.Variable  `gnark:"str1,secret"`
+	Str2   [2000]frontend.Variable `gnark:"str2,public"`
+	Offset frontend.Variable       `gnark:"offset,secret"`
+}
+
+func (circuit *OffsetMatchCircuit) Define(api frontend.API) error {
+	assertMatchAt(api, circuit.Str1[:], circuit.Str2[:], circuit.Offset)
+	return nil
+}
+
+// IndexedMatchCircuit is OffsetMatchCircuit with the match position disclosed: the
+// verifier learns MatchIndex, so it can cross-check the surrounding text, but not Str1
+type IndexedMatchCircuit struct {
+	Str1       [500]frontend.Variable  `gnark:"str1,secret"`
+	Str2       [2000]frontend.Variable `gnark:"str2,public"`
+	MatchIndex frontend.Variable       `gnark:"matchIndex,public"`
+}
+
+func (circuit *IndexedMatchCircuit) Define(api frontend.API) error {
+	assertMatchAt(api, circuit.Str1[:], circuit.Str2[:], circuit.MatchIndex)
+	return nil
+}
+
+// buildIndexedMatchWitness returns an IndexedMatchCircuit assignment with MatchIndex set
+// to the first occurrence of pattern in text, or an error if pattern does not occur
+func buildIndexedMatchWitness(pattern, text []frontend.Variable) (*IndexedMatchCircuit, error) {
+	index := firstMatchIndex(pattern, text, AnchorNone)
+	if index < 0 {
+		return nil, fmt.Errorf("pattern does not occur in the text")
+	}
+	return &IndexedMatchCircuit{
+		Str1:       convertToFixedSizeArray500(pattern),
+		Str2:       convertToFixedSizeArray2000(text),
+		MatchIndex: index,
+	}, nil
+}
+
+// assertMatchAt asserts offset+len(pattern) <= len(text) and pattern[j] == text[offset+j]
+// for every j, reading the text window through a lookup table
+func assertMatchAt(api frontend.API, pattern, text []frontend.Variable, offset frontend.Variable) {
+	// The difference wraps around to a huge field element when the window runs off the text
+	nbBits := mathbits.Len(uint(len(text)))
+	bits.ToBinary(api, api.Sub(len(text)-len(pattern), offset), bits.WithNbDigits(nbBits))
+
+	textTable := logderivlookup.New(api)
+	for i := range text {
+		textTable.Insert(text[i])
+	}
+	indices := make([]frontend.Variable, len(pattern))
+	for j := range indices {
+		indices[j] = api.Add(offset, j)
+	}
+	window := textTable.Lookup(indices...)
+	for j := range window {
+		api.AssertIsEqual(window[j], pattern[j])
+	}
+}
+
+// classHalfBits is how many bitmap bits are packed into each field element of a class commitment
+const classHalfBits = 128
+
+// CharClassCircuit proves that some window of the public text Text starting at a secret
+// Offset has, at every position j, a byte allowed by the secret bitmap Classes[j]. The
+// bitmaps are bound to the public ClassCommitment, so the verifier knows which character
+// classes were checked without seeing them in the proof.
+type CharClassCircuit struct {
+	Classes         [][256]frontend.Variable `gnark:"classes,secret"` // Classes[j][c] is 1 if byte c is allowed at position j
+	ClassCommitment frontend.Variable        `gnark:"classCommitment,public"`
+	Text            []frontend.Variable      `gnark:"text,public"`
+	Offset          frontend.Variable        `gnark:"offset,secret"`
+}
+
+// newCharClassCircuit returns a CharClassCircuit shaped for classLength positions and a
+// text of textLength bytes
+func newCharClassCircuit(classLength, textLength int) *CharClassCircuit {
+	return &CharClassCircuit{
+		Classes: make([][256]frontend.Variable, classLength),
+		Text:    make([]frontend.Variable, textLength),
+	}
+}
+
+func (circuit *CharClassCircuit) Define(api frontend.API) error {
+	if len(circuit.Classes) == 0 {
+		return ErrEmptyPattern
+	}
+	if len(circuit.Classes) > len(circuit.Text) {
+		return fmt.Errorf("%w (%d > %d)", ErrPatternLongerThanText, len(circuit.Classes), len(circuit.Text))
+	}
+
+	// The bitmaps, packed classHalfBits bits per element, must hash to the commitment
+	hFunc, err := mimc.NewMiMC(api)
+	if err != nil {
+		return err
+	}
+	for _, class := range circuit.Classes {
+		for c := range class {
+			api.AssertIsBoolean(class[c])
+		}
+		for half := 0; half < len(class); half += classHalfBits {
+			hFunc.Write(api.FromBinary(class[half : half+classHalfBits]...))
+		}
+	}
+	api.AssertIsEqual(hFunc.Sum(), circuit.ClassCommitment)
+
+	// Read the window at Offset, which must fit in the text
+	nbBits := mathbits.Len(uint(len(circuit.Text)))
+	bits.ToBinary(api, api.Sub(len(circuit.Text)-len(circuit.Classes), circuit.Offset), bits.WithNbDigits(nbBits))
+	textTable := logderivlookup.New(api)
+	for i := range circuit.Text {
+		textTable.Insert(circuit.Text[i])
+	}
+	indices := make([]frontend.Variable, len(circuit.Classes))
+	for j := range indices {
+		indices[j] = api.Add(circuit.Offset, j)
+	}
+	window := textTable.Lookup(indices...)
 
+	// Each byte must be allowed by its class; the lookup also rejects bytes outside 0..255
+	for j, class := range circuit.Classes {
+		classTable := logderivlookup.New(api)
+		for c := range class {
+			classTable.Insert(class[c])
+		}
+		api.AssertIsEqual(classTable.Lookup(window[j])[0], 1)
+	}
 	return nil
 }
 
+// parseClassPattern parses a regex-lite pattern of literal bytes and bracket classes such
+// as [0-9] or [a-z_], each optionally repeated a fixed number of times with {n}, into one
+// allowed-byte bitmap per position
+func parseClassPattern(pattern string) ([][256]bool, error) {
+	var classes [][256]bool
+	for i := 0; i < len(pattern); {
+		var class [256]bool
+		if pattern[i] != '[' {
+			class[pattern[i]] = true
+			i++
+		} else {
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end <= 0 {
+				return nil, fmt.Errorf("%w: unterminated or empty class at %d", ErrInvalidClassPattern, i)
+			}
+			set := pattern[i+1 : i+1+end]
+			for k := 0; k < len(set); k++ {
+				lo, hi := set[k], set[k]
+				if k+2 < len(set) && set[k+1] == '-' {
+					hi = set[k+2]
+					k += 2
+				}
+				if lo > hi {
+					return nil, fmt.Errorf("%w: range %c-%c", ErrInvalidClassPattern, lo, hi)
+				}
+				for c := int(lo); c <= int(hi); c++ {
+					class[c] = true
+				}
+			}
+			i += end + 2
+		}
+
+		repeat := 1
+		if i < len(pattern) && pattern[i] == '{' {
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated repetition at %d", ErrInvalidClassPattern, i)
+			}
+			n, err := strconv.Atoi(pattern[i+1 : i+end])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: repetition %q", ErrInvalidClassPattern, pattern[i:i+end+1])
+			}
+			repeat = n
+			i += end + 1
+		}
+		for ; repeat > 0; repeat-- {
+			classes = append(classes, class)
+		}
+	}
+	if len(classes) == 0 {
+		return nil, ErrEmptyPattern
+	}
+	return classes, nil
+}
+
+// commitClasses computes the commitment checked by CharClassCircuit off-circuit
+func commitClasses(classes [][256]bool) *big.Int {
+	hFunc := mimcHash.NewMiMC()
+	for _, class := range classes {
+		for half := 0; half < len(class); half += classHalfBits {
+			packed := new(big.Int)
+			for c := half; c < half+classHalfBits; c++ {
+				if class[c] {
+					packed.SetBit(packed, c-half, 1)
+				}
+			}
+			var elem fr.Element
+			elem.SetBigInt(packed)
+			bytes := elem.Bytes()
+			hFunc.Write(bytes[:])
+		}
+	}
+	return new(big.Int).SetBytes(hFunc.Sum(nil))
+}
+
+// findClassMatch returns the first offset of a window of text matching classes, or -1
+func findClassMatch(classes [][256]bool, text []frontend.Variable) int {
+	for i := 0; i+len(classes) <= len(text); i++ {
+		match := true
+		for j := range classes {
+			if !classes[j][text[i+j].(int)] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// buildCharClassWitness returns a CharClassCircuit assignment for classes in text, or an
+// error if no window matches
+func buildCharClassWitness(classes [][256]bool, text []frontend.Variable) (*CharClassCircuit, error) {
+	offset := findClassMatch(classes, text)
+	if offset < 0 {
+		return nil, fmt.Errorf("no window of the text matches the character classes")
+	}
+	assignment := newCharClassCircuit(len(classes), len(text))
+	assignment.ClassCommitment = commitClasses(classes)
+	copy(assignment.Text, text)
+	assignment.Offset = offset
+	for j, class := range classes {
+		for c := range class {
+			assignment.Classes[j][c] = 0
+			if class[c] {
+				assignment.Classes[j][c] = 1
+			}
+		}
+	}
+	return assignment, nil
+}
+
+// bmhShiftTable returns the Boyer-Moore-Horspool bad-character shifts of pattern, with
+// the last index below len(pattern)-1 of each byte or -1 when it does not occur there
+func bmhShiftTable(pattern []frontend.Variable) (shift, lastPos [256]int) {
+	m := len(pattern)
+	for c := range shift {
+		shift[c], lastPos[c] = m, -1
+	}
+	for j := 0; j < m-1; j++ {
+		c := pattern[j].(int)
+		shift[c], lastPos[c] = m-1-j, j
+	}
+	return shift, lastPos
+}
+
+// bmhSearch returns the first offset of pattern in text found with Boyer-Moore-Horspool, or -1
+func bmhSearch(pattern, text []frontend.Variable, shift [256]int) int {
+	m := len(pattern)
+	for i := 0; i+m <= len(text); i += shift[text[i+m-1].(int)] {
+		j := m - 1
+		for j >= 0 && text[i+j] == pattern[j] {
+			j--
+		}
+		if j < 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// buildBMHWitness returns a BMHSubstringCircuit assignment for pattern in text, or an
+// error if pattern does not occur
+func buildBMHWitness(pattern, text []frontend.Variable) (*BMHSubstringCircuit, error) {
+	shift, lastPos := bmhShiftTable(pattern)
+	offset := bmhSearch(pattern, text, shift)
+	if offset < 0 {
+		return nil, fmt.Errorf("pattern does not occur in the text")
+	}
+	assignment := &BMHSubstringCircuit{
+		Str1:        convertToFixedSizeArray500(pattern),
+		Str2:        convertToFixedSizeArray2000(text),
+		MatchOffset: offset,
+	}
+	for c := range shift {
+		assignment.Shift[c], assignment.LastPos[c], assignment.Absent[c] = shift[c], max(lastPos[c], 0), 0
+		if lastPos[c] < 0 {
+			assignment.Absent[c] = 1
+		}
+	}
+	return assignment, nil
+}
+
 func generateString(N int) []frontend.Variable {
 	pattern := []frontend.Variable{
 		frontend.Variable(120), // 'x'
@@ -117,6 +735,17 @@ func generateString(N int) []frontend.Variable {
 	return result
 }
 
+// generateRandomText returns n lowercase letters drawn from a generator seeded with seed,
+// so benchmarks can use a realistic text and still be reproduced exactly
+func generateRandomText(n int, seed int64) []frontend.Variable {
+	rng := rand.New(rand.NewSource(seed))
+	text := make([]frontend.Variable, n)
+	for i := range text {
+		text[i] = 'a' + rng.Intn(26)
+	}
+	return text
+}
+
 func convertToFixedSizeArray2000(s []frontend.Variable) [2000]frontend.Variable {
 	var arr [2000]frontend.Variable
 	copy(arr[:], s) // Copy elements from the slice to the array
@@ -129,19 +758,142 @@ func convertToFixedSizeArray500(s []frontend.Variable) [500]frontend.Variable {
 	return arr
 }
 
+// circuitSize is the size of a compiled constraint system
+type circuitSize struct {
+	NbConstraints, NbPublic, NbSecret, NbInternal int
+}
+
+// sizeOf returns the size of ccs
+func sizeOf(ccs constraint.ConstraintSystem) circuitSize {
+	return circuitSize{
+		NbConstraints: ccs.GetNbConstraints(),
+		NbPublic:      ccs.GetNbPublicVariables(),
+		NbSecret:      ccs.GetNbSecretVariables(),
+		NbInternal:    ccs.GetNbInternalVariables(),
+	}
+}
+
+func (s circuitSize) String() string {
+	return fmt.Sprintf("%d constraints, %d public, %d secret and %d internal variables", s.NbConstraints, s.NbPublic, s.NbSecret, s.NbInternal)
+}
+
 func main() {
-	str1s := generateString(500)
-	str1 := convertToFixedSizeArray500(str1s)
+	absence := flag.Bool("absence", false, "Prove that a pattern does NOT occur in the text")
+	anchorName := flag.String("anchor", "none", "Where the pattern must occur: none, prefix or suffix")
+	bmh := flag.Bool("bmh", false, "Prove the match at an offset found with Boyer-Moore-Horspool instead of scanning every window")
+	offset := flag.Bool("offset", false, "Prove the match at the first offset found off-circuit, checking only that window")
+	discloseIndex := flag.Bool("disclose-index", false, "Prove the match at its first occurrence and make that index public")
+	charClass := flag.String("char-class", "", "Prove some window of the text matches this character-class pattern, e.g. [a-c]{3}")
+	minOccurrences := flag.Int("min-occurrences", 1, "Prove the pattern occurs at least this many times, overlapping occurrences included")
+	randomText := flag.Bool("random-text", false, "Prove against random lowercase text drawn with -seed instead of the repeating test string; the pattern is its prefix")
+	seed := flag.Int64("seed", 1, "Seed for -random-text; the same seed always gives the same text")
+	scan := flag.String("scan", "", "Prove in one proof which of these comma-separated patterns occur in the text, e.g. abc,zzz")
+	flag.Parse()
 
+	anchor, err := parseAnchor(*anchorName)
+	if err != nil {
+		log.Fatalf("Invalid -anchor: %v", err)
+	}
+	if *minOccurrences < 1 || (*minOccurrences > 1 && (*absence || *bmh || *offset || *discloseIndex)) {
+		log.Fatalf("Invalid -min-occurrences: must be at least 1, and 1 with -absence, -bmh, -offset or -disclose-index")
+	}
+
+	// The pattern is a prefix of the text, so it occurs whichever text is used
+	str1s := generateString(500)
 	str2s := generateString(2000)
+	if *randomText {
+		str2s = generateRandomText(len(str2s), *seed)
+		str1s = slices.Clone(str2s[:len(str1s)])
+		fmt.Printf("Random text with seed %d\n", *seed)
+	}
+	if *absence {
+		// 'z' never occurs in the generated text
+		for i := range str1s {
+			str1s[i] = frontend.Variable(122)
+		}
+	}
+	str1 := convertToFixedSizeArray500(str1s)
 	str2 := convertToFixedSizeArray2000(str2s)
 
-	var circuit SubstringCircuit
+	var circuit, assignment frontend.Circuit
+	if *scan != "" {
+		var patterns [][]frontend.Variable
+		var lengths []int
+		for _, pattern := range strings.Split(*scan, ",") {
+			if pattern == "" {
+				log.Fatalf("Invalid -scan: empty pattern")
+			}
+			v := make([]frontend.Variable, len(pattern))
+			for i := range pattern {
+				v[i] = int(pattern[i])
+			}
+			patterns = append(patterns, v)
+			lengths = append(lengths, len(pattern))
+		}
+		scanAssignment := buildScanWitness(patterns, str2s)
+		fmt.Printf("Found bitmask: %0*b\n", len(patterns), scanBitmask(scanAssignment.Found))
+		circuit = newScanCircuit(lengths, len(str2s))
+		assignment = scanAssignment
+	} else if *charClass != "" {
+		classes, err := parseClassPattern(*charClass)
+		if err != nil {
+			log.Fatalf("Invalid -char-class: %v", err)
+		}
+		classAssignment, err := buildCharClassWitness(classes, str2s)
+		if err != nil {
+			fmt.Printf("Cannot build witness: %v\n", err)
+			return
+		}
+		fmt.Printf("Match offset: %d\n", classAssignment.Offset)
+		circuit = newCharClassCircuit(len(classes), len(str2s))
+		assignment = classAssignment
+	} else if *bmh && !*absence {
+		circuit = &BMHSubstringCircuit{}
+		bmhAssignment, err := buildBMHWitness(str1s, str2s)
+		if err != nil {
+			fmt.Printf("Cannot build witness: %v\n", err)
+			return
+		}
+		fmt.Printf("Match offset: %d\n", bmhAssignment.MatchOffset)
+		assignment = bmhAssignment
+	} else if *discloseIndex && !*absence {
+		indexedAssignment, err := buildIndexedMatchWitness(str1s, str2s)
+		if err != nil {
+			fmt.Printf("Cannot build witness: %v\n", err)
+			return
+		}
+		fmt.Printf("Public match index: %d\n", indexedAssignment.MatchIndex)
+		circuit = &IndexedMatchCircuit{}
+		assignment = indexedAssignment
+	} else if *offset && !*absence {
+		matchOffset := firstMatchIndex(str1s, str2s, AnchorNone)
+		if matchOffset < 0 {
+			fmt.Println("Cannot build witness: pattern does not occur in the text")
+			return
+		}
+		fmt.Printf("Match offset: %d\n", matchOffset)
+		circuit = &OffsetMatchCircuit{}
+		assignment = &OffsetMatchCircuit{Str1: str1, Str2: str2, Offset: matchOffset}
+	} else if *absence {
+		circuit = &AbsenceCircuit{anchor: anchor}
+		assignment = &AbsenceCircuit{Str1: str1, Str2: str2}
+	} else {
+		circuit = &SubstringCircuit{anchor: anchor}
+		matchIndex := firstMatchIndex(str1s, str2s, anchor)
+		if matchIndex < 0 {
+			matchIndex = 0
+		}
+		fmt.Printf("First match index: %d\n", matchIndex)
+		fmt.Printf("Occurrences: %d (at least %d required)\n", countOccurrences(str1s, str2s), *minOccurrences)
+		assignment = &SubstringCircuit{Str1: str1, Str2: str2, MatchIndex: matchIndex, MinOccurrences: *minOccurrences}
+	}
+
 	fmt.Println("Compiling circuit...")
-	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit)
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
 	if err != nil {
 		log.Fatalf("Circuit compilation failed: %v", err)
 	}
+	fmt.Printf("Circuit size: %s\n", sizeOf(ccs))
 
 	fmt.Println("Setting up Groth16...")
 	pk, vk, err := groth16.Setup(ccs)
@@ -149,13 +901,8 @@ func main() {
 		log.Fatalf("Setup failed: %v", err)
 	}
 
-	assignment := SubstringCircuit{
-		Str1: str1,
-		Str2: str2,
-	}
-
 	fmt.Println("Creating witness...")
-	witness, err := frontend.NewWitness(&assignment, ecc.BN254.ScalarField())
+	witness, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
 	if err != nil {
 		log.Fatalf("Failed to create witness: %v", err)
 	}
@@ -168,15 +915,24 @@ func main() {
 	fmt.Println("Generating proof...")
 	proof, err := groth16.Prove(ccs, pk, witness)
 	if err != nil {
-		fmt.Println("Proof generation failed: Pattern not found in the string.")
+		if *absence {
+			fmt.Println("Proof generation failed: Pattern found in the string.")
+		} else {
+			fmt.Println("Proof generation failed: Pattern not found in the string.")
+		}
 		return
 	}
 
 	fmt.Println("Verifying proof...")
 	err = groth16.Verify(proof, vk, publicWitness)
-	if err != nil {
-		fmt.Println("Verification failed: Pattern not found in the string.")
-	} else {
+	switch {
+	case err != nil:
+		fmt.Println("Verification failed.")
+	case *scan != "":
+		fmt.Println("Proof verified successfully: Found bitmask matches the text.")
+	case *absence:
+		fmt.Println("Proof verified successfully: Pattern absent from the string.")
+	default:
 		fmt.Println("Proof verified successfully: Pattern found in the string.")
 	}
 }
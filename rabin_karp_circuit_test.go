@@ -0,0 +1,699 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+)
+
+// TestScan checks that scanning for four patterns, the first and third present, yields
+// the bitmask 0b0101, that any other claimed bitmask is rejected and that a slot filled
+// with separators reports 0
+func TestScan(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	text := toVariables("www.example.com\x01mail.example.org\x01shop.test-site.net")
+	patterns := [][]frontend.Variable{
+		toVariables("example.org"),
+		toVariables("example.net"),
+		toVariables("test-site"),
+		toVariables(".com\x01mail"), // Spans two entries, so it is not found
+	}
+	assignment := buildScanWitness(patterns, text)
+	if mask := scanBitmask(assignment.Found); mask != 0b0101 {
+		t.Fatalf("found bitmask %04b, want 0101", mask)
+	}
+	field := ecc.BN254.ScalarField()
+	shape := newScanCircuit([]int{11, 11, 9, 9}, len(text))
+	if err := test.IsSolved(shape, assignment, field); err != nil {
+		t.Fatalf("bitmask 0101 rejected: %v", err)
+	}
+	for _, mask := range []uint64{0b0000, 0b0100, 0b0111, 0b1101} {
+		forged := *assignment
+		forged.Found = make([]frontend.Variable, len(assignment.Found))
+		for i := range forged.Found {
+			forged.Found[i] = int(mask >> i & 1)
+		}
+		if test.IsSolved(shape, &forged, field) == nil {
+			t.Fatalf("bitmask %04b accepted", mask)
+		}
+	}
+
+	// An unused slot holds separators only and reports 0
+	unused := slices.Repeat([]frontend.Variable{entrySeparator}, 4)
+	padded := buildScanWitness([][]frontend.Variable{toVariables("mail"), unused}, text)
+	if mask := scanBitmask(padded.Found); mask != 0b01 {
+		t.Fatalf("padded scan bitmask %02b, want 01", mask)
+	}
+	if err := test.IsSolved(newScanCircuit([]int{4, 4}, len(text)), padded, field); err != nil {
+		t.Fatalf("padded scan rejected: %v", err)
+	}
+	if _, err := frontend.Compile(field, r1cs.NewBuilder, newScanCircuit(nil, len(text))); !errors.Is(err, ErrEmptyPattern) {
+		t.Fatalf("scan without patterns compiled: %v", err)
+	}
+}
+
+// TestIndexedMatch checks that IndexedMatchCircuit accepts the first occurrence, rejects
+// a wrong MatchIndex and exposes MatchIndex in the public witness
+func TestIndexedMatch(t *testing.T) {
+	text := generateString(2000)
+	assignment, err := buildIndexedMatchWitness(text[5:505], text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.MatchIndex != 5 {
+		t.Fatalf("first occurrence at %v, want 5", assignment.MatchIndex)
+	}
+	field := ecc.BN254.ScalarField()
+	if err := test.IsSolved(&IndexedMatchCircuit{}, assignment, field); err != nil {
+		t.Fatalf("present pattern rejected: %v", err)
+	}
+	for _, index := range []int{4, 6, len(text)} {
+		wrong := *assignment
+		wrong.MatchIndex = index
+		if test.IsSolved(&IndexedMatchCircuit{}, &wrong, field) == nil {
+			t.Fatalf("wrong MatchIndex %d accepted", index)
+		}
+	}
+
+	full, err := frontend.NewWitness(assignment, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := full.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := public.Vector().(fr.Vector)
+	if got := values[len(values)-1]; !got.Equal(new(fr.Element).SetUint64(5)) {
+		t.Fatalf("public witness ends with %s, want MatchIndex 5", got.String())
+	}
+}
+
+// TestCharClass checks that a digit-class pattern is found in "abc123xyz" and that a
+// wrong offset, a swapped class or a text without digits is rejected
+func TestCharClass(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	digits, err := parseClassPattern("[0-9]{3}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := toVariables("abc123xyz")
+	assignment, err := buildCharClassWitness(digits, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.Offset != 3 {
+		t.Fatalf("digits found at offset %v, want 3", assignment.Offset)
+	}
+	field := ecc.BN254.ScalarField()
+	shape := newCharClassCircuit(len(digits), len(text))
+	if err := test.IsSolved(shape, assignment, field); err != nil {
+		t.Fatalf("digit class rejected: %v", err)
+	}
+
+	wrongOffset := *assignment
+	wrongOffset.Offset = 2
+	// Allow letters at the first position but keep the digit-only commitment
+	swapped := *assignment
+	swapped.Classes = append([][256]frontend.Variable(nil), assignment.Classes...)
+	swapped.Classes[0]['c'] = 1
+	swapped.Offset = 2
+	for name, forged := range map[string]*CharClassCircuit{"wrong offset": &wrongOffset, "class not matching the commitment": &swapped} {
+		if test.IsSolved(shape, forged, field) == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+	if _, err := buildCharClassWitness(digits, toVariables("abcdefxyz")); err == nil {
+		t.Fatalf("witness built for a text without digits")
+	}
+
+	mixed, err := parseClassPattern("[0-9]{2}[a-z_]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset := findClassMatch(mixed, text); offset != 4 {
+		t.Fatalf("mixed pattern found at offset %d, want 4", offset)
+	}
+	for _, bad := range []string{"", "[0-9", "[]", "[9-0]", "a{0}", "a{2"} {
+		if _, err := parseClassPattern(bad); err == nil {
+			t.Fatalf("pattern %q accepted", bad)
+		}
+	}
+}
+
+// TestOffsetMatch checks that OffsetMatchCircuit accepts the offset of an occurrence and
+// rejects a wrong offset, an offset running off the text and an absent pattern
+func TestOffsetMatch(t *testing.T) {
+	text := generateString(2000)
+	pattern := text[5:505]
+	assignment := OffsetMatchCircuit{
+		Str1:   convertToFixedSizeArray500(pattern),
+		Str2:   convertToFixedSizeArray2000(text),
+		Offset: firstMatchIndex(pattern, text, AnchorNone),
+	}
+	field := ecc.BN254.ScalarField()
+	if err := test.IsSolved(&OffsetMatchCircuit{}, &assignment, field); err != nil {
+		t.Fatalf("present pattern rejected: %v", err)
+	}
+
+	wrongOffset := assignment
+	wrongOffset.Offset = assignment.Offset.(int) + 1
+	pastEnd := assignment
+	pastEnd.Offset = len(text) - len(pattern) + 1
+	absent := assignment
+	for j := range absent.Str1 {
+		absent.Str1[j] = 122 // 'z'
+	}
+	for name, forged := range map[string]*OffsetMatchCircuit{"wrong offset": &wrongOffset, "offset past the end": &pastEnd, "absent pattern": &absent} {
+		if test.IsSolved(&OffsetMatchCircuit{}, forged, field) == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+
+	ccs, err := frontend.Compile(field, r1cs.NewBuilder, &OffsetMatchCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("OffsetMatchCircuit constraints: %d\n", ccs.GetNbConstraints())
+}
+
+// TestBMH checks that BMHSubstringCircuit accepts an honest witness and rejects a wrong
+// offset, a tampered shift table and an absent pattern
+func TestBMH(t *testing.T) {
+	text := generateString(2000)
+	assignment, err := buildBMHWitness(text[5:505], text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := ecc.BN254.ScalarField()
+	if err := test.IsSolved(&BMHSubstringCircuit{}, assignment, field); err != nil {
+		t.Fatalf("present pattern rejected: %v", err)
+	}
+
+	wrongOffset := *assignment
+	wrongOffset.MatchOffset = assignment.MatchOffset.(int) + 1
+	tampered := *assignment
+	tampered.Shift['a'] = tampered.Shift['a'].(int) + 1
+	absent := *assignment
+	for j := range absent.Str1 {
+		absent.Str1[j] = 122 // 'z'
+	}
+	for name, forged := range map[string]*BMHSubstringCircuit{"wrong offset": &wrongOffset, "tampered shift table": &tampered, "absent pattern": &absent} {
+		if test.IsSolved(&BMHSubstringCircuit{}, forged, field) == nil {
+			t.Fatalf("%s accepted", name)
+		}
+	}
+	if _, err := buildBMHWitness(absent.Str1[:], text); err == nil {
+		t.Fatalf("witness built for an absent pattern")
+	}
+}
+
+// TestRandomText checks that generateRandomText is reproducible for a seed, differs
+// across seeds and only yields lowercase letters
+func TestRandomText(t *testing.T) {
+	a, b, other := generateRandomText(1000, 7), generateRandomText(1000, 7), generateRandomText(1000, 8)
+	differs := false
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("seed 7 gave %v and %v at %d", a[i], b[i], i)
+		}
+		if c := a[i].(int); c < 'a' || c > 'z' {
+			t.Fatalf("character %d is %d, not a lowercase letter", i, c)
+		}
+		differs = differs || a[i] != other[i]
+	}
+	if !differs {
+		t.Fatal("seeds 7 and 8 gave the same text")
+	}
+}
+
+// proverCase is an assignment for assertProver and whether it satisfies the circuit
+type proverCase struct {
+	name       string
+	assignment frontend.Circuit
+	valid      bool
+}
+
+// assertProver runs each case in its own subtest through gnark's test assertions on BN254
+// with Groth16, expecting ProverSucceeded for the valid ones and ProverFailed for the rest
+func assertProver(t *testing.T, circuit frontend.Circuit, cases []proverCase) {
+	assert := test.NewAssert(t)
+	for _, c := range cases {
+		assert.Run(func(assert *test.Assert) {
+			if c.valid {
+				assert.ProverSucceeded(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			} else {
+				assert.ProverFailed(circuit, c.assignment, test.WithCurves(ecc.BN254), test.WithBackends(backend.GROTH16))
+			}
+		}, c.name)
+	}
+}
+
+// TestSubstringCircuit checks that the Rabin-Karp match and its absence are provable
+// exactly when they should be, over a text short enough to prove in a test: the match only
+// for a present pattern at its first index, the absence only for a pattern that does not
+// occur and holds no separator
+func TestSubstringCircuit(t *testing.T) {
+	text := generateString(200)
+	present := text[5:55]
+	absent := slices.Repeat([]frontend.Variable{122}, 50) // 'z'
+	nearMiss := slices.Clone(present)
+	nearMiss[len(nearMiss)-1] = frontend.Variable(122)
+	withSeparator := append(slices.Clone(present[:49]), frontend.Variable(entrySeparator))
+	first := firstMatchIndex(present, text, AnchorNone)
+
+	assertProver(t, &matchCircuit{Pattern: make([]frontend.Variable, 50), Text: make([]frontend.Variable, len(text))}, []proverCase{
+		{"match, present", &matchCircuit{Pattern: present, Text: text, MatchIndex: first}, true},
+		{"match, absent", &matchCircuit{Pattern: absent, Text: text, MatchIndex: 0}, false},
+		{"match, near miss", &matchCircuit{Pattern: nearMiss, Text: text, MatchIndex: first}, false},
+		{"match, index past the first occurrence", &matchCircuit{Pattern: present, Text: text, MatchIndex: first + 1}, false},
+	})
+	assertProver(t, &absenceMatchCircuit{Pattern: make([]frontend.Variable, 50), Text: make([]frontend.Variable, len(text))}, []proverCase{
+		{"absence, absent", &absenceMatchCircuit{Pattern: absent, Text: text}, true},
+		{"absence, near miss", &absenceMatchCircuit{Pattern: nearMiss, Text: text}, true},
+		{"absence, present", &absenceMatchCircuit{Pattern: present, Text: text}, false},
+		{"absence, present, then a separator", &absenceMatchCircuit{Pattern: withSeparator, Text: text}, false},
+	})
+}
+
+// TestAbsence checks that AbsenceCircuit rejects a pattern occurring at the start, the
+// middle or the very end of the text, accepts one differing from an occurrence in its last
+// character only, and with an anchor accepts exactly the patterns not at that end. A
+// pattern holding an entrySeparator, which findMatch never finds, is rejected too.
+func TestAbsence(t *testing.T) {
+	text := generateString(2000)
+	str2 := convertToFixedSizeArray2000(text)
+	nearMiss := slices.Clone(text[5:505])
+	nearMiss[len(nearMiss)-1] = frontend.Variable(122) // 'z' never occurs in the text
+	withSeparator := append(slices.Clone(text[:499]), frontend.Variable(entrySeparator))
+	cases := []struct {
+		name    string
+		pattern []frontend.Variable
+		anchor  Anchor
+		absent  bool
+	}{
+		{"at the start", text[:500], AnchorNone, false},
+		{"in the middle", text[700:1200], AnchorNone, false},
+		{"at the end", text[1500:], AnchorNone, false},
+		{"near miss", nearMiss, AnchorNone, true},
+		{"at the start, prefix", text[:500], AnchorPrefix, false},
+		{"in the middle, prefix", text[5:505], AnchorPrefix, true},
+		{"at the end, suffix", text[1500:], AnchorSuffix, false},
+		{"at the start, suffix", text[:500], AnchorSuffix, true},
+		{"present, then a separator", withSeparator, AnchorNone, false},
+		{"present, then a separator, prefix", withSeparator, AnchorPrefix, false},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		if got := firstMatchIndex(c.pattern, text, c.anchor) < 0 && !hasSeparator(c.pattern); got != c.absent {
+			t.Fatalf("%s: absent off-circuit = %v, want %v", c.name, got, c.absent)
+		}
+		assignment := AbsenceCircuit{Str1: convertToFixedSizeArray500(c.pattern), Str2: str2}
+		err := test.IsSolved(&AbsenceCircuit{anchor: c.anchor}, &assignment, field)
+		if got := err == nil; got != c.absent {
+			t.Fatalf("%s: absence proof accepted = %v, want %v", c.name, got, c.absent)
+		}
+	}
+}
+
+// matchCircuit runs findMatch over slices of any length, so edge cases compile and solve quickly
+type matchCircuit struct {
+	Pattern    []frontend.Variable
+	Text       []frontend.Variable
+	MatchIndex frontend.Variable
+
+	anchor Anchor
+}
+
+func (circuit *matchCircuit) Define(api frontend.API) error {
+	found, firstIndex, _, err := findMatch(api, circuit.Pattern, circuit.Text, circuit.anchor)
+	if err != nil {
+		return err
+	}
+	api.AssertIsEqual(found, 1)
+	api.AssertIsEqual(firstIndex, circuit.MatchIndex)
+	return nil
+}
+
+// variablesString converts byte variables back to the string they encode
+func variablesString(v []frontend.Variable) string {
+	b := make([]byte, len(v))
+	for i := range v {
+		b[i] = byte(v[i].(int))
+	}
+	return string(b)
+}
+
+// TestMatchIndex checks that SubstringCircuit accepts MatchIndex only at the first
+// occurrence, as strings.Index finds it, for patterns whose first occurrence comes before
+// the window they were cut from, and rejects an index one off or at a later occurrence.
+// Short patterns cut from random text check the same against strings.Index.
+func TestMatchIndex(t *testing.T) {
+	text := generateString(2000)
+	str2 := convertToFixedSizeArray2000(text)
+	field := ecc.BN254.ScalarField()
+	for _, start := range []int{5, 600, 1500} {
+		pattern := text[start : start+500]
+		want := strings.Index(variablesString(text), variablesString(pattern))
+		if got := firstMatchIndex(pattern, text, AnchorNone); got != want {
+			t.Fatalf("window at %d: first match index %d, strings.Index %d", start, got, want)
+		}
+		assignment := SubstringCircuit{Str1: convertToFixedSizeArray500(pattern), Str2: str2, MatchIndex: want, MinOccurrences: 1}
+		if err := test.IsSolved(&SubstringCircuit{}, &assignment, field); err != nil {
+			t.Fatalf("window at %d: index %d rejected: %v", start, want, err)
+		}
+		for _, wrong := range []int{want - 1, want + 1, start} {
+			if wrong < 0 || wrong == want {
+				continue
+			}
+			forged := assignment
+			forged.MatchIndex = wrong
+			if test.IsSolved(&SubstringCircuit{}, &forged, field) == nil {
+				t.Fatalf("window at %d: wrong index %d accepted, first occurrence is %d", start, wrong, want)
+			}
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	random := generateRandomText(60, 3)
+	for i := 0; i < 20; i++ {
+		length := 1 + rng.Intn(2)
+		start := rng.Intn(len(random) - length + 1)
+		pattern := random[start : start+length]
+		want := strings.Index(variablesString(random), variablesString(pattern))
+		shape := matchCircuit{Pattern: make([]frontend.Variable, length), Text: make([]frontend.Variable, len(random))}
+		assignment := matchCircuit{Pattern: pattern, Text: random, MatchIndex: want}
+		if err := test.IsSolved(&shape, &assignment, field); err != nil {
+			t.Fatalf("%q in random text: strings.Index %d rejected: %v", variablesString(pattern), want, err)
+		}
+		if want != start {
+			assignment.MatchIndex = start
+			if test.IsSolved(&shape, &assignment, field) == nil {
+				t.Fatalf("%q in random text: later occurrence %d accepted, first is %d", variablesString(pattern), start, want)
+			}
+		}
+	}
+}
+
+// TestAnchors checks that prefix and suffix anchoring accept a pattern only at their end
+// of the text, so a mid-text occurrence fails, and that an anchored circuit checks a
+// single window: its size does not grow with the text
+func TestAnchors(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	text := toVariables("abxxcdxxef")
+	cases := []struct {
+		pattern string
+		anchor  Anchor
+		want    bool
+	}{
+		{"ab", AnchorPrefix, true},
+		{"cd", AnchorPrefix, false},
+		{"ef", AnchorPrefix, false},
+		{"ef", AnchorSuffix, true},
+		{"cd", AnchorSuffix, false},
+		{"cd", AnchorNone, true},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		pattern := toVariables(c.pattern)
+		index := firstMatchIndex(pattern, text, c.anchor)
+		assignment := matchCircuit{Pattern: pattern, Text: text, MatchIndex: max(index, 0)}
+		shape := matchCircuit{Pattern: make([]frontend.Variable, len(pattern)), Text: make([]frontend.Variable, len(text)), anchor: c.anchor}
+		err := test.IsSolved(&shape, &assignment, field)
+		if got := err == nil; got != c.want || got != (index >= 0) {
+			t.Fatalf("pattern %q with anchor %d: accepted=%v, off-circuit index %d, want %v", c.pattern, c.anchor, got, index, c.want)
+		}
+	}
+
+	var sizes [3]int
+	for anchor := AnchorNone; anchor <= AnchorSuffix; anchor++ {
+		shape := matchCircuit{Pattern: make([]frontend.Variable, 2), Text: make([]frontend.Variable, len(text)), anchor: anchor}
+		ccs, err := frontend.Compile(field, r1cs.NewBuilder, &shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[anchor] = ccs.GetNbConstraints()
+	}
+	fmt.Printf("Constraints: none %d, prefix %d, suffix %d\n", sizes[AnchorNone], sizes[AnchorPrefix], sizes[AnchorSuffix])
+	if sizes[AnchorPrefix] >= sizes[AnchorNone] || sizes[AnchorSuffix] >= sizes[AnchorNone] {
+		t.Fatalf("anchoring does not reduce constraints")
+	}
+	for anchor := AnchorPrefix; anchor <= AnchorSuffix; anchor++ {
+		shape := matchCircuit{Pattern: make([]frontend.Variable, 2), Text: make([]frontend.Variable, 10*len(text)), anchor: anchor}
+		ccs, err := frontend.Compile(field, r1cs.NewBuilder, &shape)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ccs.GetNbConstraints(); n != sizes[anchor] {
+			t.Fatalf("anchor %d: %d constraints for a %d-character text, %d for %d", anchor, n, 10*len(text), sizes[anchor], len(text))
+		}
+	}
+}
+
+// occurrenceCircuit runs findMatch over slices of any length and asserts at least
+// MinOccurrences matching windows
+type occurrenceCircuit struct {
+	Pattern        []frontend.Variable
+	Text           []frontend.Variable
+	MinOccurrences frontend.Variable
+}
+
+func (circuit *occurrenceCircuit) Define(api frontend.API) error {
+	_, _, count, err := findMatch(api, circuit.Pattern, circuit.Text, AnchorNone)
+	if err != nil {
+		return err
+	}
+	api.AssertIsLessOrEqual(circuit.MinOccurrences, count)
+	return nil
+}
+
+// TestMinOccurrences checks that a threshold equal to or below the number of occurrences,
+// overlapping ones included, is accepted and one above it is rejected
+func TestMinOccurrences(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	cases := []struct {
+		pattern, text string
+		k             int
+		want          bool
+	}{
+		{"ab", "abxxabxab", 3, true},  // Exactly k
+		{"ab", "abxxabxab", 2, true},  // More than k
+		{"ab", "abxxabxab", 4, false}, // Only k-1
+		{"aa", "aaaa", 3, true},       // Overlapping occurrences count separately
+		{"aa", "aaaa", 4, false},
+		{"ab", "xxxxxxxxx", 1, false},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		pattern, text := toVariables(c.pattern), toVariables(c.text)
+		shape := occurrenceCircuit{Pattern: make([]frontend.Variable, len(pattern)), Text: make([]frontend.Variable, len(text))}
+		assignment := occurrenceCircuit{Pattern: pattern, Text: text, MinOccurrences: c.k}
+		err := test.IsSolved(&shape, &assignment, field)
+		if got := err == nil; got != c.want || got != (countOccurrences(pattern, text) >= c.k) {
+			t.Fatalf("pattern %q in %q with k=%d: accepted=%v, want %v", c.pattern, c.text, c.k, got, c.want)
+		}
+	}
+}
+
+// containsSubstring is the off-circuit oracle the circuits are checked against
+func containsSubstring(text, pattern string) bool {
+	return strings.Contains(text, pattern) && !strings.ContainsRune(pattern, entrySeparator)
+}
+
+// TestEntrySeparator checks that a pattern found only across the separator between two
+// entries is not found, anchored or not, while each entry still matches on its own. Such
+// a pattern cannot be proved absent either.
+func TestEntrySeparator(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	const text = "foo\x01bar"
+	cases := []struct {
+		pattern string
+		anchor  Anchor
+		want    bool
+	}{
+		{"bar", AnchorNone, true},
+		{"foo", AnchorPrefix, true},
+		{"o\x01b", AnchorNone, false},
+		{"\x01", AnchorNone, false},
+		{"foo\x01", AnchorPrefix, false},
+		{"\x01bar", AnchorSuffix, false},
+	}
+	field := ecc.BN254.ScalarField()
+	for _, c := range cases {
+		pattern, textVars := toVariables(c.pattern), toVariables(text)
+		index := max(firstMatchIndex(pattern, textVars, c.anchor), 0)
+		shape := matchCircuit{Pattern: make([]frontend.Variable, len(pattern)), Text: make([]frontend.Variable, len(textVars)), anchor: c.anchor}
+		assignment := matchCircuit{Pattern: pattern, Text: textVars, MatchIndex: index}
+		if got := test.IsSolved(&shape, &assignment, field) == nil; got != c.want {
+			t.Fatalf("pattern %q with anchor %d: found=%v, want %v", c.pattern, c.anchor, got, c.want)
+		}
+		if got := countOccurrences(pattern, textVars) > 0; c.anchor == AnchorNone && got != c.want {
+			t.Fatalf("pattern %q: off-circuit count disagrees", c.pattern)
+		}
+		absence := absenceMatchCircuit{Pattern: pattern, Text: textVars}
+		absenceShape := absenceMatchCircuit{Pattern: make([]frontend.Variable, len(pattern)), Text: make([]frontend.Variable, len(textVars))}
+		wantAbsent := !c.want && !hasSeparator(pattern)
+		if got := test.IsSolved(&absenceShape, &absence, field) == nil; c.anchor == AnchorNone && got != wantAbsent {
+			t.Fatalf("pattern %q: absence proved=%v, want %v", c.pattern, got, wantAbsent)
+		}
+	}
+}
+
+// oracleRounds is how many random cases TestOracle tries
+const oracleRounds = 300
+
+// randomOracleCase returns a random ASCII text of 1 to 12 characters and a pattern of 1
+// to 4. Both are mostly drawn from "abc", and half the patterns are cut from the text,
+// so roughly half of them occur.
+func randomOracleCase(rng *rand.Rand) (text, pattern string) {
+	randomString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			if rng.Intn(4) == 0 {
+				b[i] = byte(' ' + rng.Intn('~'-' '+1))
+			} else {
+				b[i] = byte('a' + rng.Intn(3))
+			}
+		}
+		return string(b)
+	}
+	text = randomString(1 + rng.Intn(12))
+	patternLength := 1 + rng.Intn(4)
+	if start := rng.Intn(len(text)); rng.Intn(2) == 0 && start+patternLength <= len(text) {
+		return text, text[start : start+patternLength]
+	}
+	return text, randomString(patternLength)
+}
+
+// absenceMatchCircuit is AbsenceCircuit over slices of any length
+type absenceMatchCircuit struct {
+	Pattern []frontend.Variable
+	Text    []frontend.Variable
+}
+
+func (circuit *absenceMatchCircuit) Define(api frontend.API) error {
+	found, _, _, err := findMatch(api, circuit.Pattern, circuit.Text, AnchorNone)
+	if err != nil {
+		return err
+	}
+	assertNoSeparator(api, circuit.Pattern)
+	api.AssertIsEqual(found, 0)
+	return nil
+}
+
+// offsetCircuit is OffsetMatchCircuit over slices of any length
+type offsetCircuit struct {
+	Pattern []frontend.Variable
+	Text    []frontend.Variable
+	Offset  frontend.Variable
+}
+
+func (circuit *offsetCircuit) Define(api frontend.API) error {
+	assertMatchAt(api, circuit.Pattern, circuit.Text, circuit.Offset)
+	return nil
+}
+
+// TestOracle checks on seeded random texts and patterns that the Rabin-Karp circuit
+// proves a match, and the absence circuit proves none, exactly when containsSubstring
+// says the pattern occurs. The offset circuit must accept some offset, past the end of
+// the text included, exactly then too. A pattern longer than the text fails to compile,
+// which counts as rejection, so the absence circuit refuses it rather than proving it
+// absent.
+func TestOracle(t *testing.T) {
+	toVariables := func(s string) []frontend.Variable {
+		v := make([]frontend.Variable, len(s))
+		for i := range s {
+			v[i] = int(s[i])
+		}
+		return v
+	}
+	rng := rand.New(rand.NewSource(1))
+	field := ecc.BN254.ScalarField()
+	for round := 0; round < oracleRounds; round++ {
+		text, pattern := randomOracleCase(rng)
+		want := containsSubstring(text, pattern)
+		textVars, patternVars := toVariables(text), toVariables(pattern)
+		patternShape, textShape := make([]frontend.Variable, len(pattern)), make([]frontend.Variable, len(text))
+
+		index := firstMatchIndex(patternVars, textVars, AnchorNone)
+		match := matchCircuit{Pattern: patternVars, Text: textVars, MatchIndex: max(index, 0)}
+		absence := absenceMatchCircuit{Pattern: patternVars, Text: textVars}
+		offsetAccepted := false
+		for offset := 0; offset <= len(text) && !offsetAccepted; offset++ {
+			assignment := offsetCircuit{Pattern: patternVars, Text: textVars, Offset: offset}
+			offsetAccepted = test.IsSolved(&offsetCircuit{Pattern: patternShape, Text: textShape}, &assignment, field) == nil
+		}
+		for _, c := range []struct {
+			name     string
+			accepted bool
+			want     bool
+		}{
+			{"Rabin-Karp", test.IsSolved(&matchCircuit{Pattern: patternShape, Text: textShape}, &match, field) == nil, want},
+			{"absence", test.IsSolved(&absenceMatchCircuit{Pattern: patternShape, Text: textShape}, &absence, field) == nil, !want && len(pattern) <= len(text)},
+			{"offset", offsetAccepted, want},
+		} {
+			if c.accepted != c.want {
+				t.Fatalf("round %d: %s circuit, pattern %q in text %q: accepted=%v, want %v (oracle says %v)",
+					round, c.name, pattern, text, c.accepted, c.want, want)
+			}
+		}
+	}
+}
+
+// TestLengthGuards checks that compiling for an empty pattern or a pattern longer than
+// the text fails with the matching error
+func TestLengthGuards(t *testing.T) {
+	cases := []struct {
+		patternLength, textLength int
+		want                      error
+	}{
+		{0, 8, ErrEmptyPattern},
+		{9, 8, ErrPatternLongerThanText},
+	}
+	for _, c := range cases {
+		circuit := matchCircuit{Pattern: make([]frontend.Variable, c.patternLength), Text: make([]frontend.Variable, c.textLength)}
+		if _, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &circuit); !errors.Is(err, c.want) {
+			t.Fatalf("pattern %d, text %d: got %v, want %v", c.patternLength, c.textLength, err, c.want)
+		}
+	}
+}